@@ -13,7 +13,11 @@ writes are asynchronous and appear to complete quickly, but may take longer to
 propagate to the servers. A flag sets writethrough mode instead, which operates
 synchronously and more slowly, but also more safely. Cacheserver uses local disk
 to store data it has read or written. The size of the local disk area is
-configurable with a flag.
+configurable with a flag. In writeback mode, the progress of writebacks is
+journaled in the file storejournal alongside the cache so that, after a crash,
+only writebacks that may not have completed are retried. The blocks awaiting
+writeback are listed in the file storewbindex, so that after a clean shutdown
+cacheserver can resume their writebacks without first walking the whole cache.
 
 The 'cache:' key should be set in the config file to enable the cacheserver.
 It will be started automatically by the upspin command or upspinfs if it is
@@ -33,6 +37,53 @@ The flags are:
 		Make storage cache writethrough.
 	-cachesize=bytes
 		Set the maximum bytes usable for the on disk cache to 'bytes'.
+	-serverconfig=key=value,...
+		Set storage cache options. The option refMismatch=delete
+		removes, rather than quarantines in 'directory'/storequarantine,
+		blocks for which the store returns an unexpected reference.
+		The option schedule=leastLoaded sends writebacks to the
+		stores with the fewest in progress rather than round robin.
+		The option deadline=duration, for example deadline=30s, logs
+		blocks not written back within the duration.
+		The option smallBlock=bytes, 16384 by default, sets the size
+		below which blocks are written back ahead of larger ones,
+		and fastLaneSlots=n, 0 by default, the number of parallel
+		writebacks kept free of larger blocks for them.
+		The option aging=duration, 1m by default, sets how long
+		a larger block waits before it is written back as promptly
+		as a small one, so that it is never starved; 0 turns this off.
+		The option pack=bytes stores blocks smaller than 'bytes' in
+		large pack files in 'directory'/storepacks rather than a file
+		each, sparing inodes when there are many small blocks.
+		The option writerIdle=duration, 0 by default, stops writers
+		idle for the duration, leaving at least minWriters=n, 1 by
+		default, running; more start when writebacks wait.
+		The option putTimeout=duration, 0 by default for no limit,
+		gives up on a writeback Put that takes longer and queues the
+		block again. A Put given up on is left to finish, and while
+		a few are still running for a store no more are sent to it.
+		The option latencySeed=duration, 0 by default, times a Put
+		to the first store written back to and starts with one
+		parallel writeback for each latencySeed of the round trip.
+		The option fsync=never, the default, fsync=writeback or
+		fsync=always sets when cache files are committed to stable
+		storage: never, before a block is queued for writeback, or
+		as each file is written.
+		The option batch=n, 1 by default, sends up to n waiting
+		blocks to a store in one call.
+		The option healthCheck=duration, 0 by default, checks a
+		failed store at that interval, with healthOp=ping, the
+		default, or healthOp=put, and retries its writebacks as soon
+		as it passes rather than after 5 minutes.
+		The option startupCheck=duration, 0 by default, checks the
+		stores of the writebacks found on startup, waiting at most
+		the duration, before the writebacks are queued.
+		The option userParallel=n, 0 by default for no limit, caps
+		the writebacks in flight for the blocks of any one user;
+		whatever the option, users take turns in the writebacks to
+		each store.
+		The option writebackMemory=bytes, 0 by default for no limit,
+		caps the block data that writers hold in memory at once.
 
 Example $HOME/upspin/config entry:
 
@@ -39,7 +39,7 @@ func serve(cfg upspin.Config, addr string) (<-chan error, error) {
 	maxRefBytes := (9 * (*cacheSizeFlag)) / 10
 	maxLogBytes := maxRefBytes / 9
 
-	sc, blockFlusher, err := storecache.New(cfg, flags.CacheDir, maxRefBytes, *writethrough)
+	sc, blockFlusher, err := storecache.New(cfg, flags.CacheDir, maxRefBytes, *writethrough, flags.ServerConfig...)
 	if err != nil {
 		return nil, err
 	}
@@ -5,13 +5,22 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"upspin.io/access"
+	"upspin.io/bind"
 	"upspin.io/config"
 	"upspin.io/errors"
 	"upspin.io/path"
@@ -38,10 +47,352 @@ they must be absolute paths or start with '.', '..',  or '~'.
 When copying from one Upspin path to another Upspin path, cp can be
 very efficient, copying only the references to the data rather than
 the data itself.
+
+A local path within an upspinfs mount is treated as the Upspin path it
+represents, so copies to or from it use the Upspin client directly,
+including the efficient copy by reference, rather than the mount.
+
+When both source and destination are in Upspin, a source that is an
+Upspin link is recreated as a link to the same target rather than
+followed. The -L flag instead copies the contents of the link's target.
+
+The -relativize-links flag, which requires -R, makes a copied tree
+self-contained, so that it can be moved or restored under another root.
+Links within the source directories, whether local symbolic links or
+Upspin links, are recreated rather than followed, and a link to a file
+within the same tree is made to point to that file's copy: relative to
+the link when copying to local files, or by full name in Upspin, whose
+links cannot be relative. A link to a file outside the tree keeps its
+target, with a warning, except that a local link cannot become an Upspin
+link, so it is followed instead. Links named as arguments are followed
+as usual. The flag is incompatible with -L, -cat, and -archive.
+
+A copy within Upspin is recorded as written by the user making it,
+since the Writer of an Upspin file is the user who signed its directory
+entry, and only that user can sign. A file the user wrote is copied by
+reference to its data and keeps its writer; a file written by another
+user is copied by reading its data. The -preserve-writer flag, which
+applies only to copies from Upspin to Upspin, keeps the writer where it
+can and warns about each copy that cannot, naming the original writer,
+so the change in attribution is never silent. The flag is incompatible
+with -cat, -mv, and -archive.
+
+The -at flag copies Upspin sources as they were at the given time,
+such as 2017-02-12 or 2017-02-12 15:04 in local time, or in RFC 3339
+format. Each source is found in the latest snapshot of its user's tree
+taken at or before then; the snapshots are in the tree of the user's
+snapshot user, such as ann+snapshot@example.com. The dir server must
+support snapshots, and the sources must not be local. The -at flag
+does not affect the destination and is incompatible with -mv.
+
+The -cat flag concatenates the contents of all the source files, in
+order, into the final argument, which must not be a directory.
+
+The -tee flag copies a single source file, the first argument, to each
+of the remaining arguments, reading the source only once, which saves
+time when it is remote or expensive to read. Destinations may be any
+mix of local and Upspin files or directories; a directory receives the
+file under the source's name. Upspin destinations of an Upspin source
+are copied by reference where possible. A destination that cannot be
+created or written is reported without affecting the others. The -tee
+flag is incompatible with -R, -cat, -mv, -archive, -keep-packdata, and
+-dedup.
+
+If a file cannot be copied completely, cp reports whether reading the
+source or writing the destination failed, and removes the incomplete
+destination. A failed copy to Upspin leaves any existing file unchanged.
+Before copying into a directory, cp checks that files can be created
+there, and if not, stops before copying anything. Similarly, a recursive
+copy of a directory into itself or one of its subdirectories, even one
+reached through a link, is refused.
+
+An interrupt stops cp before it lists a directory, opens a file, or
+begins another copy. A second interrupt stops it at once.
+
+If a directory cannot be listed completely during a recursive copy,
+cp stops. With the -k flag, it instead reports the error and copies
+whatever entries were listed; the exit status still reflects the failure.
+A recursive copy that fails anywhere ends by summarizing its errors,
+grouped by kind, such as permission denied, with the path and operation
+of each.
+
+The -mv flag removes each source once it has been copied successfully,
+making cp a move. A source that fails to copy is left in place. When
+source and destination belong to the same Upspin user, files are renamed
+rather than copied. With -R, a source directory is removed once all its
+contents have been moved.
+
+The -delete flag, which requires -R, makes cp a one-way sync: after
+each source directory has been listed and copied completely, anything
+in its copy at the destination that is absent from the source is
+removed, including whole directory trees. As a safeguard, -delete alone
+only lists what would be removed; add -confirm to remove it. Links at
+the destination are removed, not followed. Directories whose listing
+or copy failed are left alone.
+
+The -perms-preview flag, which requires -R and an Upspin destination,
+shows who could read each Upspin source directory and its copy, so that
+a copy does not share data more widely than intended. For each source
+directory and subdirectory, cp prints the users that its Access file
+grants the read right, expanding groups, and compares them with those
+the copy would have. The copy is governed by any Access file copied
+with it, interpreted at its new name, else by an Access file already in
+the destination directory, else by the Access file governing the
+destination. A copy readable by users who cannot read the source is
+marked WIDENED; one unreadable by some who can is marked NARROWED.
+As a safeguard, -perms-preview alone copies nothing; add -confirm to
+copy after the preview. Local sources are not previewed.
+
+The -expand-groups flag, which requires -perms-preview, also shows who
+each Access or Group file copied would grant access to at its new name.
+For each copied Access file, cp prints the users granted each right,
+with every group named, directly or through other groups, replaced by
+its members, and then the members of each of those groups. For each
+file copied into a Group directory, it prints the users the group would
+hold, likewise expanded. Groups are read from where the copy would name
+them; a group that includes itself is expanded once.
+
+The -publish flag, which requires -R and an Upspin destination, makes
+the copy appear all at once, so readers never see a partial tree. Cp
+copies the sources into a new staging directory, named .staging- and
+the time, within the destination. Only if everything is copied does cp
+make each source's name in the destination a link to its staged copy,
+replacing any link from an earlier publish, whose staged copy is then
+removed. Readers see the old tree until the link is replaced, though
+the name is missing for a moment while the old link is deleted. If the
+new link cannot be made, the old one is restored and cp reports where
+the staged copy remains. If the copy fails, the staging directory is
+removed and nothing is published. A source cannot be published over an
+existing directory.
+
+The -statefile flag, which requires -R, makes a long recursive copy
+resumable. As each file is copied, cp appends a record of its source
+and destination to the named local file. When cp is run again with the
+same state file, it skips the files recorded there, so a copy that was
+interrupted picks up where it left off. Directories are always listed
+again, and files changed at the source since they were recorded are not
+copied again. Remove the state file to start afresh.
+
+The -checkpoint flag makes cp sync each local destination file to disk
+every time another interval of the given size, such as 256M, has been
+written to it, so that a crash loses at most the last interval of a long
+copy. With -statefile, each checkpoint is also recorded in the state
+file, and a later run resumes a copy cut short from its last checkpoint
+rather than from the start. Upspin destinations are not supported, as
+an Upspin file reaches its store only once it is complete. The flag is
+incompatible with -cat, -tee, and -archive.
+
+Local file names that are not valid in Upspin, because they are not
+UTF-8, hold control characters, or are longer than 255 bytes, are
+found before anything in their directory is copied to Upspin, and those
+files are reported and skipped. The -sanitize flag instead copies each
+under a valid name: invalid bytes, control characters, and percent signs
+become %XX escapes, an over-long name is truncated, keeping its
+extension, and ~N is added if need be to keep it distinct. Each such
+copy is reported. The flag is incompatible with -cat, -tee, and
+-archive.
+
+The -compare flag, which requires -R, makes cp copy nothing and instead
+report how the destination directory differs from what the copy would
+make it. For each path the copy would write, cp prints only-in-source if
+the destination lacks it, otherwise differs, with the reason, or
+identical; and for each file in a destination directory that the source
+lacks, it prints only-in-dest. Files of the same size are compared by
+their contents, except that Upspin files holding the same blocks are
+identical without being read; links are compared by their targets.
+Paths are relative to the destination directory. The -json flag prints
+each line instead as a JSON object with fields status, path, src, dst,
+and reason. The -compare flag is incompatible with -cat, -mv, -delete,
+-publish, -dirs-only, -perms-preview, -statefile, -checkpoint, and
+-archive.
+
+The -use-ignore flag, which requires -R, makes cp skip files named in
+.upspinignore files found in the source directories, local or Upspin,
+much as git skips those named in .gitignore files. Each line of an
+ignore file is a pattern, as in a .gitignore file, and applies to the
+files below its directory, at any depth. A pattern with a slash other
+than at its end is anchored to that directory; one ending in a slash
+matches only directories; a leading ! includes again what an earlier
+pattern excluded; and ** matches any number of directories. Blank lines
+and lines starting with # are ignored. The last pattern to match a file
+decides, with those in deeper ignore files coming later. A directory
+that is skipped is not listed, so nothing in it can be included again.
+The flag is incompatible with -mv, -cat, and -archive.
+
+The -dirs-only flag, which requires -R, recreates the directory tree of
+each source in the destination without copying any files or links.
+
+The -p flag gives local directories created by a recursive copy the
+modification times of their sources. Upspin directories always record
+the time they were created.
+
+The -keep-packdata flag, when copying an Upspin file to a local file,
+saves the Upspin directory entry, including the encryption packdata with
+the keys wrapped for each reader, in a sidecar file named by adding
+the suffix .upspin-packdata. When the local file is later copied back to
+the same Upspin path with -keep-packdata, the entry is restored from the
+sidecar, reusing the original stored blocks, so the file keeps its readers
+even if the user restoring it could not decrypt it. The local file must
+not have changed. Sidecar files are not themselves copied to Upspin.
+
+The -archive flag writes the Upspin sources into a single local archive
+file, named by the final argument, in the given format, tar or zip.
+Each source is stored under its final path element, with relative paths
+below it. Directories require -R. Upspin links become symbolic links.
+
+The -repair flag, which applies only to copies from Upspin to Upspin,
+makes cp check, before copying each file by reference, that every block
+of the source can be fetched from its store. Otherwise a source whose
+store has lost a block would be copied without complaint, leaving two
+broken files rather than one. A missing block that the user's cache
+server still holds is put back in the store, with a warning; a file
+with a block that cannot be restored is reported and not copied. Like
+-confirm-durable, the check asks the stores directly and reads each
+block back. The flag is incompatible with -cat.
+
+The -confirm-durable flag makes cp check, after writing each file to
+Upspin, that every block of the file can be fetched from its store,
+reporting any that cannot. This catches stores that acknowledge writes
+they did not keep. Since a store can only be asked for a block by
+fetching it, the check reads each block back, though it does not
+decrypt it. The stores are asked directly, not through a cache server,
+so blocks a writeback cache has yet to send are reported as missing.
+
+The -manifest-verify flag, which requires that the final argument be an
+Upspin directory, makes cp vouch for each copy it makes there. Once
+everything is copied, cp lists every file and link in the copy of each
+source, with its size and the references and stores of its blocks, and
+fetches each block from its store, as -confirm-durable does. If all are
+there, it stores the list, signed by the user, in a file named by adding
+the suffix .upspin-manifest to the copy's name; the signature is of the
+SHA-256 hash of the list as encoded in the file. A missing block is
+reported, and no manifest is written for its copy, nor for any if the
+copy failed. The flag is incompatible with -cat, -publish, -dirs-only,
+-compare, and -archive.
+
+The -dedup flag, when copying local files to Upspin, hashes each source
+and, if its contents are identical to a file already copied by the same
+command, makes the destination a duplicate of that copy, sharing its
+stored blocks, rather than storing the data again. Each such source is
+read twice, once to hash it and once to copy it. Sources in Upspin
+already share their blocks with their copies.
+
+The -z flag compresses the data of each file copied with gzip, and the
+-unz flag decompresses the data of each source, which must be gzip
+compressed, as it is copied; so a tree can be kept compressed on local
+disk and unpacked on its way back into Upspin. The -gzip-by-name flag
+instead compresses a file copied to a name ending in .gz from one that
+does not and decompresses a file copied the other way. Names are not
+changed. A compressed or decompressed copy is never made by reference,
+nor by renaming with -mv. The three flags are mutually exclusive and
+incompatible with -cat, -tee, -checkpoint, -keep-packdata, -dedup,
+-compare, and -archive.
+
+The -sparse flag makes copies of sparse files cheaper. A local file
+copied to Upspin has only its data read, not its holes, the ranges the
+local file system stores no data for; a hole-finding system, such as
+Linux or macOS, is needed to find them. In Upspin the holes are stored
+as the zeros they read as, which pack and store to little. An Upspin
+file copied to a local file leaves holes in the copy where it holds
+runs of zeros, rather than writing them. The flag is incompatible with
+-cat, -tee, -checkpoint, -keep-packdata, -dedup, -z, -unz,
+-gzip-by-name, and -archive.
+
+The -schedule flag paces the copy by a bandwidth plan, so that a long
+copy respects the network's policy without being restarted. The plan is
+a list, separated by commas, of daily windows, each with the rate at
+which to copy while it lasts, and at most one rate alone, for the time
+outside the windows, which is unlimited if not given. A rate is in bytes
+per second, such as 1M; 0 pauses the copy and unlimited lifts the limit.
+For example,
+
+	upspin cp -R -schedule 22:00-06:00=unlimited,512K src dst
+
+copies at full speed overnight and at 512K per second by day. Times are
+local. A plan that begins with @ names a local file holding it, with its
+entries separated by commas or white space and # beginning a comment.
+The rate applies to the command as a whole, one file after another.
+
+The -progress-json flag prints, as each file is copied, events for
+front ends to follow the copy by. Each is a line of JSON, with an
+"event" field of "start", as the file's data begins to be read;
+"progress", about once a second as it is read; and "done" when the file
+is finished, whose "status" is "ok", "failed", or "by reference" for an
+Upspin copy or move that copied only the references to the data. That
+is the only event for such a file. They also give the "path" of the
+source and the "dst" of its copy, the "bytes_done" so far, the
+"bytes_total" of the source, -1 if unknown, and the "rate" in bytes per
+second. A last "summary" event gives the total "bytes_done", "rate",
+and "status", and counts the "files" copied and the "failed". The
+events go to standard error, or to the file descriptor given by
+-progress-fd. The flag is incompatible with -cat, -tee, -archive, and
+-compare.
+
+The -apparent-size flag prints the number of files to be copied and
+their total size in bytes, as recorded in Upspin directory entries and
+local file metadata, before copying begins. A link that the copy
+recreates counts as a file of no bytes; one that it follows counts as
+what it links to.
+
+Cp bounds the number of local files it has open at once, so that a
+copy with many destinations cannot exhaust the process's file
+descriptors. By default the bound leaves a few dozen of the descriptors
+the process may open for the client's connections and other uses. The
+-maxfiles flag sets the bound, which must be at least 2. A -tee copy
+with more local destinations than the bound allows reads the source
+again for each batch.
+
+The -mode and -dirmode flags set, in octal, the permissions of local
+files and directories created by cp, regardless of the umask. By default
+files are created with mode 0666 and directories with mode 0755, both
+modified by the umask. Permissions of existing directories are unchanged.
+The flags do not affect Upspin destinations.
 `
+	if isComplete(args) {
+		s.complete(args[1])
+		return
+	}
 	fs := flag.NewFlagSet("cp", flag.ExitOnError)
 	fs.Bool("v", false, "log each file as it is copied")
 	fs.Bool("R", false, "recursively copy directories")
+	fs.Bool("L", false, "follow Upspin links, copying the contents of their targets")
+	fs.Bool("relativize-links", false, "with -R, recreate links within the tree to point to the copies of their targets")
+	fs.Bool("apparent-size", false, "report the total size of the source files before copying")
+	fs.String("at", "", "copy Upspin sources as they were in the latest snapshot at or before `time`")
+	fs.Bool("cat", false, "concatenate the source files into the destination file")
+	fs.Bool("tee", false, "copy the first file to each of the other files, reading it once")
+	fs.Bool("mv", false, "remove each source after it is copied")
+	fs.String("archive", "", "write the sources to a local archive in the given `format` (tar or zip)")
+	fs.Bool("compare", false, "with -R, report how the destination differs from the sources rather than copy")
+	fs.Bool("json", false, "with -compare, print the report as JSON")
+	fs.Bool("sanitize", false, "copy local files whose names are not valid in Upspin under valid names rather than skip them")
+	fs.Bool("use-ignore", false, "with -R, skip files named in .upspinignore files in the source directories")
+	fs.Bool("dirs-only", false, "with -R, create the directories of the source tree but copy no files")
+	fs.Bool("delete", false, "with -R, list what at the destination is absent from the source (see -confirm)")
+	fs.Bool("publish", false, "with -R, stage the copy and publish it all at once with links")
+	fs.Bool("confirm", false, "with -delete, remove what it lists; with -perms-preview, copy after the preview")
+	fs.Bool("perms-preview", false, "with -R, show who could read each Upspin directory copied (see -confirm)")
+	fs.Bool("expand-groups", false, "with -perms-preview, show the users granted by each Access and Group file copied")
+	fs.String("statefile", "", "with -R, record copied files in the local `file` and skip those recorded by earlier runs")
+	fs.String("checkpoint", "", "sync local destination files to disk after each `size` bytes, such as 256M")
+	fs.Bool("p", false, "preserve the modification times of created local directories")
+	fs.Bool("keep-packdata", false, "save or restore the Upspin packdata of files copied to or from local files")
+	fs.Bool("k", false, "keep going, copying what was listed, if a directory cannot be listed completely")
+	fs.Bool("preserve-writer", false, "warn when a copy within Upspin cannot keep the Writer of its source")
+	fs.Bool("dedup", false, "store the data of identical local files copied to Upspin only once")
+	fs.Bool("z", false, "compress the data copied with gzip")
+	fs.Bool("unz", false, "decompress the gzip-compressed sources as they are copied")
+	fs.Bool("gzip-by-name", false, "compress files copied to names ending in .gz, and decompress those copied from them")
+	fs.Bool("progress-json", false, "print the progress of the copy as a stream of JSON events")
+	fs.Int("progress-fd", 2, "with -progress-json, print the events to the file descriptor `fd`")
+	fs.String("schedule", "", "pace the copy by the bandwidth `plan`, such as 22:00-06:00=unlimited,512K")
+	fs.Bool("sparse", false, "keep the holes of sparse files copied into and out of Upspin")
+	fs.Bool("repair", false, "check that the blocks of each Upspin file copied by reference can be fetched, restoring them from the cache if possible")
+	fs.Bool("confirm-durable", false, "check that the blocks of each file copied to Upspin can be fetched from their stores")
+	fs.Bool("manifest-verify", false, "verify that the blocks of each copy can be fetched from their stores and store a signed manifest of it")
+	fs.String("mode", "", "set the permissions of created local files to the octal `mode`")
+	fs.String("dirmode", "", "set the permissions of created local directories to the octal `mode`")
+	fs.Int("maxfiles", 0, "keep at most `n` local files open at once (default from the file descriptor limit)")
 	s.ParseFlags(fs, args, help, "cp [opts] file... file or cp [opts] file... directory")
 
 	var err error
@@ -52,34 +403,395 @@ the data itself.
 		}
 	}
 
+	ctx, cancel := newCopyContext()
+	defer cancel()
 	cs := &copyState{
+		ctx:     ctx,
 		state:   s,
 		flagSet: fs,
 		recur:   subcmd.BoolFlag(fs, "R"),
 		verbose: subcmd.BoolFlag(fs, "v"),
+		follow:  subcmd.BoolFlag(fs, "L"),
+		cat:     subcmd.BoolFlag(fs, "cat"),
+		tee:     subcmd.BoolFlag(fs, "tee"),
+		move:    subcmd.BoolFlag(fs, "mv"),
+		keepOn:  subcmd.BoolFlag(fs, "k"),
+
+		dirsOnly: subcmd.BoolFlag(fs, "dirs-only"),
+		preserve: subcmd.BoolFlag(fs, "p"),
+		mirror:   subcmd.BoolFlag(fs, "delete"),
+		confirm:  subcmd.BoolFlag(fs, "confirm"),
+		publish:  subcmd.BoolFlag(fs, "publish"),
+
+		permsPreview: subcmd.BoolFlag(fs, "perms-preview"),
+		expandGroups: subcmd.BoolFlag(fs, "expand-groups"),
+		relativize:   subcmd.BoolFlag(fs, "relativize-links"),
+		useIgnore:    subcmd.BoolFlag(fs, "use-ignore"),
+		sanitize:     subcmd.BoolFlag(fs, "sanitize"),
+		compare:      subcmd.BoolFlag(fs, "compare"),
+		json:         subcmd.BoolFlag(fs, "json"),
+
+		keepPackdata:   subcmd.BoolFlag(fs, "keep-packdata"),
+		confirmDurable: subcmd.BoolFlag(fs, "confirm-durable"),
+		manifestVerify: subcmd.BoolFlag(fs, "manifest-verify"),
+		repair:         subcmd.BoolFlag(fs, "repair"),
+		dedup:          subcmd.BoolFlag(fs, "dedup"),
+		preserveWriter: subcmd.BoolFlag(fs, "preserve-writer"),
+
+		compress:   subcmd.BoolFlag(fs, "z"),
+		decompress: subcmd.BoolFlag(fs, "unz"),
+		gzipByName: subcmd.BoolFlag(fs, "gzip-by-name"),
+		sparse:     subcmd.BoolFlag(fs, "sparse"),
+	}
+	if cs.cat && cs.move {
+		s.Failf("-cat and -mv are incompatible")
+		fs.Usage()
+	}
+	if cs.tee && (cs.recur || cs.cat || cs.move || cs.keepPackdata) {
+		s.Failf("-tee is incompatible with -R, -cat, -mv, and -keep-packdata")
+		fs.Usage()
+	}
+	if cs.dedup && (cs.cat || cs.tee) {
+		s.Failf("-dedup is incompatible with -cat and -tee")
+		fs.Usage()
+	}
+	if cs.preserveWriter && (cs.cat || cs.move) {
+		s.Failf("-preserve-writer is incompatible with -cat and -mv")
+		fs.Usage()
+	}
+	if cs.repair && cs.cat {
+		s.Failf("-repair and -cat are incompatible")
+		fs.Usage()
+	}
+	if cs.keepPackdata && (cs.cat || cs.move) {
+		s.Failf("-keep-packdata is incompatible with -cat and -mv")
+		fs.Usage()
+	}
+	if cs.dirsOnly && (!cs.recur || cs.cat || cs.move) {
+		s.Failf("-dirs-only requires -R and is incompatible with -cat and -mv")
+		fs.Usage()
+	}
+	if cs.mirror && (!cs.recur || cs.cat || cs.move || cs.dirsOnly) {
+		s.Failf("-delete requires -R and is incompatible with -cat, -mv, and -dirs-only")
+		fs.Usage()
+	}
+	if cs.confirm && !cs.mirror && !cs.permsPreview {
+		s.Failf("-confirm requires -delete or -perms-preview")
+		fs.Usage()
+	}
+	if cs.permsPreview && (!cs.recur || cs.cat) {
+		s.Failf("-perms-preview requires -R and is incompatible with -cat")
+		fs.Usage()
+	}
+	if cs.expandGroups && !cs.permsPreview {
+		s.Failf("-expand-groups requires -perms-preview")
+		fs.Usage()
+	}
+	if cs.useIgnore && (!cs.recur || cs.move || cs.cat) {
+		s.Failf("-use-ignore requires -R and is incompatible with -mv and -cat")
+		fs.Usage()
+	}
+	if cs.sanitize && (cs.cat || cs.tee) {
+		s.Failf("-sanitize is incompatible with -cat and -tee")
+		fs.Usage()
+	}
+	if cs.relativize && (!cs.recur || cs.follow || cs.cat) {
+		s.Failf("-relativize-links requires -R and is incompatible with -L and -cat")
+		fs.Usage()
+	}
+	if cs.publish && (!cs.recur || cs.cat || cs.move || cs.mirror) {
+		s.Failf("-publish requires -R and is incompatible with -cat, -mv, and -delete")
+		fs.Usage()
+	}
+	if at := subcmd.StringFlag(fs, "at"); at != "" {
+		if cs.move {
+			s.Failf("-at and -mv are incompatible")
+			fs.Usage()
+		}
+		cs.at = cs.parseAt(at)
+	}
+	stateFile := subcmd.StringFlag(fs, "statefile")
+	if stateFile != "" && (!cs.recur || cs.cat || cs.publish) {
+		s.Failf("-statefile requires -R and is incompatible with -cat and -publish")
+		fs.Usage()
+	}
+	if size := subcmd.StringFlag(fs, "checkpoint"); size != "" {
+		if cs.cat || cs.tee {
+			s.Failf("-checkpoint is incompatible with -cat and -tee")
+			fs.Usage()
+		}
+		cs.checkpoint, err = parseSize(size)
+		if err != nil {
+			s.Exitf("invalid -checkpoint: %v", err)
+		}
+	}
+	if cs.compare && (!cs.recur || cs.cat || cs.move || cs.mirror || cs.publish || cs.dirsOnly || cs.permsPreview || stateFile != "" || cs.checkpoint > 0) {
+		s.Failf("-compare requires -R and is incompatible with -cat, -mv, -delete, -publish, -dirs-only, -perms-preview, -statefile, and -checkpoint")
+		fs.Usage()
+	}
+	if cs.manifestVerify && (cs.cat || cs.publish || cs.dirsOnly || cs.compare) {
+		s.Failf("-manifest-verify is incompatible with -cat, -publish, -dirs-only, and -compare")
+		fs.Usage()
+	}
+	if cs.json && !cs.compare {
+		s.Failf("-json requires -compare")
+		fs.Usage()
+	}
+	cs.fileMode = cs.parseMode("mode")
+	cs.dirMode = cs.parseMode("dirmode")
+	maxFiles := subcmd.IntFlag(fs, "maxfiles")
+	if maxFiles < 0 || maxFiles == 1 {
+		s.Failf("-maxfiles must be at least %d", minOpenFiles)
+		fs.Usage()
+	}
+	cs.limitFiles(maxFiles)
+	archive := subcmd.StringFlag(fs, "archive")
+	if archive != "" && (cs.cat || cs.tee || cs.move || cs.dirsOnly || cs.keepPackdata || cs.preserveWriter || cs.mirror || cs.publish || cs.permsPreview || cs.relativize || cs.useIgnore || cs.sanitize || stateFile != "" || cs.checkpoint > 0 || cs.compare || cs.manifestVerify) {
+		s.Failf("-archive is incompatible with -cat, -tee, -mv, -dirs-only, -keep-packdata, -preserve-writer, -delete, -publish, -perms-preview, -relativize-links, -use-ignore, -sanitize, -statefile, -checkpoint, -compare, and -manifest-verify")
+		fs.Usage()
+	}
+	if cs.compress && cs.decompress || cs.gzipByName && (cs.compress || cs.decompress) {
+		s.Failf("-z, -unz, and -gzip-by-name are mutually exclusive")
+		fs.Usage()
+	}
+	if (cs.compress || cs.decompress || cs.gzipByName) && (cs.cat || cs.tee || cs.checkpoint > 0 || cs.keepPackdata || cs.dedup || cs.compare || archive != "") {
+		s.Failf("-z, -unz, and -gzip-by-name are incompatible with -cat, -tee, -checkpoint, -keep-packdata, -dedup, -compare, and -archive")
+		fs.Usage()
+	}
+	if cs.sparse && (cs.cat || cs.tee || cs.checkpoint > 0 || cs.keepPackdata || cs.dedup || cs.compress || cs.decompress || cs.gzipByName || archive != "") {
+		s.Failf("-sparse is incompatible with -cat, -tee, -checkpoint, -keep-packdata, -dedup, -z, -unz, -gzip-by-name, and -archive")
+		fs.Usage()
+	}
+	if subcmd.BoolFlag(fs, "progress-json") {
+		if cs.cat || cs.tee || archive != "" || cs.compare {
+			s.Failf("-progress-json is incompatible with -cat, -tee, -archive, and -compare")
+			fs.Usage()
+		}
+		cs.events = newCopyEvents(subcmd.IntFlag(fs, "progress-fd"))
+	}
+	if plan := subcmd.StringFlag(fs, "schedule"); plan != "" {
+		p, err := parseRatePlan(subcmd.Tilde(plan))
+		if err != nil {
+			s.Exitf("invalid -schedule: %v", err)
+		}
+		cs.schedule = &throttle{ctx: cs.ctx, plan: p}
+	}
+	if stateFile != "" {
+		cs.progress, err = openProgress(subcmd.Tilde(stateFile))
+		if err != nil {
+			s.Exit(err)
+		}
+		defer cs.progress.close()
 	}
 
 	// Do all the glob processing here.
 	// Special one-at-time glob processing because each item may be local or Upspin.
 	var files []cpFile
-	for _, file := range fs.Args() {
+	nFirst := 0
+	for i, file := range fs.Args() {
+		// With -tee, only the first argument is a source.
+		if !cs.at.IsZero() && (i == 0 || !cs.tee && i < fs.NArg()-1) {
+			file = cs.snapshotPattern(file)
+		}
 		files = append(files, cs.glob(file)...)
+		if i == 0 {
+			nFirst = len(files)
+		}
 	}
 
 	if len(files) < 2 {
 		fs.Usage()
 	}
+	if cs.tee {
+		if nFirst != 1 {
+			s.Exitf("-tee requires a single source file; %s matches %d", fs.Arg(0), nFirst)
+		}
+		if subcmd.BoolFlag(fs, "apparent-size") {
+			// The source is read unless every copy is a link.
+			toUpspin := true
+			for _, dst := range files[1:] {
+				toUpspin = toUpspin && dst.isUpspin
+			}
+			n, size := s.apparentSize(cs, files[:1], toUpspin)
+			fmt.Printf("%d bytes in %d files\n", size, n)
+		}
+		s.teeCommand(cs, files[0], files[1:])
+		return
+	}
 
 	nSrc := len(files) - 1
 	src, dest := files[:nSrc], files[nSrc]
+	if subcmd.BoolFlag(fs, "apparent-size") {
+		n, size := s.apparentSize(cs, src, dest.isUpspin)
+		fmt.Printf("%d bytes in %d files\n", size, n)
+	}
+	if archive != "" {
+		s.archiveCommand(cs, archive, src, dest)
+		return
+	}
+	if cs.compare {
+		s.compareCommand(cs, src, dest)
+		return
+	}
+	if cs.checkpoint > 0 && dest.isUpspin {
+		s.Exitf("-checkpoint requires a local destination; an Upspin file reaches its store only when complete")
+	}
+	if cs.manifestVerify && (!dest.isUpspin || !s.isDir(dest)) {
+		s.Exitf("-manifest-verify requires that final argument (%s) be an Upspin directory", dest.path)
+	}
+	if cs.permsPreview {
+		if !dest.isUpspin || !s.isDir(dest) {
+			s.Exitf("-perms-preview requires that final argument (%s) be an Upspin directory", dest.path)
+		}
+		if !s.permsPreview(cs, src, dest) {
+			s.Exitf("cannot preview permissions of the copy")
+		}
+		if !cs.confirm {
+			return
+		}
+	}
+	// A recursive copy may fail in many places; end it with a summary.
+	failed := len(s.Failures)
 	s.copyCommand(cs, src, dest)
+	if cs.manifestVerify {
+		if len(s.Failures) > failed {
+			s.Failf("copy to %s failed; no manifest written", dest.path)
+		} else {
+			s.manifestVerify(cs, src, dest)
+		}
+	}
+	if cs.recur {
+		s.PrintFailures(os.Stderr, s.Failures[failed:])
+	}
+	cs.summaryEvent()
 }
 
 type copyState struct {
+	ctx     context.Context // Canceled to abandon the copy; may be nil.
 	state   *State
 	flagSet *flag.FlagSet // Used only to call Usage.
 	verbose bool
 	recur   bool
+	follow  bool // Copy the targets of Upspin links rather than the links.
+	cat     bool // Concatenate the sources into a single destination.
+	tee     bool // Copy a single source to each of several destinations.
+	move    bool // Remove each source after it is copied.
+	keepOn  bool // Copy what was listed of a directory whose listing failed.
+
+	dirsOnly bool // Create directories but copy no files.
+	preserve bool // Give created local directories their sources' times.
+	mirror   bool // Remove what the destination has but the source lacks.
+	confirm  bool // With mirror, remove rather than only list.
+	publish  bool // Stage the copy and then publish it with links.
+
+	permsPreview bool // Show who could read the copies before copying.
+	expandGroups bool // With permsPreview, show the users granted by copied Access and Group files.
+	relativize   bool // Point links within a copied tree to the copies.
+	sanitize     bool // Give local files valid Upspin names rather than skip them.
+	compare      bool // Report how the destination differs rather than copy.
+	json         bool // With compare, print the report as JSON.
+
+	// With relativize, the outermost source directory being copied and
+	// its copy; see cplinks.go.
+	treeSrc, treeDst cpFile
+
+	useIgnore bool          // Skip files named in .upspinignore files.
+	ignores   []*ignoreFile // The ignore files that apply, outermost first.
+
+	// With expandGroups, the members of the groups read; see cpgroups.go.
+	groups *groupExpander
+
+	keepPackdata   bool // Save and restore packdata sidecars of local copies.
+	confirmDurable bool // Check that the blocks of Upspin copies reached their stores.
+	manifestVerify bool // Verify each Upspin copy and store a signed manifest of it.
+	repair         bool // Check the blocks of Upspin sources before copying by reference.
+	dedup          bool // Share the blocks of identical local files copied to Upspin.
+	preserveWriter bool // Warn when Upspin copies cannot keep the Writer of their sources.
+
+	compress   bool // Compress the copies with gzip.
+	decompress bool // Decompress the gzip-compressed sources.
+	gzipByName bool // Compress or decompress as the names end in .gz; see cpgzip.go.
+	sparse     bool // Keep the holes of files copied into and out of Upspin; see cpsparse.go.
+
+	// With -schedule, the pace of the copy; see cpschedule.go.
+	schedule *throttle
+
+	// With -progress-json, prints the events of the copy; see cpevents.go.
+	events *copyEvents
+
+	// With dedup, the first Upspin copy of each local file, by the
+	// SHA-256 hash of its contents.
+	copied map[[sha256.Size]byte]upspin.PathName
+
+	// Permissions of created local files and directories.
+	// Zero means the default, modified by the umask.
+	fileMode os.FileMode
+	dirMode  os.FileMode
+
+	mounts []string // Mount points of upspinfs file systems; nil until read.
+
+	// Bounds the number of local files open at once; see cpfiles.go.
+	// Nil means no bound.
+	files chan struct{}
+
+	progress   *cpProgress // With -statefile, the files already copied.
+	checkpoint int64       // Sync local copies after each checkpoint bytes.
+
+	// With -at, the time as of which to copy Upspin sources, and the
+	// root of the snapshot chosen for each user.
+	at        time.Time
+	snapshots map[upspin.UserName]upspin.PathName
+}
+
+// parseMode returns the permissions set, in octal, by the named flag,
+// or zero if the flag is not set.
+func (c *copyState) parseMode(name string) os.FileMode {
+	str := subcmd.StringFlag(c.flagSet, name)
+	if str == "" {
+		return 0
+	}
+	mode, err := strconv.ParseUint(str, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		c.state.Exitf("invalid -%s %q: must be octal permissions such as 0600", name, str)
+	}
+	return os.FileMode(mode)
+}
+
+// newCopyContext returns the context for a cp command, which is canceled
+// when the process is interrupted, so that cp starts no more work and
+// exits. It takes the interrupt from the shutdown package, which would
+// exit at once, and gives it back once the first arrives, so that a
+// second interrupt stops cp immediately. It is a variable so tests can
+// replace it.
+var newCopyContext = func() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Reset(os.Interrupt)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		select {
+		case <-c:
+			signal.Stop(c)
+			signal.Reset(os.Interrupt)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(c)
+		cancel()
+	}
+}
+
+// checkCanceled exits if the copy has been canceled. It is called before
+// each listing, open, and copy.
+func (c *copyState) checkCanceled() {
+	if c.ctx == nil {
+		return
+	}
+	if err := c.ctx.Err(); err != nil {
+		c.state.Exitf("interrupted: %v", err)
+	}
 }
 
 func (c *copyState) logf(format string, args ...interface{}) {
@@ -93,17 +805,48 @@ func (c *copyState) logf(format string, args ...interface{}) {
 type cpFile struct {
 	path     string
 	isUpspin bool
+
+	// The Upspin directory entry of the file, if it was found by listing
+	// its directory; see contents.
+	entry *upspin.DirEntry
 }
 
 var (
 	errExist    = errors.E(errors.Exist)
 	errNotExist = errors.E(errors.NotExist)
 	errIsDir    = errors.E(errors.IsDir)
+
+	// errReported is returned by functions that have already
+	// reported their error with Fail.
+	errReported = errors.Str("error already reported")
 )
 
 func (s *State) copyCommand(cs *copyState, srcFiles []cpFile, dstFile cpFile) {
 	// TODO: Check for nugatory copies.
+	if cs.cat {
+		if s.isDir(dstFile) {
+			s.Failf("-cat requires that final argument (%s) not be a directory", dstFile.path)
+			cs.flagSet.Usage()
+		}
+		s.concatenate(cs, srcFiles, dstFile)
+		return
+	}
 	if s.isDir(dstFile) {
+		// Fail now rather than after copying some of the files.
+		if cs.recur {
+			for _, src := range srcFiles {
+				if s.isDir(src) && s.within(dstFile, src) {
+					s.Exitf("cannot copy a directory into itself: %s into %s", src.path, dstFile.path)
+				}
+			}
+		}
+		if err := s.checkWritable(dstFile); err != nil {
+			s.Exitf("cannot copy to %s: %v", dstFile.path, err)
+		}
+		if cs.publish {
+			s.publishCommand(cs, srcFiles, dstFile)
+			return
+		}
 		s.copyToDir(cs, srcFiles, dstFile)
 		return
 	}
@@ -115,16 +858,39 @@ func (s *State) copyCommand(cs *copyState, srcFiles []cpFile, dstFile cpFile) {
 		s.Failf("recursive copy requires that final argument (%s) be an existing directory", dstFile.path)
 		cs.flagSet.Usage()
 	}
-	reader, err := s.open(srcFiles[0])
+	if target, ok := s.linkTarget(cs, srcFiles[0], dstFile); ok {
+		if s.copyLink(cs, target, dstFile) {
+			s.removeSource(cs, srcFiles[0])
+		}
+		return
+	}
+	if s.rename(cs, srcFiles[0], dstFile) {
+		cs.byReferenceEvent(srcFiles[0], dstFile)
+		return
+	}
+	cs.checkCanceled()
+	reader, err := s.open(cs, srcFiles[0])
 	if err != nil {
 		s.Exit(err)
 	}
-	s.copyToFile(cs, reader, srcFiles[0], dstFile)
+	if s.copyToFile(cs, reader, srcFiles[0], dstFile) {
+		s.removeSource(cs, srcFiles[0])
+	}
 }
 
 // isDir reports whether the file is a directory either in Upspin
 // or in the local file system.
 func (s *State) isDir(cf cpFile) bool {
+	_, isDir := s.fileType(cf)
+	return isDir
+}
+
+// fileType reports whether the file exists, either in Upspin or in the
+// local file system, and whether it is a directory.
+func (s *State) fileType(cf cpFile) (exists, isDir bool) {
+	if cf.entry != nil && !cf.entry.IsLink() {
+		return true, cf.entry.IsDir()
+	}
 	if cf.isUpspin {
 		entry, err := s.Client.Lookup(upspin.PathName(cf.path), true)
 		// Report the error here if it's anything odd, because otherwise
@@ -132,114 +898,709 @@ func (s *State) isDir(cf cpFile) bool {
 		if err != nil && !errors.Match(errNotExist, err) {
 			log.Printf("%q: %v", cf.path, err)
 		}
-		return err == nil && entry.IsDir()
+		return err == nil, err == nil && entry.IsDir()
 	}
 	// Not an Upspin name. Is it a local directory?
 	info, err := os.Stat(cf.path)
-	return err == nil && info.IsDir()
+	return err == nil, err == nil && info.IsDir()
+}
+
+// overwritable reports whether the copy of src may replace dst, if it
+// exists: a directory may be copied over only a directory, and a file
+// only over a file. Otherwise it reports the conflict in the words of
+// the Unix cp, before anything is copied. The types of the files in the
+// directory of dst are given by dirTypes; if they are nil, dst is
+// looked up.
+func (s *State) overwritable(cs *copyState, src, dst cpFile, types map[string]bool) bool {
+	exists, dstIsDir := false, false
+	if types != nil {
+		dstIsDir, exists = types[dst.path]
+	} else {
+		exists, dstIsDir = s.fileType(dst)
+	}
+	if !exists {
+		return true
+	}
+	srcIsDir := s.isDir(src)
+	switch {
+	case dstIsDir && !srcIsDir:
+		s.Failf("cannot overwrite directory %s with non-directory %s", dst.path, src.path)
+	case !dstIsDir && srcIsDir && cs.recur:
+		// Without -R, the directory is not copied at all.
+		s.Failf("cannot overwrite non-directory %s with directory %s", dst.path, src.path)
+	default:
+		return true
+	}
+	return false
+}
+
+// dirTypes lists the directory dir and reports, for the full name of
+// each file in it, whether the file is a directory, following links, so
+// that the files copied into dir can be checked against those they would
+// replace with one listing rather than a lookup each. If dir cannot be
+// listed, it returns nil.
+func (s *State) dirTypes(cs *copyState, dir cpFile) map[string]bool {
+	cs.checkCanceled()
+	types := make(map[string]bool)
+	if dir.isUpspin {
+		entries, err := s.Client.Glob(upspin.AllFilesGlob(upspin.PathName(dir.path)))
+		if err != nil {
+			return nil
+		}
+		for _, entry := range entries {
+			_, types[string(entry.Name)] = s.fileType(cpFile{path: string(entry.Name), isUpspin: true, entry: entry})
+		}
+		return types
+	}
+	infos, err := ioutil.ReadDir(dir.path)
+	if err != nil {
+		return nil
+	}
+	for _, info := range infos {
+		name := filepath.Join(dir.path, info.Name())
+		isDir := info.IsDir()
+		if info.Mode()&os.ModeSymlink != 0 {
+			_, isDir = s.fileType(cpFile{path: name})
+		}
+		types[name] = isDir
+	}
+	return types
+}
+
+// within reports whether file is dir or lies within it, comparing the
+// names they resolve to after following links.
+func (s *State) within(file, dir cpFile) bool {
+	if file.isUpspin != dir.isUpspin {
+		return false
+	}
+	if file.isUpspin {
+		fileName, dirName := s.resolve(file), s.resolve(dir)
+		filePath, err := path.Parse(fileName)
+		if err != nil {
+			return false
+		}
+		dirPath, err := path.Parse(dirName)
+		if err != nil {
+			return false
+		}
+		return filePath.HasPrefix(dirPath)
+	}
+	filePath, dirPath := resolveLocal(file.path), resolveLocal(dir.path)
+	rel, err := filepath.Rel(dirPath, filePath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolve returns the name the Upspin file has after following links,
+// or its own name if it cannot be looked up.
+func (s *State) resolve(file cpFile) upspin.PathName {
+	entry, err := s.Client.Lookup(upspin.PathName(file.path), true)
+	if err != nil {
+		return upspin.PathName(file.path)
+	}
+	return entry.Name
+}
+
+// resolveLocal returns the absolute name of the local file after following
+// symbolic links, or as much of that as can be determined.
+func resolveLocal(file string) string {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	if real, err := filepath.EvalSymlinks(file); err == nil {
+		file = real
+	}
+	return file
 }
 
 // open opens the file regardless of its location.
-func (s *State) open(file cpFile) (io.ReadCloser, error) {
+// A local file counts against the limit on open files until it is closed.
+func (s *State) open(cs *copyState, file cpFile) (io.ReadCloser, error) {
 	if s.isDir(file) {
 		return nil, errors.E(upspin.PathName(file.path), errors.IsDir)
 	}
 	if file.isUpspin {
 		return s.Client.Open(upspin.PathName(file.path))
 	}
-	return os.Open(file.path)
+	fd, err := cs.openLocal(file.path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
 }
 
 // create creates the file regardless of its location.
-func (s *State) create(file cpFile) (io.WriteCloser, error) {
+// A local file is given the permissions set by -mode, if any,
+// and counts against the limit on open files until it is closed.
+func (s *State) create(cs *copyState, file cpFile) (io.WriteCloser, error) {
 	if file.isUpspin {
 		fd, err := s.Client.Create(upspin.PathName(file.path))
 		return fd, err
 	}
-	fd, err := os.Create(file.path)
-	return fd, err
+	perm := cs.fileMode
+	if perm == 0 {
+		perm = 0666
+	}
+	fd, err := cs.openLocal(file.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	if cs.fileMode == 0 {
+		return fd, nil
+	}
+	// Override the umask, and the mode of an existing file.
+	if err := fd.Chmod(cs.fileMode); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return fd, nil
+}
+
+// mkdirLocal creates a local directory with the permissions set by
+// -dirmode, if any. An existing directory is left unchanged and
+// reported as an error satisfying os.IsExist.
+func (cs *copyState) mkdirLocal(dir string) error {
+	if cs.dirMode == 0 {
+		return os.Mkdir(dir, 0755)
+	}
+	if err := os.Mkdir(dir, cs.dirMode); err != nil {
+		return err
+	}
+	// Override the umask.
+	return os.Chmod(dir, cs.dirMode)
+}
+
+// concatenate copies the contents of the source files, in order, to the
+// destination file. A source that cannot be read is reported and skipped.
+func (s *State) concatenate(cs *copyState, src []cpFile, dst cpFile) {
+	writer, err := s.create(cs, dst)
+	if err != nil {
+		s.Exit(err)
+	}
+	for _, from := range src {
+		cs.checkCanceled()
+		cs.logf("cat %s to %s", from.path, dst.path)
+		reader, err := s.open(cs, from)
+		if err != nil {
+			s.Fail(err)
+			continue
+		}
+		_, err = io.Copy(writer, cs.throttled(reader))
+		reader.Close()
+		if err != nil {
+			s.Fail(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		s.Fail(err)
+		return
+	}
+	if cs.confirmDurable && dst.isUpspin {
+		s.confirmDurable(cs, dst)
+	}
+}
+
+// checkWritable returns an error if files certainly cannot be created in the
+// directory: for Upspin, if its Access file grants the user neither the
+// create nor the write right; for local directories, if a trial file cannot
+// be created. Any other problem is left for the copy itself to report.
+func (s *State) checkWritable(dir cpFile) error {
+	if !dir.isUpspin {
+		f, err := ioutil.TempFile(dir.path, ".upspin-cp-")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	}
+	name := upspin.PathName(dir.path)
+	dirServer, err := s.Client.DirServer(name)
+	if err != nil {
+		return nil
+	}
+	whichAccess, err := dirServer.WhichAccess(name)
+	if err != nil {
+		return nil
+	}
+	me := s.Config.UserName()
+	if whichAccess == nil {
+		// With no Access file, only the owner has rights.
+		parsed, err := path.Parse(name)
+		if err != nil || parsed.User() == me {
+			return nil
+		}
+		return errors.E(errors.Permission, me)
+	}
+	data, err := s.Client.Get(whichAccess.Name)
+	if err != nil {
+		return nil
+	}
+	acc, err := access.Parse(whichAccess.Name, data)
+	if err != nil {
+		return nil
+	}
+	for _, right := range []access.Right{access.Create, access.Write} {
+		if ok, err := acc.Can(me, right, name, s.Client.Get); ok || err != nil {
+			return nil
+		}
+	}
+	return errors.E(errors.Permission, me, errors.Errorf("no create or write right in %s", whichAccess.Name))
 }
 
 // copyToDir copies the source files to the destination directory.
 // It recurs if -R is set and a source is a subdirectory.
-func (s *State) copyToDir(cs *copyState, src []cpFile, dir cpFile) {
-	for _, from := range src {
-		dstPath := path.Join(upspin.PathName(dir.path), filepath.Base(from.path))
-		if dir.isUpspin && from.isUpspin {
+// It reports whether all the files were copied. A local file whose name
+// is not valid in Upspin is not copied to Upspin unless -sanitize gives
+// it a valid one; see dstNames.
+func (s *State) copyToDir(cs *copyState, src []cpFile, dir cpFile) bool {
+	ok := true
+	names := s.dstNames(cs, src, dir)
+	// Check for conflicts with what dir holds by listing it, unless a
+	// lookup of the only file copied is cheaper.
+	var types map[string]bool
+	if len(src) > 1 {
+		types = s.dirTypes(cs, dir)
+	}
+	for i, from := range src {
+		cs.checkCanceled()
+		dstPath := path.Join(upspin.PathName(dir.path), names[i].name)
+		dst := cpFile{
+			path:     string(dstPath),
+			isUpspin: dir.isUpspin,
+		}
+		if cs.keepPackdata && !from.isUpspin && strings.HasSuffix(from.path, packdataSuffix) {
+			cs.logf("skip packdata sidecar %s", from.path)
+			continue
+		}
+		if len(cs.ignores) > 0 && s.ignored(cs, from) {
+			cs.logf("skip %s: ignored", from.path)
+			continue
+		}
+		if cs.dirsOnly && !s.isDir(from) {
+			cs.logf("skip %s: not a directory", from.path)
+			continue
+		}
+		if cs.progress != nil && cs.progress.completed(from, dst) {
+			cs.logf("skip %s: copied by an earlier run", from.path)
+			continue
+		}
+		if err := names[i].err; err != nil {
+			if !cs.sanitize {
+				s.Failf("cannot copy %q to Upspin: its name %v; -sanitize would copy it under a valid name", from.path, err)
+				ok = false
+				continue
+			}
+			cs.warnf("copying %q as %s: its name %v", from.path, dstPath, err)
+		}
+		if !s.overwritable(cs, from, dst, types) {
+			ok = false
+			continue
+		}
+		if isLink, linked := s.relinkTree(cs, from, dst); isLink {
+			ok = linked && s.recordCopy(cs, from, dst) && s.removeSource(cs, from) && ok
+			continue
+		}
+		if target, isLink := s.linkTarget(cs, from, dir); isLink {
+			ok = s.copyLink(cs, target, dst) && s.recordCopy(cs, from, dst) && s.removeSource(cs, from) && ok
+			continue
+		}
+		if s.rename(cs, from, dst) {
+			cs.byReferenceEvent(from, dst)
+			ok = s.recordCopy(cs, from, dst) && ok
+			continue
+		}
+		if dir.isUpspin && from.isUpspin && !cs.transforms(from, dst) {
 			// Try a fast copy. It can fail but that's OK.
 			cs.logf("try fast copy to %s", dstPath)
-			if s.fastCopy(upspin.PathName(from.path), dstPath) == nil {
+			switch s.duplicate(cs, from, dstPath) {
+			case nil:
+				cs.byReferenceEvent(from, dst)
+				ok = s.recordCopy(cs, from, dst) && s.removeSource(cs, from) && ok
+				continue
+			case errReported:
+				ok = false
 				continue
 			}
 		}
-		reader, err := s.open(from)
+		reader, err := s.open(cs, from)
 		if cs.recur && errors.Match(errIsDir, err) {
 			// If the problem is that from is a directory but we have -R,
 			// recur on the contents.
 			cs.logf("recursive descent into %s", from.path)
 			newFiles, err := s.contents(cs, from)
-			if len(newFiles) == 0 && err != nil {
-				continue
+			if err != nil {
+				if !cs.keepOn {
+					s.Exitf("cannot list all of %s: %v", from.path, err)
+				}
+				s.Fail(err)
+				if len(newFiles) == 0 {
+					ok = false
+					continue
+				}
 			}
 			// May need to make subdirectory (even if it will have no files).
 			subDir := dir
 			if dir.isUpspin {
 				// Rather than use the libraries and a lot of casting, it's easiest just to cat the strings here.
-				subDir.path = subDir.path + "/" + filepath.Base(from.path) // TODO: is filepath.Base OK?
+				subDir.path = subDir.path + "/" + names[i].name
 				_, err := s.Client.MakeDirectory(upspin.PathName(subDir.path))
 				if err != nil && !errors.Match(errExist, err) {
 					s.Fail(err)
+					ok = false
 					continue
 				}
 			} else {
-				subDir.path = filepath.Join(subDir.path, filepath.Base(from.path))
-				err := os.Mkdir(subDir.path, 0755) // TODO: Mode.
+				subDir.path = filepath.Join(subDir.path, names[i].name)
+				err := cs.mkdirLocal(subDir.path)
 				if err != nil && !os.IsExist(err) {
 					s.Fail(err)
+					ok = false
 					continue
 				}
 			}
-			s.copyToDir(cs, newFiles, subDir)
+			ignores := cs.ignores
+			if cs.useIgnore {
+				if err := s.readIgnore(cs, from); err != nil {
+					s.Fail(err)
+					ok = false
+					continue
+				}
+			}
+			// Links are relativized to the outermost directory copied.
+			outer := cs.relativize && cs.treeSrc.path == ""
+			if outer {
+				cs.treeSrc, cs.treeDst = from, subDir
+			}
+			copied := s.copyToDir(cs, newFiles, subDir)
+			if outer {
+				cs.treeSrc, cs.treeDst = cpFile{}, cpFile{}
+			}
+			cs.ignores = ignores
+			// The directory can be removed only if all of it was copied.
+			// Likewise, only then can the copy be made to mirror it.
+			if copied && err == nil {
+				if cs.mirror {
+					ok = s.deleteExtras(cs, newFiles, subDir) && ok
+				}
+				ok = s.removeSource(cs, from) && ok
+			} else {
+				ok = false
+			}
+			// Set the time last, as copying the contents changes it.
+			if cs.preserve && !subDir.isUpspin {
+				ok = s.copyDirTime(from, subDir) && ok
+			}
 			continue
 		}
 		if err != nil {
 			s.Fail(err)
+			ok = false
 			continue
 		}
-		dst := cpFile{
-			path:     string(dstPath),
-			isUpspin: dir.isUpspin,
+		ok = s.copyToFile(cs, reader, from, dst) && s.recordCopy(cs, from, dst) && s.removeSource(cs, from) && ok
+	}
+	return ok
+}
+
+// recordCopy records in the -statefile, if any, that src has been copied
+// to dst. It reports whether it succeeded.
+func (s *State) recordCopy(cs *copyState, src, dst cpFile) bool {
+	if cs.progress == nil {
+		return true
+	}
+	if err := cs.progress.record(src, dst); err != nil {
+		s.Fail(err)
+		return false
+	}
+	return true
+}
+
+// copyDirTime sets the modification time of the local directory dst
+// to that of the directory src. It reports whether it succeeded.
+func (s *State) copyDirTime(src, dst cpFile) bool {
+	var mtime time.Time
+	if src.isUpspin {
+		entry, err := s.Client.Lookup(upspin.PathName(src.path), true)
+		if err != nil {
+			s.Fail(err)
+			return false
+		}
+		mtime = entry.Time.Go()
+	} else {
+		info, err := os.Stat(src.path)
+		if err != nil {
+			s.Fail(err)
+			return false
 		}
-		s.copyToFile(cs, reader, from, dst)
+		mtime = info.ModTime()
+	}
+	if err := os.Chtimes(dst.path, mtime, mtime); err != nil {
+		s.Fail(err)
+		return false
 	}
+	return true
 }
 
 // copyToFile copies the source to the destination. The source file has already been opened.
-func (s *State) copyToFile(cs *copyState, reader io.ReadCloser, src, dst cpFile) {
+// It reports whether the copy succeeded.
+func (s *State) copyToFile(cs *copyState, reader io.ReadCloser, src, dst cpFile) bool {
+	cs.beginEvents(src, dst)
+	ok := s.copyFile(cs, reader, src, dst)
+	if ok && cs.confirmDurable && dst.isUpspin {
+		ok = s.confirmDurable(cs, dst)
+	}
+	cs.endEvents(ok)
+	return ok
+}
+
+// copyFile does the work of copyToFile.
+func (s *State) copyFile(cs *copyState, reader io.ReadCloser, src, dst cpFile) bool {
 	cs.logf("start cp %s %s", src.path, dst.path)
 	defer cs.logf("end cp %s %s", src.path, dst.path)
 	// If both are in Upspin, we can avoid touching the data by copying
 	// just the references.
-	if src.isUpspin && dst.isUpspin {
+	if src.isUpspin && dst.isUpspin && !cs.transforms(src, dst) {
 		cs.logf("try fast copy to %v", dst)
-		err := s.fastCopy(upspin.PathName(src.path), upspin.PathName(dst.path))
-		if err == nil {
-			return
+		switch s.duplicate(cs, src, upspin.PathName(dst.path)) {
+		case nil:
+			cs.copiedByReference()
+			return true
+		case errReported:
+			return false
 		}
 	}
-	writer, err := s.create(dst)
+	s.warnWriter(cs, src, dst)
+	if cs.keepPackdata && src.isUpspin && !dst.isUpspin {
+		return s.exportPackdata(cs, reader, src, dst)
+	}
+	if cs.keepPackdata && !src.isUpspin && dst.isUpspin && hasPackdata(src) {
+		return s.restorePackdata(cs, reader, src, dst)
+	}
+	if cs.dedup && !src.isUpspin && dst.isUpspin {
+		return s.dedupCopy(cs, reader, src, dst)
+	}
+	if cs.sparse && !src.isUpspin && dst.isUpspin {
+		return s.sparseCopyIn(cs, reader, src, dst)
+	}
+	if cs.sparse && src.isUpspin && !dst.isUpspin {
+		return s.sparseCopyOut(cs, reader, src, dst)
+	}
+	if writer, ok := s.resumeCheckpoint(cs, reader, src, dst); ok {
+		return cs.doCopy(reader, writer, src, dst)
+	}
+	writer, err := s.create(cs, dst)
 	if err != nil {
 		s.Fail(err)
 		reader.Close()
-		return
+		return false
+	}
+	return cs.doCopy(reader, writer, src, dst)
+}
+
+// rename moves src to dst with a single Rename if -mv is set and both are
+// files in the tree of the same Upspin user. It reports whether it did so;
+// if not, the caller should copy the file instead.
+func (s *State) rename(cs *copyState, src, dst cpFile) bool {
+	if !cs.move || !src.isUpspin || !dst.isUpspin || cs.transforms(src, dst) {
+		return false
+	}
+	srcParsed, err := path.Parse(upspin.PathName(src.path))
+	if err != nil {
+		return false
+	}
+	dstParsed, err := path.Parse(upspin.PathName(dst.path))
+	if err != nil || srcParsed.User() != dstParsed.User() {
+		return false
+	}
+	// Rename follows links and cannot move directories.
+	entry, err := s.Client.Lookup(srcParsed.Path(), false)
+	if err != nil || entry.IsLink() || entry.IsDir() {
+		return false
+	}
+	cs.logf("rename %s to %s", src.path, dst.path)
+	return s.Client.Rename(srcParsed.Path(), dstParsed.Path()) == nil
+}
+
+// removeSource removes a source that has been copied if -mv is set.
+// It reports whether the source is gone or was not meant to be removed.
+func (s *State) removeSource(cs *copyState, src cpFile) bool {
+	if !cs.move {
+		return true
+	}
+	cs.logf("remove %s", src.path)
+	var err error
+	if src.isUpspin {
+		err = s.Client.Delete(upspin.PathName(src.path))
+	} else {
+		err = os.Remove(src.path)
+	}
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	return true
+}
+
+// deleteExtras removes, or with -delete but not -confirm lists, the entries
+// of the destination directory dir whose names are not those of the files
+// src that were copied into it. It reports whether it succeeded.
+func (s *State) deleteExtras(cs *copyState, src []cpFile, dir cpFile) bool {
+	keep := make(map[string]bool)
+	names := s.dstNames(cs, src, dir)
+	for i, file := range src {
+		name := names[i].name
+		if cs.keepPackdata && !file.isUpspin && strings.HasSuffix(name, packdataSuffix) {
+			// Sidecars are not copied.
+			continue
+		}
+		keep[name] = true
+		if cs.keepPackdata && file.isUpspin && !dir.isUpspin {
+			// Nor are the sidecars made by copying them removed.
+			keep[name+packdataSuffix] = true
+		}
+	}
+	existing, err := s.contents(cs, dir)
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	ok := true
+	for _, file := range existing {
+		if !keep[filepath.Base(file.path)] {
+			ok = s.removeTree(cs, file) && ok
+		}
 	}
-	cs.doCopy(reader, writer)
+	return ok
+}
+
+// removeTree removes the file and, if it is a directory, everything in it,
+// or with -delete but not -confirm prints what it would remove. Links are
+// removed, not followed. It reports whether it succeeded.
+func (s *State) removeTree(cs *copyState, file cpFile) bool {
+	cs.checkCanceled()
+	if !cs.confirm {
+		fmt.Printf("would remove %s\n", file.path)
+		return true
+	}
+	var isDir bool
+	if file.isUpspin {
+		entry, err := s.Client.Lookup(upspin.PathName(file.path), false)
+		isDir = err == nil && entry.IsDir()
+	} else {
+		info, err := os.Lstat(file.path)
+		isDir = err == nil && info.IsDir()
+	}
+	if isDir {
+		contents, err := s.contents(cs, file)
+		if err != nil {
+			s.Fail(err)
+			return false
+		}
+		for _, f := range contents {
+			if !s.removeTree(cs, f) {
+				return false
+			}
+		}
+	}
+	cs.logf("remove %s", file.path)
+	var err error
+	if file.isUpspin {
+		err = s.Client.Delete(upspin.PathName(file.path))
+	} else {
+		err = os.Remove(file.path)
+	}
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	return true
+}
+
+// linkTarget reports whether src is an Upspin link that should be recreated
+// as a link at dst rather than followed and, if so, returns the link's target.
+// Links are only recreated when both files are in Upspin and -L is not set.
+func (s *State) linkTarget(cs *copyState, src, dst cpFile) (upspin.PathName, bool) {
+	if cs.follow || !src.isUpspin || !dst.isUpspin {
+		return "", false
+	}
+	entry, err := s.unfollowedEntry(src)
+	if err != nil || !entry.IsLink() {
+		return "", false
+	}
+	return entry.Link, true
+}
+
+// unfollowedEntry returns the directory entry of the Upspin file, not
+// following a final link: the entry it was listed with, if any, or else
+// the one looked up.
+func (s *State) unfollowedEntry(file cpFile) (*upspin.DirEntry, error) {
+	if file.entry != nil {
+		return file.entry, nil
+	}
+	return s.Client.Lookup(upspin.PathName(file.path), false)
+}
+
+// copyLink creates an Upspin link at dst pointing to target.
+// It reports whether it succeeded.
+func (s *State) copyLink(cs *copyState, target upspin.PathName, dst cpFile) bool {
+	cs.logf("link %s to %s", dst.path, target)
+	if _, err := s.Client.PutLink(target, upspin.PathName(dst.path)); err != nil {
+		s.Fail(err)
+		return false
+	}
+	return true
+}
+
+// dialDurable returns the store server at the endpoint, bypassing any
+// cache server. Bind would return the store it already dialed through the
+// cache server, so dial anew through that store's Dial method. It is a
+// variable so tests can replace it.
+var dialDurable = func(cfg upspin.Config, e upspin.Endpoint) (upspin.StoreServer, error) {
+	cfg = config.SetCacheEndpoint(cfg, upspin.Endpoint{})
+	store, err := bind.StoreServer(cfg, e)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := store.Dial(cfg, e)
+	if err != nil {
+		return nil, err
+	}
+	return svc.(upspin.StoreServer), nil
+}
+
+// confirmDurable checks that every block of the Upspin file can be fetched
+// from its store, reporting those that cannot, and reports whether all can.
+func (s *State) confirmDurable(cs *copyState, file cpFile) bool {
+	entry, err := s.Client.Lookup(upspin.PathName(file.path), true)
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	cs.logf("confirm %d blocks of %s are durable", len(entry.Blocks), entry.Name)
+	ok := true
+	for i, b := range entry.Blocks {
+		if err := s.fetchBlock(b.Location); err != nil {
+			s.Fail(errors.E(entry.Name, errors.NotExist, errors.Errorf("block %d of %d, %q in store %s, is not durable: %v", i+1, len(entry.Blocks), b.Location.Reference, b.Location.Endpoint, err)))
+			ok = false
+		}
+	}
+	return ok
+}
+
+// fetchBlock fetches the block at loc from its store. A store that
+// refers to other locations is taken to know where the block is.
+func (s *State) fetchBlock(loc upspin.Location) error {
+	store, err := dialDurable(s.Config, loc.Endpoint)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = store.Get(loc.Reference)
+	return err
 }
 
 // fastCopy copies the source to the destination using the references rather than the data.
 // If it fails, PutDuplicate failed because the file exists or the source is a directory.
-// (Any other error is unexpected and exits the copy command.)
 // The caller may be able to retry with a regular copy.
+// Any other error is unexpected; it is reported and errReported returned.
 func (s *State) fastCopy(src, dst upspin.PathName) error {
 	_, err := s.Client.PutDuplicate(src, dst)
 	if err == nil {
@@ -255,23 +1616,74 @@ func (s *State) fastCopy(src, dst upspin.PathName) error {
 		// Oops, we have a directory. Retry.
 		return err
 	}
-	// Unexpected error. Die.
+	// Unexpected error.
 	s.Fail(err)
-	return nil
+	return errReported
 }
 
-func (cs *copyState) doCopy(reader io.ReadCloser, writer io.WriteCloser) {
-	defer func() {
-		reader.Close()
-		err := writer.Close()
-		if err != nil {
+// doCopy copies reader, opened from src, to writer, created for dst,
+// closing both, and reports whether it succeeded. If the copy fails
+// partway, it reports whether reading or writing failed and removes
+// the incomplete destination. With -checkpoint, a local destination is
+// synced to disk as the copy goes, and with -statefile one that reached
+// a checkpoint is kept so a later run can resume it; see cpcheckpoint.go.
+func (cs *copyState) doCopy(reader io.ReadCloser, writer io.WriteCloser, src, dst cpFile) bool {
+	defer reader.Close()
+	writer = cs.checkpointed(writer, src, dst, 0)
+	in := cs.counted(reader)
+	switch compress, decompress := cs.gzips(src, dst); {
+	case compress:
+		writer = newGzipWriter(writer)
+	case decompress:
+		in = &gunzipReader{r: in}
+	}
+	in = cs.throttled(in)
+	r := &readErrorReader{Reader: in}
+	n, err := io.Copy(writer, r)
+	if err == nil {
+		if err := writer.Close(); err != nil {
 			cs.state.Fail(err)
+			return false
 		}
-	}()
-	_, err := io.Copy(writer, reader)
-	if err != nil {
+		return true
+	}
+	if r.err != nil {
+		cs.state.Failf("reading %s failed after %d bytes: %v", src.path, n, err)
+	} else {
+		cs.state.Failf("writing %s failed after %d bytes: %v", dst.path, n, err)
+	}
+	if dst.isUpspin {
+		// Nothing reaches Upspin until the file is closed,
+		// so abandoning it leaves no partial copy.
+		return false
+	}
+	writer.Close()
+	if cs.checkpoint != 0 && cs.progress != nil {
+		if offset := cs.progress.checkpointed(src, dst); offset > 0 {
+			cs.logf("keep incomplete %s to resume at checkpoint %d", dst.path, offset)
+			return false
+		}
+	}
+	cs.logf("remove incomplete %s", dst.path)
+	if err := os.Remove(dst.path); err != nil {
 		cs.state.Fail(err)
 	}
+	return false
+}
+
+// readErrorReader records the error, other than io.EOF, returned by
+// the reader it wraps so a failed copy can be blamed on the source.
+type readErrorReader struct {
+	io.Reader
+	err error
+}
+
+func (r *readErrorReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
 }
 
 // isLocal reports whether the argument names a fully-qualified local file.
@@ -304,6 +1716,14 @@ func (cs *copyState) glob(pattern string) (files []cpFile) {
 	// Path on local machine?
 	if isLocal(pattern) {
 		for _, path := range cs.state.GlobLocal(subcmd.Tilde(pattern)) {
+			if name, ok := cs.upspinfsPath(path); ok {
+				cs.logf("%s is in an upspinfs mount; using %s", path, name)
+				files = append(files, cpFile{
+					path:     string(name),
+					isUpspin: true,
+				})
+				continue
+			}
 			files = append(files, cpFile{
 				path:     path,
 				isUpspin: false,
@@ -333,18 +1753,17 @@ func (cs *copyState) glob(pattern string) (files []cpFile) {
 }
 
 // contents return the top-level contents of dir as a slice of cpFiles.
+// If the listing fails, it returns whatever files were listed, and the error.
 func (s *State) contents(cs *copyState, dir cpFile) ([]cpFile, error) {
+	cs.checkCanceled()
 	if dir.isUpspin {
 		entries, err := s.Client.Glob(upspin.AllFilesGlob(upspin.PathName(dir.path)))
-		if err != nil {
-			s.Fail(err)
-			// OK to continue; there may still be files.
-		}
 		files := make([]cpFile, len(entries))
 		for i, entry := range entries {
 			files[i] = cpFile{
 				path:     string(entry.Name),
 				isUpspin: true,
+				entry:    entry,
 			}
 		}
 		return files, err
@@ -352,15 +1771,10 @@ func (s *State) contents(cs *copyState, dir cpFile) ([]cpFile, error) {
 	// Local directory. We're descending into a directory here, so there can be no ~.
 	fd, err := os.Open(dir.path)
 	if err != nil {
-		s.Fail(err)
 		return nil, err
 	}
 	defer fd.Close()
 	names, err := fd.Readdirnames(0)
-	if err != nil {
-		s.Fail(err)
-		// OK to continue; there may still be files.
-	}
 	files := make([]cpFile, len(names))
 	for i, name := range names {
 		files[i] = cpFile{
@@ -370,3 +1784,129 @@ func (s *State) contents(cs *copyState, dir cpFile) ([]cpFile, error) {
 	}
 	return files, err
 }
+
+// apparentSize returns the number of files and their total size in bytes,
+// taken from Upspin directory entries and local file metadata. Directories
+// are descended into only if -R is set; otherwise they are not counted.
+// Links are sized as the copy to a destination in Upspin, if toUpspin is
+// set, or to local files, will treat them: see linkSize.
+func (s *State) apparentSize(cs *copyState, files []cpFile, toUpspin bool) (n int, size int64) {
+	for _, file := range files {
+		fn, fsize := s.fileApparentSize(cs, file, toUpspin)
+		n += fn
+		size += fsize
+	}
+	return n, size
+}
+
+// fileApparentSize returns the number of files and their total size in
+// bytes in the Upspin or local file, a directory or a link, as for
+// apparentSize.
+func (s *State) fileApparentSize(cs *copyState, file cpFile, toUpspin bool) (n int, size int64) {
+	if file.isUpspin {
+		entry, err := s.unfollowedEntry(file)
+		if err == nil && entry.IsLink() {
+			if !s.linkFollowed(cs, file, toUpspin) {
+				return 1, 0
+			}
+			entry, err = s.Client.Lookup(upspin.PathName(file.path), true)
+		}
+		if err != nil {
+			s.Fail(err)
+			return 0, 0
+		}
+		return s.upspinApparentSize(cs, entry, toUpspin)
+	}
+	info, err := os.Lstat(file.path)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if !s.linkFollowed(cs, file, toUpspin) {
+			return 1, 0
+		}
+		info, err = os.Stat(file.path)
+	}
+	if err != nil {
+		s.Fail(err)
+		return 0, 0
+	}
+	return s.localApparentSize(cs, file, info, toUpspin)
+}
+
+// linkFollowed reports whether the copy of the link file, to a destination
+// in Upspin if toUpspin is set, will copy what it links to rather than
+// recreate the link; see relinkTree and linkTarget.
+func (s *State) linkFollowed(cs *copyState, file cpFile, toUpspin bool) bool {
+	if cs.relativize && cs.treeSrc.path != "" {
+		if file.isUpspin || !toUpspin {
+			return false
+		}
+		target, _ := s.sourceLink(file)
+		_, inTree := cs.treeRelative(target)
+		return !inTree
+	}
+	return cs.follow || !file.isUpspin || !toUpspin
+}
+
+// upspinApparentSize returns the number of files and their total size in
+// bytes in the Upspin file or directory with the given entry, as for
+// apparentSize.
+func (s *State) upspinApparentSize(cs *copyState, entry *upspin.DirEntry, toUpspin bool) (n int, size int64) {
+	if !entry.IsDir() {
+		fsize, err := entry.Size()
+		if err != nil {
+			s.Fail(err)
+		}
+		return 1, fsize
+	}
+	if !cs.recur {
+		return 0, 0
+	}
+	entries, err := s.Client.Glob(upspin.AllFilesGlob(entry.Name))
+	if err != nil {
+		s.Fail(err)
+	}
+	dir := cpFile{path: string(entry.Name), isUpspin: true}
+	outer := cs.relativize && cs.treeSrc.path == ""
+	if outer {
+		cs.treeSrc = dir
+		defer func() { cs.treeSrc = cpFile{} }()
+	}
+	for _, e := range entries {
+		fn, fsize := s.fileApparentSize(cs, cpFile{path: string(e.Name), isUpspin: true, entry: e}, toUpspin)
+		n += fn
+		size += fsize
+	}
+	return n, size
+}
+
+// localApparentSize returns the number of files and their total size in
+// bytes in the local file or directory, with the given metadata, as for
+// apparentSize.
+func (s *State) localApparentSize(cs *copyState, file cpFile, info os.FileInfo, toUpspin bool) (n int, size int64) {
+	if !info.IsDir() {
+		return 1, info.Size()
+	}
+	if !cs.recur {
+		return 0, 0
+	}
+	fd, err := os.Open(file.path)
+	if err != nil {
+		s.Fail(err)
+		return 0, 0
+	}
+	names, err := fd.Readdirnames(0)
+	fd.Close()
+	if err != nil {
+		s.Fail(err)
+	}
+	outer := cs.relativize && cs.treeSrc.path == ""
+	if outer {
+		cs.treeSrc = file
+		defer func() { cs.treeSrc = cpFile{} }()
+	}
+	for _, name := range names {
+		fn, fsize := s.fileApparentSize(cs, cpFile{path: filepath.Join(file.path, name)}, toUpspin)
+		n += fn
+		size += fsize
+	}
+	return n, size
+}
@@ -0,0 +1,3074 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"upspin.io/bind"
+	"upspin.io/client"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/factotum"
+	"upspin.io/flags"
+	"upspin.io/subcmd"
+	"upspin.io/test/testenv"
+	"upspin.io/upspin"
+)
+
+const cpTestUser = "user1@google.com"
+
+// newCopyTestState returns a State for running cp against an inprocess
+// test environment owned by cpTestUser. The caller must call env.Exit.
+func newCopyTestState(t *testing.T) (*State, *testenv.Env) {
+	env, err := testenv.New(&testenv.Setup{
+		OwnerName: cpTestUser,
+		Kind:      "inprocess",
+		Packing:   upspin.EEPack,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newState("cp")
+	s.Interactive = true
+	s.Config = env.Config
+	s.Client = env.Client
+	return s, env
+}
+
+// runCp runs the cp command with the given arguments, recovering from
+// the panic with which an interactive State exits.
+func runCp(s *State, args ...string) (exited bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != "exit" {
+				panic(r)
+			}
+			exited = true
+		}
+	}()
+	s.cp(args...)
+	return false
+}
+
+func mkUpspinDir(t *testing.T, s *State, name upspin.PathName) {
+	if _, err := s.Client.MakeDirectory(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func putUpspin(t *testing.T, s *State, name upspin.PathName, data string) {
+	if _, err := s.Client.Put(name, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyUpspinLink(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	const (
+		src    = cpTestUser + "/src"
+		dst    = cpTestUser + "/dst"
+		target = src + "/file"
+	)
+	mkUpspinDir(t, s, src)
+	mkUpspinDir(t, s, dst)
+	putUpspin(t, s, target, "target contents")
+	if _, err := s.Client.PutLink(target, src+"/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	checkLink := func(name upspin.PathName) {
+		entry, err := s.Client.Lookup(name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !entry.IsLink() {
+			t.Fatalf("%s is not a link", name)
+		}
+		if entry.Link != target {
+			t.Errorf("%s links to %q, want %q", name, entry.Link, target)
+		}
+	}
+
+	// Into a directory.
+	runCp(s, src+"/link", dst)
+	checkLink(dst + "/link")
+
+	// To a named file.
+	runCp(s, src+"/link", dst+"/link2")
+	checkLink(dst + "/link2")
+
+	// With -L the contents are copied instead.
+	runCp(s, "-L", src+"/link", dst+"/copy")
+	entry, err := s.Client.Lookup(dst+"/copy", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.IsLink() {
+		t.Errorf("%s is a link with -L", entry.Name)
+	}
+	data, err := s.Client.Get(dst + "/copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "target contents" {
+		t.Errorf("copy contains %q, want %q", data, "target contents")
+	}
+	if s.ExitCode != 0 {
+		t.Errorf("exit code %d, want 0", s.ExitCode)
+	}
+}
+
+func TestApparentSize(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	// An Upspin tree.
+	const dir = cpTestUser + "/tree"
+	mkUpspinDir(t, s, dir)
+	mkUpspinDir(t, s, dir+"/sub")
+	putUpspin(t, s, dir+"/a", "12345")
+	putUpspin(t, s, dir+"/sub/b", "1234567890")
+	putUpspin(t, s, dir+"/sub/empty", "")
+
+	// A local tree.
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Mkdir(filepath.Join(tmp, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "c"), make([]byte, 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "sub", "d"), make([]byte, 1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	src := []cpFile{
+		{path: dir, isUpspin: true},
+		{path: tmp, isUpspin: false},
+		{path: dir + "/a", isUpspin: true},
+	}
+	n, size := s.apparentSize(&copyState{state: s, recur: true}, src, false)
+	if n != 6 || size != 5+10+0+100+1000+5 {
+		t.Errorf("apparentSize = %d files, %d bytes; want 6 files, %d bytes", n, size, 5+10+0+100+1000+5)
+	}
+
+	// Without -R, directories are not counted.
+	n, size = s.apparentSize(&copyState{state: s}, src, false)
+	if n != 1 || size != 5 {
+		t.Errorf("apparentSize without -R = %d files, %d bytes; want 1 file, 5 bytes", n, size)
+	}
+
+	// Links count as what they link to when the copy follows them, and
+	// as files of no bytes when it recreates them.
+	if _, err := s.Client.PutLink(dir+"/sub/b", dir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("c", filepath.Join(tmp, "e")); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		cs       copyState
+		toUpspin bool
+		n        int
+		size     int64
+	}{
+		// To local files, both links are followed.
+		{copyState{recur: true}, false, 7, 5 + 10 + 0 + 10 + 100 + 1000 + 100},
+		// Within Upspin, the Upspin link is recreated.
+		{copyState{recur: true}, true, 7, 5 + 10 + 0 + 0 + 100 + 1000 + 100},
+		// Unless -L is set.
+		{copyState{recur: true, follow: true}, true, 7, 5 + 10 + 0 + 10 + 100 + 1000 + 100},
+		// With -relativize-links, links in a tree are recreated.
+		{copyState{recur: true, relativize: true}, false, 7, 5 + 10 + 0 + 0 + 100 + 1000 + 0},
+	} {
+		cs := test.cs
+		cs.state = s
+		n, size := s.apparentSize(&cs, src[:2], test.toUpspin)
+		if n != test.n || size != test.size {
+			t.Errorf("apparentSize(-L=%v, -relativize-links=%v, to Upspin %v) = %d files, %d bytes; want %d files, %d bytes",
+				cs.follow, cs.relativize, test.toUpspin, n, size, test.n, test.size)
+		}
+	}
+	if s.ExitCode != 0 {
+		t.Errorf("exit code %d, want 0", s.ExitCode)
+	}
+}
+
+func TestCopyCat(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const dir = cpTestUser + "/cat"
+	mkUpspinDir(t, s, dir)
+	local1 := filepath.Join(tmp, "part1")
+	if err := ioutil.WriteFile(local1, []byte("one,"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	putUpspin(t, s, dir+"/part2", "two,")
+	putUpspin(t, s, dir+"/empty", "")
+	local3 := filepath.Join(tmp, "part3")
+	if err := ioutil.WriteFile(local3, []byte("three"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	const want = "one,two,three"
+
+	runCp(s, "-cat", local1, dir+"/part2", dir+"/empty", local3, dir+"/combined")
+	data, err := s.Client.Get(dir + "/combined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("Upspin destination contains %q, want %q", data, want)
+	}
+
+	localDst := filepath.Join(tmp, "combined")
+	runCp(s, "-cat", local1, dir+"/part2", dir+"/empty", local3, localDst)
+	data, err = ioutil.ReadFile(localDst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("local destination contains %q, want %q", data, want)
+	}
+	if s.ExitCode != 0 {
+		t.Errorf("exit code %d, want 0", s.ExitCode)
+	}
+
+	// A directory destination is refused.
+	if !runCp(s, "-cat", local1, local3, tmp) {
+		t.Error("-cat into a directory did not exit")
+	}
+}
+
+func TestCopyMove(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const dir = cpTestUser + "/mv"
+	mkUpspinDir(t, s, dir)
+	upspinGone := func(name upspin.PathName) bool {
+		_, err := s.Client.Lookup(name, false)
+		return err != nil
+	}
+	localGone := func(name string) bool {
+		_, err := os.Stat(name)
+		return os.IsNotExist(err)
+	}
+	checkUpspin := func(name upspin.PathName, want string) {
+		data, err := s.Client.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s contains %q, want %q", name, data, want)
+		}
+	}
+
+	// Local to Upspin.
+	local := filepath.Join(tmp, "local")
+	if err := ioutil.WriteFile(local, []byte("local data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	runCp(s, "-mv", local, dir+"/fromlocal")
+	checkUpspin(dir+"/fromlocal", "local data")
+	if !localGone(local) {
+		t.Errorf("%s not removed", local)
+	}
+
+	// Upspin to local.
+	toLocal := filepath.Join(tmp, "fromupspin")
+	runCp(s, "-mv", dir+"/fromlocal", toLocal)
+	data, err := ioutil.ReadFile(toLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "local data" {
+		t.Errorf("%s contains %q, want %q", toLocal, data, "local data")
+	}
+	if !upspinGone(dir + "/fromlocal") {
+		t.Errorf("%s not removed", dir+"/fromlocal")
+	}
+
+	// Upspin to Upspin, into a directory.
+	mkUpspinDir(t, s, dir+"/sub")
+	putUpspin(t, s, dir+"/file", "upspin data")
+	runCp(s, "-mv", dir+"/file", dir+"/sub")
+	checkUpspin(dir+"/sub/file", "upspin data")
+	if !upspinGone(dir + "/file") {
+		t.Errorf("%s not removed", dir+"/file")
+	}
+
+	// A recursive move removes the source tree.
+	tree := filepath.Join(tmp, "tree")
+	if err := os.Mkdir(tree, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tree, "a"), []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	runCp(s, "-mv", "-R", tree, dir)
+	checkUpspin(dir+"/tree/a", "a")
+	if !localGone(tree) {
+		t.Errorf("%s not removed", tree)
+	}
+	if s.ExitCode != 0 {
+		t.Fatalf("exit code %d, want 0", s.ExitCode)
+	}
+
+	// Failed copies leave their sources in place.
+	if err := ioutil.WriteFile(local, []byte("local data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	putUpspin(t, s, dir+"/keep", "keep")
+	runCp(s, "-mv", local, dir+"/nonexistent/file")
+	runCp(s, "-mv", dir+"/keep", filepath.Join(tmp, "nonexistent", "file"))
+	runCp(s, "-mv", dir+"/keep", dir+"/nonexistent/file")
+	if localGone(local) {
+		t.Errorf("%s removed after failed copy", local)
+	}
+	checkUpspin(dir+"/keep", "keep")
+	if s.ExitCode == 0 {
+		t.Error("exit code 0 after failed copies")
+	}
+}
+
+// partialGlobClient is a Client whose Glob of the contents of dir returns
+// only the first entry, and an error.
+type partialGlobClient struct {
+	upspin.Client
+	dir upspin.PathName
+}
+
+func (c partialGlobClient) Glob(pattern string) ([]*upspin.DirEntry, error) {
+	entries, err := c.Client.Glob(pattern)
+	if err != nil || pattern != string(upspin.AllFilesGlob(c.dir)) {
+		return entries, err
+	}
+	return entries[:1], errors.E(c.dir, errors.IO, errors.Str("listing interrupted"))
+}
+
+func TestCopyPartialListing(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	const dir = cpTestUser + "/partial"
+	mkUpspinDir(t, s, dir)
+	mkUpspinDir(t, s, dir+"/src")
+	mkUpspinDir(t, s, dir+"/dst")
+	putUpspin(t, s, dir+"/src/a", "a")
+	putUpspin(t, s, dir+"/src/b", "b")
+	s.Client = partialGlobClient{Client: s.Client, dir: dir + "/src"}
+
+	// By default, the copy is abandoned.
+	if !runCp(s, "-R", dir+"/src", dir+"/dst") {
+		t.Error("copy with incomplete listing did not exit")
+	}
+	if _, err := s.Client.Lookup(dir+"/dst/src/a", false); err == nil {
+		t.Error("copy with incomplete listing copied files")
+	}
+
+	// With -k, what was listed is copied but the failure is reported.
+	if runCp(s, "-k", "-R", dir+"/src", dir+"/dst") {
+		t.Error("copy with -k exited")
+	}
+	if _, err := s.Client.Lookup(dir+"/dst/src/a", false); err != nil {
+		t.Errorf("listed file not copied with -k: %v", err)
+	}
+	if _, err := s.Client.Lookup(dir+"/dst/src/b", false); err == nil {
+		t.Error("unlisted file copied with -k")
+	}
+	if s.ExitCode == 0 {
+		t.Error("exit code 0 after incomplete listing")
+	}
+}
+
+func TestCopyArchive(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const dir = cpTestUser + "/archive"
+	mkUpspinDir(t, s, dir)
+	mkUpspinDir(t, s, dir+"/sub")
+	putUpspin(t, s, dir+"/a", "file a")
+	putUpspin(t, s, dir+"/sub/b", "file b")
+	if _, err := s.Client.PutLink(dir+"/a", dir+"/sub/link"); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := s.Client.Lookup(dir+"/a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tarFile := filepath.Join(tmp, "backup.tar")
+	runCp(s, "-R", "-archive=tar", dir, tarFile)
+	if s.ExitCode != 0 {
+		t.Fatalf("exit code %d, want 0", s.ExitCode)
+	}
+	fd, err := os.Open(tarFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	type want struct {
+		typ  byte
+		data string
+	}
+	wants := map[string]want{
+		"archive/":         {tar.TypeDir, ""},
+		"archive/a":        {tar.TypeReg, "file a"},
+		"archive/sub/":     {tar.TypeDir, ""},
+		"archive/sub/b":    {tar.TypeReg, "file b"},
+		"archive/sub/link": {tar.TypeSymlink, dir + "/a"},
+	}
+	tr := tar.NewReader(fd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, ok := wants[hdr.Name]
+		if !ok {
+			t.Errorf("unexpected archive entry %q", hdr.Name)
+			continue
+		}
+		delete(wants, hdr.Name)
+		if hdr.Typeflag != w.typ {
+			t.Errorf("%s: type %c, want %c", hdr.Name, hdr.Typeflag, w.typ)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.typ == tar.TypeSymlink {
+			data = []byte(hdr.Linkname)
+		}
+		if string(data) != w.data {
+			t.Errorf("%s: contents %q, want %q", hdr.Name, data, w.data)
+		}
+		if hdr.Name == "archive/a" && !hdr.ModTime.Equal(entry.Time.Go()) {
+			t.Errorf("%s: time %v, want %v", hdr.Name, hdr.ModTime, entry.Time.Go())
+		}
+	}
+	for name := range wants {
+		t.Errorf("%s missing from archive", name)
+	}
+
+	// The zip archive has the same names.
+	zipFile := filepath.Join(tmp, "backup.zip")
+	runCp(s, "-R", "-archive=zip", dir, zipFile)
+	zr, err := zip.OpenReader(zipFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	const wantNames = "archive/ archive/a archive/sub/ archive/sub/b archive/sub/link"
+	if got := strings.Join(names, " "); got != wantNames {
+		t.Errorf("zip entries %q, want %q", got, wantNames)
+	}
+}
+
+func TestCopyComplete(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for _, name := range []string{"apple", "apricot", "banana", ".alias"} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(tmp, "april"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	const dir = cpTestUser + "/complete"
+	mkUpspinDir(t, s, dir)
+	mkUpspinDir(t, s, dir+"/april")
+	putUpspin(t, s, dir+"/apple", "a")
+	putUpspin(t, s, dir+"/apricot", "a")
+	putUpspin(t, s, dir+"/banana", "b")
+
+	for _, test := range []struct {
+		prefix string
+		want   []string
+	}{
+		{tmp + "/ap", []string{tmp + "/apple", tmp + "/apricot", tmp + "/april/"}},
+		{tmp + "/b", []string{tmp + "/banana"}},
+		{tmp + "/.a", []string{tmp + "/.alias"}},
+		{tmp + "/c", nil},
+		{tmp + "/nonexistent/", nil},
+		{dir + "/ap", []string{dir + "/apple", dir + "/apricot", dir + "/april/"}},
+		{dir + "/", []string{dir + "/apple", dir + "/apricot", dir + "/april/", dir + "/banana"}},
+		{"@/comp", []string{"@/complete/"}},
+		{cpTestUser + "/", []string{cpTestUser + "/complete/"}},
+		{"relative/path", nil},
+		{"~", []string{"~/"}},
+	} {
+		got := s.completions(test.prefix)
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("completions(%q) = %q, want %q", test.prefix, got, test.want)
+		}
+	}
+}
+
+// captureStderr returns what f writes to standard error.
+func captureStderr(t *testing.T, f func()) string {
+	return capture(t, &os.Stderr, f)
+}
+
+// captureStdout is like captureStderr but for standard output.
+func captureStdout(t *testing.T, f func()) string {
+	return capture(t, &os.Stdout, f)
+}
+
+func capture(t *testing.T, file **os.File, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := *file
+	*file = w
+	defer func() { *file = saved }()
+	out := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- string(data)
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+// failingReader returns its data and then the error.
+func failingReader(data string, err error) io.ReadCloser {
+	return ioutil.NopCloser(io.MultiReader(strings.NewReader(data), &errorReader{err}))
+}
+
+type errorReader struct{ err error }
+
+func (r *errorReader) Read([]byte) (int, error) { return 0, r.err }
+
+// shortWriter writes at most n bytes to the file and then fails.
+type shortWriter struct {
+	io.WriteCloser
+	n int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) <= w.n {
+		w.n -= len(p)
+		return w.WriteCloser.Write(p)
+	}
+	n, _ := w.WriteCloser.Write(p[:w.n])
+	w.n = 0
+	return n, errors.Str("device full")
+}
+
+func TestCopyPartialWrite(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cs := &copyState{state: s}
+	src := cpFile{path: cpTestUser + "/src", isUpspin: true}
+	gone := func(name string) bool {
+		_, err := os.Stat(name)
+		return os.IsNotExist(err)
+	}
+
+	// A read error removes the partial local copy.
+	dst := cpFile{path: filepath.Join(tmp, "read")}
+	writer, err := s.create(cs, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := captureStderr(t, func() {
+		if cs.doCopy(failingReader("partial", errors.Str("source gone")), writer, src, dst) {
+			t.Error("copy with a read error succeeded")
+		}
+	})
+	if want := "reading " + src.path + " failed after 7 bytes: source gone"; !strings.Contains(msg, want) {
+		t.Errorf("read error reported as %q, want %q", msg, want)
+	}
+	if !gone(dst.path) {
+		t.Errorf("partial copy %s not removed", dst.path)
+	}
+
+	// A write error does too, and is reported differently.
+	dst = cpFile{path: filepath.Join(tmp, "write")}
+	writer, err = s.create(cs, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = captureStderr(t, func() {
+		if cs.doCopy(failingReader("some data", io.EOF), &shortWriter{writer, 4}, src, dst) {
+			t.Error("copy with a write error succeeded")
+		}
+	})
+	if want := "writing " + dst.path + " failed after 4 bytes: device full"; !strings.Contains(msg, want) {
+		t.Errorf("write error reported as %q, want %q", msg, want)
+	}
+	if !gone(dst.path) {
+		t.Errorf("partial copy %s not removed", dst.path)
+	}
+
+	// A failed copy to Upspin leaves the existing file alone.
+	const upspinDst = cpTestUser + "/dst"
+	putUpspin(t, s, upspinDst, "original")
+	dst = cpFile{path: upspinDst, isUpspin: true}
+	writer, err = s.create(cs, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureStderr(t, func() {
+		if cs.doCopy(failingReader("partial", errors.Str("source gone")), writer, src, dst) {
+			t.Error("copy with a read error succeeded")
+		}
+	})
+	if data, err := s.Client.Get(upspinDst); err != nil || string(data) != "original" {
+		t.Errorf("%s: %q, %v; want original contents", upspinDst, data, err)
+	}
+	if s.ExitCode != 1 {
+		t.Errorf("exit code %d, want 1", s.ExitCode)
+	}
+}
+
+func TestCopyDirsOnly(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const top = cpTestUser + "/tree"
+	dirs := []string{"", "/a", "/a/b", "/a/b/c", "/d"}
+	files := []string{"/f", "/a/f", "/a/b/f", "/a/b/c/f"}
+	for _, d := range dirs {
+		mkUpspinDir(t, s, upspin.PathName(top+d))
+	}
+	for _, f := range files {
+		putUpspin(t, s, upspin.PathName(top+f), "data")
+	}
+	if _, err := s.Client.PutLink(top+"/f", top+"/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Into Upspin.
+	const dst = cpTestUser + "/copy"
+	mkUpspinDir(t, s, dst)
+	if runCp(s, "-R", "-dirs-only", top, dst) {
+		t.Fatal("cp exited")
+	}
+	for _, d := range dirs {
+		name := upspin.PathName(dst + "/tree" + d)
+		if entry, err := s.Client.Lookup(name, false); err != nil || !entry.IsDir() {
+			t.Errorf("%s not created as a directory: %v", name, err)
+		}
+	}
+	for _, f := range append(files, "/link") {
+		name := upspin.PathName(dst + "/tree" + f)
+		if _, err := s.Client.Lookup(name, false); err == nil {
+			t.Errorf("%s copied", name)
+		}
+	}
+
+	// Into a local directory, preserving times.
+	if runCp(s, "-R", "-dirs-only", "-p", top, tmp) {
+		t.Fatal("cp exited")
+	}
+	for _, d := range dirs {
+		name := filepath.Join(tmp, "tree"+d)
+		info, err := os.Stat(name)
+		if err != nil || !info.IsDir() {
+			t.Errorf("%s not created as a directory: %v", name, err)
+			continue
+		}
+		entry, err := s.Client.Lookup(upspin.PathName(top+d), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := entry.Time.Go(); !info.ModTime().Equal(want) {
+			t.Errorf("%s: time %v, want %v", name, info.ModTime(), want)
+		}
+	}
+	for _, f := range append(files, "/link") {
+		name := filepath.Join(tmp, "tree"+f)
+		if _, err := os.Lstat(name); !os.IsNotExist(err) {
+			t.Errorf("%s copied: %v", name, err)
+		}
+	}
+
+	if !runCp(s, "-dirs-only", top, tmp) {
+		t.Error("cp -dirs-only without -R did not exit")
+	}
+}
+
+// interruptingGlobClient is a Client that calls interrupt during
+// its first Glob, as if the user typed an interrupt while a slow
+// listing was in progress.
+type interruptingGlobClient struct {
+	upspin.Client
+	interrupt func()
+	globs     *int
+}
+
+func (c interruptingGlobClient) Glob(pattern string) ([]*upspin.DirEntry, error) {
+	*c.globs++
+	if *c.globs == 1 {
+		c.interrupt()
+	}
+	return c.Client.Glob(pattern)
+}
+
+func TestCopyInterrupted(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	const dir = cpTestUser + "/interrupt"
+	mkUpspinDir(t, s, dir)
+	mkUpspinDir(t, s, dir+"/src")
+	mkUpspinDir(t, s, dir+"/src/sub")
+	mkUpspinDir(t, s, dir+"/dst")
+	putUpspin(t, s, dir+"/src/a", "a")
+	putUpspin(t, s, dir+"/src/sub/b", "b")
+
+	var cancel context.CancelFunc
+	defer func(f func() (context.Context, context.CancelFunc)) { newCopyContext = f }(newCopyContext)
+	newCopyContext = func() (context.Context, context.CancelFunc) {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		return ctx, cancel
+	}
+	globs := 0
+	s.Client = interruptingGlobClient{
+		Client:    s.Client,
+		interrupt: func() { cancel() },
+		globs:     &globs,
+	}
+
+	if !runCp(s, "-R", dir+"/src", dir+"/dst") {
+		t.Fatal("interrupted copy did not exit")
+	}
+	// The listing in progress finishes, but nothing more is done.
+	if globs != 1 {
+		t.Errorf("%d listings, want 1", globs)
+	}
+	for _, name := range []upspin.PathName{dir + "/dst/src/a", dir + "/dst/src/sub"} {
+		if _, err := s.Client.Lookup(name, false); err == nil {
+			t.Errorf("%s copied after interrupt", name)
+		}
+	}
+}
+
+func TestCopyKeepPackdata(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// The file is shared with a reader, whose wrapped key must survive.
+	const reader = "bob@google.com"
+	readerConfig, err := env.NewUser(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		dir  = cpTestUser + "/packdata"
+		file = dir + "/file"
+		data = "shared data"
+	)
+	mkUpspinDir(t, s, dir)
+	putUpspin(t, s, dir+"/Access", "*: "+cpTestUser+"\nr: "+reader+"\n")
+	putUpspin(t, s, file, data)
+	orig, err := s.Client.Lookup(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := filepath.Join(tmp, "file")
+	if runCp(s, "-keep-packdata", file, local) {
+		t.Fatal("cp exited")
+	}
+	if got, err := ioutil.ReadFile(local); err != nil || string(got) != data {
+		t.Fatalf("local copy: %q, %v", got, err)
+	}
+	if _, err := os.Stat(local + packdataSuffix); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restore the file after it is deleted.
+	if err := s.Client.Delete(file); err != nil {
+		t.Fatal(err)
+	}
+	if runCp(s, "-keep-packdata", local, file) {
+		t.Fatal("cp exited")
+	}
+	entry, err := s.Client.Lookup(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(entry.Packdata, orig.Packdata) {
+		t.Error("packdata not preserved")
+	}
+	if !reflect.DeepEqual(entry.Blocks, orig.Blocks) {
+		t.Errorf("blocks %v, want %v", entry.Blocks, orig.Blocks)
+	}
+	if got, err := s.Client.Get(file); err != nil || string(got) != data {
+		t.Errorf("owner: Get: %q, %v", got, err)
+	}
+	if got, err := client.New(readerConfig).Get(file); err != nil || string(got) != data {
+		t.Errorf("reader: Get: %q, %v", got, err)
+	}
+
+	// A recursive copy into Upspin copies files without sidecars
+	// as usual but does not copy sidecars.
+	tree := filepath.Join(tmp, "tree")
+	if err := os.Mkdir(tree, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"plain", "orphan" + packdataSuffix} {
+		if err := ioutil.WriteFile(filepath.Join(tree, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runCp(s, "-R", "-keep-packdata", tree, dir) {
+		t.Fatal("cp exited")
+	}
+	if got, err := s.Client.Get(dir + "/tree/plain"); err != nil || string(got) != data {
+		t.Errorf("recursive copy: %q, %v", got, err)
+	}
+	if _, err := s.Client.Lookup(dir+"/tree/orphan"+packdataSuffix, false); err == nil {
+		t.Error("packdata sidecar copied")
+	}
+
+	// The packdata cannot be restored under another name.
+	s.ExitCode = 0
+	msg := captureStderr(t, func() { runCp(s, "-keep-packdata", local, dir+"/other") })
+	if s.ExitCode == 0 || !strings.Contains(msg, "cannot restore") {
+		t.Errorf("restore under another name: exit code %d, %q", s.ExitCode, msg)
+	}
+
+	// Nor for a file changed since it was saved.
+	if err := ioutil.WriteFile(local, []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.ExitCode = 0
+	msg = captureStderr(t, func() { runCp(s, "-keep-packdata", local, file) })
+	if s.ExitCode == 0 || !strings.Contains(msg, "has changed") {
+		t.Errorf("restore of changed file: exit code %d, %q", s.ExitCode, msg)
+	}
+	if got, err := s.Client.Get(file); err != nil || string(got) != data {
+		t.Errorf("after refused restore: %q, %v", got, err)
+	}
+}
+
+func TestCopyReadOnlyDestination(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	tree := filepath.Join(tmp, "tree")
+	if err := os.Mkdir(tree, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(tree, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The destination is readable, but not writable, by the copier.
+	const reader = "bob@google.com"
+	readerConfig, err := env.NewUser(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const dir = cpTestUser + "/readonly"
+	mkUpspinDir(t, s, dir)
+	putUpspin(t, s, dir+"/Access", "*: "+cpTestUser+"\nr: "+reader+"\n")
+	owner := s.Client
+
+	s.Config = readerConfig
+	s.Client = client.New(readerConfig)
+	var exited bool
+	msg := captureStderr(t, func() { exited = runCp(s, "-R", tree, dir) })
+	if !exited || !strings.Contains(msg, "cannot copy to "+dir) {
+		t.Errorf("copy to read-only destination: exited %v, %q", exited, msg)
+	}
+	if entries, err := owner.Glob(dir + "/*"); err != nil || len(entries) != 1 {
+		t.Errorf("destination has %d entries, want only the Access file: %v", len(entries), err)
+	}
+
+	// The owner can copy there.
+	s.Config = env.Config
+	s.Client = owner
+	if runCp(s, "-R", tree, dir) {
+		t.Fatal("cp exited")
+	}
+	if got, err := owner.Get(dir + "/tree/c"); err != nil || string(got) != "c" {
+		t.Errorf("copy by owner: %q, %v", got, err)
+	}
+}
+
+func TestCopyIntoItself(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const top = cpTestUser + "/top"
+	mkUpspinDir(t, s, top)
+	mkUpspinDir(t, s, top+"/sub")
+	mkUpspinDir(t, s, top+"/sub/deeper")
+	putUpspin(t, s, top+"/file", "data")
+	if _, err := s.Client.PutLink(top, cpTestUser+"/alias"); err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(tmp, "top")
+	for _, dir := range []string{"", "sub", "sub/deeper"} {
+		if err := os.MkdirAll(filepath.Join(local, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(local, "file"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		src, dst string
+	}{
+		{top, top},
+		{top, top + "/sub"},
+		{top, top + "/sub/deeper"},
+		{top, cpTestUser + "/alias/sub"},
+		{local, local},
+		{local, filepath.Join(local, "sub")},
+		{local, filepath.Join(local, "sub", "..", "sub", "deeper")},
+	} {
+		var exited bool
+		msg := captureStderr(t, func() { exited = runCp(s, "-R", test.src, test.dst) })
+		if !exited || !strings.Contains(msg, "cannot copy a directory into itself") {
+			t.Errorf("cp -R %s %s: exited %v, %q", test.src, test.dst, exited, msg)
+		}
+	}
+
+	// Nothing was copied.
+	if entries, err := s.Client.Glob(top + "/sub/*"); err != nil || len(entries) != 1 {
+		t.Errorf("%s/sub has %d entries, want 1: %v", top, len(entries), err)
+	}
+	if names, err := ioutil.ReadDir(filepath.Join(local, "sub")); err != nil || len(names) != 1 {
+		t.Errorf("%s/sub has %d entries, want 1: %v", local, len(names), err)
+	}
+
+	// A sibling with a common prefix is not within the source.
+	mkUpspinDir(t, s, top+"2")
+	if runCp(s, "-R", top, top+"2") {
+		t.Fatal("cp exited")
+	}
+	if _, err := s.Client.Lookup(top+"2/top/file", false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCopyTypeConflict(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// Sources: a file and a directory, in Upspin and locally.
+	const src = cpTestUser + "/src"
+	mkUpspinDir(t, s, src)
+	mkUpspinDir(t, s, src+"/dir")
+	putUpspin(t, s, src+"/dir/inner", "inner")
+	putUpspin(t, s, src+"/file", "file")
+	local := filepath.Join(tmp, "src")
+	if err := os.MkdirAll(filepath.Join(local, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{"dir/inner": "inner", "file": "file"} {
+		if err := ioutil.WriteFile(filepath.Join(local, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Destinations in which each name has the other type.
+	const dst = cpTestUser + "/dst"
+	mkUpspinDir(t, s, dst)
+	mkUpspinDir(t, s, dst+"/file")
+	putUpspin(t, s, dst+"/dir", "not a directory")
+	localDst := filepath.Join(tmp, "dst")
+	if err := os.MkdirAll(filepath.Join(localDst, "file"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(localDst, "dir"), []byte("not a directory"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	join := func(dir, name string) string {
+		if strings.HasPrefix(dir, cpTestUser) {
+			return dir + "/" + name
+		}
+		return filepath.Join(dir, name)
+	}
+	for _, test := range []struct{ from, to string }{
+		{local, dst},
+		{src, localDst},
+		{src, dst},
+	} {
+		s.ExitCode = 0
+		msg := captureStderr(t, func() {
+			if runCp(s, "-R", join(test.from, "file"), join(test.from, "dir"), test.to) {
+				t.Fatalf("cp -R to %s exited", test.to)
+			}
+		})
+		for _, want := range []string{
+			fmt.Sprintf("cannot overwrite directory %s with non-directory %s", join(test.to, "file"), join(test.from, "file")),
+			fmt.Sprintf("cannot overwrite non-directory %s with directory %s", join(test.to, "dir"), join(test.from, "dir")),
+		} {
+			if !strings.Contains(msg, want) {
+				t.Errorf("cp -R from %s to %s: got %q, want %q", test.from, test.to, msg, want)
+			}
+		}
+		if s.ExitCode != 1 {
+			t.Errorf("cp -R from %s to %s: exit code %d, want 1", test.from, test.to, s.ExitCode)
+		}
+	}
+
+	// The destinations are untouched.
+	if entry, err := s.Client.Lookup(dst+"/file", false); err != nil || !entry.IsDir() {
+		t.Errorf("%s/file is no longer a directory: %v", dst, err)
+	}
+	if data, err := s.Client.Get(dst + "/dir"); err != nil || string(data) != "not a directory" {
+		t.Errorf("%s/dir: %q, %v", dst, data, err)
+	}
+	if info, err := os.Stat(filepath.Join(localDst, "file")); err != nil || !info.IsDir() {
+		t.Errorf("%s/file is no longer a directory: %v", localDst, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(localDst, "dir")); err != nil || string(data) != "not a directory" {
+		t.Errorf("%s/dir: %q, %v", localDst, data, err)
+	}
+}
+
+// lookupClient is a Client that counts its lookups.
+type lookupClient struct {
+	upspin.Client
+	lookups *int
+}
+
+func (c lookupClient) Lookup(name upspin.PathName, followFinal bool) (*upspin.DirEntry, error) {
+	*c.lookups++
+	return c.Client.Lookup(name, followFinal)
+}
+
+func TestCopyListedEntries(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	const (
+		src = cpTestUser + "/listed"
+		dst = cpTestUser + "/listedcopy"
+		n   = 20
+	)
+	mkUpspinDir(t, s, src)
+	mkUpspinDir(t, s, dst)
+	for i := 0; i < n; i++ {
+		putUpspin(t, s, upspin.PathName(fmt.Sprintf("%s/file%d", src, i)), fmt.Sprint(i))
+	}
+	if _, err := s.Client.PutLink(src+"/file0", src+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	// Some of the files are already at the destinations.
+	putUpspin(t, s, dst+"/file1", "old")
+	if err := os.Mkdir(filepath.Join(tmp, "listed"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "listed", "file1"), []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The types of the files and whether they are links are known from
+	// the listings of the directories, not looked up for each file.
+	lookups := 0
+	client := s.Client
+	s.Client = lookupClient{Client: client, lookups: &lookups}
+	for _, to := range []string{dst, tmp} {
+		lookups = 0
+		if runCp(s, "-R", src, to) {
+			t.Fatalf("cp -R to %s exited", to)
+		}
+		if lookups >= n {
+			t.Errorf("cp -R of %d files to %s made %d lookups", n, to, lookups)
+		}
+	}
+	s.Client = client
+	if entry, err := s.Client.Lookup(dst+"/listed/link", false); err != nil || !entry.IsLink() {
+		t.Errorf("link not recreated: %v, %v", entry, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(tmp, "listed", "file1")); err != nil || string(data) != "1" {
+		t.Errorf("local copy of file1: %q, %v", data, err)
+	}
+	if s.ExitCode != 0 {
+		t.Errorf("exit code %d, want 0", s.ExitCode)
+	}
+}
+
+func TestCopyDelete(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const (
+		src  = cpTestUser + "/src"
+		dst  = cpTestUser + "/dst"
+		keep = cpTestUser + "/keep"
+		cp   = dst + "/src"
+	)
+	for _, dir := range []upspin.PathName{src, src + "/sub", dst, keep} {
+		mkUpspinDir(t, s, dir)
+	}
+	putUpspin(t, s, src+"/a", "a")
+	putUpspin(t, s, src+"/sub/b", "b")
+	putUpspin(t, s, keep+"/file", "keep")
+	if runCp(s, "-R", src, dst) {
+		t.Fatal("cp exited")
+	}
+	// Add to the copy what the source lacks.
+	putUpspin(t, s, cp+"/extra", "extra")
+	putUpspin(t, s, cp+"/sub/extra", "extra")
+	mkUpspinDir(t, s, cp+"/gone")
+	putUpspin(t, s, cp+"/gone/x", "x")
+	if _, err := s.Client.PutLink(keep, cp+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	// This is outside the copy.
+	putUpspin(t, s, dst+"/other", "other")
+	extras := []upspin.PathName{cp + "/extra", cp + "/gone", cp + "/link", cp + "/sub/extra"}
+	survivors := []upspin.PathName{cp + "/a", cp + "/sub/b", dst + "/other", keep + "/file"}
+	exist := func(name upspin.PathName) bool {
+		_, err := s.Client.Lookup(name, false)
+		return err == nil
+	}
+
+	// Without -confirm, the extras are only listed.
+	out := captureStdout(t, func() {
+		if runCp(s, "-R", "-delete", src, dst) {
+			t.Fatal("cp exited")
+		}
+	})
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	sort.Strings(lines)
+	var want []string
+	for _, name := range extras {
+		want = append(want, "would remove "+string(name))
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("cp -delete printed:\n%s\nwant:\n%s", out, strings.Join(want, "\n"))
+	}
+	for _, name := range extras {
+		if !exist(name) {
+			t.Errorf("cp -delete removed %s", name)
+		}
+	}
+
+	// With it, they are removed.
+	if runCp(s, "-R", "-delete", "-confirm", src, dst) {
+		t.Fatal("cp exited")
+	}
+	for _, name := range extras {
+		if exist(name) {
+			t.Errorf("cp -delete -confirm left %s", name)
+		}
+	}
+	for _, name := range survivors {
+		if !exist(name) {
+			t.Errorf("cp -delete -confirm removed %s", name)
+		}
+	}
+
+	// Into a local directory.
+	if err := os.MkdirAll(filepath.Join(tmp, "src", "gone"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "src", "gone", "x"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if runCp(s, "-R", "-delete", "-confirm", src, tmp) {
+		t.Fatal("cp exited")
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "src", "gone")); !os.IsNotExist(err) {
+		t.Errorf("local extra not removed: %v", err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(tmp, "src", "sub", "b")); err != nil || string(got) != "b" {
+		t.Errorf("local copy: %q, %v", got, err)
+	}
+
+	for _, args := range [][]string{
+		{"-delete", src, dst},
+		{"-R", "-confirm", src, dst},
+		{"-R", "-delete", "-mv", src, dst},
+	} {
+		if !runCp(s, args...) {
+			t.Errorf("cp %s did not exit", strings.Join(args, " "))
+		}
+	}
+}
+
+func TestCopyFailureSummary(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const src = cpTestUser + "/src"
+	mkUpspinDir(t, s, src)
+	mkUpspinDir(t, s, src+"/dir")
+	putUpspin(t, s, src+"/file", "file")
+	putUpspin(t, s, src+"/dir/file", "file")
+	putUpspin(t, s, src+"/ok", "ok")
+	if _, err := s.Client.PutLink(cpTestUser+"/nowhere", src+"/broken"); err != nil {
+		t.Fatal(err)
+	}
+	// Make the local destination conflict with the source.
+	dst := filepath.Join(tmp, "src")
+	if err := os.MkdirAll(filepath.Join(dst, "file", "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dst, "dir"), []byte("not a dir"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := captureStderr(t, func() {
+		if runCp(s, "-R", "-L", src, tmp) {
+			t.Fatal("cp exited")
+		}
+	})
+	if s.ExitCode != 1 {
+		t.Errorf("exit code %d, want 1", s.ExitCode)
+	}
+	// The conflicts with the destination are reported, without a path,
+	// before anything is copied over them.
+	want := []string{
+		fmt.Sprintf("cannot overwrite directory %s with non-directory %s", filepath.Join(dst, "file"), src+"/file"),
+		fmt.Sprintf("cannot overwrite non-directory %s with directory %s", filepath.Join(dst, "dir"), src+"/dir"),
+	}
+	wantBroken := subcmd.Failure{Path: src + "/broken", Op: "client.Open", Kind: errors.BrokenLink}
+	if len(s.Failures) != 3 {
+		t.Fatalf("got %d failures, want 3:\n%s", len(s.Failures), msg)
+	}
+	var other []string
+	for _, f := range s.Failures {
+		if f.Kind != errors.Other {
+			f.Err = nil
+			if f != wantBroken {
+				t.Errorf("failure: got %+v, want %+v", f, wantBroken)
+			}
+			continue
+		}
+		other = append(other, f.String())
+	}
+	sort.Strings(other)
+	if !reflect.DeepEqual(other, want) {
+		t.Errorf("other failures: got %q, want %q", other, want)
+	}
+	// The summary follows the individual errors, grouped by kind
+	// in the order of the kinds.
+	summary := msg[strings.Index(msg, "upspin: cp: 3 errors:"):]
+	if !strings.HasPrefix(summary, "upspin: cp: 3 errors:\nother error (2):\n\t") {
+		t.Fatalf("bad summary:\n%s", summary)
+	}
+	for _, f := range want {
+		if !strings.Contains(summary, "\t"+f+"\n") {
+			t.Errorf("summary lacks %q:\n%s", f, summary)
+		}
+	}
+	broken := "link target does not exist (1):\n\t" + wantBroken.String() + "\n"
+	if !strings.HasSuffix(summary, broken) {
+		t.Errorf("summary does not end with %q:\n%s", broken, summary)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "ok")); err != nil {
+		t.Errorf("file copied despite other failures: %v", err)
+	}
+
+	// A copy that fails nowhere prints no summary.
+	s.Failures = nil
+	msg = captureStderr(t, func() {
+		if runCp(s, "-R", src+"/ok", tmp) {
+			t.Fatal("cp exited")
+		}
+	})
+	if msg != "" || len(s.Failures) != 0 {
+		t.Errorf("successful copy printed %q", msg)
+	}
+}
+
+// droppingStore is a StoreServer that has lost one block, as a store that
+// acknowledged a write it did not keep would have.
+type droppingStore struct {
+	upspin.StoreServer
+	dropped upspin.Reference
+}
+
+func (s droppingStore) Get(ref upspin.Reference) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	if ref == s.dropped {
+		return nil, nil, nil, errors.E(errors.NotExist, errors.Errorf("no such reference %q", ref))
+	}
+	return s.StoreServer.Get(ref)
+}
+
+func TestCopyConfirmDurable(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+	defer func(n int) { flags.BlockSize = n }(flags.BlockSize)
+	flags.BlockSize = 100
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	local := filepath.Join(tmp, "file")
+	if err := ioutil.WriteFile(local, bytes.Repeat([]byte("durable "), 30), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once lose is set, the store loses the second block of the file.
+	const dst = cpTestUser + "/file"
+	var lose bool
+	var lost upspin.Reference
+	dial := dialDurable
+	defer func() { dialDurable = dial }()
+	dialDurable = func(cfg upspin.Config, e upspin.Endpoint) (upspin.StoreServer, error) {
+		store, err := dial(cfg, e)
+		if err != nil || !lose {
+			return store, err
+		}
+		entry, err := s.Client.Lookup(dst, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(entry.Blocks) != 3 {
+			t.Fatalf("file has %d blocks, want 3", len(entry.Blocks))
+		}
+		lost = entry.Blocks[1].Location.Reference
+		return droppingStore{StoreServer: store, dropped: lost}, nil
+	}
+
+	// Every block is there.
+	msg := captureStderr(t, func() {
+		if runCp(s, "-confirm-durable", local, dst) {
+			t.Fatal("cp exited")
+		}
+	})
+	if s.ExitCode != 0 || msg != "" {
+		t.Fatalf("exit code %d, stderr %q", s.ExitCode, msg)
+	}
+
+	// One is lost.
+	lose = true
+	msg = captureStderr(t, func() {
+		if runCp(s, "-confirm-durable", local, dst) {
+			t.Fatal("cp exited")
+		}
+	})
+	want := fmt.Sprintf("block 2 of 3, %q in store", lost)
+	if s.ExitCode != 1 || strings.Count(msg, "is not durable") != 1 || !strings.Contains(msg, want) {
+		t.Errorf("exit code %d, stderr %q; want report of %s", s.ExitCode, msg, want)
+	}
+
+	// Without the flag, nothing is checked.
+	s.ExitCode = 0
+	msg = captureStderr(t, func() {
+		if runCp(s, local, dst) {
+			t.Fatal("cp exited")
+		}
+	})
+	if s.ExitCode != 0 || msg != "" {
+		t.Errorf("without -confirm-durable: exit code %d, stderr %q", s.ExitCode, msg)
+	}
+}
+
+func TestCopyRepair(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+	defer func(n int) { flags.BlockSize = n }(flags.BlockSize)
+	flags.BlockSize = 100
+
+	const (
+		src = cpTestUser + "/src"
+		dst = cpTestUser + "/dst"
+	)
+	putUpspin(t, s, src, strings.Repeat("precious ", 30))
+	entry, err := s.Client.Lookup(src, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entry.Blocks) != 3 {
+		t.Fatalf("file has %d blocks, want 3", len(entry.Blocks))
+	}
+	lost := entry.Blocks[1].Location
+
+	// The store has lost the second block of the source.
+	dial := dialDurable
+	defer func() { dialDurable = dial }()
+	dialDurable = func(cfg upspin.Config, e upspin.Endpoint) (upspin.StoreServer, error) {
+		store, err := dial(cfg, e)
+		if err != nil {
+			return nil, err
+		}
+		return droppingStore{StoreServer: store, dropped: lost.Reference}, nil
+	}
+	var cached []byte
+	defer func(f func(upspin.Config, upspin.Location) ([]byte, error)) { cachedBlock = f }(cachedBlock)
+	cachedBlock = func(cfg upspin.Config, loc upspin.Location) ([]byte, error) {
+		if cached == nil {
+			return nil, errors.E(errors.NotExist, errors.Str("not cached"))
+		}
+		return cached, nil
+	}
+
+	// Without -repair, the copy by reference succeeds.
+	msg := captureStderr(t, func() {
+		if runCp(s, src, dst) {
+			t.Fatal("cp exited")
+		}
+	})
+	if s.ExitCode != 0 || msg != "" {
+		t.Fatalf("exit code %d, stderr %q", s.ExitCode, msg)
+	}
+	if err := s.Client.Delete(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// With it, the missing block is reported and nothing is copied.
+	msg = captureStderr(t, func() {
+		if runCp(s, "-repair", src, dst) {
+			t.Fatal("cp exited")
+		}
+	})
+	want := fmt.Sprintf("block 2 of 3, %q in store", lost.Reference)
+	if s.ExitCode != 1 || !strings.Contains(msg, want) || !strings.Contains(msg, "is missing") {
+		t.Errorf("exit code %d, stderr %q; want report of %s", s.ExitCode, msg, want)
+	}
+	if _, err := s.Client.Lookup(dst, false); !errors.Match(errNotExist, err) {
+		t.Errorf("copy made despite missing block: %v", err)
+	}
+
+	// A block the cache holds is put back, and the file copied.
+	s.ExitCode = 0
+	store, err := bind.StoreServer(s.Config, lost.Endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, _, _, err = store.Get(lost.Reference); err != nil {
+		t.Fatal(err)
+	}
+	msg = captureStderr(t, func() {
+		if runCp(s, "-repair", src, dst) {
+			t.Fatal("cp exited")
+		}
+	})
+	if s.ExitCode != 0 || !strings.Contains(msg, "restored it from the cache") {
+		t.Errorf("exit code %d, stderr %q; want warning of restored block", s.ExitCode, msg)
+	}
+	if data, err := s.Client.Get(dst); err != nil || string(data) != strings.Repeat("precious ", 30) {
+		t.Errorf("copy: %q, %v", data, err)
+	}
+}
+
+func TestCopyUseIgnore(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	const top = cpTestUser + "/ignoring"
+	for _, dir := range []upspin.PathName{"", "/build", "/src", "/src/tmp", "/src/sub", "/docs", "/docs/a", "/docs/a/b"} {
+		mkUpspinDir(t, s, top+dir)
+	}
+	files := map[upspin.PathName]string{
+		"/.upspinignore":     "# Top level.\n*.log\n!keep.log\n/build/\ntmp/\ndocs/**/*.tmp\n",
+		"/a.log":             "ignored",
+		"/keep.log":          "included again",
+		"/notes.txt":         "not below src",
+		"/build/x":           "in an ignored directory",
+		"/src/build":         "not the anchored directory",
+		"/src/deep.log":      "ignored from above",
+		"/src/.upspinignore": "*.txt\n!important.txt\n",
+		"/src/a.txt":         "ignored",
+		"/src/important.txt": "included again",
+		"/src/tmp/y":         "in an ignored directory",
+		"/src/sub/b.txt":     "ignored from above",
+		"/docs/d.tmp":        "ignored",
+		"/docs/a/b/c.tmp":    "ignored",
+		"/docs/e.md":         "copied",
+	}
+	for name, data := range files {
+		putUpspin(t, s, top+name, data)
+	}
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if runCp(s, "-R", "-use-ignore", top, tmp) {
+		t.Fatal("cp exited")
+	}
+	var copied []string
+	err = filepath.Walk(tmp, func(name string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			copied = append(copied, filepath.ToSlash(strings.TrimPrefix(name, filepath.Join(tmp, "ignoring"))))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(copied)
+	want := []string{"/.upspinignore", "/docs/e.md", "/keep.log", "/notes.txt", "/src/.upspinignore", "/src/build", "/src/important.txt"}
+	if !reflect.DeepEqual(copied, want) {
+		t.Errorf("copied %q, want %q", copied, want)
+	}
+
+	// Without the flag, everything is copied.
+	all := filepath.Join(tmp, "all")
+	if err := os.Mkdir(all, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if runCp(s, "-R", top, all) {
+		t.Fatal("cp exited")
+	}
+	if _, err := os.Stat(filepath.Join(all, "ignoring", "build", "x")); err != nil {
+		t.Error(err)
+	}
+
+	patterns := parseIgnore("# comment\n\n\\#lit\n!x\nb/\n/c/d\n")
+	if len(patterns) != 4 || patterns[0].elems[0] != "#lit" || !patterns[1].negate || !patterns[2].dirOnly || patterns[2].anchored || !patterns[3].anchored {
+		t.Errorf("parseIgnore: %+v", patterns)
+	}
+}
+
+func TestCopyPublish(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+	defer func() { publishHook = nil }()
+
+	const (
+		src  = cpTestUser + "/src"
+		dst  = cpTestUser + "/pub"
+		tree = dst + "/src"
+	)
+	for _, dir := range []upspin.PathName{src, src + "/sub", dst} {
+		mkUpspinDir(t, s, dir)
+	}
+	putUpspin(t, s, src+"/a", "old a")
+	putUpspin(t, s, src+"/sub/b", "old b")
+	read := func(name upspin.PathName) string {
+		data, err := s.Client.Get(name)
+		if err != nil {
+			return err.Error()
+		}
+		return string(data)
+	}
+	staged := func() []string {
+		entries, err := s.Client.Glob(string(dst) + "/" + stagingPrefix + "*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, string(e.Name))
+		}
+		return names
+	}
+
+	// Nothing is visible until the whole tree is copied.
+	var hooked bool
+	publishHook = func(staging cpFile) {
+		hooked = true
+		if got := read(upspin.PathName(staging.path + "/src/sub/b")); got != "old b" {
+			t.Errorf("staged copy holds %q", got)
+		}
+		if _, err := s.Client.Lookup(tree, false); !errors.Match(errNotExist, err) {
+			t.Errorf("mid-publish, %s: %v; want it not to exist", tree, err)
+		}
+	}
+	if runCp(s, "-R", "-publish", src, dst) {
+		t.Fatal("cp exited")
+	}
+	if !hooked {
+		t.Fatal("publish hook not called")
+	}
+	if got := read(tree + "/sub/b"); got != "old b" {
+		t.Errorf("published b: %q", got)
+	}
+	first := staged()
+	if len(first) != 1 {
+		t.Fatalf("staging directories %q, want one", first)
+	}
+
+	// Republishing shows the old tree until the new one is complete.
+	putUpspin(t, s, src+"/a", "new a")
+	publishHook = func(staging cpFile) {
+		if got := read(tree + "/a"); got != "old a" {
+			t.Errorf("mid-publish, a is %q; want old a", got)
+		}
+	}
+	if runCp(s, "-R", "-publish", src, dst) {
+		t.Fatal("cp exited")
+	}
+	if got := read(tree + "/a"); got != "new a" {
+		t.Errorf("republished a: %q", got)
+	}
+	if got := staged(); len(got) != 1 || got[0] == first[0] {
+		t.Errorf("staging directories %q, want one other than %q", got, first[0])
+	}
+
+	// A failed copy publishes nothing and leaves no staging directory.
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	bad := filepath.Join(tmp, "src")
+	if err := os.Mkdir(bad, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bad, "a"), []byte("bad a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(tmp, "missing"), filepath.Join(bad, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	publishHook = func(cpFile) { t.Error("failed copy reached publication") }
+	captureStderr(t, func() {
+		if runCp(s, "-R", "-publish", bad, dst) {
+			t.Fatal("cp exited")
+		}
+	})
+	if got := read(tree + "/a"); got != "new a" {
+		t.Errorf("after failed publish, a is %q", got)
+	}
+	if got := staged(); len(got) != 1 {
+		t.Errorf("after failed publish, staging directories %q", got)
+	}
+
+	// If the new link cannot be made, the old one is restored and
+	// neither staged copy is removed.
+	putUpspin(t, s, src+"/a", "newer a")
+	publishHook = nil
+	client := s.Client
+	s.Client = failingLinkClient{Client: client, name: tree, refused: new(bool)}
+	msg := captureStderr(t, func() {
+		if runCp(s, "-R", "-publish", src, dst) {
+			t.Fatal("cp exited")
+		}
+	})
+	s.Client = client
+	if want := "cannot publish " + tree + ": link refused; the copy remains in " + dst + "/" + stagingPrefix; !strings.Contains(msg, want) {
+		t.Errorf("output %q does not contain %q", msg, want)
+	}
+	if got := read(tree + "/a"); got != "new a" {
+		t.Errorf("after failed link, a is %q; want new a", got)
+	}
+	if got := staged(); len(got) != 2 {
+		t.Errorf("after failed link, staging directories %q, want two", got)
+	}
+
+	for _, args := range [][]string{
+		{"-publish", src, dst},
+		{"-R", "-publish", "-mv", src, dst},
+		{"-R", "-publish", src, tmp},
+	} {
+		if !runCp(s, args...) {
+			t.Errorf("cp %s did not exit", strings.Join(args, " "))
+		}
+	}
+}
+
+// failingLinkClient is a Client that fails the first time it is to put
+// a link at name.
+type failingLinkClient struct {
+	upspin.Client
+	name    upspin.PathName
+	refused *bool
+}
+
+func (c failingLinkClient) PutLink(oldName, linkName upspin.PathName) (*upspin.DirEntry, error) {
+	if linkName == c.name && !*c.refused {
+		*c.refused = true
+		return nil, errors.Str("link refused")
+	}
+	return c.Client.PutLink(oldName, linkName)
+}
+
+func TestCopyAt(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	mkUpspinDir(t, s, cpTestUser+"/dir")
+	putUpspin(t, s, cpTestUser+"/dir/f", "now")
+
+	// Make a snapshot tree by hand, as the dir server would.
+	const snapUser = "user1+snapshot@google.com"
+	snapConfig := config.SetUserName(s.Config, snapUser)
+	key, err := bind.KeyServer(snapConfig, snapConfig.KeyEndpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Put(&upspin.User{
+		Name:      snapUser,
+		Dirs:      []upspin.Endpoint{snapConfig.DirEndpoint()},
+		Stores:    []upspin.Endpoint{snapConfig.StoreEndpoint()},
+		PublicKey: snapConfig.Factotum().PublicKey(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	snap := client.New(snapConfig)
+	if _, err := snap.MakeDirectory(snapUser + "/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snap.Put(snapUser+"/Access", []byte("*: "+snapUser+"\nr,l: "+cpTestUser+"\n")); err != nil {
+		t.Fatal(err)
+	}
+	for when, data := range map[string]string{
+		"2017/02/12/15:45": "old",
+		"2017/02/13/09:00": "newer",
+	} {
+		dir := upspin.PathName(snapUser)
+		for _, elem := range strings.Split(when+"/dir", "/") {
+			dir = dir + "/" + upspin.PathName(elem)
+			if _, err := snap.MakeDirectory(dir); err != nil && !errors.Match(errors.E(errors.Exist), err) {
+				t.Fatal(err)
+			}
+		}
+		if _, err := snap.Put(dir+"/f", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A copy to a local file is of the latest snapshot at the time.
+	local := filepath.Join(tmp, "f")
+	if runCp(s, "-at", "2017-02-13T08:00:00Z", cpTestUser+"/dir/f", local) {
+		t.Fatal("cp exited")
+	}
+	if got, err := ioutil.ReadFile(local); err != nil || string(got) != "old" {
+		t.Errorf("copy as of 08:00: got %q, %v; want %q", got, err, "old")
+	}
+	// So is a recursive copy within Upspin.
+	mkUpspinDir(t, s, cpTestUser+"/restored")
+	if runCp(s, "-R", "-at", "2017-02-14", cpTestUser+"/dir", cpTestUser+"/restored") {
+		t.Fatal("cp exited")
+	}
+	if got, err := s.Client.Get(cpTestUser + "/restored/dir/f"); err != nil || string(got) != "newer" {
+		t.Errorf("copy as of the next day: got %q, %v; want %q", got, err, "newer")
+	}
+	if got, err := s.Client.Get(cpTestUser + "/dir/f"); err != nil || string(got) != "now" {
+		t.Errorf("source changed: got %q, %v", got, err)
+	}
+
+	// Times before any snapshot, users without snapshots, local
+	// sources, and -mv are refused.
+	if _, err := env.NewUser("bob@google.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"-at", "2017-02-01", cpTestUser + "/dir/f", local},
+		{"-at", "2017-02-14", "bob@google.com/f", local},
+		{"-at", "2017-02-14", local, cpTestUser + "/restored"},
+		{"-at", "2017-02-14", "-mv", cpTestUser + "/dir/f", local},
+		{"-at", "yesterday", cpTestUser + "/dir/f", local},
+	} {
+		s := newState("cp")
+		s.Interactive = true
+		s.Config = env.Config
+		s.Client = env.Client
+		if !runCp(s, args...) {
+			t.Errorf("cp %q did not exit", args)
+		}
+	}
+}
+
+func TestCopyDedup(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	for name, data := range map[string]string{
+		"a":     "same",
+		"b":     "same",
+		"c":     "different",
+		"sub/d": "same",
+	} {
+		file := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// refs returns the references of the blocks of the copied files.
+	refs := func(dst upspin.PathName) map[string]upspin.Reference {
+		m := make(map[string]upspin.Reference)
+		for _, name := range []string{"a", "b", "c", "sub/d"} {
+			entry, err := s.Client.Lookup(dst+"/src/"+upspin.PathName(name), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entry.Blocks) != 1 {
+				t.Fatalf("%s has %d blocks, want 1", entry.Name, len(entry.Blocks))
+			}
+			m[name] = entry.Blocks[0].Location.Reference
+			data, err := s.Client.Get(entry.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "same"
+			if name == "c" {
+				want = "different"
+			}
+			if string(data) != want {
+				t.Errorf("%s contains %q, want %q", entry.Name, data, want)
+			}
+		}
+		return m
+	}
+
+	// Encrypted copies of the same data are stored separately...
+	plain := upspin.PathName(cpTestUser + "/plain")
+	mkUpspinDir(t, s, plain)
+	if runCp(s, "-R", src, string(plain)) {
+		t.Fatal("cp exited")
+	}
+	r := refs(plain)
+	if r["a"] == r["b"] || r["a"] == r["sub/d"] {
+		t.Fatalf("copies without -dedup share blocks: %q", r)
+	}
+
+	// ...unless -dedup shares them.
+	dedup := upspin.PathName(cpTestUser + "/dedup")
+	mkUpspinDir(t, s, dedup)
+	if runCp(s, "-R", "-dedup", src, string(dedup)) {
+		t.Fatal("cp exited")
+	}
+	r = refs(dedup)
+	if r["a"] != r["b"] || r["a"] != r["sub/d"] {
+		t.Errorf("identical copies do not share blocks: %q", r)
+	}
+	if r["a"] == r["c"] {
+		t.Errorf("different copies share blocks: %q", r)
+	}
+}
+
+// creatingClient is a Client that counts the files it creates and
+// calls created, if set, after each.
+type creatingClient struct {
+	upspin.Client
+	creates *int
+	created func()
+}
+
+func (c creatingClient) Create(name upspin.PathName) (upspin.File, error) {
+	*c.creates++
+	if c.created != nil {
+		defer c.created()
+	}
+	return c.Client.Create(name)
+}
+
+func TestCopyStateFile(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	names := []string{"a", "b", "c", "sub/d", "sub/e", "sub/f"}
+	for _, name := range names {
+		file := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const dst = cpTestUser + "/dst"
+	mkUpspinDir(t, s, dst)
+	stateFile := filepath.Join(tmp, "progress.json")
+	client := s.Client
+
+	// Interrupt the copy once half the files are copied.
+	var cancel context.CancelFunc
+	defer func(f func() (context.Context, context.CancelFunc)) { newCopyContext = f }(newCopyContext)
+	newCopyContext = func() (context.Context, context.CancelFunc) {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		return ctx, cancel
+	}
+	creates := 0
+	s.Client = creatingClient{
+		Client:  client,
+		creates: &creates,
+		created: func() {
+			if creates == len(names)/2 {
+				cancel()
+			}
+		},
+	}
+	if !runCp(s, "-R", "-statefile", stateFile, src, dst) {
+		t.Fatal("interrupted copy did not exit")
+	}
+	if creates != len(names)/2 {
+		t.Fatalf("%d files copied before the interrupt, want %d", creates, len(names)/2)
+	}
+	seqs := make(map[string]int64)
+	for _, name := range names {
+		if entry, err := client.Lookup(upspin.PathName(dst+"/src/"+name), false); err == nil {
+			seqs[name] = entry.Sequence
+		}
+	}
+	if len(seqs) != creates {
+		t.Fatalf("%d files at the destination, want %d", len(seqs), creates)
+	}
+
+	// A stop partway through a record leaves a partial line.
+	f, err := os.OpenFile(stateFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"src":"` + src)
+	f.Close()
+
+	// Resuming copies only the rest.
+	creates = 0
+	s.Client = creatingClient{Client: client, creates: &creates}
+	if runCp(s, "-R", "-statefile", stateFile, src, dst) {
+		t.Fatal("resumed copy exited")
+	}
+	if want := len(names) - len(seqs); creates != want {
+		t.Errorf("resumed copy created %d files, want %d", creates, want)
+	}
+	for _, name := range names {
+		entry, err := client.Lookup(upspin.PathName(dst+"/src/"+name), false)
+		if err != nil {
+			t.Errorf("%s not copied: %v", name, err)
+			continue
+		}
+		if seq, ok := seqs[name]; ok && entry.Sequence != seq {
+			t.Errorf("%s copied again", name)
+		}
+		if data, err := client.Get(entry.Name); err != nil || string(data) != name {
+			t.Errorf("%s: got %q, %v", entry.Name, data, err)
+		}
+	}
+
+	// Running it again copies nothing.
+	creates = 0
+	if runCp(s, "-R", "-statefile", stateFile, src, dst) {
+		t.Fatal("repeated copy exited")
+	}
+	if creates != 0 {
+		t.Errorf("repeated copy created %d files", creates)
+	}
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != len(names) || !strings.HasSuffix(string(data), "\n") {
+		t.Errorf("state file has %d lines, want %d:\n%s", n, len(names), data)
+	}
+}
+
+type openingClient struct {
+	upspin.Client
+	opens *int
+}
+
+func (c openingClient) Open(name upspin.PathName) (upspin.File, error) {
+	*c.opens++
+	return c.Client.Open(name)
+}
+
+func TestCopyTee(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const dir = cpTestUser + "/tee"
+	mkUpspinDir(t, s, dir)
+	putUpspin(t, s, dir+"/src", "teed")
+	localDir := filepath.Join(tmp, "dir")
+	if err := os.Mkdir(localDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	opens := 0
+	s.Client = openingClient{Client: s.Client, opens: &opens}
+
+	// One Upspin source to a local file, a local directory, and an
+	// Upspin file, reading the source once.
+	localFile := filepath.Join(tmp, "file")
+	if runCp(s, "-tee", dir+"/src", localFile, localDir, dir+"/copy") {
+		t.Fatal("cp exited")
+	}
+	if opens != 1 {
+		t.Errorf("source opened %d times, want 1", opens)
+	}
+	for _, name := range []string{localFile, filepath.Join(localDir, "src")} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "teed" {
+			t.Errorf("%s contains %q, want %q", name, data, "teed")
+		}
+	}
+	data, err := s.Client.Get(dir + "/copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "teed" {
+		t.Errorf("%s contains %q, want %q", dir+"/copy", data, "teed")
+	}
+	if s.ExitCode != 0 {
+		t.Errorf("exit code %d, want 0", s.ExitCode)
+	}
+
+	// A destination that cannot be created does not stop the others.
+	local := filepath.Join(tmp, "local")
+	if err := ioutil.WriteFile(local, []byte("local data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(tmp, "missing", "file")
+	if runCp(s, "-tee", local, bad, dir+"/local", localFile) {
+		t.Fatal("cp exited")
+	}
+	if s.ExitCode == 0 {
+		t.Error("exit code 0 after failed destination")
+	}
+	if _, err := os.Stat(bad); err == nil {
+		t.Errorf("%s was created", bad)
+	}
+	data, err = s.Client.Get(dir + "/local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "local data" {
+		t.Errorf("%s contains %q, want %q", dir+"/local", data, "local data")
+	}
+	data, err = ioutil.ReadFile(localFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "local data" {
+		t.Errorf("%s contains %q, want %q", localFile, data, "local data")
+	}
+
+	// Only a single source may be teed.
+	if !runCp(s, "-tee", dir+"/*", localDir) {
+		t.Error("-tee of several sources did not exit")
+	}
+}
+
+// Names and contents of the files written by otherWriter.
+const (
+	otherWriterSrc  = cpTestUser + "/bobs"
+	otherWriterDst  = cpTestUser + "/dst"
+	otherWriterData = "written by bob"
+)
+
+// otherWriter makes the directory otherWriterSrc, holding the file "file",
+// written by another user, whose name it returns, and the file "mine",
+// written by the test user, and the empty directory otherWriterDst.
+func otherWriter(t *testing.T, s *State, env *testenv.Env) upspin.UserName {
+	t.Helper()
+	const writer = "bob@google.com"
+	writerConfig, err := env.NewUser(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkUpspinDir(t, s, otherWriterSrc)
+	mkUpspinDir(t, s, otherWriterDst)
+	putUpspin(t, s, otherWriterSrc+"/Access", "*: "+cpTestUser+"\nr,w,c,l: "+writer+"\n")
+	if _, err := client.New(writerConfig).Put(otherWriterSrc+"/file", []byte(otherWriterData)); err != nil {
+		t.Fatal(err)
+	}
+	putUpspin(t, s, otherWriterSrc+"/mine", otherWriterData)
+	return writer
+}
+
+// checkWriter checks that the Upspin file name is readable and written by
+// the test user, and returns its entry.
+func checkWriter(t *testing.T, s *State, name upspin.PathName) *upspin.DirEntry {
+	t.Helper()
+	entry, err := s.Client.Lookup(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Writer != cpTestUser {
+		t.Errorf("%s has Writer %s, want %s", name, entry.Writer, cpTestUser)
+	}
+	if got, err := s.Client.Get(name); err != nil || string(got) != otherWriterData {
+		t.Errorf("%s contains %q, %v; want %q", name, got, err, otherWriterData)
+	}
+	return entry
+}
+
+func TestCopyOtherWriter(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+	otherWriter(t, s, env)
+	const src, dst = otherWriterSrc, otherWriterDst
+
+	// A copy of another writer's file is made from its data, and so is
+	// written by the user making it; it must be readable.
+	stderr := captureStderr(t, func() {
+		if runCp(s, src+"/file", dst+"/file") {
+			t.Fatal("cp exited")
+		}
+	})
+	checkWriter(t, s, dst+"/file")
+	if stderr != "" {
+		t.Errorf("unexpected output without -preserve-writer: %q", stderr)
+	}
+
+	// A copy of the user's own file is made by reference.
+	if runCp(s, src+"/mine", dst+"/mine") {
+		t.Fatal("cp exited")
+	}
+	mine := checkWriter(t, s, src+"/mine")
+	copied := checkWriter(t, s, dst+"/mine")
+	if mine.Blocks[0].Location != copied.Blocks[0].Location {
+		t.Errorf("copy of own file has block at %v, want %v", copied.Blocks[0].Location, mine.Blocks[0].Location)
+	}
+	if s.ExitCode != 0 {
+		t.Errorf("exit code %d, want 0", s.ExitCode)
+	}
+}
+
+func TestCopyPreserveWriter(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+	writer := otherWriter(t, s, env)
+	const src, dst = otherWriterSrc, otherWriterDst
+
+	// The writer of another user's file cannot be kept, which is
+	// reported, naming the writer, for each file.
+	mkUpspinDir(t, s, dst+"/tree")
+	for _, args := range [][]string{
+		{src + "/file", dst + "/file"},
+		{"-R", src, dst + "/tree"},
+		{"-tee", src + "/file", dst + "/tee"},
+	} {
+		stderr := captureStderr(t, func() {
+			if runCp(s, append([]string{"-preserve-writer"}, args...)...) {
+				t.Fatalf("cp %q exited", args)
+			}
+		})
+		if n := strings.Count(stderr, "warning: cannot preserve writer "+string(writer)+" of "+src+"/file"); n != 1 {
+			t.Errorf("cp %q: %d warnings for file, want 1; stderr:\n%s", args, n, stderr)
+		}
+		if strings.Contains(stderr, "/mine") {
+			t.Errorf("cp %q: warning for own file; stderr:\n%s", args, stderr)
+		}
+	}
+	checkWriter(t, s, dst+"/file")
+	checkWriter(t, s, dst+"/tree/bobs/file")
+	checkWriter(t, s, dst+"/tee")
+
+	// The user's own file keeps its writer, by reference, without a
+	// warning.
+	stderr := captureStderr(t, func() {
+		if runCp(s, "-preserve-writer", src+"/mine", dst+"/mine") {
+			t.Fatal("cp exited")
+		}
+	})
+	if stderr != "" {
+		t.Errorf("unexpected output for own file: %q", stderr)
+	}
+	mine := checkWriter(t, s, src+"/mine")
+	copied := checkWriter(t, s, dst+"/mine")
+	if mine.Blocks[0].Location != copied.Blocks[0].Location {
+		t.Errorf("copy of own file has block at %v, want %v", copied.Blocks[0].Location, mine.Blocks[0].Location)
+	}
+	if s.ExitCode != 0 {
+		t.Errorf("exit code %d, want 0", s.ExitCode)
+	}
+
+	// The flag makes no sense when nothing is copied in Upspin.
+	for _, flag := range []string{"-cat", "-mv"} {
+		var exited bool
+		captureStderr(t, func() { exited = runCp(s, "-preserve-writer", flag, src+"/mine", dst+"/mv") })
+		if !exited {
+			t.Errorf("-preserve-writer %s did not exit", flag)
+		}
+	}
+}
+
+func TestCopyPermsPreview(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	const (
+		base = cpTestUser + "/perms"
+		ann  = "ann@example.com"
+		bob  = "bob@example.com"
+	)
+	mkUpspinDir(t, s, base)
+	putUpspin(t, s, base+"/Access", "*: "+cpTestUser+"\nr: "+ann+"\n")
+	mkUpspinDir(t, s, base+"/src")
+	mkUpspinDir(t, s, base+"/src/pub")
+	putUpspin(t, s, base+"/src/pub/Access", "*: "+cpTestUser+"\nr: all\n")
+	mkUpspinDir(t, s, base+"/src/team")
+	putUpspin(t, s, base+"/src/team/file", "team data")
+
+	// A destination readable by more users than the source.
+	mkUpspinDir(t, s, cpTestUser+"/wide")
+	putUpspin(t, s, cpTestUser+"/wide/Access", "*: "+cpTestUser+"\nr: "+ann+", "+bob+"\n")
+	// And one readable only by its owner.
+	mkUpspinDir(t, s, cpTestUser+"/narrow")
+
+	preview := func(args ...string) map[string]string {
+		out := captureStdout(t, func() {
+			if runCp(s, append([]string{"-R", "-perms-preview"}, args...)...) {
+				t.Fatal("cp exited")
+			}
+		})
+		lines := make(map[string]string)
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			i := strings.Index(line, ": ")
+			if i < 0 {
+				t.Fatalf("odd preview line %q", line)
+			}
+			lines[line[:i]] = line[i+2:]
+		}
+		return lines
+	}
+	check := func(lines map[string]string, src, dst, want string) {
+		key := base + src + " -> " + cpTestUser + dst
+		if got := lines[key]; got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+
+	lines := preview(base+"/src", cpTestUser+"/wide")
+	check(lines, "/src", "/wide/src", "WIDENED: also readable by "+bob)
+	check(lines, "/src/pub", "/wide/src/pub", "unchanged, readable by all@upspin.io, "+cpTestUser)
+	check(lines, "/src/team", "/wide/src/team", "WIDENED: also readable by "+bob)
+	if len(lines) != 3 {
+		t.Errorf("%d lines of preview, want 3: %q", len(lines), lines)
+	}
+	// The preview alone copies nothing.
+	if _, err := s.Client.Lookup(cpTestUser+"/wide/src", false); err == nil {
+		t.Error("preview without -confirm copied the source")
+	}
+
+	lines = preview("-confirm", base+"/src", cpTestUser+"/narrow")
+	check(lines, "/src", "/narrow/src", "NARROWED: no longer readable by "+ann)
+	check(lines, "/src/pub", "/narrow/src/pub", "unchanged, readable by all@upspin.io, "+cpTestUser)
+	check(lines, "/src/team", "/narrow/src/team", "NARROWED: no longer readable by "+ann)
+	if data, err := s.Client.Get(cpTestUser + "/narrow/src/team/file"); err != nil || string(data) != "team data" {
+		t.Errorf("copy after preview: %q, %v; want %q", data, err, "team data")
+	}
+	if s.ExitCode != 0 {
+		t.Errorf("exit code %d, want 0", s.ExitCode)
+	}
+}
+
+func TestCopyExpandGroups(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	const (
+		src   = cpTestUser + "/src"
+		dst   = cpTestUser + "/dst"
+		group = cpTestUser + "/Group"
+		ann   = "ann@example.com"
+		bob   = "bob@example.com"
+		carol = "carol@example.com"
+		dave  = "dave@example.com"
+	)
+	for _, dir := range []upspin.PathName{src, src + "/shared", src + "/teams", dst, group} {
+		mkUpspinDir(t, s, dir)
+	}
+	// Nested groups, the inner one naming the outer.
+	putUpspin(t, s, group+"/team", ann+", inner\n")
+	putUpspin(t, s, group+"/inner", bob+", "+carol+", team\n")
+	putUpspin(t, s, src+"/shared/Access", "*: "+cpTestUser+"\nr: team\nw: inner\n")
+	putUpspin(t, s, src+"/shared/file", "shared data")
+	// A group file, which a copy into the Group directory would define.
+	putUpspin(t, s, src+"/teams/ops", dave+", team\n")
+
+	out := captureStdout(t, func() {
+		if runCp(s, "-R", "-perms-preview", "-expand-groups", "-confirm", src+"/shared", dst) {
+			t.Fatal("cp exited")
+		}
+	})
+	members := strings.Join([]string{ann, bob, carol}, ", ")
+	everyone := strings.Join([]string{ann, bob, carol, cpTestUser}, ", ")
+	for _, want := range []string{
+		dst + "/shared/Access: read: " + everyone,
+		dst + "/shared/Access: write: " + everyone,
+		dst + "/shared/Access: list: " + cpTestUser,
+		dst + "/shared/Access: group " + group + "/inner: " + members,
+		dst + "/shared/Access: group " + group + "/team: " + members,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	// The report comes before the copy, which -confirm allows.
+	if data, err := s.Client.Get(dst + "/shared/file"); err != nil || string(data) != "shared data" {
+		t.Errorf("copy after expansion: %q, %v; want %q", data, err, "shared data")
+	}
+
+	out = captureStdout(t, func() {
+		if runCp(s, "-R", "-perms-preview", "-expand-groups", src+"/teams", group) {
+			t.Fatal("cp exited")
+		}
+	})
+	want := group + "/teams/ops: members: " + strings.Join([]string{ann, bob, carol, dave}, ", ") + "\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("output lacks %q:\n%s", want, out)
+	}
+	if _, err := s.Client.Lookup(group+"/teams", false); err == nil {
+		t.Error("preview without -confirm copied the source")
+	}
+	if s.ExitCode != 0 {
+		t.Errorf("exit code %d, want 0", s.ExitCode)
+	}
+}
+
+func TestCopyGzip(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	files := map[string]string{
+		"a":     strings.Repeat("compress me ", 1000),
+		"sub/b": "short",
+	}
+	src := filepath.Join(tmp, "src")
+	for name, data := range files {
+		file := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gunzip := func(name string, data []byte) string {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		plain, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return string(plain)
+	}
+
+	// Compress a tree on its way into Upspin.
+	dst := upspin.PathName(cpTestUser + "/gz")
+	mkUpspinDir(t, s, dst)
+	if runCp(s, "-R", "-z", src, string(dst)) {
+		t.Fatal("cp -z exited")
+	}
+	for name, want := range files {
+		data, err := s.Client.Get(dst + "/src/" + upspin.PathName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := gunzip(name, data); got != want {
+			t.Errorf("%s: compressed %q, want %q", name, got, want)
+		}
+	}
+
+	// And decompress it on its way back out.
+	out := filepath.Join(tmp, "out")
+	if err := os.Mkdir(out, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if runCp(s, "-R", "-unz", string(dst)+"/src", out) {
+		t.Fatal("cp -unz exited")
+	}
+	for name, want := range files {
+		data, err := ioutil.ReadFile(filepath.Join(out, "src", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: round trip gave %q, want %q", name, data, want)
+		}
+	}
+
+	// Within Upspin, a compressed copy is not a copy by reference.
+	twice := upspin.PathName(cpTestUser + "/twice")
+	if runCp(s, "-z", string(dst)+"/src/a", string(twice)) {
+		t.Fatal("cp -z exited")
+	}
+	data, err := s.Client.Get(twice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gunzip("twice", []byte(gunzip("twice", data))); got != files["a"] {
+		t.Errorf("compressed twice: %q, want %q", got, files["a"])
+	}
+
+	// With -gzip-by-name, the names say what to do.
+	if runCp(s, "-gzip-by-name", filepath.Join(src, "a"), cpTestUser+"/a.gz") {
+		t.Fatal("cp -gzip-by-name exited")
+	}
+	data, err = s.Client.Get(cpTestUser + "/a.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gunzip("a.gz", data); got != files["a"] {
+		t.Errorf("a.gz: compressed %q, want %q", got, files["a"])
+	}
+	back := filepath.Join(tmp, "back")
+	if runCp(s, "-gzip-by-name", cpTestUser+"/a.gz", back) {
+		t.Fatal("cp -gzip-by-name exited")
+	}
+	if data, err := ioutil.ReadFile(back); err != nil || string(data) != files["a"] {
+		t.Errorf("a.gz decompressed: %q, %v; want %q", data, err, files["a"])
+	}
+	if s.ExitCode != 0 {
+		t.Errorf("exit code %d, want 0", s.ExitCode)
+	}
+
+	// A source that is not compressed cannot be decompressed,
+	// and leaves no partial copy.
+	bad := filepath.Join(tmp, "bad")
+	msg := captureStderr(t, func() { runCp(s, "-unz", filepath.Join(src, "sub", "b"), bad) })
+	if !strings.Contains(msg, "reading") {
+		t.Errorf("decompressing plain file: got %q", msg)
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Errorf("partial copy left: %v", err)
+	}
+	if s.ExitCode != 1 {
+		t.Errorf("exit code %d, want 1", s.ExitCode)
+	}
+}
+
+func TestCopyCompare(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	const (
+		src  = cpTestUser + "/src"
+		dst  = cpTestUser + "/dst"
+		tree = src + "/tree"
+		cp   = dst + "/tree"
+	)
+	for _, dir := range []upspin.PathName{src, tree, tree + "/sub", dst, cp, cp + "/sub", cp + "/type"} {
+		mkUpspinDir(t, s, dir)
+	}
+	for name, data := range map[upspin.PathName]string{
+		tree + "/content":    "abc",
+		cp + "/content":      "abd",
+		tree + "/size":       "a",
+		cp + "/size":         "ab",
+		tree + "/same":       "same",
+		cp + "/same":         "same",
+		tree + "/dup":        "dup",
+		tree + "/type":       "file",
+		tree + "/new":        "new",
+		tree + "/sub/new":    "new",
+		tree + "/sub/same":   "same",
+		cp + "/sub/same":     "same",
+		cp + "/extra":        "extra",
+		cp + "/sub/extra":    "extra",
+		cp + "/type/in-copy": "x",
+	} {
+		putUpspin(t, s, name, data)
+	}
+	if _, err := s.Client.PutDuplicate(tree+"/dup", cp+"/dup"); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[upspin.PathName]upspin.PathName{
+		tree + "/link":     src,
+		cp + "/link":       src,
+		tree + "/linkdiff": src,
+		cp + "/linkdiff":   dst,
+	} {
+		if _, err := s.Client.PutLink(target, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the files of the same size with different blocks are read.
+	opens := 0
+	s.Client = openingClient{Client: s.Client, opens: &opens}
+	out := captureStdout(t, func() {
+		if runCp(s, "-R", "-compare", tree, dst) {
+			t.Fatal("cp exited")
+		}
+	})
+	want := `differs tree/content (content)
+identical tree/dup
+identical tree/link
+differs tree/linkdiff (link target)
+only-in-source tree/new
+identical tree/same
+differs tree/size (size)
+only-in-source tree/sub/new
+identical tree/sub/same
+only-in-dest tree/sub/extra
+differs tree/type (type)
+only-in-dest tree/extra
+`
+	if out != want {
+		t.Errorf("cp -compare printed:\n%s\nwant:\n%s", out, want)
+	}
+	if opens != 6 {
+		t.Errorf("cp -compare opened %d files, want 6", opens)
+	}
+	if _, err := s.Client.Lookup(cp+"/new", false); !errors.Match(errNotExist, err) {
+		t.Errorf("cp -compare copied %s: %v", tree+"/new", err)
+	}
+
+	out = captureStdout(t, func() {
+		if runCp(s, "-R", "-compare", "-json", tree, dst) {
+			t.Fatal("cp exited")
+		}
+	})
+	var got []compareResult
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var r compareResult
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		got = append(got, r)
+	}
+	if len(got) != strings.Count(want, "\n") {
+		t.Fatalf("cp -compare -json printed %d lines, want %d:\n%s", len(got), strings.Count(want, "\n"), out)
+	}
+	if r := got[0]; r != (compareResult{Status: differs, Path: "tree/content", Src: tree + "/content", Dst: cp + "/content", Reason: "content"}) {
+		t.Errorf("first result %+v", r)
+	}
+	if r := got[len(got)-1]; r != (compareResult{Status: onlyInDest, Path: "tree/extra", Src: tree + "/extra", Dst: cp + "/extra"}) {
+		t.Errorf("last result %+v", r)
+	}
+
+	// A local copy of the tree is identical to it.
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Mkdir(filepath.Join(tmp, "tree"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"content", "same", "size"} {
+		if runCp(s, tree+"/"+name, filepath.Join(tmp, "tree", name)) {
+			t.Fatal("cp exited")
+		}
+	}
+	out = captureStdout(t, func() {
+		if runCp(s, "-R", "-compare", tree+"/content", tree+"/same", tree+"/size", filepath.Join(tmp, "tree")) {
+			t.Fatal("cp exited")
+		}
+	})
+	if want := "identical content\nidentical same\nidentical size\n"; out != want {
+		t.Errorf("cp -compare with a local copy printed:\n%s\nwant:\n%s", out, want)
+	}
+
+	for _, args := range [][]string{
+		{"-compare", tree, dst},
+		{"-R", "-json", tree, dst},
+		{"-R", "-compare", "-delete", tree, dst},
+	} {
+		if !runCp(s, args...) {
+			t.Errorf("cp %s did not exit", strings.Join(args, " "))
+		}
+	}
+}
+
+func TestCopyManifestVerify(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+	defer func(n int) { flags.BlockSize = n }(flags.BlockSize)
+	flags.BlockSize = 100
+
+	const (
+		src  = cpTestUser + "/src"
+		dst  = cpTestUser + "/dst"
+		tree = src + "/tree"
+		cp   = dst + "/tree"
+	)
+	for _, dir := range []upspin.PathName{src, tree, tree + "/sub", dst} {
+		mkUpspinDir(t, s, dir)
+	}
+	putUpspin(t, s, tree+"/small", "small")
+	putUpspin(t, s, tree+"/sub/large", strings.Repeat("large ", 40))
+	if _, err := s.Client.PutLink(tree+"/small", tree+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	if runCp(s, "-R", "-manifest-verify", tree, dst) {
+		t.Fatal("cp exited")
+	}
+	if s.ExitCode != 0 {
+		t.Fatalf("exit code %d", s.ExitCode)
+	}
+
+	// The manifest is signed by the user.
+	data, err := s.Client.Get(cp + manifestSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signed signedManifest
+	if err := json.Unmarshal(data, &signed); err != nil {
+		t.Fatal(err)
+	}
+	var r, s2 big.Int
+	rs := strings.Split(signed.Signature, "-")
+	if len(rs) != 2 {
+		t.Fatalf("signature %q", signed.Signature)
+	}
+	if _, ok := r.SetString(rs[0], 16); !ok {
+		t.Fatalf("signature %q", signed.Signature)
+	}
+	if _, ok := s2.SetString(rs[1], 16); !ok {
+		t.Fatalf("signature %q", signed.Signature)
+	}
+	hash := sha256.Sum256(signed.Manifest)
+	if err := factotum.Verify(hash[:], upspin.Signature{R: &r, S: &s2}, s.Config.Factotum().PublicKey()); err != nil {
+		t.Errorf("manifest signature does not verify: %v", err)
+	}
+
+	// It lists the references of the files as stored.
+	var m cpManifest
+	if err := json.Unmarshal(signed.Manifest, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Tree != cp || m.User != cpTestUser {
+		t.Errorf("manifest of %s by %s, want %s by %s", m.Tree, m.User, cp, cpTestUser)
+	}
+	var names []upspin.PathName
+	for _, f := range m.Files {
+		names = append(names, f.Name)
+		entry, err := s.Client.Lookup(f.Name, false)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if entry.IsLink() {
+			if f.Link != entry.Link || len(f.Blocks) != 0 {
+				t.Errorf("%s: manifest lists %+v, want link to %s", f.Name, f, entry.Link)
+			}
+			continue
+		}
+		size, _ := entry.Size()
+		if f.Size != size || len(f.Blocks) != len(entry.Blocks) {
+			t.Errorf("%s: manifest lists %d bytes in %d blocks, want %d in %d", f.Name, f.Size, len(f.Blocks), size, len(entry.Blocks))
+			continue
+		}
+		for i, b := range entry.Blocks {
+			want := manifestBlock{Reference: b.Location.Reference, Endpoint: b.Location.Endpoint.String()}
+			if f.Blocks[i] != want {
+				t.Errorf("%s: block %d is %+v, want %+v", f.Name, i, f.Blocks[i], want)
+			}
+		}
+	}
+	want := []upspin.PathName{cp + "/link", cp + "/small", cp + "/sub/large"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("manifest lists %v, want %v", names, want)
+	}
+
+	// A block lost by the store fails the verification.
+	dst2 := upspin.PathName(cpTestUser + "/dst2")
+	mkUpspinDir(t, s, dst2)
+	large, err := s.Client.Lookup(tree+"/sub/large", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost := large.Blocks[1].Location.Reference
+	dial := dialDurable
+	defer func() { dialDurable = dial }()
+	dialDurable = func(cfg upspin.Config, e upspin.Endpoint) (upspin.StoreServer, error) {
+		store, err := dial(cfg, e)
+		if err != nil {
+			return nil, err
+		}
+		return droppingStore{StoreServer: store, dropped: lost}, nil
+	}
+	msg := captureStderr(t, func() {
+		if runCp(s, "-R", "-manifest-verify", tree, string(dst2)) {
+			t.Fatal("cp exited")
+		}
+	})
+	if s.ExitCode != 1 || !strings.Contains(msg, fmt.Sprintf("%q in store", lost)) || !strings.Contains(msg, "no manifest written") {
+		t.Errorf("exit code %d, stderr %q; want report of %s", s.ExitCode, msg, lost)
+	}
+	if _, err := s.Client.Lookup(dst2+"/tree"+manifestSuffix, false); !errors.Match(errNotExist, err) {
+		t.Errorf("manifest written for copy with a missing block: %v", err)
+	}
+
+	if !runCp(s, "-R", "-manifest-verify", tree, os.TempDir()) {
+		t.Error("cp -manifest-verify to a local directory did not exit")
+	}
+}
+
+func TestCopySchedule(t *testing.T) {
+	// A fake clock, starting ten seconds before a window opens, that
+	// moves only when the copy sleeps.
+	now := time.Date(2017, 6, 1, 21, 59, 50, 0, time.Local)
+	boundary := time.Date(2017, 6, 1, 22, 0, 0, 0, time.Local)
+	defer func(n func() time.Time, s func(context.Context, time.Duration) error) {
+		scheduleNow, scheduleSleep = n, s
+	}(scheduleNow, scheduleSleep)
+	scheduleNow = func() time.Time { return now }
+	scheduleSleep = func(ctx context.Context, d time.Duration) error {
+		now = now.Add(d)
+		return nil
+	}
+
+	plan, err := parseRatePlan("22:00-06:00=4K,1K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &throttledReader{r: bytes.NewReader(make([]byte, 64*1024)), t: &throttle{plan: plan}}
+	var before, after int64
+	buf := make([]byte, 4096)
+	for now.Before(boundary.Add(5 * time.Second)) {
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if now.Before(boundary) {
+			before += int64(n)
+		} else {
+			after += int64(n)
+		}
+	}
+	// Ten seconds at 1K per second, then five at 4K, give or take a
+	// couple of the tenth of a second's worth read at once.
+	within := func(what string, got, want, slack int64) {
+		if got < want-slack || got > want+slack {
+			t.Errorf("%s: copied %d bytes, want %d±%d", what, got, want, slack)
+		}
+	}
+	within("before 22:00", before, 10*1024, 2*1024/10)
+	within("after 22:00", after, 5*4096, 2*4096/10)
+
+	// A paused copy waits for its window without failing.
+	plan, err = parseRatePlan("22:00-23:00=unlimited,0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = boundary.Add(-time.Hour)
+	r = &throttledReader{r: strings.NewReader("paused"), t: &throttle{plan: plan}}
+	data, err := ioutil.ReadAll(r)
+	if err != nil || string(data) != "paused" {
+		t.Fatalf("paused copy: %q, %v", data, err)
+	}
+	if !now.Equal(boundary) {
+		t.Errorf("paused copy resumed at %v, want %v", now, boundary)
+	}
+
+	for _, bad := range []string{"", "1M,2M", "22:00=1M", "25:00-06:00=1M", "22:00-06:00=fast"} {
+		if _, err := parseRatePlan(bad); err == nil {
+			t.Errorf("plan %q: no error", bad)
+		}
+	}
+
+	// The copy itself, with the plan in a file.
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	planFile := filepath.Join(tmp, "plan")
+	if err := ioutil.WriteFile(planFile, []byte("# Full speed overnight.\n22:00-06:00=unlimited\n2K\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(tmp, "src")
+	want := strings.Repeat("scheduled ", 1000)
+	if err := ioutil.WriteFile(src, []byte(want), 0600); err != nil {
+		t.Fatal(err)
+	}
+	now = boundary.Add(-time.Hour)
+	start := now
+	if runCp(s, "-schedule", "@"+planFile, src, cpTestUser+"/dst") {
+		t.Fatal("cp -schedule exited")
+	}
+	got, err := s.Client.Get(cpTestUser + "/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("copied %q, want %q", got, want)
+	}
+	if d := now.Sub(start); d < 4*time.Second {
+		t.Errorf("copy of %d bytes at 2K per second took %v", len(want), d)
+	}
+	msg := captureStderr(t, func() {
+		if !runCp(s, "-schedule", "22:00-06:00", src, cpTestUser+"/bad") {
+			t.Error("cp with invalid -schedule did not exit")
+		}
+	})
+	if !strings.Contains(msg, "invalid -schedule") {
+		t.Errorf("invalid -schedule: got %q", msg)
+	}
+}
+
+func TestCopyProgressJSON(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+	defer func(d time.Duration) { progressInterval = d }(progressInterval)
+	progressInterval = 0
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	if err := os.Mkdir(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]int{"big": 200 * 1024, "small": 10}
+	for name, size := range files {
+		if err := ioutil.WriteFile(filepath.Join(src, name), bytes.Repeat([]byte("x"), size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// events runs cp and returns the events it prints, checking that
+	// each has the fields its kind should.
+	events := func(args ...string) []map[string]interface{} {
+		msg := captureStderr(t, func() {
+			if runCp(s, append([]string{"-progress-json"}, args...)...) {
+				t.Fatalf("cp %q exited", args)
+			}
+		})
+		var evs []map[string]interface{}
+		for _, line := range strings.Split(msg, "\n") {
+			if !strings.HasPrefix(line, "{") {
+				continue
+			}
+			var ev map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &ev); err != nil {
+				t.Fatalf("%q: %v", line, err)
+			}
+			fields := []string{"event", "path", "dst", "bytes_done", "bytes_total", "rate"}
+			switch ev["event"] {
+			case "done":
+				fields = append(fields, "status")
+			case "summary":
+				fields = []string{"event", "bytes_done", "rate", "status", "files", "failed"}
+			}
+			for _, f := range fields {
+				if _, ok := ev[f]; !ok {
+					t.Errorf("event %q lacks %q", line, f)
+				}
+			}
+			evs = append(evs, ev)
+		}
+		return evs
+	}
+
+	// A copy into Upspin reports each file from start to done, one
+	// file at a time, and then sums up.
+	dst := upspin.PathName(cpTestUser + "/dst")
+	mkUpspinDir(t, s, dst)
+	evs := events("-R", src, string(dst))
+	if len(evs) == 0 {
+		t.Fatal("no events")
+	}
+	seen := make(map[string]bool)
+	var current string
+	var done int64
+	for i, ev := range evs[:len(evs)-1] {
+		path, _ := ev["path"].(string)
+		name := filepath.Base(path)
+		size, ok := files[name]
+		if !ok {
+			t.Fatalf("event %d: unexpected path %q", i, path)
+		}
+		if want := string(dst) + "/src/" + name; ev["dst"] != want {
+			t.Errorf("event %d: dst %v, want %s", i, ev["dst"], want)
+		}
+		if ev["bytes_total"] != float64(size) {
+			t.Errorf("event %d: bytes_total %v, want %d", i, ev["bytes_total"], size)
+		}
+		if rate, _ := ev["rate"].(float64); rate < 0 {
+			t.Errorf("event %d: rate %v", i, rate)
+		}
+		n, _ := ev["bytes_done"].(float64)
+		switch ev["event"] {
+		case "start":
+			if current != "" || seen[name] {
+				t.Errorf("event %d: %s started again or during %s", i, name, current)
+			}
+			current, seen[name], done = name, true, 0
+			if n != 0 {
+				t.Errorf("event %d: started with %v bytes done", i, n)
+			}
+		case "progress":
+			if current != name || int64(n) <= done || n > float64(size) {
+				t.Errorf("event %d: progress of %s to %v bytes after %d, during %q", i, name, n, done, current)
+			}
+			done = int64(n)
+		case "done":
+			if current != name || ev["status"] != "ok" || n != float64(size) {
+				t.Errorf("event %d: %v", i, ev)
+			}
+			current = ""
+		default:
+			t.Errorf("event %d: unexpected %v", i, ev)
+		}
+	}
+	if current != "" || len(seen) != len(files) {
+		t.Errorf("files started %v; %q not done", seen, current)
+	}
+	if sum := evs[len(evs)-1]; sum["event"] != "summary" || sum["status"] != "ok" ||
+		sum["files"] != float64(2) || sum["failed"] != float64(0) || sum["bytes_done"] != float64(files["big"]+files["small"]) {
+		t.Errorf("summary: %v", sum)
+	}
+	// The big file was read in more than one piece.
+	progress := 0
+	for _, ev := range evs {
+		if ev["event"] == "progress" && ev["path"] == filepath.Join(src, "big") {
+			progress++
+		}
+	}
+	if progress < 2 {
+		t.Errorf("%d progress events for big file, want at least 2", progress)
+	}
+
+	// A copy within Upspin, by reference, is a single event.
+	evs = events(string(dst)+"/src/big", cpTestUser+"/copy")
+	if len(evs) != 2 {
+		t.Fatalf("copy by reference: got %v, want done and summary", evs)
+	}
+	if ev := evs[0]; ev["event"] != "done" || ev["status"] != "by reference" || ev["bytes_total"] != float64(files["big"]) {
+		t.Errorf("copy by reference: %v", ev)
+	}
+	if sum := evs[1]; sum["event"] != "summary" || sum["files"] != float64(1) || sum["bytes_done"] != float64(0) {
+		t.Errorf("copy by reference: summary %v", sum)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// Modes recorded in archives. Upspin has no permission bits.
+const (
+	archiveFileMode = 0644
+	archiveDirMode  = 0755
+	archiveLinkMode = 0777
+)
+
+// archiveWriter writes the entries of an archive created by cp -archive.
+// Names are slash-separated and relative to the archive's root.
+type archiveWriter interface {
+	dir(name string, modTime time.Time) error
+	link(name, target string, modTime time.Time) error
+	file(name string, size int64, modTime time.Time) (io.Writer, error)
+	Close() error
+}
+
+// archiveCommand writes the Upspin source trees to a local archive file
+// in the given format. Each source is stored under its final path element.
+func (s *State) archiveCommand(cs *copyState, format string, src []cpFile, dst cpFile) {
+	if dst.isUpspin || s.isDir(dst) {
+		s.Exitf("-archive requires that final argument (%s) be a local file", dst.path)
+	}
+	for _, from := range src {
+		if !from.isUpspin {
+			s.Exitf("-archive requires Upspin sources; %s is local", from.path)
+		}
+	}
+	fd, err := s.create(cs, dst)
+	if err != nil {
+		s.Exit(err)
+	}
+	var aw archiveWriter
+	switch format {
+	case "tar":
+		aw = tarArchive{tar.NewWriter(fd)}
+	case "zip":
+		aw = zipArchive{zip.NewWriter(fd)}
+	default:
+		fd.Close()
+		os.Remove(dst.path)
+		s.Exitf("unknown archive format %q; must be tar or zip", format)
+	}
+	for _, from := range src {
+		entry, err := s.Client.Lookup(upspin.PathName(from.path), cs.follow)
+		if err != nil {
+			s.Fail(err)
+			continue
+		}
+		s.archiveEntry(cs, aw, entry, filepath.Base(from.path))
+	}
+	if err := aw.Close(); err != nil {
+		s.Fail(err)
+	}
+	if err := fd.Close(); err != nil {
+		s.Fail(err)
+	}
+}
+
+// archiveEntry adds the entry to the archive under the given name,
+// descending into directories if -R is set.
+func (s *State) archiveEntry(cs *copyState, aw archiveWriter, entry *upspin.DirEntry, name string) {
+	cs.checkCanceled()
+	cs.logf("archive %s as %s", entry.Name, name)
+	modTime := entry.Time.Go()
+	switch {
+	case entry.IsDir():
+		if !cs.recur {
+			s.Fail(errors.E(entry.Name, errors.IsDir))
+			return
+		}
+		if err := aw.dir(name, modTime); err != nil {
+			s.Exit(err)
+		}
+		files, err := s.contents(cs, cpFile{path: string(entry.Name), isUpspin: true})
+		if err != nil {
+			if !cs.keepOn {
+				s.Exitf("cannot list all of %s: %v", entry.Name, err)
+			}
+			s.Fail(err)
+		}
+		for _, f := range files {
+			e, err := s.Client.Lookup(upspin.PathName(f.path), cs.follow)
+			if err != nil {
+				s.Fail(err)
+				continue
+			}
+			s.archiveEntry(cs, aw, e, name+"/"+filepath.Base(f.path))
+		}
+	case entry.IsLink():
+		if err := aw.link(name, string(entry.Link), modTime); err != nil {
+			s.Exit(err)
+		}
+	default:
+		size, err := entry.Size()
+		if err != nil {
+			s.Fail(err)
+			return
+		}
+		reader, err := s.Client.Open(entry.Name)
+		if err != nil {
+			s.Fail(err)
+			return
+		}
+		defer reader.Close()
+		w, err := aw.file(name, size, modTime)
+		if err != nil {
+			s.Exit(err)
+		}
+		// A short copy leaves the archive unusable.
+		if _, err := io.Copy(w, cs.throttled(reader)); err != nil {
+			s.Exit(err)
+		}
+	}
+}
+
+// tarArchive is an archiveWriter for tar files.
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (t tarArchive) dir(name string, modTime time.Time) error {
+	return t.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     archiveDirMode,
+		ModTime:  modTime,
+	})
+}
+
+func (t tarArchive) link(name, target string, modTime time.Time) error {
+	return t.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     archiveLinkMode,
+		ModTime:  modTime,
+	})
+}
+
+func (t tarArchive) file(name string, size int64, modTime time.Time) (io.Writer, error) {
+	err := t.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     archiveFileMode,
+		ModTime:  modTime,
+	})
+	return t.Writer, err
+}
+
+// zipArchive is an archiveWriter for zip files. Symbolic links are stored,
+// as is conventional, as entries whose contents are the link's target.
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (z zipArchive) create(name string, mode os.FileMode, modTime time.Time) (io.Writer, error) {
+	hdr := &zip.FileHeader{
+		Name:   name,
+		Method: zip.Deflate,
+	}
+	hdr.SetModTime(modTime)
+	hdr.SetMode(mode)
+	return z.CreateHeader(hdr)
+}
+
+func (z zipArchive) dir(name string, modTime time.Time) error {
+	_, err := z.create(name+"/", os.ModeDir|archiveDirMode, modTime)
+	return err
+}
+
+func (z zipArchive) link(name, target string, modTime time.Time) error {
+	w, err := z.create(name, os.ModeSymlink|archiveLinkMode, modTime)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, target)
+	return err
+}
+
+func (z zipArchive) file(name string, size int64, modTime time.Time) (io.Writer, error) {
+	return z.create(name, archiveFileMode, modTime)
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"upspin.io/errors"
+)
+
+// parseSize parses a size in bytes, such as the argument of -checkpoint,
+// with an optional suffix K, M, or G for the binary multiples.
+func parseSize(size string) (int64, error) {
+	str := size
+	shift := uint(0)
+	switch strings.ToUpper(str[len(str)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift > 0 {
+		str = str[:len(str)-1]
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)>>shift {
+		return 0, errors.Errorf("%q is not a size in bytes, such as 256M", size)
+	}
+	return n << shift, nil
+}
+
+// syncLocal flushes a local destination file to disk at a checkpoint.
+// It is a variable so tests can replace it.
+var syncLocal = (*os.File).Sync
+
+// checkpointWriter writes a local destination file for cp -checkpoint,
+// syncing it to disk each time another interval of bytes is written, so
+// that a crash loses no more than that. With -statefile, it records the
+// offset of each checkpoint so that a later run can resume the copy there;
+// see resumeCheckpoint.
+type checkpointWriter struct {
+	cs       *copyState
+	file     *limitedFile
+	src, dst cpFile
+	offset   int64 // Offset in the file of the next byte written.
+	next     int64 // Offset of the next checkpoint.
+}
+
+// checkpointed returns the writer for the local destination dst, created
+// by s.create, wrapped to write checkpoints from offset on. Without
+// -checkpoint, or for an Upspin destination, it returns the writer.
+func (cs *copyState) checkpointed(writer io.WriteCloser, src, dst cpFile, offset int64) io.WriteCloser {
+	f, ok := writer.(*limitedFile)
+	if cs.checkpoint == 0 || !ok {
+		return writer
+	}
+	return &checkpointWriter{
+		cs:     cs,
+		file:   f,
+		src:    src,
+		dst:    dst,
+		offset: offset,
+		next:   (offset/cs.checkpoint + 1) * cs.checkpoint,
+	}
+}
+
+// Write writes p, stopping at each checkpoint to sync the file.
+func (w *checkpointWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if left := w.next - w.offset; int64(len(chunk)) > left {
+			chunk = chunk[:left]
+		}
+		n, err := w.file.Write(chunk)
+		written += n
+		w.offset += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if w.offset == w.next {
+			if err := w.checkpoint(); err != nil {
+				return written, err
+			}
+			w.next += w.cs.checkpoint
+		}
+	}
+	return written, nil
+}
+
+// checkpoint syncs the file and, with -statefile, records how much of it
+// is safely on disk.
+func (w *checkpointWriter) checkpoint() error {
+	w.cs.logf("checkpoint %s at %d bytes", w.dst.path, w.offset)
+	if err := syncLocal(w.file.File); err != nil {
+		return err
+	}
+	if w.cs.progress == nil {
+		return nil
+	}
+	return w.cs.progress.checkpoint(w.src, w.dst, w.offset)
+}
+
+func (w *checkpointWriter) Close() error {
+	return w.file.Close()
+}
+
+// resumeCheckpoint, with -checkpoint and -statefile, reopens the local
+// destination dst of a copy that an earlier run left at a recorded
+// checkpoint, discards what follows the checkpoint, and advances the
+// reader for src to match, so that the copy picks up from there. It
+// returns the writer to finish the copy with, and reports whether it did
+// so; if not, the copy should start afresh. As with copies recorded in
+// the state file, a source changed since the checkpoint is not noticed.
+func (s *State) resumeCheckpoint(cs *copyState, reader io.Reader, src, dst cpFile) (io.WriteCloser, bool) {
+	if cs.checkpoint == 0 || cs.progress == nil || dst.isUpspin {
+		return nil, false
+	}
+	offset := cs.progress.checkpointed(src, dst)
+	if offset == 0 {
+		return nil, false
+	}
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		return nil, false
+	}
+	info, err := os.Stat(dst.path)
+	if err != nil || info.Size() < offset {
+		cs.logf("cannot resume %s: the checkpoint at %d bytes is gone", dst.path, offset)
+		return nil, false
+	}
+	f, err := cs.openLocal(dst.path, os.O_RDWR, 0)
+	if err != nil {
+		cs.logf("cannot resume %s: %v", dst.path, err)
+		return nil, false
+	}
+	if err := f.Truncate(offset); err != nil {
+		cs.logf("cannot resume %s: %v", dst.path, err)
+		f.Close()
+		return nil, false
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		cs.logf("cannot resume %s: %v", dst.path, err)
+		f.Close()
+		return nil, false
+	}
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		cs.logf("cannot resume %s: %v", dst.path, err)
+		f.Close()
+		return nil, false
+	}
+	cs.logf("resume %s at checkpoint %d", dst.path, offset)
+	return cs.checkpointed(f, src, dst, offset), true
+}
@@ -0,0 +1,276 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// The results of cp -compare for each path.
+const (
+	onlyInSource = "only-in-source"
+	onlyInDest   = "only-in-dest"
+	differs      = "differs"
+	identical    = "identical"
+)
+
+// A compareResult is a line of the report of cp -compare, as printed
+// with -json.
+type compareResult struct {
+	Status string `json:"status"`
+	Path   string `json:"path"`             // Relative to the destination directory.
+	Src    string `json:"src"`              // The file in the source tree.
+	Dst    string `json:"dst"`              // The file in the destination tree.
+	Reason string `json:"reason,omitempty"` // How the files differ.
+}
+
+// cpStat is what cp -compare knows of a file.
+type cpStat struct {
+	exists bool
+	isDir  bool
+	isLink bool
+	link   string // The target of a link.
+	size   int64
+	refs   []upspin.Reference // The blocks of an Upspin file.
+}
+
+// compareCommand implements cp -compare. Rather than copy the sources into
+// the directory dst, it reports, for every path the copy would write,
+// whether the file is only in the source tree or already in dst and, if
+// so, whether it differs; and, for every directory the copy would write
+// into, the files there that are not in the source. Files whose sizes
+// match are compared by their contents, unless both are Upspin files
+// with the same blocks. Links are compared by their targets.
+func (s *State) compareCommand(cs *copyState, src []cpFile, dst cpFile) {
+	if !s.isDir(dst) {
+		s.Exitf("-compare requires that final argument (%s) be a directory", dst.path)
+	}
+	s.compareDir(cs, src, dst, "")
+}
+
+// compareDir compares the source files with their copies in dir, whose
+// name relative to the destination directory is rel.
+func (s *State) compareDir(cs *copyState, src []cpFile, dir cpFile, rel string) {
+	names := s.dstNames(cs, src, dir)
+	for i, from := range src {
+		cs.checkCanceled()
+		if len(cs.ignores) > 0 && s.ignored(cs, from) {
+			cs.logf("skip %s: ignored", from.path)
+			continue
+		}
+		if err := names[i].err; err != nil && !cs.sanitize {
+			s.Failf("cannot compare %q with an Upspin file: its name %v", from.path, err)
+			continue
+		}
+		to := cpFile{
+			path:     string(path.Join(upspin.PathName(dir.path), names[i].name)),
+			isUpspin: dir.isUpspin,
+		}
+		name := names[i].name
+		if rel != "" {
+			name = rel + "/" + name
+		}
+		srcStat, err := s.compareStat(from)
+		if err != nil {
+			s.Fail(err)
+			continue
+		}
+		dstStat, err := s.compareStat(to)
+		if err != nil {
+			s.Fail(err)
+			continue
+		}
+		if !dstStat.exists {
+			s.compareReport(cs, onlyInSource, name, from, to, "")
+			continue
+		}
+		if srcStat.isDir && dstStat.isDir {
+			s.compareTree(cs, from, to, name)
+			continue
+		}
+		status, reason, err := s.compareFiles(cs, from, to, srcStat, dstStat)
+		if err != nil {
+			s.Fail(err)
+			continue
+		}
+		s.compareReport(cs, status, name, from, to, reason)
+	}
+}
+
+// compareTree compares the directory from with its copy, the directory to.
+func (s *State) compareTree(cs *copyState, from, to cpFile, rel string) {
+	srcFiles, err := s.contents(cs, from)
+	if err != nil {
+		s.Fail(err)
+		return
+	}
+	dstFiles, err := s.contents(cs, to)
+	if err != nil {
+		s.Fail(err)
+		return
+	}
+	ignores := cs.ignores
+	if cs.useIgnore {
+		if err := s.readIgnore(cs, from); err != nil {
+			s.Fail(err)
+			return
+		}
+	}
+	sortFiles(srcFiles)
+	s.compareDir(cs, srcFiles, to, rel)
+	cs.ignores = ignores
+
+	// What is left in the copy that the source lacks.
+	have := make(map[string]bool)
+	for _, n := range s.dstNames(cs, srcFiles, to) {
+		have[n.name] = true
+	}
+	sortFiles(dstFiles)
+	for _, file := range dstFiles {
+		name := filepath.Base(file.path)
+		if !have[name] {
+			missing := cpFile{
+				path:     string(path.Join(upspin.PathName(from.path), name)),
+				isUpspin: from.isUpspin,
+			}
+			s.compareReport(cs, onlyInDest, rel+"/"+name, missing, file, "")
+		}
+	}
+}
+
+// compareFiles compares the file from, which is not a directory unless to
+// is not one either, with its copy, to, returning the result and how they
+// differ, if they do.
+func (s *State) compareFiles(cs *copyState, from, to cpFile, srcStat, dstStat cpStat) (status, reason string, err error) {
+	switch {
+	case srcStat.isDir != dstStat.isDir || srcStat.isLink != dstStat.isLink:
+		return differs, "type", nil
+	case srcStat.isLink:
+		if srcStat.link != dstStat.link {
+			return differs, "link target", nil
+		}
+		return identical, "", nil
+	case srcStat.size != dstStat.size:
+		return differs, "size", nil
+	case from.isUpspin && to.isUpspin && reflect.DeepEqual(srcStat.refs, dstStat.refs):
+		// The same blocks hold the same contents.
+		return identical, "", nil
+	}
+	same, err := s.sameContents(cs, from, to)
+	if err != nil {
+		return "", "", err
+	}
+	if !same {
+		return differs, "content", nil
+	}
+	return identical, "", nil
+}
+
+// compareStat returns what cp -compare needs to know of the file, which
+// may not exist. Links are not followed.
+func (s *State) compareStat(file cpFile) (cpStat, error) {
+	if file.isUpspin {
+		entry, err := s.Client.Lookup(upspin.PathName(file.path), false)
+		if errors.Match(errNotExist, err) {
+			return cpStat{}, nil
+		}
+		if err != nil {
+			return cpStat{}, err
+		}
+		st := cpStat{exists: true, isDir: entry.IsDir(), isLink: entry.IsLink(), link: string(entry.Link)}
+		if st.isDir || st.isLink {
+			return st, nil
+		}
+		if st.size, err = entry.Size(); err != nil {
+			return cpStat{}, err
+		}
+		for _, b := range entry.Blocks {
+			st.refs = append(st.refs, b.Location.Reference)
+		}
+		return st, nil
+	}
+	info, err := os.Lstat(file.path)
+	if os.IsNotExist(err) {
+		return cpStat{}, nil
+	}
+	if err != nil {
+		return cpStat{}, err
+	}
+	st := cpStat{exists: true, isDir: info.IsDir(), size: info.Size()}
+	if info.Mode()&os.ModeSymlink != 0 {
+		st.isLink = true
+		if st.link, err = os.Readlink(file.path); err != nil {
+			return cpStat{}, err
+		}
+	}
+	return st, nil
+}
+
+// sameContents reports whether the two files hold the same bytes.
+func (s *State) sameContents(cs *copyState, a, b cpFile) (bool, error) {
+	ra, err := s.open(cs, a)
+	if err != nil {
+		return false, err
+	}
+	defer ra.Close()
+	rb, err := s.open(cs, b)
+	if err != nil {
+		return false, err
+	}
+	defer rb.Close()
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, len(bufA))
+	for {
+		na, errA := io.ReadFull(ra, bufA)
+		nb, errB := io.ReadFull(rb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		endA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		endB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		switch {
+		case errA != nil && !endA:
+			return false, errA
+		case errB != nil && !endB:
+			return false, errB
+		case endA || endB:
+			return endA == endB, nil
+		}
+	}
+}
+
+// compareReport prints a line of the report of cp -compare, as JSON with
+// -json.
+func (s *State) compareReport(cs *copyState, status, rel string, src, dst cpFile, reason string) {
+	if cs.json {
+		data, err := json.Marshal(compareResult{Status: status, Path: rel, Src: src.path, Dst: dst.path, Reason: reason})
+		if err != nil {
+			s.Exit(err)
+		}
+		fmt.Printf("%s\n", data)
+		return
+	}
+	if reason != "" {
+		fmt.Printf("%s %s (%s)\n", status, rel, reason)
+		return
+	}
+	fmt.Printf("%s %s\n", status, rel)
+}
+
+// sortFiles sorts files by name so that reports are in a stable order.
+func sortFiles(files []cpFile) {
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"upspin.io/subcmd"
+)
+
+// completeFlag, given with a single argument as the only arguments to cp,
+// prints the completions of the argument, one per line, for use by shell
+// completion scripts. It is deliberately absent from the help text.
+const completeFlag = "-complete"
+
+// isComplete reports whether the cp arguments request completions.
+func isComplete(args []string) bool {
+	return len(args) == 2 && (args[0] == completeFlag || args[0] == "-"+completeFlag)
+}
+
+// complete prints the completions of the prefix, one per line.
+func (s *State) complete(prefix string) {
+	for _, c := range s.completions(prefix) {
+		fmt.Println(c)
+	}
+}
+
+// completions returns, sorted, the local or Upspin path names that extend the
+// partial path name, which is interpreted as cp would interpret it. The names
+// keep the form of the prefix, including any leading '~' or '@', and those of
+// directories end in a slash. Errors are ignored; they yield no completions.
+func (s *State) completions(prefix string) []string {
+	slash := strings.LastIndex(prefix, "/")
+	if slash < 0 {
+		// No directory to look in. Complete only the
+		// abbreviations that name one.
+		switch prefix {
+		case ".", "..", "~", "@":
+			return []string{prefix + "/"}
+		}
+		return nil
+	}
+	dir, base := prefix[:slash+1], prefix[slash+1:]
+	var names []string
+	if isLocal(prefix) {
+		names = localCompletions(subcmd.Tilde(dir), base)
+	} else if strings.Contains(prefix, "@") {
+		names = s.upspinCompletions(string(s.AtSign(dir)), base)
+	}
+	for i, name := range names {
+		names[i] = dir + name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// localCompletions returns the names in the local directory that begin with
+// base. Names beginning with a period are included only if base does too.
+func localCompletions(dir, base string) []string {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+	all, _ := fd.Readdirnames(0)
+	var names []string
+	for _, name := range all {
+		if !strings.HasPrefix(name, base) || (name[0] == '.' && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && info.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// upspinCompletions returns the names in the Upspin directory, which ends in
+// a slash, that begin with base. Links are not followed.
+func (s *State) upspinCompletions(dir, base string) []string {
+	entries, _ := s.Client.Glob(dir + "*")
+	var names []string
+	for _, entry := range entries {
+		name := strings.TrimPrefix(string(entry.Name), dir)
+		if !strings.HasPrefix(name, base) {
+			continue
+		}
+		if entry.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	return names
+}
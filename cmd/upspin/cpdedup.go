@@ -0,0 +1,73 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+
+	"upspin.io/upspin"
+)
+
+// dedupCopy copies the local file src to the Upspin file dst unless a file
+// with identical contents has already been copied to Upspin by this
+// command, in which case dst is made a duplicate of that copy, sharing
+// its blocks. The source is read twice, once to hash it and once to copy
+// it, and a copy whose contents differ from the hash, because the source
+// changed between, is not shared. It reports whether the copy succeeded.
+func (s *State) dedupCopy(cs *copyState, reader io.ReadCloser, src, dst cpFile) bool {
+	sum, err := hashLocalFile(src.path)
+	if err != nil {
+		s.Fail(err)
+		reader.Close()
+		return false
+	}
+	if first, ok := cs.copied[sum]; ok {
+		cs.logf("%s is identical to %s; duplicate it", src.path, first)
+		switch s.fastCopy(first, upspin.PathName(dst.path)) {
+		case nil:
+			reader.Close()
+			return true
+		case errReported:
+			reader.Close()
+			return false
+		}
+		// The destination exists; copy the data instead.
+	}
+	writer, err := s.create(cs, dst)
+	if err != nil {
+		s.Fail(err)
+		reader.Close()
+		return false
+	}
+	hr := hashingReader{reader, sha256.New()}
+	if !cs.doCopy(hr, writer, src, dst) {
+		return false
+	}
+	if _, ok := cs.copied[sum]; !ok && bytes.Equal(hr.hash.Sum(nil), sum[:]) {
+		if cs.copied == nil {
+			cs.copied = make(map[[sha256.Size]byte]upspin.PathName)
+		}
+		cs.copied[sum] = upspin.PathName(dst.path)
+	}
+	return true
+}
+
+// hashLocalFile returns the SHA-256 hash of the contents of the local file.
+func hashLocalFile(name string) (sum [sha256.Size]byte, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
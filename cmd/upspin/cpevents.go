@@ -0,0 +1,254 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+// copyEvent is a line of the stream printed by cp -progress-json. Its
+// fields, once released, should only be added to, as front ends rely on
+// them.
+type copyEvent struct {
+	// Event is "start" as a file's data begins to be copied, "progress"
+	// as it continues, and "done" when the file is finished.
+	Event string `json:"event"`
+
+	Path string `json:"path,omitempty"` // The source file.
+	Dst  string `json:"dst,omitempty"`  // Its copy.
+
+	// BytesDone is the number of bytes of the source copied so far.
+	// BytesTotal is the size of the source, or -1 if it is not known.
+	BytesDone  int64 `json:"bytes_done"`
+	BytesTotal int64 `json:"bytes_total"`
+
+	// Rate is the bytes copied per second since the file was begun.
+	Rate float64 `json:"rate"`
+
+	// Status is set when the file is done: "ok", "failed", or "by
+	// reference" for a copy or move within Upspin that copied only
+	// the references to the data, which is the only event for such a
+	// file.
+	Status string `json:"status,omitempty"`
+}
+
+// copySummary is the last line of the stream printed by cp -progress-json,
+// with the event "summary". Its fields are as in copyEvent, with Files and
+// Failed counting the files copied and those that could not be.
+type copySummary struct {
+	Event     string  `json:"event"`
+	BytesDone int64   `json:"bytes_done"`
+	Rate      float64 `json:"rate"`
+	Status    string  `json:"status"`
+	Files     int     `json:"files"`
+	Failed    int     `json:"failed"`
+}
+
+// copyEvents prints the events of cp -progress-json.
+type copyEvents struct {
+	w     io.Writer
+	start time.Time
+
+	// The file being copied, if any.
+	file    *copyEvent
+	begun   time.Time
+	started bool      // Its start event has been printed.
+	byRef   bool      // It was copied by reference.
+	last    time.Time // The last progress event for it.
+
+	// For the summary.
+	files, failed int
+	bytes         int64
+}
+
+// progressInterval is the least time between two progress events for a
+// file. It is a variable so tests can replace it.
+var progressInterval = time.Second
+
+// newCopyEvents returns a copyEvents printing to the file descriptor fd,
+// with standard error used as os.Stderr.
+func newCopyEvents(fd int) *copyEvents {
+	w := os.Stderr
+	if fd != 2 {
+		w = os.NewFile(uintptr(fd), "progress-json")
+	}
+	return &copyEvents{w: w, start: time.Now()}
+}
+
+// print prints an event, ignoring any error, as a front end that goes
+// away should not stop the copy.
+func (ev *copyEvents) print(e interface{}) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	ev.w.Write(append(data, '\n'))
+}
+
+// rate returns the bytes per second for n bytes copied since t.
+func rate(n int64, t time.Time) float64 {
+	d := time.Since(t).Seconds()
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d
+}
+
+// beginEvents notes that src is to be copied to dst. Its start event
+// waits for its data to be read, so that a copy by reference has only
+// its done event.
+func (cs *copyState) beginEvents(src, dst cpFile) {
+	ev := cs.events
+	if ev == nil {
+		return
+	}
+	ev.file = &copyEvent{Path: src.path, Dst: dst.path, BytesTotal: cs.state.sourceSize(src)}
+	ev.begun = time.Now()
+	ev.started, ev.byRef = false, false
+}
+
+// sourceSize returns the size of the file, or -1 if it is not known.
+func (s *State) sourceSize(src cpFile) int64 {
+	if src.isUpspin {
+		entry, err := s.Client.Lookup(upspin.PathName(src.path), true)
+		if err != nil {
+			return -1
+		}
+		size, err := entry.Size()
+		if err != nil {
+			return -1
+		}
+		return size
+	}
+	info, err := os.Stat(src.path)
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
+
+// copiedByReference notes that the file being copied was copied by
+// reference.
+func (cs *copyState) copiedByReference() {
+	if cs.events != nil {
+		cs.events.byRef = true
+	}
+}
+
+// startEvent prints the start event for the file being copied, if it
+// has not been printed.
+func (ev *copyEvents) startEvent() {
+	if ev.started {
+		return
+	}
+	ev.started = true
+	ev.last = time.Now()
+	e := *ev.file
+	e.Event = "start"
+	ev.print(&e)
+}
+
+// endEvents prints the done event for the file being copied.
+func (cs *copyState) endEvents(ok bool) {
+	ev := cs.events
+	if ev == nil || ev.file == nil {
+		return
+	}
+	if ok && !ev.byRef {
+		// A copy that read no data, as of an empty file, still starts.
+		ev.startEvent()
+	}
+	e := ev.file
+	ev.file = nil
+	switch {
+	case !ok:
+		e.Status = "failed"
+		ev.failed++
+	case ev.byRef:
+		e.Status = "by reference"
+		e.BytesDone = 0
+		ev.files++
+	default:
+		e.Status = "ok"
+		ev.files++
+	}
+	if ev.started {
+		e.Rate = rate(e.BytesDone, ev.begun)
+	}
+	ev.bytes += e.BytesDone
+	e.Event = "done"
+	ev.print(e)
+}
+
+// byReferenceEvent prints the only event for src, copied or moved to dst
+// by reference. Its size is that of dst, as a moved src is gone.
+func (cs *copyState) byReferenceEvent(src, dst cpFile) {
+	ev := cs.events
+	if ev == nil {
+		return
+	}
+	ev.file = &copyEvent{Path: src.path, Dst: dst.path, BytesTotal: cs.state.sourceSize(dst)}
+	ev.started, ev.byRef = false, true
+	cs.endEvents(true)
+}
+
+// summaryEvent prints the summary of the command.
+func (cs *copyState) summaryEvent() {
+	ev := cs.events
+	if ev == nil {
+		return
+	}
+	status := "ok"
+	if cs.state.ExitCode != 0 {
+		status = "failed"
+	}
+	ev.print(&copySummary{
+		Event:     "summary",
+		BytesDone: ev.bytes,
+		Rate:      rate(ev.bytes, ev.start),
+		Status:    status,
+		Files:     ev.files,
+		Failed:    ev.failed,
+	})
+}
+
+// counted returns r, wrapped to count the bytes read from it as the
+// progress of the file being copied. Without -progress-json it returns r.
+func (cs *copyState) counted(r io.Reader) io.Reader {
+	if cs.events == nil || cs.events.file == nil {
+		return r
+	}
+	return &countingReader{r: r, ev: cs.events}
+}
+
+// countingReader counts the bytes read from r for ev, printing the start
+// event before the first read and progress events as it goes.
+type countingReader struct {
+	r  io.Reader
+	ev *copyEvents
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	ev := c.ev
+	if ev.file == nil {
+		return c.r.Read(p)
+	}
+	ev.startEvent()
+	n, err := c.r.Read(p)
+	ev.file.BytesDone += int64(n)
+	if now := time.Now(); n > 0 && now.Sub(ev.last) >= progressInterval {
+		ev.last = now
+		e := *ev.file
+		e.Event = "progress"
+		e.Rate = rate(e.BytesDone, ev.begun)
+		ev.print(&e)
+	}
+	return n, err
+}
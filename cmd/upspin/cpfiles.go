@@ -0,0 +1,83 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// fileHeadroom is the number of file descriptors, of those the process
+// may have open, that cp leaves for other uses, such as standard input
+// and output, the client's network connections, and the files it opens
+// only briefly.
+const fileHeadroom = 32
+
+// minOpenFiles is the fewest local files a copy needs open at once:
+// a source and a destination.
+const minOpenFiles = 2
+
+// limitFiles bounds the number of local source and destination files cp
+// has open at once to n or, if n is zero, to the number the process's
+// descriptor limit allows, less fileHeadroom. If the limit is unknown,
+// there is no bound.
+func (c *copyState) limitFiles(n int) {
+	if n == 0 {
+		limit := openFileLimit()
+		if limit == 0 {
+			return
+		}
+		n = limit - fileHeadroom
+	}
+	if n < minOpenFiles {
+		n = minOpenFiles
+	}
+	c.files = make(chan struct{}, n)
+}
+
+// acquireFile waits until another local file may be opened.
+func (c *copyState) acquireFile() {
+	if c.files != nil {
+		c.files <- struct{}{}
+	}
+}
+
+// releaseFile makes room for another local file to be opened.
+func (c *copyState) releaseFile() {
+	if c.files != nil {
+		<-c.files
+	}
+}
+
+// maxFiles returns the number of local files that may be open at once,
+// or zero if there is no bound.
+func (c *copyState) maxFiles() int {
+	return cap(c.files)
+}
+
+// openLocal opens the local file with os.OpenFile once the limit on open
+// files allows it. Closing the returned file makes room for another.
+func (c *copyState) openLocal(name string, flag int, perm os.FileMode) (*limitedFile, error) {
+	c.acquireFile()
+	fd, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		c.releaseFile()
+		return nil, err
+	}
+	return &limitedFile{File: fd, release: c.releaseFile}, nil
+}
+
+// limitedFile is a local file counted against the limit on open files.
+type limitedFile struct {
+	*os.File
+	once    sync.Once
+	release func()
+}
+
+func (f *limitedFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(f.release)
+	return err
+}
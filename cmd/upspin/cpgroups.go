@@ -0,0 +1,203 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// A groupExpander resolves the groups named in Access and Group files to
+// the users in them, for cp -expand-groups. It reads each Group file
+// once, and a group that includes itself, however indirectly, is
+// expanded only once.
+type groupExpander struct {
+	s       *State
+	members map[upspin.PathName][]path.Parsed // Of each Group file read.
+}
+
+// expandCopied prints, for each Access or Group file in entries, which
+// are in the source directory being copied to dst, the users its copy
+// would grant each right or hold, with groups expanded, and then the
+// users in each of those groups. It reports whether every file could be
+// expanded.
+func (s *State) expandCopied(cs *copyState, entries []*upspin.DirEntry, dst upspin.PathName) bool {
+	if cs.groups == nil {
+		cs.groups = &groupExpander{s: s, members: make(map[upspin.PathName][]path.Parsed)}
+	}
+	ok := true
+	for _, entry := range entries {
+		if entry.IsDir() || entry.IsLink() {
+			continue
+		}
+		to := path.Join(dst, filepath.Base(string(entry.Name)))
+		var err error
+		switch {
+		case access.IsAccessFile(entry.Name):
+			err = cs.groups.printAccess(entry.Name, to)
+		case access.IsGroupFile(to):
+			err = cs.groups.printGroup(entry.Name, to)
+		default:
+			continue
+		}
+		if err != nil {
+			s.Fail(err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// printAccess prints the rights the Access file file would grant if
+// copied to name.
+func (g *groupExpander) printAccess(file, name upspin.PathName) error {
+	acc, err := g.s.accessAt(file, name)
+	if err != nil {
+		return err
+	}
+	owner, err := path.Parse(name)
+	if err != nil {
+		return err
+	}
+	var groups []upspin.PathName
+	for _, right := range []access.Right{access.Read, access.Write, access.List, access.Create, access.Delete} {
+		members := acc.List(right)
+		switch right {
+		case access.Read, access.List:
+			// The owner can always read and list.
+			members = append(members, owner.First(0))
+		}
+		users, expanded, err := g.expand(members)
+		if err != nil {
+			return errors.E(name, err)
+		}
+		groups = append(groups, expanded...)
+		if len(users) > 0 {
+			fmt.Printf("%s: %s: %s\n", name, right, joinUsers(users))
+		}
+	}
+	return g.printGroups(name, groups)
+}
+
+// printGroup prints the users in the Group file file if copied to name.
+func (g *groupExpander) printGroup(file, name upspin.PathName) error {
+	data, err := g.s.Client.Get(file)
+	if err != nil {
+		return err
+	}
+	parsed, err := path.Parse(name)
+	if err != nil {
+		return err
+	}
+	members, err := access.ParseGroup(parsed, data)
+	if err != nil {
+		return err
+	}
+	users, groups, err := g.expand(members)
+	if err != nil {
+		return errors.E(name, err)
+	}
+	fmt.Printf("%s: members: %s\n", name, joinUsers(users))
+	return g.printGroups(name, groups)
+}
+
+// printGroups prints, once each and in order, the users in the groups
+// named in the Access or Group file name.
+func (g *groupExpander) printGroups(name upspin.PathName, groups []upspin.PathName) error {
+	sortPathNames(groups)
+	for i, group := range groups {
+		if i > 0 && group == groups[i-1] {
+			continue
+		}
+		p, err := path.Parse(group)
+		if err != nil {
+			return err
+		}
+		users, _, err := g.expand([]path.Parsed{p})
+		if err != nil {
+			return errors.E(name, err)
+		}
+		fmt.Printf("%s: group %s: %s\n", name, group, joinUsers(users))
+	}
+	return nil
+}
+
+// expand returns the users among the members, which may be users or
+// groups, with each group replaced by the users in it, and the groups
+// expanded. Both are sorted.
+func (g *groupExpander) expand(members []path.Parsed) ([]upspin.UserName, []upspin.PathName, error) {
+	users := make(map[upspin.UserName]bool)
+	groups := make(map[upspin.PathName]bool)
+	var add func([]path.Parsed) error
+	add = func(members []path.Parsed) error {
+		for _, m := range members {
+			if m.IsRoot() {
+				users[m.User()] = true
+				continue
+			}
+			group := m.Path()
+			if groups[group] {
+				// Already expanded, or being expanded: a cycle.
+				continue
+			}
+			groups[group] = true
+			inGroup, err := g.groupMembers(group)
+			if err != nil {
+				return err
+			}
+			if err := add(inGroup); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := add(members); err != nil {
+		return nil, nil, err
+	}
+	var userList []upspin.UserName
+	for u := range users {
+		userList = append(userList, u)
+	}
+	sort.Slice(userList, func(i, j int) bool { return userList[i] < userList[j] })
+	var groupList []upspin.PathName
+	for group := range groups {
+		groupList = append(groupList, group)
+	}
+	sortPathNames(groupList)
+	return userList, groupList, nil
+}
+
+// groupMembers returns the members of the group, reading its Group file
+// if it has not been read already.
+func (g *groupExpander) groupMembers(group upspin.PathName) ([]path.Parsed, error) {
+	if members, ok := g.members[group]; ok {
+		return members, nil
+	}
+	data, err := g.s.Client.Get(group)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := path.Parse(group)
+	if err != nil {
+		return nil, err
+	}
+	members, err := access.ParseGroup(parsed, data)
+	if err != nil {
+		return nil, err
+	}
+	g.members[group] = members
+	return members, nil
+}
+
+// sortPathNames sorts the names.
+func sortPathNames(names []upspin.PathName) {
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+)
+
+// gzipSuffix marks the names of gzip-compressed files for -gzip-by-name.
+const gzipSuffix = ".gz"
+
+// gzips reports whether the copy of src to dst compresses the data, with
+// -z, or decompresses it, with -unz. With -gzip-by-name, a copy to a name
+// ending in .gz from one that does not compresses it, and the reverse
+// decompresses it. Such copies transform the data, so they cannot be made
+// by reference.
+func (cs *copyState) gzips(src, dst cpFile) (compress, decompress bool) {
+	if cs.gzipByName {
+		fromGz := strings.HasSuffix(src.path, gzipSuffix)
+		toGz := strings.HasSuffix(dst.path, gzipSuffix)
+		return toGz && !fromGz, fromGz && !toGz
+	}
+	return cs.compress, cs.decompress
+}
+
+// transforms reports whether the copy of src to dst changes the data.
+func (cs *copyState) transforms(src, dst cpFile) bool {
+	compress, decompress := cs.gzips(src, dst)
+	return compress || decompress
+}
+
+// gzipWriter compresses what is written to the file it wraps.
+type gzipWriter struct {
+	*gzip.Writer
+	file io.WriteCloser
+}
+
+func newGzipWriter(file io.WriteCloser) *gzipWriter {
+	return &gzipWriter{Writer: gzip.NewWriter(file), file: file}
+}
+
+// Close writes the end of the compressed stream, without which the copy
+// would be truncated, and then closes the file.
+func (w *gzipWriter) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// gunzipReader decompresses the gzip stream it reads. It reads the gzip
+// header at the first Read, so that a source that is not compressed
+// fails as an unreadable one does.
+type gunzipReader struct {
+	r  io.Reader
+	gz *gzip.Reader
+}
+
+func (g *gunzipReader) Read(p []byte) (int, error) {
+	if g.gz == nil {
+		gz, err := gzip.NewReader(g.r)
+		if err == io.EOF {
+			// An empty file is not a gzip stream.
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		g.gz = gz
+	}
+	return g.gz.Read(p)
+}
@@ -0,0 +1,186 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// ignoreFileName is the name of the files listing what cp -use-ignore
+// skips in the directory holding them and below it.
+const ignoreFileName = ".upspinignore"
+
+// ignoreFile holds the patterns of an ignore file, which apply to files
+// below the directory dir.
+type ignoreFile struct {
+	dir      cpFile
+	patterns []ignorePattern
+}
+
+// ignorePattern is a line of an ignore file, with the syntax and meaning
+// of a line of a .gitignore file.
+type ignorePattern struct {
+	elems    []string // The pattern, split at slashes.
+	negate   bool     // Re-include what earlier patterns excluded.
+	dirOnly  bool     // Match only directories.
+	anchored bool     // Match relative to the directory of the file only.
+}
+
+// readIgnore reads the ignore file, if any, in the directory dir and
+// pushes it on the stack of those that apply, for the caller to pop.
+func (s *State) readIgnore(cs *copyState, dir cpFile) error {
+	var data []byte
+	var err error
+	if dir.isUpspin {
+		data, err = s.Client.Get(upspin.PathName(dir.path + "/" + ignoreFileName))
+		if errors.Match(errNotExist, err) {
+			return nil
+		}
+	} else {
+		data, err = ioutil.ReadFile(filepath.Join(dir.path, ignoreFileName))
+		if os.IsNotExist(err) {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	cs.logf("read %s in %s", ignoreFileName, dir.path)
+	cs.ignores = append(cs.ignores, &ignoreFile{dir: dir, patterns: parseIgnore(string(data))})
+	return nil
+}
+
+// parseIgnore returns the patterns in the text of an ignore file.
+func parseIgnore(text string) []ignorePattern {
+	var patterns []ignorePattern
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var p ignorePattern
+		if line[0] == '!' {
+			p.negate = true
+			line = line[1:]
+		} else if line[0] == '\\' {
+			// Escapes a leading # or !.
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		// A slash other than at the end anchors the pattern.
+		p.anchored = strings.Contains(line, "/")
+		p.elems = strings.Split(strings.TrimPrefix(line, "/"), "/")
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// match reports whether the pattern matches a file whose name, relative
+// to the directory of the ignore file, has the elements name.
+func (p ignorePattern) match(name []string) bool {
+	if p.anchored {
+		return matchElems(p.elems, name)
+	}
+	// An unanchored pattern may match at any depth.
+	for i := range name {
+		if matchElems(p.elems, name[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchElems reports whether the pattern elements match the name
+// elements. An element "**" matches any number of elements: zero or
+// more at the start or in the middle of a pattern, one or more at its
+// end, matching everything below a directory.
+func matchElems(pat, name []string) bool {
+	if len(pat) == 0 {
+		return len(name) == 0
+	}
+	if pat[0] == "**" {
+		if len(pat) == 1 {
+			return len(name) > 0
+		}
+		for i := 0; i <= len(name); i++ {
+			if matchElems(pat[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if ok, err := path.Match(pat[0], name[0]); err != nil || !ok {
+		return false
+	}
+	return matchElems(pat[1:], name[1:])
+}
+
+// ignored reports whether, with -use-ignore, the ignore files that apply
+// to the file exclude it. As with .gitignore files, the last pattern that
+// matches decides, and the patterns of a file deeper in the tree come
+// after those of the files above it.
+func (s *State) ignored(cs *copyState, file cpFile) bool {
+	ignored := false
+	var isDir *bool
+	for _, f := range cs.ignores {
+		name, ok := f.relative(file)
+		if !ok {
+			continue
+		}
+		for _, p := range f.patterns {
+			if p.negate != ignored || !p.match(name) {
+				// It cannot change the outcome.
+				continue
+			}
+			if p.dirOnly {
+				if isDir == nil {
+					dir := s.isDir(file)
+					isDir = &dir
+				}
+				if !*isDir {
+					continue
+				}
+			}
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// relative returns the elements of the name of the file relative to the
+// directory of the ignore file, and reports whether the file is below it.
+func (f *ignoreFile) relative(file cpFile) ([]string, bool) {
+	if file.isUpspin != f.dir.isUpspin {
+		return nil, false
+	}
+	if file.isUpspin {
+		rel := strings.TrimPrefix(file.path, f.dir.path+"/")
+		if rel == file.path {
+			return nil, false
+		}
+		return strings.Split(rel, "/"), true
+	}
+	rel, err := filepath.Rel(f.dir.path, file.path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, false
+	}
+	return strings.Split(filepath.ToSlash(rel), "/"), true
+}
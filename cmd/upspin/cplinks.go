@@ -0,0 +1,116 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// relinkTree, with -relativize-links, recreates at dst the link src, a
+// local symbolic link or an Upspin link found within a source directory,
+// rather than following it. A link to a file within the source tree
+// being copied is made to point to that file's copy: relative to the
+// link for local copies, or by its full name in Upspin, whose links
+// cannot be relative. A link to a file outside the tree keeps its target,
+// with a warning, except that a local link cannot become an Upspin link
+// to a local file, so it is followed as usual. It reports whether src was
+// recreated as a link and, if so, whether that succeeded.
+func (s *State) relinkTree(cs *copyState, src, dst cpFile) (isLink, ok bool) {
+	if !cs.relativize || cs.treeSrc.path == "" {
+		return false, false
+	}
+	target, isLink := s.sourceLink(src)
+	if !isLink {
+		return false, false
+	}
+	rel, inTree := cs.treeRelative(target)
+	switch {
+	case inTree && dst.isUpspin:
+		target = string(path.Join(upspin.PathName(cs.treeDst.path), rel))
+	case inTree:
+		abs := filepath.Join(cs.treeDst.path, filepath.FromSlash(rel))
+		var err error
+		if target, err = filepath.Rel(filepath.Dir(dst.path), abs); err != nil {
+			s.Fail(err)
+			return true, false
+		}
+	case dst.isUpspin && !src.isUpspin:
+		cs.warnf("%s links outside the tree, to %s; copying what it links to", src.path, target)
+		return false, false
+	default:
+		cs.warnf("%s links outside the tree, to %s; its copy links there too", src.path, target)
+	}
+	if dst.isUpspin {
+		return true, s.copyLink(cs, upspin.PathName(target), dst)
+	}
+	cs.logf("symlink %s to %s", dst.path, target)
+	// Replace an existing file, as a copy would.
+	if info, err := os.Lstat(dst.path); err == nil && !info.IsDir() {
+		os.Remove(dst.path)
+	}
+	if err := os.Symlink(target, dst.path); err != nil {
+		s.Fail(err)
+		return true, false
+	}
+	return true, true
+}
+
+// sourceLink reports whether the file is an Upspin link or a local
+// symbolic link and, if so, returns the full name of its target.
+func (s *State) sourceLink(file cpFile) (string, bool) {
+	if file.isUpspin {
+		entry, err := s.unfollowedEntry(file)
+		if err != nil || !entry.IsLink() {
+			return "", false
+		}
+		return string(entry.Link), true
+	}
+	target, err := os.Readlink(file.path)
+	if err != nil {
+		return "", false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(file.path), target)
+	}
+	return target, true
+}
+
+// treeRelative reports whether the target of a link, as returned by
+// sourceLink, lies within the source tree being copied and, if so,
+// returns its slash-separated name relative to the top of the tree.
+func (c *copyState) treeRelative(target string) (string, bool) {
+	if c.treeSrc.isUpspin {
+		t, err := path.Parse(upspin.PathName(target))
+		if err != nil {
+			return "", false
+		}
+		top, err := path.Parse(upspin.PathName(c.treeSrc.path))
+		if err != nil || !t.HasPrefix(top) {
+			return "", false
+		}
+		elems := make([]string, 0, t.NElem()-top.NElem())
+		for i := top.NElem(); i < t.NElem(); i++ {
+			elems = append(elems, t.Elem(i))
+		}
+		return strings.Join(elems, "/"), true
+	}
+	top, err := filepath.Abs(c.treeSrc.path)
+	if err != nil {
+		return "", false
+	}
+	if target, err = filepath.Abs(target); err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(top, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
@@ -0,0 +1,192 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// manifestSuffix is added to the name of each copy made with
+// -manifest-verify to name the file holding its manifest.
+const manifestSuffix = ".upspin-manifest"
+
+// A cpManifest lists the files of a copy made with -manifest-verify and
+// the blocks holding their contents.
+type cpManifest struct {
+	Tree  upspin.PathName `json:"tree"` // The copy.
+	User  upspin.UserName `json:"user"` // The user who made it, and signed the manifest.
+	Time  string          `json:"time"` // When, in RFC 3339 format.
+	Files []manifestFile  `json:"files"`
+}
+
+// A manifestFile is a file, or link, in a manifest.
+type manifestFile struct {
+	Name   upspin.PathName `json:"name"`
+	Link   upspin.PathName `json:"link,omitempty"` // The target, if it is a link.
+	Size   int64           `json:"size"`
+	Blocks []manifestBlock `json:"blocks,omitempty"`
+}
+
+// A manifestBlock is the location of a block of a file in a manifest.
+type manifestBlock struct {
+	Reference upspin.Reference `json:"reference"`
+	Endpoint  string           `json:"endpoint"`
+}
+
+// A signedManifest is what is stored in a manifest file: the manifest,
+// encoded as JSON, and the signature of the user who made the copy of the
+// SHA-256 hash of that encoding, as the hexadecimal R and S separated by
+// a hyphen.
+type signedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+}
+
+// manifestVerify implements cp -manifest-verify once the sources have been
+// copied into the Upspin directory dst. For the copy of each source, it
+// lists every file and link, with the location of each block, and then
+// fetches each block from its store directly, bypassing any cache server,
+// as -confirm-durable does. Only if every block is there does it store the
+// manifest, signed, alongside the copy, so that the manifest vouches that
+// the copy was complete and durable when made. Each block missing is
+// reported. It reports whether every copy was verified.
+func (s *State) manifestVerify(cs *copyState, src []cpFile, dst cpFile) bool {
+	ok := true
+	for _, n := range s.dstNames(cs, src, dst) {
+		if n.err != nil && !cs.sanitize {
+			// Not copied.
+			continue
+		}
+		tree := path.Join(upspin.PathName(dst.path), n.name)
+		m, err := s.manifest(cs, tree)
+		if errors.Match(errNotExist, err) {
+			// Skipped, as an ignored file is.
+			cs.logf("no copy %s to verify", tree)
+			continue
+		}
+		if err != nil {
+			s.Fail(err)
+			ok = false
+			continue
+		}
+		if !s.verifyManifest(cs, m) {
+			s.Failf("%s is not durable; no manifest written", tree)
+			ok = false
+			continue
+		}
+		if err := s.storeManifest(m); err != nil {
+			s.Fail(err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// manifest returns the manifest of the Upspin file or tree.
+func (s *State) manifest(cs *copyState, tree upspin.PathName) (*cpManifest, error) {
+	m := &cpManifest{
+		Tree: tree,
+		User: s.Config.UserName(),
+		Time: time.Now().UTC().Format(time.RFC3339),
+	}
+	entry, err := s.Client.Lookup(tree, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addToManifest(cs, m, entry); err != nil {
+		return nil, err
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Name < m.Files[j].Name })
+	return m, nil
+}
+
+// addToManifest adds the entry to the manifest, with all below it if it
+// is a directory.
+func (s *State) addToManifest(cs *copyState, m *cpManifest, entry *upspin.DirEntry) error {
+	cs.checkCanceled()
+	switch {
+	case entry.IsDir():
+		entries, err := s.Client.Glob(upspin.AllFilesGlob(entry.Name))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := s.addToManifest(cs, m, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	case entry.IsLink():
+		m.Files = append(m.Files, manifestFile{Name: entry.Name, Link: entry.Link})
+		return nil
+	}
+	size, err := entry.Size()
+	if err != nil {
+		return err
+	}
+	f := manifestFile{Name: entry.Name, Size: size}
+	for _, b := range entry.Blocks {
+		f.Blocks = append(f.Blocks, manifestBlock{
+			Reference: b.Location.Reference,
+			Endpoint:  b.Location.Endpoint.String(),
+		})
+	}
+	m.Files = append(m.Files, f)
+	return nil
+}
+
+// verifyManifest checks that every block listed in the manifest can be
+// fetched from its store, reporting those that cannot, and reports whether
+// all can.
+func (s *State) verifyManifest(cs *copyState, m *cpManifest) bool {
+	ok := true
+	n := 0
+	for _, f := range m.Files {
+		for i, b := range f.Blocks {
+			cs.checkCanceled()
+			e, err := upspin.ParseEndpoint(b.Endpoint)
+			if err == nil {
+				err = s.fetchBlock(upspin.Location{Reference: b.Reference, Endpoint: *e})
+			}
+			if err != nil {
+				s.Fail(errors.E(f.Name, errors.NotExist, errors.Errorf("block %d of %d, %q in store %s, is missing: %v", i+1, len(f.Blocks), b.Reference, b.Endpoint, err)))
+				ok = false
+			}
+			n++
+		}
+	}
+	cs.logf("verified %d blocks of %d files in %s", n, len(m.Files), m.Tree)
+	return ok
+}
+
+// storeManifest signs the manifest and stores it alongside its tree.
+func (s *State) storeManifest(m *cpManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(data)
+	sig, err := s.Config.Factotum().Sign(hash[:])
+	if err != nil {
+		return err
+	}
+	signed, err := json.Marshal(signedManifest{
+		Manifest:  data,
+		Signature: fmt.Sprintf("%x-%x", sig.R, sig.S),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.Client.Put(m.Tree+manifestSuffix, append(signed, '\n'))
+	return err
+}
@@ -0,0 +1,49 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"upspin.io/upspin"
+)
+
+// upspinfsFSName is the file system name with which upspinfs mounts.
+const upspinfsFSName = "upspin"
+
+// upspinfsMounts returns the mount points of the upspinfs file systems
+// on this machine. It is a variable so tests can replace it.
+var upspinfsMounts = mountedUpspinfs
+
+// upspinfsPath reports whether the local file is within an upspinfs mount
+// and, if so, returns the Upspin path name the file represents. The mount
+// points are read once per cp command. The root of a mount is not an Upspin
+// path name.
+func (c *copyState) upspinfsPath(file string) (upspin.PathName, bool) {
+	if c.mounts == nil {
+		c.mounts = upspinfsMounts()
+		if c.mounts == nil {
+			c.mounts = []string{}
+		}
+	}
+	file = filepath.Clean(file)
+	best := ""
+	for _, m := range c.mounts {
+		m = filepath.Clean(m)
+		if len(m) > len(best) && strings.HasPrefix(file, m+string(filepath.Separator)) {
+			best = m
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	name := filepath.ToSlash(strings.TrimPrefix(file[len(best):], string(filepath.Separator)))
+	// The first element must be a user name.
+	if user := strings.SplitN(name, "/", 2)[0]; !strings.Contains(user, "@") {
+		return "", false
+	}
+	return upspin.PathName(name), true
+}
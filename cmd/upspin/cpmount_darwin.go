@@ -0,0 +1,43 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "syscall"
+
+// mountedUpspinfs returns the mount points of the upspinfs file systems
+// reported by getfsstat.
+func mountedUpspinfs() []string {
+	n, err := syscall.Getfsstat(nil, mntNoWait)
+	if err != nil || n == 0 {
+		return nil
+	}
+	buf := make([]syscall.Statfs_t, n)
+	n, err = syscall.Getfsstat(buf, mntNoWait)
+	if err != nil {
+		return nil
+	}
+	var mounts []string
+	for _, st := range buf[:n] {
+		if cString(st.Mntfromname[:]) == upspinfsFSName {
+			mounts = append(mounts, cString(st.Mntonname[:]))
+		}
+	}
+	return mounts
+}
+
+// mntNoWait is MNT_NOWAIT from <sys/mount.h>: return cached statistics.
+const mntNoWait = 2
+
+// cString converts a NUL-terminated C string to a Go string.
+func cString(b []int8) string {
+	s := make([]byte, 0, len(b))
+	for _, c := range b {
+		if c == 0 {
+			break
+		}
+		s = append(s, byte(c))
+	}
+	return string(s)
+}
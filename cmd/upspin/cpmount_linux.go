@@ -0,0 +1,65 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mountedUpspinfs returns the mount points of the upspinfs file systems
+// listed in /proc/self/mountinfo.
+func mountedUpspinfs() []string {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The fields are described in proc(5). The file system type
+		// and source follow a separator after the optional fields.
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || sep+2 >= len(fields) {
+			continue
+		}
+		fsType, source := fields[sep+1], fields[sep+2]
+		if source != upspinfsFSName || (fsType != "fuse" && !strings.HasPrefix(fsType, "fuse.")) {
+			continue
+		}
+		mounts = append(mounts, unescapeMountField(fields[4]))
+	}
+	return mounts
+}
+
+// unescapeMountField decodes the octal escapes with which the kernel
+// writes spaces and other awkward characters in mountinfo fields.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
@@ -0,0 +1,13 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux,!darwin
+
+package main
+
+// mountedUpspinfs returns no mount points; upspinfs mounts are
+// not detected on this system.
+func mountedUpspinfs() []string {
+	return nil
+}
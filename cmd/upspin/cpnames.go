@@ -0,0 +1,119 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"unicode"
+	"unicode/utf8"
+
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// maxElemLen is the longest element of an Upspin name, in bytes, that cp
+// creates. Upspin itself sets no bound, but a longer name could not be
+// served by upspinfs nor copied back to most local file systems.
+const maxElemLen = 255
+
+// A dstName is the name, within the destination directory, of the copy
+// of a source file.
+type dstName struct {
+	name string // The name of the source, unless it was sanitized.
+	err  error  // Why the name of the source is not a valid Upspin name.
+}
+
+// dstNames returns the names of the copies in the directory dir of the
+// source files, which are all in one directory. Only local files copied to
+// Upspin may have names that are not valid there. With -sanitize, those are
+// given valid names, distinct from the names of the other copies.
+func (s *State) dstNames(cs *copyState, src []cpFile, dir cpFile) []dstName {
+	names := make([]dstName, len(src))
+	taken := make(map[string]bool)
+	for i, from := range src {
+		names[i].name = filepath.Base(from.path)
+		if dir.isUpspin && !from.isUpspin {
+			names[i].err = checkUpspinName(dir, names[i].name)
+		}
+		if names[i].err == nil {
+			taken[names[i].name] = true
+		}
+	}
+	if !cs.sanitize {
+		return names
+	}
+	for i := range names {
+		if names[i].err != nil {
+			names[i].name = sanitizeName(names[i].name, taken)
+			taken[names[i].name] = true
+		}
+	}
+	return names
+}
+
+// checkUpspinName returns an error saying what is wrong with elem as the
+// name of a file in the Upspin directory dir, or nil if nothing is.
+func checkUpspinName(dir cpFile, elem string) error {
+	if !utf8.ValidString(elem) {
+		return errors.Str("is not valid UTF-8")
+	}
+	for _, r := range elem {
+		if unicode.IsControl(r) {
+			return errors.Errorf("has control character %U", r)
+		}
+	}
+	if len(elem) > maxElemLen {
+		return errors.Errorf("is %d bytes long, more than %d", len(elem), maxElemLen)
+	}
+	if _, err := path.Parse(upspin.PathName(dir.path + "/" + elem)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// sanitizeName returns a valid Upspin name for a file named elem that is
+// not among those taken. Bytes that are not valid UTF-8, control characters,
+// and, to keep the result unambiguous, percent signs, become %XX escapes. A
+// name that is then too long is truncated, keeping a short extension, and
+// one that is taken is given a suffix ~N before its extension.
+func sanitizeName(elem string, taken map[string]bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(elem); {
+		r, size := utf8.DecodeRuneInString(elem[i:])
+		if r == utf8.RuneError && size == 1 || unicode.IsControl(r) || r == '%' {
+			for _, c := range []byte(elem[i : i+size]) {
+				fmt.Fprintf(&buf, "%%%02X", c)
+			}
+		} else {
+			buf.WriteString(elem[i : i+size])
+		}
+		i += size
+	}
+	name := buf.String()
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	for n := 0; ; n++ {
+		suffix := ""
+		if n > 0 {
+			suffix = fmt.Sprintf("~%d", n)
+		}
+		s := stem
+		if keep := maxElemLen - len(suffix) - len(ext); len(s) > keep {
+			for keep > 0 && !utf8.RuneStart(s[keep]) {
+				keep--
+			}
+			s = s[:keep]
+		}
+		if name := s + suffix + ext; !taken[name] {
+			return name
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// The packdata sidecar written by cp -keep-packdata holds a header line,
+// the SHA-256 hash of the file's cleartext, and the marshaled directory
+// entry of the Upspin file, which records its blocks, wrapped keys, and
+// signature.
+const (
+	packdataSuffix = ".upspin-packdata"
+	packdataHeader = "upspin-packdata 1\n"
+)
+
+// hashingReader is a ReadCloser that hashes what is read from it.
+type hashingReader struct {
+	io.ReadCloser
+	hash hash.Hash
+}
+
+func (r hashingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+// exportPackdata copies the Upspin file src to the local file dst and
+// saves the directory entry of src in a sidecar file alongside dst.
+// It reports whether it succeeded.
+func (s *State) exportPackdata(cs *copyState, reader io.ReadCloser, src, dst cpFile) bool {
+	entry, err := s.Client.Lookup(upspin.PathName(src.path), true)
+	if err != nil {
+		s.Fail(err)
+		reader.Close()
+		return false
+	}
+	writer, err := s.create(cs, dst)
+	if err != nil {
+		s.Fail(err)
+		reader.Close()
+		return false
+	}
+	hr := hashingReader{reader, sha256.New()}
+	if !cs.doCopy(hr, writer, src, dst) {
+		return false
+	}
+	marshaled, err := entry.Marshal()
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	var b bytes.Buffer
+	b.WriteString(packdataHeader)
+	b.Write(hr.hash.Sum(nil))
+	b.Write(marshaled)
+	cs.logf("save packdata of %s in %s", src.path, dst.path+packdataSuffix)
+	if err := ioutil.WriteFile(dst.path+packdataSuffix, b.Bytes(), 0600); err != nil {
+		s.Fail(err)
+		return false
+	}
+	return true
+}
+
+// hasPackdata reports whether the local file has a packdata sidecar.
+func hasPackdata(file cpFile) bool {
+	_, err := os.Stat(file.path + packdataSuffix)
+	return err == nil
+}
+
+// restorePackdata restores the Upspin file dst from the sidecar alongside
+// the local file src, reusing the original blocks and packdata so that the
+// file keeps its wrapped keys, and so its readers, without being
+// re-encrypted. The sidecar must describe dst and src must be unchanged
+// since it was exported. It reports whether it succeeded.
+func (s *State) restorePackdata(cs *copyState, reader io.ReadCloser, src, dst cpFile) bool {
+	defer reader.Close()
+	sidecar := src.path + packdataSuffix
+	data, err := ioutil.ReadFile(sidecar)
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	entry, sum, err := parsePackdata(data)
+	if err != nil {
+		s.Fail(errors.E(upspin.PathName(sidecar), err))
+		return false
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		s.Failf("reading %s: %v", src.path, err)
+		return false
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		s.Failf("%s has changed since its packdata was saved; copy it without -keep-packdata", src.path)
+		return false
+	}
+	// The packdata is signed for the original name.
+	parsed, err := path.Parse(upspin.PathName(dst.path))
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	if parsed.Path() != entry.SignedName {
+		s.Failf("packdata of %s is for %s; cannot restore it as %s", src.path, entry.SignedName, dst.path)
+		return false
+	}
+	cs.logf("restore %s from packdata in %s", dst.path, sidecar)
+	entry.Name = entry.SignedName
+	entry.Sequence = upspin.SeqIgnore
+	dir, err := s.Client.DirServer(entry.Name)
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	if _, err := dir.Put(entry); err != nil {
+		s.Fail(err)
+		return false
+	}
+	return true
+}
+
+// parsePackdata parses the contents of a packdata sidecar, returning the
+// directory entry and cleartext hash it holds.
+func parsePackdata(data []byte) (*upspin.DirEntry, []byte, error) {
+	if !bytes.HasPrefix(data, []byte(packdataHeader)) {
+		return nil, nil, errors.E(errors.Invalid, errors.Str("not a packdata file"))
+	}
+	data = data[len(packdataHeader):]
+	if len(data) < sha256.Size {
+		return nil, nil, errors.E(errors.Invalid, errors.Str("packdata file too short"))
+	}
+	sum, data := data[:sha256.Size], data[sha256.Size:]
+	entry := new(upspin.DirEntry)
+	rest, err := entry.Unmarshal(data)
+	if err != nil {
+		return nil, nil, errors.E(errors.Invalid, err)
+	}
+	if len(rest) != 0 || entry.IsDir() || entry.IsLink() {
+		return nil, nil, errors.E(errors.Invalid, errors.Str("bad packdata file"))
+	}
+	return entry, sum, nil
+}
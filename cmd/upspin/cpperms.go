@@ -0,0 +1,180 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"upspin.io/access"
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// permsPreview prints, for each Upspin directory a recursive copy of the
+// sources into dir would create, who can read the source directory and
+// who could read its copy, flagging copies readable by different users.
+// It reports whether every directory was analyzed; those that could not
+// be are reported.
+func (s *State) permsPreview(cs *copyState, src []cpFile, dir cpFile) bool {
+	// The copies inherit the Access file governing dir.
+	dirAccess, err := s.governingAccess(upspin.PathName(dir.path))
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	ok := true
+	for _, from := range src {
+		if !from.isUpspin || !s.isDir(from) {
+			continue
+		}
+		dst := path.Join(upspin.PathName(dir.path), filepath.Base(from.path))
+		ok = s.previewDir(cs, upspin.PathName(from.path), dst, dirAccess) && ok
+	}
+	return ok
+}
+
+// previewDir prints the preview for the source directory src, copied to
+// dst, and recurs into its subdirectories. The parent of dst is governed
+// by parentAccess, which is nil if only the owner has rights.
+func (s *State) previewDir(cs *copyState, src, dst upspin.PathName, parentAccess *access.Access) bool {
+	entries, err := s.Client.Glob(upspin.AllFilesGlob(src))
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	srcAccess, err := s.governingAccess(src)
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+
+	// The Access file governing dst after the copy: a copied Access
+	// file, interpreted at its new name, else one already there, else
+	// that of the parent.
+	dstAccess := parentAccess
+	copiedAccess := false
+	for _, entry := range entries {
+		if access.IsAccessFile(entry.Name) {
+			if dstAccess, err = s.accessAt(entry.Name, path.Join(dst, access.AccessFile)); err != nil {
+				s.Fail(err)
+				return false
+			}
+			copiedAccess = true
+		}
+	}
+	if !copiedAccess {
+		if existing, err := s.accessAt(path.Join(dst, access.AccessFile), path.Join(dst, access.AccessFile)); err == nil {
+			dstAccess = existing
+		} else if !errors.Match(errNotExist, err) {
+			s.Fail(err)
+			return false
+		}
+	}
+
+	before, err := s.readers(src, srcAccess)
+	if err != nil {
+		s.Fail(errors.E(src, err))
+		return false
+	}
+	after, err := s.readers(dst, dstAccess)
+	if err != nil {
+		s.Fail(errors.E(dst, err))
+		return false
+	}
+	fmt.Printf("%s -> %s: %s\n", src, dst, readersChange(before, after))
+
+	ok := true
+	if cs.expandGroups {
+		ok = s.expandCopied(cs, entries, dst)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			cs.checkCanceled()
+			ok = s.previewDir(cs, entry.Name, path.Join(dst, filepath.Base(string(entry.Name))), dstAccess) && ok
+		}
+	}
+	return ok
+}
+
+// governingAccess returns the Access file that governs the Upspin
+// directory, or nil if there is none and only the owner has rights.
+func (s *State) governingAccess(dir upspin.PathName) (*access.Access, error) {
+	dirServer, err := s.Client.DirServer(dir)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := dirServer.WhichAccess(dir)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return s.accessAt(entry.Name, entry.Name)
+}
+
+// accessAt reads the Access file named file and parses it as if it were
+// named name, where a copy of it would be.
+func (s *State) accessAt(file, name upspin.PathName) (*access.Access, error) {
+	data, err := s.Client.Get(file)
+	if err != nil {
+		return nil, err
+	}
+	return access.Parse(name, data)
+}
+
+// readers returns the users who can read the file, which is governed by
+// the Access file acc, or if acc is nil, by none.
+func (s *State) readers(file upspin.PathName, acc *access.Access) ([]upspin.UserName, error) {
+	if acc == nil {
+		parsed, err := path.Parse(file)
+		if err != nil {
+			return nil, err
+		}
+		return []upspin.UserName{parsed.User()}, nil
+	}
+	return acc.Users(access.Read, s.Client.Get)
+}
+
+// readersChange describes how a copy changes who can read a directory,
+// from the users before to those after, both sorted.
+func readersChange(before, after []upspin.UserName) string {
+	gained := userDifference(after, before)
+	lost := userDifference(before, after)
+	var change []string
+	if len(gained) > 0 {
+		change = append(change, "WIDENED: also readable by "+joinUsers(gained))
+	}
+	if len(lost) > 0 {
+		change = append(change, "NARROWED: no longer readable by "+joinUsers(lost))
+	}
+	if len(change) == 0 {
+		return "unchanged, readable by " + joinUsers(after)
+	}
+	return strings.Join(change, "; ")
+}
+
+// userDifference returns the users in a that are not in b.
+func userDifference(a, b []upspin.UserName) []upspin.UserName {
+	in := make(map[upspin.UserName]bool)
+	for _, u := range b {
+		in[u] = true
+	}
+	var diff []upspin.UserName
+	for _, u := range a {
+		if !in[u] {
+			diff = append(diff, u)
+		}
+	}
+	return diff
+}
+
+func joinUsers(users []upspin.UserName) string {
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = string(u)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// stagingPrefix begins the name of each directory, within the destination
+// of cp -publish, that holds a published copy.
+const stagingPrefix = ".staging-"
+
+// publishHook, if set, is called once the sources have been copied into
+// the staging directory, before they are published. Tests set it.
+var publishHook func(staging cpFile)
+
+// publishCommand copies the sources into a new staging directory within
+// the Upspin directory dst and, only if everything was copied, publishes
+// each by making the name it would have in dst a link to its staged copy.
+// Readers see the old tree, then, once the link is replaced, the new one,
+// never a partial copy. Putting a link where one exists would follow it,
+// and a link cannot be renamed, so the old link is deleted first; the
+// name is missing briefly between. If the new link cannot be made, the
+// old one is put back and the staged copy is kept and reported. If the
+// copy fails, the staging directory is removed. Staged copies that are no
+// longer linked are removed once the links are replaced.
+func (s *State) publishCommand(cs *copyState, src []cpFile, dst cpFile) {
+	if !dst.isUpspin {
+		s.Exitf("-publish requires that final argument (%s) be an Upspin directory", dst.path)
+	}
+	// A link can replace a file or a link, but not a directory.
+	names := s.dstNames(cs, src, dst)
+	for i := range src {
+		name := path.Join(upspin.PathName(dst.path), names[i].name)
+		if entry, err := s.Client.Lookup(name, false); err == nil && entry.IsDir() {
+			s.Exitf("cannot publish over directory %s; remove it first", name)
+		}
+	}
+
+	stamp := time.Now().UTC().Format("20060102T150405.000000000")
+	staging := cpFile{
+		path:     string(path.Join(upspin.PathName(dst.path), stagingPrefix+stamp)),
+		isUpspin: true,
+	}
+	cs.logf("stage in %s", staging.path)
+	if _, err := s.Client.MakeDirectory(upspin.PathName(staging.path)); err != nil {
+		s.Exit(err)
+	}
+	// Report listing errors rather than exit, so the staging
+	// directory can be cleaned up.
+	cs.keepOn = true
+	failed := len(s.Failures)
+	if !s.copyToDir(cs, src, staging) || len(s.Failures) > failed {
+		s.Failf("cannot publish to %s: copy failed; nothing was published", dst.path)
+		s.removeStaged(cs, staging)
+		return
+	}
+	if publishHook != nil {
+		publishHook(staging)
+	}
+
+	var stale []cpFile
+	for i := range src {
+		name := names[i].name
+		target := path.Join(upspin.PathName(staging.path), name)
+		if _, err := s.Client.Lookup(target, false); err != nil {
+			// Nothing was copied, as for a skipped sidecar.
+			continue
+		}
+		link := path.Join(upspin.PathName(dst.path), name)
+		cs.logf("publish %s as %s", target, link)
+		old, err := s.Client.Lookup(link, false)
+		if err == nil {
+			if err := s.Client.Delete(link); err != nil {
+				s.Fail(err)
+				continue
+			}
+		}
+		if _, err := s.Client.PutLink(target, link); err != nil {
+			s.Failf("cannot publish %s: %v; the copy remains in %s", link, err, target)
+			if old != nil && old.IsLink() {
+				cs.logf("restore link %s to %s", link, old.Link)
+				if _, err := s.Client.PutLink(old.Link, link); err != nil {
+					s.Failf("cannot restore link %s to %s: %v", link, old.Link, err)
+				}
+			}
+			continue
+		}
+		// Only now that it is not linked may the old copy be removed.
+		if old != nil && old.IsLink() && isStaged(old.Link, dst) {
+			stale = append(stale, cpFile{path: string(old.Link), isUpspin: true})
+		}
+	}
+	for _, file := range stale {
+		s.removeStaged(cs, file)
+		// Remove its staging directory too once nothing in it
+		// is published. Deleting a directory that is not yet
+		// empty fails, which is fine.
+		s.Client.Delete(path.DropPath(upspin.PathName(file.path), 1))
+	}
+}
+
+// isStaged reports whether name is a copy published by cp -publish to dst.
+func isStaged(name upspin.PathName, dst cpFile) bool {
+	parsed, err := path.Parse(name)
+	if err != nil || parsed.NElem() < 2 {
+		return false
+	}
+	return parsed.Drop(2).Path() == path.Clean(upspin.PathName(dst.path)) &&
+		strings.HasPrefix(parsed.Elem(parsed.NElem()-2), stagingPrefix)
+}
+
+// removeStaged removes a staged copy, which cp made and may remove
+// without -confirm.
+func (s *State) removeStaged(cs *copyState, file cpFile) {
+	rm := *cs
+	rm.confirm = true
+	s.removeTree(&rm, file)
+}
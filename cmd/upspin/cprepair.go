@@ -0,0 +1,82 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"upspin.io/bind"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// checkBlocks, with -repair, checks that every block of the Upspin file
+// src can be fetched from its store before src is copied by reference,
+// which would otherwise make a copy as broken as src without a word.
+// A missing block that the user's cache server still holds is put back
+// in its store. It reports each block that cannot be restored, and
+// whether all of them are there.
+func (s *State) checkBlocks(cs *copyState, src upspin.PathName) bool {
+	entry, err := s.Client.Lookup(src, true)
+	if err != nil || entry.IsDir() {
+		// Let the copy report or deal with it.
+		return true
+	}
+	cs.logf("check %d blocks of %s", len(entry.Blocks), entry.Name)
+	ok := true
+	for i, b := range entry.Blocks {
+		cs.checkCanceled()
+		err := s.fetchBlock(b.Location)
+		if err == nil {
+			continue
+		}
+		if rerr := s.restoreBlock(b.Location); rerr != nil {
+			s.Fail(errors.E(entry.Name, errors.NotExist, errors.Errorf("block %d of %d, %q in store %s, is missing, so the file was not copied: %v", i+1, len(entry.Blocks), b.Location.Reference, b.Location.Endpoint, err)))
+			ok = false
+			continue
+		}
+		cs.warnf("block %d of %d of %s, %q, was missing from store %s; restored it from the cache", i+1, len(entry.Blocks), entry.Name, b.Location.Reference, b.Location.Endpoint)
+	}
+	return ok
+}
+
+// restoreBlock puts the block at loc, as held by the cache server, back in
+// its store.
+func (s *State) restoreBlock(loc upspin.Location) error {
+	data, err := cachedBlock(s.Config, loc)
+	if err != nil {
+		return err
+	}
+	store, err := dialDurable(s.Config, loc.Endpoint)
+	if err != nil {
+		return err
+	}
+	refdata, err := store.Put(data)
+	if err != nil {
+		return err
+	}
+	if refdata.Reference != loc.Reference {
+		return errors.E(errors.Invalid, errors.Errorf("store returned reference %q for the cached block", refdata.Reference))
+	}
+	return nil
+}
+
+// cachedBlock returns the block at loc as held by the user's cache server.
+// It is a variable so tests can replace it.
+var cachedBlock = func(cfg upspin.Config, loc upspin.Location) ([]byte, error) {
+	if cfg.CacheEndpoint().Transport == upspin.Unassigned {
+		return nil, errors.E(errors.NotExist, errors.Str("no cache server"))
+	}
+	store, err := bind.StoreServer(cfg, loc.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	data, _, _, err := store.Get(loc.Reference)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errors.E(errors.NotExist, errors.Errorf("cache does not hold %q", loc.Reference))
+	}
+	return data, nil
+}
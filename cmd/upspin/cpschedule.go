@@ -0,0 +1,238 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"upspin.io/errors"
+)
+
+// unlimitedRate is the rate of a window, or of the time outside them,
+// in which cp -schedule copies as fast as it can.
+const unlimitedRate = -1
+
+// A ratePlan is the bandwidth plan given to -schedule: the rate, in bytes
+// per second, at which to copy during each daily window, and outside
+// them. A rate of zero pauses the copy; unlimitedRate does not limit it.
+type ratePlan struct {
+	windows []rateWindow
+	rate    int64 // Outside the windows.
+}
+
+// A rateWindow is a daily window of a ratePlan, from start up to end,
+// each measured from midnight. A window whose end is not after its start
+// runs past midnight.
+type rateWindow struct {
+	start, end time.Duration
+	rate       int64
+}
+
+// parseRatePlan parses a plan given to -schedule. It is a list, separated
+// by commas, of windows such as 22:00-06:00=unlimited, and at most one
+// rate alone, for the time outside the windows, which is unlimited if
+// not given. A rate is a size in bytes per second, such as 1M, or 0 to
+// pause, or unlimited. A plan that starts with @ names a local file that
+// holds it; there, entries may also be separated by white space, and a
+// # begins a comment that runs to the end of its line.
+func parseRatePlan(str string) (*ratePlan, error) {
+	if strings.HasPrefix(str, "@") {
+		data, err := ioutil.ReadFile(str[1:])
+		if err != nil {
+			return nil, err
+		}
+		var lines []string
+		for _, line := range strings.Split(string(data), "\n") {
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			lines = append(lines, line)
+		}
+		str = strings.Join(lines, ",")
+	}
+	plan := &ratePlan{rate: unlimitedRate}
+	haveRate := false
+	for _, entry := range strings.FieldsFunc(str, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		eq := strings.Index(entry, "=")
+		if eq < 0 {
+			if haveRate {
+				return nil, errors.Errorf("%q: more than one rate outside the windows", entry)
+			}
+			rate, err := parseRate(entry)
+			if err != nil {
+				return nil, err
+			}
+			plan.rate = rate
+			haveRate = true
+			continue
+		}
+		times := strings.Split(entry[:eq], "-")
+		if len(times) != 2 {
+			return nil, errors.Errorf("%q is not a window such as 22:00-06:00=1M", entry)
+		}
+		var w rateWindow
+		var err error
+		if w.start, err = parseClock(times[0]); err != nil {
+			return nil, err
+		}
+		if w.end, err = parseClock(times[1]); err != nil {
+			return nil, err
+		}
+		if w.rate, err = parseRate(entry[eq+1:]); err != nil {
+			return nil, err
+		}
+		plan.windows = append(plan.windows, w)
+	}
+	if len(plan.windows) == 0 && !haveRate {
+		return nil, errors.Str("empty plan")
+	}
+	return plan, nil
+}
+
+// parseClock parses a time of day, such as 06:00, as the time since
+// midnight.
+func parseClock(str string) (time.Duration, error) {
+	t, err := time.Parse("15:04", str)
+	if err != nil {
+		return 0, errors.Errorf("%q is not a time of day such as 06:00", str)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseRate parses a rate in a plan.
+func parseRate(str string) (int64, error) {
+	switch str {
+	case "unlimited":
+		return unlimitedRate, nil
+	case "0":
+		return 0, nil
+	}
+	n, err := parseSize(str)
+	if err != nil {
+		return 0, errors.Errorf("%q is not a rate in bytes per second, such as 1M, 0, or unlimited", str)
+	}
+	return n, nil
+}
+
+// rateAt returns the rate in effect at t, from the first window that
+// holds it, and the next time, after t, at which a window starts or ends
+// and so the rate may change.
+func (p *ratePlan) rateAt(t time.Time) (rate int64, next time.Time) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+	rate = p.rate
+	found := false
+	until := 24 * time.Hour
+	for _, w := range p.windows {
+		in := w.start <= now && now < w.end
+		if w.end <= w.start {
+			in = now >= w.start || now < w.end
+		}
+		if in && !found {
+			rate = w.rate
+			found = true
+		}
+		for _, b := range []time.Duration{w.start, w.end} {
+			d := (b - now + 24*time.Hour) % (24 * time.Hour)
+			if d > 0 && d < until {
+				until = d
+			}
+		}
+	}
+	return rate, t.Add(until)
+}
+
+// scheduleNow and scheduleSleep tell the time and wait for -schedule.
+// They are variables so tests can replace them. Sleep returns early, with
+// the context's error, if the context is canceled.
+var (
+	scheduleNow   = time.Now
+	scheduleSleep = func(ctx context.Context, d time.Duration) error {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+)
+
+// A throttle paces the data copied by cp -schedule to the rate its plan
+// sets for the time of day. It is shared by every file copied, so that
+// the plan bounds the command as a whole.
+type throttle struct {
+	ctx  context.Context
+	plan *ratePlan
+
+	// The rate in effect, since when, and the bytes copied since then.
+	rate  int64
+	since time.Time
+	sent  int64
+}
+
+// throttled returns r, wrapped to be read no faster than -schedule
+// allows. Without -schedule it returns r.
+func (cs *copyState) throttled(r io.Reader) io.Reader {
+	if cs.schedule == nil {
+		return r
+	}
+	return &throttledReader{r: r, t: cs.schedule}
+}
+
+// throttledReader reads from r at the pace set by t.
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	t := tr.t
+	ctx := t.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for {
+		now := scheduleNow()
+		rate, next := t.plan.rateAt(now)
+		if rate != t.rate || t.since.IsZero() {
+			// Start afresh at the new rate.
+			t.rate, t.since, t.sent = rate, now, 0
+		}
+		if rate == unlimitedRate {
+			return tr.r.Read(p)
+		}
+		// Wait until the bytes already sent are due at this rate,
+		// or, when paused, for the rate to change.
+		due := next
+		if rate > 0 {
+			due = t.since.Add(time.Duration(float64(t.sent) / float64(rate) * float64(time.Second)))
+			if due.After(next) {
+				due = next
+			}
+		}
+		if due.After(now) {
+			if err := scheduleSleep(ctx, due.Sub(now)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		// Read no more than a tenth of a second's worth at once,
+		// so that the pace is even.
+		if max := rate / 10; max > 0 && int64(len(p)) > max {
+			p = p[:max]
+		} else if max == 0 && len(p) > 1 {
+			p = p[:1]
+		}
+		n, err := tr.r.Read(p)
+		t.sent += int64(n)
+		return n, err
+	}
+}
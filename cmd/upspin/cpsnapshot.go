@@ -0,0 +1,112 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+
+	"upspin.io/path"
+	"upspin.io/upspin"
+	"upspin.io/user"
+)
+
+// A snapshot of a user's tree is kept by the user's snapshot user,
+// named by adding the suffix +snapshot, in a directory named by the UTC
+// time it was taken, such as ann+snapshot@example.com/2017/02/12/15:45/.
+// See dir/server/snapshot.go.
+const (
+	snapshotSuffix = "snapshot"
+	snapshotFormat = "2006/01/02/15:04"
+)
+
+// atFormats are the layouts accepted by the -at flag, in local time
+// unless they give a zone.
+var atFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	snapshotFormat,
+}
+
+// parseAt parses the time given to the -at flag.
+func (c *copyState) parseAt(str string) time.Time {
+	for _, layout := range atFormats {
+		if t, err := time.ParseInLocation(layout, str, time.Local); err == nil {
+			return t
+		}
+	}
+	c.state.Exitf("invalid -at time %q: must be like 2006-01-02 15:04", str)
+	return time.Time{}
+}
+
+// snapshotPattern returns the pattern that names, in the latest snapshot
+// of its user's tree taken at or before c.at, what the Upspin pattern
+// names now. The snapshot of each user is found once per cp command.
+func (c *copyState) snapshotPattern(pattern string) string {
+	if isLocal(pattern) {
+		c.state.Exitf("-at applies only to Upspin sources; %s is local", pattern)
+	}
+	parsed, err := path.Parse(c.state.AtSign(pattern))
+	if err != nil {
+		c.state.Exit(err)
+	}
+	u := parsed.User()
+	root, ok := c.snapshots[u]
+	if !ok {
+		root = c.findSnapshot(u)
+		if c.snapshots == nil {
+			c.snapshots = make(map[upspin.UserName]upspin.PathName)
+		}
+		c.snapshots[u] = root
+	}
+	name := path.Join(root, parsed.FilePath())
+	c.logf("%s as of %s is %s", parsed, c.at.Format(time.RFC3339), name)
+	return string(name)
+}
+
+// findSnapshot returns the root of the latest snapshot of the user's tree
+// taken at or before c.at.
+func (c *copyState) findSnapshot(u upspin.UserName) upspin.PathName {
+	name, suffix, domain, err := user.Parse(u)
+	if err != nil {
+		c.state.Exit(err)
+	}
+	if suffix != "" {
+		c.state.Exitf("-at: %s has no snapshots; only users without a suffix do", u)
+	}
+	snapUser := upspin.PathName(name + "+" + snapshotSuffix + "@" + domain)
+	entries, err := c.state.Client.Glob(string(snapUser) + "/*/*/*/*")
+	if err != nil {
+		c.state.Exitf("-at: cannot find snapshots of %s: %v", u, err)
+	}
+	var best upspin.PathName
+	var bestTime time.Time
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		p, err := path.Parse(e.Name)
+		if err != nil {
+			continue
+		}
+		t, err := time.Parse(snapshotFormat, p.FilePath())
+		if err != nil {
+			// Not a snapshot.
+			continue
+		}
+		if t.After(c.at) || t.Before(bestTime) {
+			continue
+		}
+		best, bestTime = e.Name, t
+	}
+	if best == "" {
+		if len(entries) == 0 {
+			c.state.Exitf("-at: %s has no snapshots", u)
+		}
+		c.state.Exitf("-at: no snapshot of %s was taken at or before %s", u, c.at.Format(time.RFC3339))
+	}
+	return best
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"upspin.io/upspin"
+)
+
+// extent is a range of bytes in a file.
+type extent struct {
+	off, size int64
+}
+
+// sparseCopyIn copies the local file src to the Upspin file dst, reading
+// only the data of src, not its holes. The holes are stored in Upspin as
+// the zeros they read as, like those of any file, which pack and store to
+// little. If the system cannot find holes, the copy is made as usual. It
+// reports whether the copy succeeded.
+func (s *State) sparseCopyIn(cs *copyState, reader io.ReadCloser, src, dst cpFile) bool {
+	f, isFile := reader.(*limitedFile)
+	if !isFile {
+		cs.warnf("cannot find the holes in %s; reading all its data", src.path)
+		writer, err := s.create(cs, dst)
+		if err != nil {
+			s.Fail(err)
+			reader.Close()
+			return false
+		}
+		return cs.doCopy(reader, writer, src, dst)
+	}
+	defer reader.Close()
+	info, err := f.Stat()
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	size := info.Size()
+	holes, err := localHoles(f.File, size)
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	data := make([]byte, size)
+	for _, e := range dataExtents(holes, size) {
+		r := cs.counted(cs.throttled(io.NewSectionReader(f, e.off, e.size)))
+		if _, err := io.ReadFull(r, data[e.off:e.off+e.size]); err != nil {
+			s.Failf("reading %s: %v", src.path, err)
+			return false
+		}
+	}
+	cs.logf("put %s, skipping %d holes", dst.path, len(holes))
+	if _, err := s.Client.Put(upspin.PathName(dst.path), data); err != nil {
+		s.Fail(err)
+		return false
+	}
+	return true
+}
+
+// sparseCopyOut copies the Upspin file src to the local file dst, leaving
+// holes in dst where src holds runs of zeros rather than writing them.
+// It reports whether the copy succeeded.
+func (s *State) sparseCopyOut(cs *copyState, reader io.ReadCloser, src, dst cpFile) bool {
+	defer reader.Close()
+	writer, err := s.create(cs, dst)
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	out := writer.(*limitedFile)
+	w := &sparseWriter{w: out}
+	if _, err := io.Copy(w, cs.counted(cs.throttled(reader))); err != nil {
+		s.Failf("copying %s to %s: %v", src.path, dst.path, err)
+		out.Close()
+		cs.logf("remove incomplete %s", dst.path)
+		if err := os.Remove(dst.path); err != nil {
+			s.Fail(err)
+		}
+		return false
+	}
+	cs.logf("wrote %s, skipping %d zero bytes", dst.path, w.skipped)
+	// A trailing hole is made by extending the file.
+	err = out.Truncate(w.off)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.Fail(err)
+		return false
+	}
+	return true
+}
+
+// dataExtents returns the extents of a file of the given size that are
+// not in the holes, which must be in order.
+func dataExtents(holes []extent, size int64) []extent {
+	var data []extent
+	var off int64
+	for _, h := range holes {
+		if h.off > off {
+			data = append(data, extent{off: off, size: h.off - off})
+		}
+		off = h.off + h.size
+	}
+	if off < size {
+		data = append(data, extent{off: off, size: size - off})
+	}
+	return data
+}
+
+// sparseChunk is the size and alignment of the runs of zeros that
+// sparseWriter leaves as holes, a common size of a file system block.
+const sparseChunk = 4096
+
+// sparseWriter writes to w sequentially from off, skipping each aligned
+// sparseChunk of zeros so that the file system leaves a hole there. The
+// file must be extended to off when the writing is done, in case it ends
+// in zeros.
+type sparseWriter struct {
+	w       io.WriterAt
+	off     int64
+	skipped int64
+}
+
+func (sw *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := sparseChunk - int(sw.off%sparseChunk)
+		if n > len(p) {
+			n = len(p)
+		}
+		if isZero(p[:n]) {
+			sw.skipped += int64(n)
+		} else if _, err := sw.w.WriteAt(p[:n], sw.off); err != nil {
+			return written, err
+		}
+		sw.off += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// isZero reports whether b holds only zeros.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
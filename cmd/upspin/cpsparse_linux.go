@@ -0,0 +1,11 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Whence values for seeking to the next data or hole in a file.
+const (
+	seekData = 3
+	seekHole = 4
+)
@@ -0,0 +1,50 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// localHoles returns the holes in the first size bytes of the local file,
+// as found by seeking for them. A file system that does not keep track
+// of holes reports none.
+func localHoles(f *os.File, size int64) ([]extent, error) {
+	var holes []extent
+	for off := int64(0); off < size; {
+		hole, err := f.Seek(off, seekHole)
+		if isErrno(err, syscall.EINVAL) && off == 0 {
+			// Seeking for holes is not supported.
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hole >= size {
+			break
+		}
+		data, err := f.Seek(hole, seekData)
+		if isErrno(err, syscall.ENXIO) || err == nil && data > size {
+			// The file ends in a hole.
+			data = size
+		} else if err != nil {
+			return nil, err
+		}
+		holes = append(holes, extent{off: hole, size: data - hole})
+		off = data
+	}
+	return holes, nil
+}
+
+// isErrno reports whether err is the system error errno.
+func isErrno(err error, errno syscall.Errno) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == errno
+	}
+	return false
+}
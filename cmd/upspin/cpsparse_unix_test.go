@@ -0,0 +1,139 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"upspin.io/upspin"
+)
+
+func TestCopySparse(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// A file of data, a hole, more data, and a trailing hole.
+	const size = 4 << 20
+	want := make([]byte, size)
+	copy(want, "head")
+	copy(want[2<<20:], "middle")
+	src := filepath.Join(tmp, "sparse.img")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{0, 2 << 20} {
+		if _, err := f.WriteAt(want[off:off+8], off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	if allocated(t, src) >= size/2 {
+		t.Skip("file system does not make sparse files")
+	}
+
+	// Into Upspin, the holes are stored as zeros.
+	dst := upspin.PathName(cpTestUser + "/sparse.img")
+	if runCp(s, "-sparse", src, string(dst)) {
+		t.Fatal("cp -sparse exited")
+	}
+	if got, err := s.Client.Get(dst); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("Upspin copy differs from source")
+	}
+
+	// And out of Upspin, the holes are made again.
+	out := filepath.Join(tmp, "out.img")
+	if runCp(s, "-sparse", string(dst), out) {
+		t.Fatal("cp -sparse exited")
+	}
+	if got, err := ioutil.ReadFile(out); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("round trip differs from source")
+	}
+	if n := allocated(t, out); n >= size/2 {
+		t.Errorf("round trip allocates %d bytes, want less than %d", n, size/2)
+	}
+
+	// Without -sparse, the holes are read as zeros.
+	dense := filepath.Join(tmp, "dense.img")
+	if runCp(s, string(dst), dense) {
+		t.Fatal("cp exited")
+	}
+	if got, err := ioutil.ReadFile(dense); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("dense copy differs from source")
+	}
+}
+
+// allocated returns the bytes of storage allocated to the local file.
+func allocated(t *testing.T, name string) int64 {
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestSparseWriter(t *testing.T) {
+	// Zeros at the start, across a chunk boundary, and at the end.
+	data := make([]byte, 5*sparseChunk+100)
+	copy(data[sparseChunk+10:], "one")
+	copy(data[3*sparseChunk-2:], "two")
+	var out bytesWriterAt
+	w := &sparseWriter{w: &out}
+	for p := data; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if w.off != int64(len(data)) {
+		t.Fatalf("wrote to %d, want %d", w.off, len(data))
+	}
+	got := make([]byte, len(data))
+	copy(got, out)
+	if !bytes.Equal(got, data) {
+		t.Error("data differs")
+	}
+	// Chunks 0 and 4 and the tail are all zeros, as are parts of the
+	// others.
+	if least := int64(2*sparseChunk + 100); w.skipped < least {
+		t.Errorf("skipped %d bytes, want at least %d", w.skipped, least)
+	}
+}
+
+// bytesWriterAt is a growable buffer that implements io.WriterAt.
+type bytesWriterAt []byte
+
+func (b *bytesWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(*b) {
+		*b = append(*b, make([]byte, end-len(*b))...)
+	}
+	return copy((*b)[off:], p), nil
+}
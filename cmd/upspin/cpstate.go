@@ -0,0 +1,119 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// cpProgress records, in the state file given to cp -statefile, the
+// files a recursive copy has completed, so that the copy, run again with
+// the same state file, skips them. The file holds one JSON record per
+// line, appended as each file is copied; a line cut short when cp was
+// stopped is ignored. With -checkpoint, the file also records how far
+// copies still under way had safely reached.
+type cpProgress struct {
+	file        *os.File
+	done        map[cpRecord]bool
+	checkpoints map[cpRecord]int64 // The latest checkpoint of each copy.
+}
+
+// cpRecord is the record of a completed copy in the state file, or of a
+// checkpoint in one under way, Offset bytes into the destination.
+type cpRecord struct {
+	Src    string `json:"src"`
+	Dst    string `json:"dst"`
+	Offset int64  `json:"offset,omitempty"`
+}
+
+// openProgress reads the state file, creating it if need be, and opens
+// it to record more copies.
+func openProgress(name string) (*cpProgress, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Drop any partial last line so the next record starts afresh.
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if err := f.Truncate(int64(end)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(int64(end), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	p := &cpProgress{
+		file:        f,
+		done:        make(map[cpRecord]bool),
+		checkpoints: make(map[cpRecord]int64),
+	}
+	for _, line := range bytes.Split(data[:end], []byte("\n")) {
+		var r cpRecord
+		if json.Unmarshal(line, &r) != nil {
+			continue
+		}
+		if r.Offset > 0 {
+			p.checkpoints[cpRecord{Src: r.Src, Dst: r.Dst}] = r.Offset
+			continue
+		}
+		p.done[r] = true
+	}
+	return p, nil
+}
+
+// completed reports whether the copy of src to dst was recorded.
+func (p *cpProgress) completed(src, dst cpFile) bool {
+	return p.done[cpRecord{Src: src.path, Dst: dst.path}]
+}
+
+// record records the completed copy of src to dst.
+func (p *cpProgress) record(src, dst cpFile) error {
+	r := cpRecord{Src: src.path, Dst: dst.path}
+	if err := p.write(r); err != nil {
+		return err
+	}
+	p.done[r] = true
+	return nil
+}
+
+// checkpointed returns the offset of the latest checkpoint recorded in the
+// copy of src to dst, or zero if there is none.
+func (p *cpProgress) checkpointed(src, dst cpFile) int64 {
+	return p.checkpoints[cpRecord{Src: src.path, Dst: dst.path}]
+}
+
+// checkpoint records that the first offset bytes of the copy of src to dst
+// are safely on disk.
+func (p *cpProgress) checkpoint(src, dst cpFile, offset int64) error {
+	r := cpRecord{Src: src.path, Dst: dst.path}
+	if err := p.write(cpRecord{Src: r.Src, Dst: r.Dst, Offset: offset}); err != nil {
+		return err
+	}
+	p.checkpoints[r] = offset
+	return nil
+}
+
+// write appends the record to the state file.
+func (p *cpProgress) write(r cpRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = p.file.Write(append(data, '\n'))
+	return err
+}
+
+func (p *cpProgress) close() error {
+	return p.file.Close()
+}
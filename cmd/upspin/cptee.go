@@ -0,0 +1,178 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// teeCommand copies the source file to each of the destinations, reading
+// the source once, or once for each batch of destinations if not all can
+// be open at once. A destination that is a directory receives the file
+// under its own name. Upspin destinations of an Upspin source are copied
+// by reference where possible and need not read the source at all. A
+// failure to create or write one destination is reported and does not
+// affect the others; a failure to read the source fails them all.
+func (s *State) teeCommand(cs *copyState, src cpFile, dsts []cpFile) {
+	if s.isDir(src) {
+		s.Exitf("-tee requires that the source (%s) not be a directory", src.path)
+	}
+	var slow []cpFile
+	for _, dst := range dsts {
+		if s.isDir(dst) {
+			dst.path = string(path.Join(upspin.PathName(dst.path), filepath.Base(src.path)))
+		}
+		cs.checkCanceled()
+		if target, ok := s.linkTarget(cs, src, dst); ok {
+			s.copyLink(cs, target, dst)
+			continue
+		}
+		if src.isUpspin && dst.isUpspin {
+			cs.logf("try fast copy to %v", dst)
+			switch s.duplicate(cs, src, upspin.PathName(dst.path)) {
+			case nil:
+				if cs.confirmDurable {
+					s.confirmDurable(cs, dst)
+				}
+				continue
+			case errReported:
+				continue
+			}
+		}
+		s.warnWriter(cs, src, dst)
+		slow = append(slow, dst)
+	}
+	// Write as many destinations at once as the limit on open files
+	// allows, reading the source again for each batch.
+	for len(slow) > 0 {
+		n := cs.teeBatch(src, slow)
+		s.teeCopy(cs, src, slow[:n])
+		slow = slow[n:]
+	}
+}
+
+// teeBatch returns how many of the destinations can be written along with
+// the source without exceeding the limit on open local files.
+func (c *copyState) teeBatch(src cpFile, dsts []cpFile) int {
+	free := c.maxFiles()
+	if free == 0 {
+		return len(dsts)
+	}
+	if !src.isUpspin {
+		free--
+	}
+	for i, dst := range dsts {
+		if dst.isUpspin {
+			continue
+		}
+		if free == 0 {
+			return i
+		}
+		free--
+	}
+	return len(dsts)
+}
+
+// teeCopy does the work of teeCommand for destinations that must be
+// written with the contents of the source, reading it once.
+func (s *State) teeCopy(cs *copyState, src cpFile, dsts []cpFile) {
+	cs.checkCanceled()
+	reader, err := s.open(cs, src)
+	if err != nil {
+		s.Exit(err)
+	}
+	defer reader.Close()
+	tee := &teeWriter{}
+	for _, dst := range dsts {
+		writer, err := s.create(cs, dst)
+		if err != nil {
+			s.Fail(err)
+			continue
+		}
+		tee.outs = append(tee.outs, &teeOut{dst: dst, writer: writer})
+	}
+	if len(tee.outs) == 0 {
+		return
+	}
+	cs.logf("start tee %s to %d files", src.path, len(tee.outs))
+	r := &readErrorReader{Reader: cs.throttled(reader)}
+	n, err := io.Copy(tee, r)
+	if r.err != nil {
+		s.Failf("reading %s failed after %d bytes: %v", src.path, n, err)
+	}
+	for _, out := range tee.outs {
+		switch {
+		case r.err != nil:
+			// Already reported.
+		case out.err != nil:
+			s.Failf("writing %s failed after %d bytes: %v", out.dst.path, out.n, out.err)
+		default:
+			if err := out.writer.Close(); err != nil {
+				s.Fail(err)
+				continue
+			}
+			if cs.confirmDurable && out.dst.isUpspin {
+				s.confirmDurable(cs, out.dst)
+			}
+			continue
+		}
+		// As in doCopy, an Upspin file that is never closed leaves no
+		// partial copy; a local one must be removed.
+		if out.dst.isUpspin {
+			continue
+		}
+		out.writer.Close()
+		cs.logf("remove incomplete %s", out.dst.path)
+		if err := os.Remove(out.dst.path); err != nil {
+			s.Fail(err)
+		}
+	}
+	cs.logf("end tee %s", src.path)
+}
+
+// teeWriter writes to each of its outputs, giving up on one that fails
+// without affecting the others. It fails only once all of them have.
+type teeWriter struct {
+	outs []*teeOut
+}
+
+// teeOut is one destination of a teeWriter.
+type teeOut struct {
+	dst    cpFile
+	writer io.WriteCloser
+	n      int64 // Bytes written.
+	err    error // The first write error.
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	live := 0
+	var err error
+	for _, out := range t.outs {
+		if out.err != nil {
+			continue
+		}
+		n, werr := out.writer.Write(p)
+		out.n += int64(n)
+		if werr == nil && n < len(p) {
+			werr = io.ErrShortWrite
+		}
+		if werr != nil {
+			out.err = werr
+			err = werr
+			continue
+		}
+		live++
+	}
+	if live == 0 {
+		return 0, errors.E(errors.IO, errors.Errorf("all destinations failed: %v", err))
+	}
+	return len(p), nil
+}
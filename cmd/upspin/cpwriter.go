@@ -0,0 +1,71 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// errOtherWriter is returned by duplicate for a file written by another
+// user, whose data must be copied instead.
+var errOtherWriter = errors.Str("written by another user")
+
+// duplicate copies the Upspin file src to the Upspin file dst by reference,
+// with the same results as fastCopy, if src was written by the current
+// user. The copy of a directory entry is signed anew for its name, and
+// the Writer of an entry is the user whose signature it must carry, so
+// a file written by anyone else cannot be copied by reference: duplicate
+// returns errOtherWriter and the caller copies the data, which is then
+// written by the current user. With -repair, it copies nothing if a
+// block of src is missing; see checkBlocks.
+func (s *State) duplicate(cs *copyState, src cpFile, dst upspin.PathName) error {
+	name := upspin.PathName(src.path)
+	if cs.repair && !s.checkBlocks(cs, name) {
+		return errReported
+	}
+	entry, err := s.sourceEntry(src)
+	if err != nil {
+		return s.fastCopy(name, dst)
+	}
+	if !entry.IsDir() && entry.Writer != s.Config.UserName() {
+		cs.logf("%s is written by %s; copying its data", name, entry.Writer)
+		return errOtherWriter
+	}
+	return s.fastCopy(name, dst)
+}
+
+// sourceEntry returns the directory entry of the Upspin file src, following
+// links. It is the entry src was listed with, if any.
+func (s *State) sourceEntry(src cpFile) (*upspin.DirEntry, error) {
+	if src.entry != nil && !src.entry.IsLink() {
+		return src.entry, nil
+	}
+	return s.Client.Lookup(upspin.PathName(src.path), true)
+}
+
+// warnWriter warns, with -preserve-writer, that the copy of the Upspin file
+// src to the Upspin file dst about to be made from its data cannot keep
+// the Writer of src, if that is not the current user.
+func (s *State) warnWriter(cs *copyState, src, dst cpFile) {
+	if !cs.preserveWriter || !src.isUpspin || !dst.isUpspin {
+		return
+	}
+	entry, err := s.sourceEntry(src)
+	if err != nil || entry.IsDir() {
+		return
+	}
+	if me := s.Config.UserName(); entry.Writer != me {
+		cs.warnf("cannot preserve writer %s of %s: only %s can sign for it; %s is written by %s", entry.Writer, src.path, entry.Writer, dst.path, me)
+	}
+}
+
+// warnf reports a problem that does not make cp fail.
+func (c *copyState) warnf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "upspin: %s: warning: %s\n", c.state.Name, fmt.Sprintf(format, args...))
+}
@@ -124,11 +124,383 @@ When copying from one Upspin path to another Upspin path, cp can be
 very efficient, copying only the references to the data rather than
 the data itself.
 
+A local path within an upspinfs mount is treated as the Upspin path it
+represents, so copies to or from it use the Upspin client directly,
+including the efficient copy by reference, rather than the mount.
+
+When both source and destination are in Upspin, a source that is an
+Upspin link is recreated as a link to the same target rather than
+followed. The -L flag instead copies the contents of the link's target.
+
+The -relativize-links flag, which requires -R, makes a copied tree
+self-contained, so that it can be moved or restored under another root.
+Links within the source directories, whether local symbolic links or
+Upspin links, are recreated rather than followed, and a link to a file
+within the same tree is made to point to that file's copy: relative to
+the link when copying to local files, or by full name in Upspin, whose
+links cannot be relative. A link to a file outside the tree keeps its
+target, with a warning, except that a local link cannot become an Upspin
+link, so it is followed instead. Links named as arguments are followed
+as usual. The flag is incompatible with -L, -cat, and -archive.
+
+A copy within Upspin is recorded as written by the user making it,
+since the Writer of an Upspin file is the user who signed its directory
+entry, and only that user can sign. A file the user wrote is copied by
+reference to its data and keeps its writer; a file written by another
+user is copied by reading its data. The -preserve-writer flag, which
+applies only to copies from Upspin to Upspin, keeps the writer where it
+can and warns about each copy that cannot, naming the original writer,
+so the change in attribution is never silent. The flag is incompatible
+with -cat, -mv, and -archive.
+
+The -at flag copies Upspin sources as they were at the given time,
+such as 2017-02-12 or 2017-02-12 15:04 in local time, or in RFC 3339
+format. Each source is found in the latest snapshot of its user's tree
+taken at or before then; the snapshots are in the tree of the user's
+snapshot user, such as ann+snapshot@example.com. The dir server must
+support snapshots, and the sources must not be local. The -at flag
+does not affect the destination and is incompatible with -mv.
+
+The -cat flag concatenates the contents of all the source files, in
+order, into the final argument, which must not be a directory.
+
+The -tee flag copies a single source file, the first argument, to each
+of the remaining arguments, reading the source only once, which saves
+time when it is remote or expensive to read. Destinations may be any
+mix of local and Upspin files or directories; a directory receives the
+file under the source's name. Upspin destinations of an Upspin source
+are copied by reference where possible. A destination that cannot be
+created or written is reported without affecting the others. The -tee
+flag is incompatible with -R, -cat, -mv, -archive, -keep-packdata, and
+-dedup.
+
+If a file cannot be copied completely, cp reports whether reading the
+source or writing the destination failed, and removes the incomplete
+destination. A failed copy to Upspin leaves any existing file unchanged.
+Before copying into a directory, cp checks that files can be created
+there, and if not, stops before copying anything. Similarly, a recursive
+copy of a directory into itself or one of its subdirectories, even one
+reached through a link, is refused.
+
+An interrupt stops cp before it lists a directory, opens a file, or
+begins another copy. A second interrupt stops it at once.
+
+If a directory cannot be listed completely during a recursive copy,
+cp stops. With the -k flag, it instead reports the error and copies
+whatever entries were listed; the exit status still reflects the failure.
+A recursive copy that fails anywhere ends by summarizing its errors,
+grouped by kind, such as permission denied, with the path and operation
+of each.
+
+The -mv flag removes each source once it has been copied successfully,
+making cp a move. A source that fails to copy is left in place. When
+source and destination belong to the same Upspin user, files are renamed
+rather than copied. With -R, a source directory is removed once all its
+contents have been moved.
+
+The -delete flag, which requires -R, makes cp a one-way sync: after
+each source directory has been listed and copied completely, anything
+in its copy at the destination that is absent from the source is
+removed, including whole directory trees. As a safeguard, -delete alone
+only lists what would be removed; add -confirm to remove it. Links at
+the destination are removed, not followed. Directories whose listing
+or copy failed are left alone.
+
+The -perms-preview flag, which requires -R and an Upspin destination,
+shows who could read each Upspin source directory and its copy, so that
+a copy does not share data more widely than intended. For each source
+directory and subdirectory, cp prints the users that its Access file
+grants the read right, expanding groups, and compares them with those
+the copy would have. The copy is governed by any Access file copied
+with it, interpreted at its new name, else by an Access file already in
+the destination directory, else by the Access file governing the
+destination. A copy readable by users who cannot read the source is
+marked WIDENED; one unreadable by some who can is marked NARROWED.
+As a safeguard, -perms-preview alone copies nothing; add -confirm to
+copy after the preview. Local sources are not previewed.
+
+The -expand-groups flag, which requires -perms-preview, also shows who
+each Access or Group file copied would grant access to at its new name.
+For each copied Access file, cp prints the users granted each right,
+with every group named, directly or through other groups, replaced by
+its members, and then the members of each of those groups. For each
+file copied into a Group directory, it prints the users the group would
+hold, likewise expanded. Groups are read from where the copy would name
+them; a group that includes itself is expanded once.
+
+The -publish flag, which requires -R and an Upspin destination, makes
+the copy appear all at once, so readers never see a partial tree. Cp
+copies the sources into a new staging directory, named .staging- and
+the time, within the destination. Only if everything is copied does cp
+make each source's name in the destination a link to its staged copy,
+replacing any link from an earlier publish, whose staged copy is then
+removed. Readers see the old tree until the link is replaced, though
+the name is missing for a moment while the old link is deleted. If the
+new link cannot be made, the old one is restored and cp reports where
+the staged copy remains. If the copy fails, the staging directory is
+removed and nothing is published. A source cannot be published over an
+existing directory.
+
+The -statefile flag, which requires -R, makes a long recursive copy
+resumable. As each file is copied, cp appends a record of its source
+and destination to the named local file. When cp is run again with the
+same state file, it skips the files recorded there, so a copy that was
+interrupted picks up where it left off. Directories are always listed
+again, and files changed at the source since they were recorded are not
+copied again. Remove the state file to start afresh.
+
+The -checkpoint flag makes cp sync each local destination file to disk
+every time another interval of the given size, such as 256M, has been
+written to it, so that a crash loses at most the last interval of a long
+copy. With -statefile, each checkpoint is also recorded in the state
+file, and a later run resumes a copy cut short from its last checkpoint
+rather than from the start. Upspin destinations are not supported, as
+an Upspin file reaches its store only once it is complete. The flag is
+incompatible with -cat, -tee, and -archive.
+
+Local file names that are not valid in Upspin, because they are not
+UTF-8, hold control characters, or are longer than 255 bytes, are
+found before anything in their directory is copied to Upspin, and those
+files are reported and skipped. The -sanitize flag instead copies each
+under a valid name: invalid bytes, control characters, and percent signs
+become %XX escapes, an over-long name is truncated, keeping its
+extension, and ~N is added if need be to keep it distinct. Each such
+copy is reported. The flag is incompatible with -cat, -tee, and
+-archive.
+
+The -compare flag, which requires -R, makes cp copy nothing and instead
+report how the destination directory differs from what the copy would
+make it. For each path the copy would write, cp prints only-in-source if
+the destination lacks it, otherwise differs, with the reason, or
+identical; and for each file in a destination directory that the source
+lacks, it prints only-in-dest. Files of the same size are compared by
+their contents, except that Upspin files holding the same blocks are
+identical without being read; links are compared by their targets.
+Paths are relative to the destination directory. The -json flag prints
+each line instead as a JSON object with fields status, path, src, dst,
+and reason. The -compare flag is incompatible with -cat, -mv, -delete,
+-publish, -dirs-only, -perms-preview, -statefile, -checkpoint, and
+-archive.
+
+The -use-ignore flag, which requires -R, makes cp skip files named in
+.upspinignore files found in the source directories, local or Upspin,
+much as git skips those named in .gitignore files. Each line of an
+ignore file is a pattern, as in a .gitignore file, and applies to the
+files below its directory, at any depth. A pattern with a slash other
+than at its end is anchored to that directory; one ending in a slash
+matches only directories; a leading ! includes again what an earlier
+pattern excluded; and ** matches any number of directories. Blank lines
+and lines starting with # are ignored. The last pattern to match a file
+decides, with those in deeper ignore files coming later. A directory
+that is skipped is not listed, so nothing in it can be included again.
+The flag is incompatible with -mv, -cat, and -archive.
+
+The -dirs-only flag, which requires -R, recreates the directory tree of
+each source in the destination without copying any files or links.
+
+The -p flag gives local directories created by a recursive copy the
+modification times of their sources. Upspin directories always record
+the time they were created.
+
+The -keep-packdata flag, when copying an Upspin file to a local file,
+saves the Upspin directory entry, including the encryption packdata with
+the keys wrapped for each reader, in a sidecar file named by adding
+the suffix .upspin-packdata. When the local file is later copied back to
+the same Upspin path with -keep-packdata, the entry is restored from the
+sidecar, reusing the original stored blocks, so the file keeps its readers
+even if the user restoring it could not decrypt it. The local file must
+not have changed. Sidecar files are not themselves copied to Upspin.
+
+The -archive flag writes the Upspin sources into a single local archive
+file, named by the final argument, in the given format, tar or zip.
+Each source is stored under its final path element, with relative paths
+below it. Directories require -R. Upspin links become symbolic links.
+
+The -repair flag, which applies only to copies from Upspin to Upspin,
+makes cp check, before copying each file by reference, that every block
+of the source can be fetched from its store. Otherwise a source whose
+store has lost a block would be copied without complaint, leaving two
+broken files rather than one. A missing block that the user's cache
+server still holds is put back in the store, with a warning; a file
+with a block that cannot be restored is reported and not copied. Like
+-confirm-durable, the check asks the stores directly and reads each
+block back. The flag is incompatible with -cat.
+
+The -confirm-durable flag makes cp check, after writing each file to
+Upspin, that every block of the file can be fetched from its store,
+reporting any that cannot. This catches stores that acknowledge writes
+they did not keep. Since a store can only be asked for a block by
+fetching it, the check reads each block back, though it does not
+decrypt it. The stores are asked directly, not through a cache server,
+so blocks a writeback cache has yet to send are reported as missing.
+
+The -manifest-verify flag, which requires that the final argument be an
+Upspin directory, makes cp vouch for each copy it makes there. Once
+everything is copied, cp lists every file and link in the copy of each
+source, with its size and the references and stores of its blocks, and
+fetches each block from its store, as -confirm-durable does. If all are
+there, it stores the list, signed by the user, in a file named by adding
+the suffix .upspin-manifest to the copy's name; the signature is of the
+SHA-256 hash of the list as encoded in the file. A missing block is
+reported, and no manifest is written for its copy, nor for any if the
+copy failed. The flag is incompatible with -cat, -publish, -dirs-only,
+-compare, and -archive.
+
+The -dedup flag, when copying local files to Upspin, hashes each source
+and, if its contents are identical to a file already copied by the same
+command, makes the destination a duplicate of that copy, sharing its
+stored blocks, rather than storing the data again. Each such source is
+read twice, once to hash it and once to copy it. Sources in Upspin
+already share their blocks with their copies.
+
+The -z flag compresses the data of each file copied with gzip, and the
+-unz flag decompresses the data of each source, which must be gzip
+compressed, as it is copied; so a tree can be kept compressed on local
+disk and unpacked on its way back into Upspin. The -gzip-by-name flag
+instead compresses a file copied to a name ending in .gz from one that
+does not and decompresses a file copied the other way. Names are not
+changed. A compressed or decompressed copy is never made by reference,
+nor by renaming with -mv. The three flags are mutually exclusive and
+incompatible with -cat, -tee, -checkpoint, -keep-packdata, -dedup,
+-compare, and -archive.
+
+The -sparse flag makes copies of sparse files cheaper. A local file
+copied to Upspin has only its data read, not its holes, the ranges the
+local file system stores no data for; a hole-finding system, such as
+Linux or macOS, is needed to find them. In Upspin the holes are stored
+as the zeros they read as, which pack and store to little. An Upspin
+file copied to a local file leaves holes in the copy where it holds
+runs of zeros, rather than writing them. The flag is incompatible with
+-cat, -tee, -checkpoint, -keep-packdata, -dedup, -z, -unz,
+-gzip-by-name, and -archive.
+
+The -schedule flag paces the copy by a bandwidth plan, so that a long
+copy respects the network's policy without being restarted. The plan is
+a list, separated by commas, of daily windows, each with the rate at
+which to copy while it lasts, and at most one rate alone, for the time
+outside the windows, which is unlimited if not given. A rate is in bytes
+per second, such as 1M; 0 pauses the copy and unlimited lifts the limit.
+For example,
+
+	upspin cp -R -schedule 22:00-06:00=unlimited,512K src dst
+
+copies at full speed overnight and at 512K per second by day. Times are
+local. A plan that begins with @ names a local file holding it, with its
+entries separated by commas or white space and # beginning a comment.
+The rate applies to the command as a whole, one file after another.
+
+The -progress-json flag prints, as each file is copied, events for
+front ends to follow the copy by. Each is a line of JSON, with an
+"event" field of "start", as the file's data begins to be read;
+"progress", about once a second as it is read; and "done" when the file
+is finished, whose "status" is "ok", "failed", or "by reference" for an
+Upspin copy or move that copied only the references to the data. That
+is the only event for such a file. They also give the "path" of the
+source and the "dst" of its copy, the "bytes_done" so far, the
+"bytes_total" of the source, -1 if unknown, and the "rate" in bytes per
+second. A last "summary" event gives the total "bytes_done", "rate",
+and "status", and counts the "files" copied and the "failed". The
+events go to standard error, or to the file descriptor given by
+-progress-fd. The flag is incompatible with -cat, -tee, -archive, and
+-compare.
+
+The -apparent-size flag prints the number of files to be copied and
+their total size in bytes, as recorded in Upspin directory entries and
+local file metadata, before copying begins. A link that the copy
+recreates counts as a file of no bytes; one that it follows counts as
+what it links to.
+
+Cp bounds the number of local files it has open at once, so that a
+copy with many destinations cannot exhaust the process's file
+descriptors. By default the bound leaves a few dozen of the descriptors
+the process may open for the client's connections and other uses. The
+-maxfiles flag sets the bound, which must be at least 2. A -tee copy
+with more local destinations than the bound allows reads the source
+again for each batch.
+
+The -mode and -dirmode flags set, in octal, the permissions of local
+files and directories created by cp, regardless of the umask. By default
+files are created with mode 0666 and directories with mode 0755, both
+modified by the umask. Permissions of existing directories are unchanged.
+The flags do not affect Upspin destinations.
+
 Flags:
+  -L	follow Upspin links, copying the contents of their targets
   -R	recursively copy directories
+  -apparent-size
+    	report the total size of the source files before copying
+  -archive format
+    	write the sources to a local archive in the given format (tar or zip)
+  -at time
+    	copy Upspin sources as they were in the latest snapshot at or before time
+  -cat
+    	concatenate the source files into the destination file
+  -checkpoint size
+    	sync local destination files to disk after each size bytes, such as 256M
+  -compare
+    	with -R, report how the destination differs from the sources rather than copy
+  -confirm
+    	with -delete, remove what it lists; with -perms-preview, copy after the preview
+  -confirm-durable
+    	check that the blocks of each file copied to Upspin can be fetched from their stores
+  -dedup
+    	store the data of identical local files copied to Upspin only once
+  -delete
+    	with -R, list what at the destination is absent from the source (see -confirm)
+  -dirmode mode
+    	set the permissions of created local directories to the octal mode
+  -dirs-only
+    	with -R, create the directories of the source tree but copy no files
+  -expand-groups
+    	with -perms-preview, show the users granted by each Access and Group file copied
+  -gzip-by-name
+    	compress files copied to names ending in .gz, and decompress those copied from them
   -help
     	print more information about the command
+  -json
+    	with -compare, print the report as JSON
+  -k	keep going, copying what was listed, if a directory cannot be listed completely
+  -keep-packdata
+    	save or restore the Upspin packdata of files copied to or from local files
+  -manifest-verify
+    	verify that the blocks of each copy can be fetched from their stores and store a signed manifest of it
+  -maxfiles n
+    	keep at most n local files open at once (default from the file descriptor limit)
+  -mode mode
+    	set the permissions of created local files to the octal mode
+  -mv
+    	remove each source after it is copied
+  -p	preserve the modification times of created local directories
+  -perms-preview
+    	with -R, show who could read each Upspin directory copied (see -confirm)
+  -preserve-writer
+    	warn when a copy within Upspin cannot keep the Writer of its source
+  -progress-fd fd
+    	with -progress-json, print the events to the file descriptor fd (default 2)
+  -progress-json
+    	print the progress of the copy as a stream of JSON events
+  -publish
+    	with -R, stage the copy and publish it all at once with links
+  -relativize-links
+    	with -R, recreate links within the tree to point to the copies of their targets
+  -repair
+    	check that the blocks of each Upspin file copied by reference can be fetched, restoring them from the cache if possible
+  -sanitize
+    	copy local files whose names are not valid in Upspin under valid names rather than skip them
+  -schedule plan
+    	pace the copy by the bandwidth plan, such as 22:00-06:00=unlimited,512K
+  -sparse
+    	keep the holes of sparse files copied into and out of Upspin
+  -statefile file
+    	with -R, record copied files in the local file and skip those recorded by earlier runs
+  -tee
+    	copy the first file to each of the other files, reading it once
+  -unz
+    	decompress the gzip-compressed sources as they are copied
+  -use-ignore
+    	with -R, skip files named in .upspinignore files in the source directories
   -v	log each file as it is copied
+  -z	compress the data copied with gzip
 
 
 
@@ -7,9 +7,11 @@
 package main
 
 import (
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 // findUpspinBinaries finds all the upspin-* binaries in $PATH.
@@ -46,3 +48,16 @@ func findUpspinBinaries() []string {
 	}
 	return cmds
 }
+
+// openFileLimit returns the number of files the process may have open,
+// or zero if it cannot be determined.
+func openFileLimit() int {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0
+	}
+	if lim.Cur > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(lim.Cur)
+}
@@ -7,12 +7,22 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
 )
 
 func TestFindUpspinBinaries(t *testing.T) {
@@ -69,3 +79,515 @@ func TestFindUpspinBinaries(t *testing.T) {
 		t.Fatalf("expected %q, got %q", wanted, got)
 	}
 }
+
+func TestCopyMode(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const dir = cpTestUser + "/mode"
+	mkUpspinDir(t, s, dir)
+	mkUpspinDir(t, s, dir+"/sub")
+	putUpspin(t, s, dir+"/a", "a")
+	putUpspin(t, s, dir+"/sub/b", "b")
+
+	// The requested modes apply regardless of the umask.
+	defer syscall.Umask(syscall.Umask(0077))
+	if runCp(s, "-R", "-mode=0640", "-dirmode=0750", dir, tmp) {
+		t.Fatal("cp exited")
+	}
+	for _, f := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"mode", os.ModeDir | 0750},
+		{"mode/sub", os.ModeDir | 0750},
+		{"mode/a", 0640},
+		{"mode/sub/b", 0640},
+	} {
+		info, err := os.Stat(filepath.Join(tmp, f.name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if info.Mode() != f.mode {
+			t.Errorf("%s: mode %v, want %v", f.name, info.Mode(), f.mode)
+		}
+	}
+
+	// An existing file takes the requested mode too.
+	local := filepath.Join(tmp, "mode", "a")
+	if runCp(s, "-mode=0600", dir+"/a", local) {
+		t.Fatal("cp exited")
+	}
+	if info, err := os.Stat(local); err != nil || info.Mode() != 0600 {
+		t.Errorf("overwritten %s: %v, %v; want mode 0600", local, info, err)
+	}
+
+	if !runCp(s, "-mode=0999", dir+"/a", local) {
+		t.Error("cp accepted an invalid mode")
+	}
+}
+
+func TestCopyUpspinfsMount(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	// Pretend tmp is an upspinfs mount.
+	mnt, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mnt)
+	defer func(f func() []string) { upspinfsMounts = f }(upspinfsMounts)
+	upspinfsMounts = func() []string { return []string{mnt} }
+
+	const dir = cpTestUser + "/mount"
+	mkUpspinDir(t, s, dir)
+	putUpspin(t, s, dir+"/src", "some data")
+
+	// Upspin to mount copies by reference.
+	dst := filepath.Join(mnt, cpTestUser, "mount", "dst")
+	if runCp(s, dir+"/src", dst) {
+		t.Fatal("cp exited")
+	}
+	src, err := s.Client.Lookup(dir+"/src", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := s.Client.Lookup(dir+"/dst", false)
+	if err != nil {
+		t.Fatalf("not copied to Upspin: %v", err)
+	}
+	if len(entry.Blocks) != len(src.Blocks) || entry.Blocks[0].Location != src.Blocks[0].Location {
+		t.Errorf("copy has blocks %v, want %v", entry.Blocks, src.Blocks)
+	}
+	if _, err := os.Stat(filepath.Join(mnt, cpTestUser)); !os.IsNotExist(err) {
+		t.Errorf("copy written below the mount point: %v", err)
+	}
+
+	// Mount to local reads from Upspin.
+	local := filepath.Join(filepath.Dir(mnt), filepath.Base(mnt)+"-local")
+	defer os.Remove(local)
+	if runCp(s, dst, local) {
+		t.Fatal("cp exited")
+	}
+	if data, err := ioutil.ReadFile(local); err != nil || string(data) != "some data" {
+		t.Errorf("local copy: %q, %v", data, err)
+	}
+
+	// The root of the mount and names outside a user tree are not Upspin paths.
+	cs := &copyState{state: s}
+	for _, file := range []string{mnt, filepath.Join(mnt, "nouser"), filepath.Join(mnt+"x", cpTestUser)} {
+		if name, ok := cs.upspinfsPath(file); ok {
+			t.Errorf("upspinfsPath(%q) = %q", file, name)
+		}
+	}
+}
+
+func TestCopyIntoItselfSymlink(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	top := filepath.Join(tmp, "top")
+	if err := os.MkdirAll(filepath.Join(top, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// The destination reaches the source through a symbolic link.
+	alias := filepath.Join(tmp, "alias")
+	if err := os.Symlink(top, alias); err != nil {
+		t.Fatal(err)
+	}
+	var exited bool
+	msg := captureStderr(t, func() { exited = runCp(s, "-R", top, filepath.Join(alias, "sub")) })
+	if !exited || !strings.Contains(msg, "cannot copy a directory into itself") {
+		t.Errorf("copy through symlink: exited %v, %q", exited, msg)
+	}
+	if _, err := os.Stat(filepath.Join(top, "sub", "top")); !os.IsNotExist(err) {
+		t.Errorf("copy made %s/sub/top: %v", top, err)
+	}
+}
+
+func TestCopyContextInterrupt(t *testing.T) {
+	ctx, cancel := newCopyContext()
+	defer cancel()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("interrupt did not cancel the copy")
+	}
+}
+
+func TestCopyMaxFiles(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	var dsts []string
+	for i := 0; i < 10; i++ {
+		sub := filepath.Join(src, fmt.Sprint("dir", i))
+		if err := os.MkdirAll(sub, 0700); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 10; j++ {
+			name := fmt.Sprint("file", j)
+			if err := ioutil.WriteFile(filepath.Join(sub, name), []byte(name), 0600); err != nil {
+				t.Fatal(err)
+			}
+			dsts = append(dsts, filepath.Join(tmp, fmt.Sprint("tee", i, j)))
+		}
+	}
+
+	// Leave room for only a few dozen more open files, far fewer
+	// than the destinations of the -tee copy.
+	open, err := ioutil.ReadDir("/dev/fd")
+	if err != nil {
+		t.Skip(err)
+	}
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim)
+	limit := len(open) + fileHeadroom + 8
+	if limit >= len(dsts) {
+		t.Skipf("%d files already open", len(open))
+	}
+	// The type of Rlimit.Cur varies among systems.
+	low := lim
+	if cur := reflect.ValueOf(&low.Cur).Elem(); cur.Kind() == reflect.Int64 {
+		cur.SetInt(int64(limit))
+	} else {
+		cur.SetUint(uint64(limit))
+	}
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &low); err != nil {
+		t.Fatal(err)
+	}
+
+	copyDir := filepath.Join(tmp, "copy")
+	if err := os.Mkdir(copyDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := captureStderr(t, func() {
+		if runCp(s, "-R", src, copyDir) {
+			t.Error("cp -R exited")
+		}
+		if runCp(s, append([]string{"-tee", filepath.Join(src, "dir0", "file0")}, dsts...)...) {
+			t.Error("cp -tee exited")
+		}
+	})
+	if s.ExitCode != 0 || msg != "" {
+		t.Fatalf("exit code %d, output %q; want 0 and none", s.ExitCode, msg)
+	}
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			name := fmt.Sprint("file", j)
+			data, err := ioutil.ReadFile(filepath.Join(copyDir, "src", fmt.Sprint("dir", i), name))
+			if err != nil || string(data) != name {
+				t.Errorf("copy of dir%d/%s: %q, %v; want %q", i, name, data, err, name)
+			}
+		}
+	}
+	for _, dst := range dsts {
+		if data, err := ioutil.ReadFile(dst); err != nil || string(data) != "file0" {
+			t.Errorf("%s: %q, %v; want %q", dst, data, err, "file0")
+		}
+	}
+}
+
+func TestCopyRelativizeLinks(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "a"), []byte("contents of a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(tmp, "outside")
+	if err := ioutil.WriteFile(outside, []byte("outside"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"sub/abs": filepath.Join(src, "a"),
+		"sub/rel": "../a",
+		"sub/dir": src,
+		"out":     outside,
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(src, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copyDir := filepath.Join(tmp, "copy")
+	if err := os.Mkdir(copyDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	msg := captureStderr(t, func() {
+		if runCp(s, "-R", "-relativize-links", src, copyDir) {
+			t.Error("cp exited")
+		}
+	})
+	if want := "links outside the tree, to " + outside; !strings.Contains(msg, want) {
+		t.Errorf("output %q does not contain %q", msg, want)
+	}
+
+	// Links within the tree still resolve once the copy is moved.
+	moved := filepath.Join(tmp, "moved")
+	if err := os.Rename(filepath.Join(copyDir, "src"), moved); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"sub/abs": "../a",
+		"sub/rel": "../a",
+		"sub/dir": "..",
+		"out":     outside,
+	}
+	for name, target := range want {
+		got, err := os.Readlink(filepath.Join(moved, name))
+		if err != nil || got != target {
+			t.Errorf("link %s: %q, %v; want %q", name, got, err, target)
+		}
+	}
+	for _, name := range []string{"sub/abs", "sub/rel", "sub/dir/a"} {
+		if data, err := ioutil.ReadFile(filepath.Join(moved, name)); err != nil || string(data) != "contents of a" {
+			t.Errorf("%s: %q, %v", name, data, err)
+		}
+	}
+
+	// An Upspin tree copied to local files is relativized too.
+	const dir = cpTestUser + "/tree"
+	mkUpspinDir(t, s, dir)
+	mkUpspinDir(t, s, dir+"/sub")
+	putUpspin(t, s, dir+"/a", "contents of a")
+	if _, err := s.Client.PutLink(dir+"/a", dir+"/sub/link"); err != nil {
+		t.Fatal(err)
+	}
+	if runCp(s, "-R", "-relativize-links", dir, copyDir) {
+		t.Fatal("cp from Upspin exited")
+	}
+	if got, err := os.Readlink(filepath.Join(copyDir, "tree", "sub", "link")); err != nil || got != "../a" {
+		t.Errorf("link from Upspin: %q, %v; want %q", got, err, "../a")
+	}
+}
+
+func TestCopyCheckpoint(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	const interval = 4096
+	data := make([]byte, 5*interval+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	src := filepath.Join(tmp, "big")
+	if err := ioutil.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var synced []int64
+	defer func(f func(*os.File) error) { syncLocal = f }(syncLocal)
+	syncLocal = func(f *os.File) error {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		synced = append(synced, info.Size())
+		return nil
+	}
+	check := func(dst string, want []int64) {
+		t.Helper()
+		if fmt.Sprint(synced) != fmt.Sprint(want) {
+			t.Errorf("synced at %v, want %v", synced, want)
+		}
+		got, err := ioutil.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s holds %d bytes, not the source", dst, len(got))
+		}
+	}
+
+	// The copy is synced after each interval.
+	dst := filepath.Join(tmp, "copy")
+	if runCp(s, "-checkpoint", "4K", src, dst) {
+		t.Fatal("cp exited")
+	}
+	check(dst, []int64{interval, 2 * interval, 3 * interval, 4 * interval, 5 * interval})
+
+	// A copy cut short after its second checkpoint resumes from there.
+	dir := filepath.Join(tmp, "dir")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	dst = filepath.Join(dir, "big")
+	partial := append(data[:2*interval:2*interval], "not yet synced"...)
+	if err := ioutil.WriteFile(dst, partial, 0600); err != nil {
+		t.Fatal(err)
+	}
+	record, err := json.Marshal(cpRecord{Src: src, Dst: dst, Offset: 2 * interval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateFile := filepath.Join(tmp, "state")
+	if err := ioutil.WriteFile(stateFile, append(record, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+	synced = nil
+	if runCp(s, "-R", "-statefile", stateFile, "-checkpoint", "4K", src, dir) {
+		t.Fatal("cp exited")
+	}
+	check(dst, []int64{3 * interval, 4 * interval, 5 * interval})
+
+	// A copy whose source fails after a checkpoint is kept, and a later
+	// run resumes it from that checkpoint.
+	dir = filepath.Join(tmp, "again")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	dst = filepath.Join(dir, "big")
+	cs := &copyState{state: s, checkpoint: interval}
+	cs.progress, err = openProgress(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := s.create(cs, cpFile{path: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced = nil
+	captureStderr(t, func() {
+		reader := failingReader(string(data[:2*interval+100]), errors.Str("source gone"))
+		if cs.doCopy(reader, writer, cpFile{path: src}, cpFile{path: dst}) {
+			t.Error("copy with a read error succeeded")
+		}
+	})
+	cs.progress.close()
+	if info, err := os.Stat(dst); err != nil || info.Size() < 2*interval {
+		t.Fatalf("failed copy not kept at its checkpoint: %v, %v", info, err)
+	}
+	synced = nil
+	s.ExitCode = 0
+	if runCp(s, "-R", "-statefile", stateFile, "-checkpoint", "4K", src, dir) {
+		t.Fatal("cp exited")
+	}
+	check(dst, []int64{3 * interval, 4 * interval, 5 * interval})
+}
+
+func TestCopySanitize(t *testing.T) {
+	s, env := newCopyTestState(t)
+	defer env.Exit()
+
+	tmp, err := ioutil.TempDir("", "upspin-cp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "names")
+	if err := os.Mkdir(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"good":       "good",
+		"bad\nname":  "newline",
+		"bad%0Aname": "percent",
+		"caf\xe9":    "latin-1",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copied := func(dir upspin.PathName) map[string]string {
+		entries, err := s.Client.Glob(string(dir) + "/names/*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]string)
+		for _, e := range entries {
+			data, err := s.Client.Get(e.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m[strings.TrimPrefix(string(e.Name), string(dir)+"/names/")] = string(data)
+		}
+		return m
+	}
+
+	// The invalid names are reported and skipped.
+	const skip = cpTestUser + "/skip"
+	mkUpspinDir(t, s, skip)
+	msg := captureStderr(t, func() {
+		if runCp(s, "-R", src, skip) {
+			t.Error("cp exited")
+		}
+	})
+	for _, want := range []string{`"` + filepath.Join(src, "bad\\nname") + `" to Upspin: its name has control character U+000A`, `"` + filepath.Join(src, "caf\\xe9") + `" to Upspin: its name is not valid UTF-8`} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("output %q does not contain %q", msg, want)
+		}
+	}
+	if got, want := copied(skip), map[string]string{"good": "good", "bad%0Aname": "percent"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("copied %q, want %q", got, want)
+	}
+
+	// With -sanitize, they are copied under valid, distinct names.
+	const clean = cpTestUser + "/sanitized"
+	mkUpspinDir(t, s, clean)
+	msg = captureStderr(t, func() {
+		if runCp(s, "-R", "-sanitize", src, clean) {
+			t.Error("cp exited")
+		}
+	})
+	if want := "as " + clean + "/names/bad%0Aname~1"; !strings.Contains(msg, want) {
+		t.Errorf("output %q does not contain %q", msg, want)
+	}
+	want := map[string]string{"good": "good", "bad%0Aname": "percent", "bad%0Aname~1": "newline", "caf%E9": "latin-1"}
+	if got := copied(clean); !reflect.DeepEqual(got, want) {
+		t.Errorf("copied %q, want %q", got, want)
+	}
+
+	// Over-long names are truncated, keeping their extension.
+	long := strings.Repeat("é", 200) + ".txt"
+	if err := checkUpspinName(cpFile{path: clean, isUpspin: true}, long); err == nil {
+		t.Errorf("%d-byte name accepted", len(long))
+	}
+	name := sanitizeName(long, map[string]bool{})
+	if len(name) > maxElemLen || !strings.HasSuffix(name, "é.txt") || !utf8.ValidString(name) {
+		t.Errorf("sanitized %d-byte name to %q", len(long), name)
+	}
+	if other := sanitizeName(long, map[string]bool{name: true}); other == name || len(other) > maxElemLen || !strings.HasSuffix(other, "~1.txt") {
+		t.Errorf("sanitized taken name to %q", other)
+	}
+}
@@ -72,3 +72,9 @@ func findUpspinBinaries() []string {
 	}
 	return cmds
 }
+
+// openFileLimit returns zero, as Windows has no fixed limit on the
+// number of files a process may have open.
+func openFileLimit() int {
+	return 0
+}
@@ -17,9 +17,11 @@ import (
 
 	"bazil.org/fuse"
 
+	"upspin.io/bind"
 	"upspin.io/client"
 	"upspin.io/client/clientutil"
 	os "upspin.io/cmd/upspinfs/internal/ose"
+	"upspin.io/config"
 	"upspin.io/errors"
 	"upspin.io/pack"
 	"upspin.io/upspin"
@@ -35,6 +37,23 @@ type cache struct {
 	dir    string        // Directory for in-the-clear cached files.
 	next   int           // The next sequence to use for temp files.
 	client upspin.Client // A client for writing back files.
+	config upspin.Config // The config of the client.
+
+	// Files smaller than syncTiny bytes are written directly to
+	// their stores when closed, rather than left to the cache server.
+	syncTiny int64
+	direct   map[upspin.Endpoint]upspin.StoreServer // Stores dialed bypassing the cache server.
+
+	// If set, larger files are made durable in the background and
+	// those that fail are recorded here. See writeback.go.
+	failed *failureLog
+
+	// If set, the directory holding local changes over a read-only
+	// Upspin tree. See overlay.go.
+	overlay string
+
+	// If set, bounds the data awaiting writeback. See dirty.go.
+	dirty *dirtyLimit
 }
 
 type cachedFile struct {
@@ -42,13 +61,23 @@ type cachedFile struct {
 	fname   string // Filename in cache.
 	inStore bool   // True if this is a cached version of something in the store.
 	dirty   bool   // True if it needs to be written back on close.
+	upper   string // If set, the file in the overlay that holds changes.
+
+	dirtyBytes int64 // Bytes written since the last writeback, with -maxdirty.
 
-	file *os.File           // The cached file.
+	file fileIO             // The cached file.
 	de   []*upspin.DirEntry // If this is a directory, its contents.
 }
 
 func newCache(config upspin.Config, dir string) *cache {
-	c := &cache{dir: dir, client: client.New(config)}
+	c := &cache{
+		dir:      dir,
+		client:   client.New(config),
+		config:   config,
+		syncTiny: *syncTiny,
+		direct:   make(map[upspin.Endpoint]upspin.StoreServer),
+		dirty:    newDirtyLimit(*maxDirty),
+	}
 	os.Mkdir(dir, 0700)
 
 	// Clean out all cache files.
@@ -88,6 +117,9 @@ func (c *cache) create(h *handle) error {
 	if h.n.cf != nil {
 		return errors.E(op, errors.IO, errors.Str("create of an open file"))
 	}
+	if c.overlay != "" {
+		return c.createUpper(h)
+	}
 	cf := &cachedFile{c: c, dirty: true}
 	cf.fname = c.mkTemp()
 	var err error
@@ -110,6 +142,11 @@ func (c *cache) open(h *handle, flags fuse.OpenFlags) error {
 		h.flags = flags
 		return nil
 	}
+	if c.overlay != "" {
+		if ok, err := c.openUpper(h, flags); ok {
+			return err
+		}
+	}
 
 	// At this point we may have the reference cached but we first need to look in
 	// the directory to see what the reference is.
@@ -129,13 +166,17 @@ func (c *cache) open(h *handle, flags fuse.OpenFlags) error {
 	// We assume that plain pack files are mutable and not completely
 	// under our control. They are reread whenever opened.
 	cf := &cachedFile{c: c}
+	if c.overlay != "" {
+		cf.upper = c.overlayPath(name)
+	}
 	cdir, fname := c.cacheName(entry)
 	if entry.Packing != upspin.PlainPack {
 		// Look for a dirty cached version.
-		cf.file, err = os.OpenFile(fname, os.O_RDWR, 0700)
+		file, err := os.OpenFile(fname, os.O_RDWR, 0700)
 		if err == nil {
 			h.flags = flags
-			if info, err := cf.file.Stat(); err == nil {
+			if info, err := file.Stat(); err == nil {
+				cf.file = file
 				n.cf = cf
 				n.attr.Size = uint64(info.Size())
 				cf.fname = fname
@@ -222,16 +263,25 @@ func (cf *cachedFile) close() {
 	if cf == nil || cf.file == nil {
 		return
 	}
+	cf.c.dirty.forget(cf)
 	cf.file.Close()
 }
 
 // clone copies the first size bytes of the old cf.file into a new temp file that replaces it.
+// In an overlay, the copy is made in the overlay instead.
 func (cf *cachedFile) clone(size int64) error {
 	const op = "upspinfs/cache.clone"
 
-	fname := cf.c.mkTemp()
+	var fname string
+	var file fileIO
 	var err error
-	file, err := os.OpenFile(fname, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0700)
+	if cf.upper != "" {
+		fname = cf.upper
+		file, err = openUpperFile(fname)
+	} else {
+		fname = cf.c.mkTemp()
+		file, err = os.OpenFile(fname, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0700)
+	}
 	if err != nil {
 		return errors.E(op, err)
 	}
@@ -306,10 +356,14 @@ func (cf *cachedFile) writeback(h *handle) error {
 	const op = "upspinfs/cache.writeback"
 	n := h.n
 
-	// Nothing to do if the cache file isn't dirty.
-	if !cf.dirty {
+	// Nothing to do if the cache file isn't dirty. Changes made
+	// in an overlay are never written back.
+	if !cf.dirty || cf.upper != "" {
 		return nil
 	}
+	stored := false
+	cf.c.dirty.startWriteback()
+	defer func() { cf.c.dirty.endWriteback(cf, stored) }()
 
 	// Read the whole file into memory. Hope it fits.
 	info, err := cf.file.Stat()
@@ -344,6 +398,15 @@ func (cf *cachedFile) writeback(h *handle) error {
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
+	stored = true
+
+	if info.Size() < cf.c.syncTiny {
+		if err := cf.c.makeDurable(de); err != nil {
+			return errors.E(op, err)
+		}
+	} else if cf.c.failed != nil {
+		cf.c.makeDurableLater(de)
+	}
 
 	// Rename it to reflect the actual reference in the store so that new
 	// opens will find the cached version.  Assume a single block.
@@ -362,6 +425,68 @@ func (cf *cachedFile) writeback(h *handle) error {
 	return nil
 }
 
+// makeDurable writes the blocks of a file, as packed by the cache server,
+// directly to their stores, so that the file does not depend on the cache
+// server's asynchronous writeback to survive. The cache server still writes
+// the blocks back, but the stores already have them.
+func (c *cache) makeDurable(de *upspin.DirEntry) error {
+	const op = "upspinfs/cache.makeDurable"
+	if c.config.CacheEndpoint().Transport == upspin.Unassigned {
+		// With no cache server, Put wrote the blocks to their stores.
+		return nil
+	}
+	for _, b := range de.Blocks {
+		data, err := clientutil.ReadLocation(c.config, b.Location)
+		if err != nil {
+			return errors.E(op, de.Name, err)
+		}
+		store, err := c.directStore(b.Location.Endpoint)
+		if err != nil {
+			return errors.E(op, de.Name, err)
+		}
+		refdata, err := store.Put(data)
+		if err != nil {
+			return errors.E(op, de.Name, err)
+		}
+		if refdata.Reference != b.Location.Reference {
+			return errors.E(op, de.Name, errors.Errorf("store returned reference %q, expected %q", refdata.Reference, b.Location.Reference))
+		}
+	}
+	return nil
+}
+
+// directStore returns the store at the endpoint, dialed without the cache
+// server.
+func (c *cache) directStore(e upspin.Endpoint) (upspin.StoreServer, error) {
+	c.Lock()
+	defer c.Unlock()
+	if store, ok := c.direct[e]; ok {
+		return store, nil
+	}
+	store, err := dialDirect(config.SetCacheEndpoint(c.config, upspin.Endpoint{}), e)
+	if err != nil {
+		return nil, err
+	}
+	c.direct[e] = store
+	return store, nil
+}
+
+// dialDirect dials the store at the endpoint using a config with no cache
+// server. Bind would return the store it already dialed through the cache
+// server, so dial anew through that store's Dial method. It is a variable
+// so tests can replace it.
+var dialDirect = func(cfg upspin.Config, e upspin.Endpoint) (upspin.StoreServer, error) {
+	store, err := bind.StoreServer(cfg, e)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := store.Dial(cfg, e)
+	if err != nil {
+		return nil, err
+	}
+	return svc.(upspin.StoreServer), nil
+}
+
 // putRedirect assumes that the target fits in a single block.
 func (c *cache) putRedirect(n *node, target upspin.PathName) error {
 	const op = "upspinfs/cache.putRedirect"
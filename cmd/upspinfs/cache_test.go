@@ -0,0 +1,101 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/key/sha256key"
+	"upspin.io/upspin"
+)
+
+// durableStore is a StoreServer standing for a store dialed directly,
+// bypassing the cache server. It records the blocks it is given.
+type durableStore struct {
+	upspin.StoreServer
+	sync.Mutex
+	refs map[upspin.Reference]bool
+}
+
+func (s *durableStore) Put(data []byte) (*upspin.Refdata, error) {
+	s.Lock()
+	defer s.Unlock()
+	ref := upspin.Reference(sha256key.Of(data).String())
+	s.refs[ref] = true
+	return &upspin.Refdata{Reference: ref}, nil
+}
+
+func (s *durableStore) has(ref upspin.Reference) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.refs[ref]
+}
+
+func TestSyncTiny(t *testing.T) {
+	const user = "synctiny@google.com"
+	cfg, err := testSetup(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocks written through a cache server are only pending
+	// until they reach the durable store.
+	cfg = config.SetCacheEndpoint(cfg, upspin.Endpoint{Transport: upspin.Remote, NetAddr: "localhost:9999"})
+	durable := &durableStore{refs: make(map[upspin.Reference]bool)}
+	defer func(f func(upspin.Config, upspin.Endpoint) (upspin.StoreServer, error)) { dialDirect = f }(dialDirect)
+	dialDirect = func(cfg upspin.Config, e upspin.Endpoint) (upspin.StoreServer, error) {
+		if cfg.CacheEndpoint().Transport != upspin.Unassigned {
+			return nil, errors.Str("store dialed through the cache server")
+		}
+		return durable, nil
+	}
+
+	dir, err := ioutil.TempDir("", "upspinfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := newCache(cfg, dir)
+	c.syncTiny = 1024
+	if _, err := c.client.MakeDirectory(user + "/"); err != nil && !errors.Match(errors.E(errors.Exist), err) {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    upspin.PathName
+		size    int
+		durable bool
+	}{
+		{user + "/tiny", 100, true},
+		{user + "/large", 100 * 1024, false},
+	} {
+		h := &handle{n: &node{uname: test.name}}
+		if err := c.create(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.n.cf.writeAt(randomBytes(t, test.size), 0); err != nil {
+			t.Fatal(err)
+		}
+		// Close the file.
+		if err := h.n.cf.writeback(h); err != nil {
+			t.Fatal(err)
+		}
+		de, err := c.client.Lookup(test.name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range de.Blocks {
+			if got := durable.has(b.Location.Reference); got != test.durable {
+				t.Errorf("%s: block durable at close: %v, want %v", test.name, got, test.durable)
+			}
+		}
+	}
+}
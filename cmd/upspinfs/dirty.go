@@ -0,0 +1,119 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"sync"
+
+	"upspin.io/log"
+)
+
+// dirtyLimit bounds, with -maxdirty, the data written to files in the
+// mount that has yet to be written back. Writeback reads a file whole
+// into memory, so an unbounded amount of it lets a process writing
+// faster than the store drains balloon the memory of upspinfs. A nil
+// *dirtyLimit imposes no bound.
+type dirtyLimit struct {
+	mu    sync.Mutex
+	cond  *sync.Cond // Signaled when a writeback ends.
+	max   int64      // The bound, in bytes.
+	bytes int64      // Bytes written to all files since their last writeback.
+	peak  int64      // The most bytes there have been at once.
+	busy  int        // Writebacks under way.
+}
+
+func newDirtyLimit(max int64) *dirtyLimit {
+	if max <= 0 {
+		return nil
+	}
+	d := &dirtyLimit{max: max}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+// makeRoom waits until n more bytes may be written to the cached file,
+// counting them against the bound. While other files are being written
+// back, it waits for them to finish; if none is, it writes back this
+// file to make room. If that makes too little, or the write alone is
+// larger than the bound, the write goes ahead regardless rather than wait
+// for room that nothing will make. Called with node locked.
+func (cf *cachedFile) makeRoom(h *handle, n int64) {
+	d := cf.c.dirty
+	if d == nil || cf.upper != "" {
+		return
+	}
+	if h.n.noWB {
+		// A removed file is never written back.
+		d.forget(cf)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	wroteBack := false
+	for d.bytes+n > d.max {
+		if d.busy > 0 {
+			d.cond.Wait()
+			continue
+		}
+		if wroteBack || cf.dirtyBytes == 0 {
+			break
+		}
+		d.mu.Unlock()
+		err := cf.writeback(h)
+		d.mu.Lock()
+		if err != nil {
+			log.Info.Printf("upspinfs: writeback of %s to make room: %s", h.n.uname, err)
+			break
+		}
+		wroteBack = true
+	}
+	cf.dirtyBytes += n
+	d.bytes += n
+	if d.bytes > d.peak {
+		d.peak = d.bytes
+	}
+}
+
+// startWriteback records that a writeback is under way.
+func (d *dirtyLimit) startWriteback() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.busy++
+	d.mu.Unlock()
+}
+
+// endWriteback records that the writeback of cf is over, freeing the
+// bytes written to it if they reached the store, and wakes the writes
+// waiting for room.
+func (d *dirtyLimit) endWriteback(cf *cachedFile, stored bool) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.busy--
+	if stored {
+		d.bytes -= cf.dirtyBytes
+		cf.dirtyBytes = 0
+	}
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// forget stops counting the bytes written to cf, whose data will not be
+// written back.
+func (d *dirtyLimit) forget(cf *cachedFile) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.bytes -= cf.dirtyBytes
+	cf.dirtyBytes = 0
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gContext "golang.org/x/net/context"
+
+	"bazil.org/fuse"
+
+	"upspin.io/client"
+	"upspin.io/upspin"
+)
+
+// slowClient is a Client whose Puts take a while, like a store that
+// drains slower than files are written.
+type slowClient struct {
+	upspin.Client
+	puts int32
+}
+
+func (c *slowClient) Put(name upspin.PathName, data []byte) (*upspin.DirEntry, error) {
+	atomic.AddInt32(&c.puts, 1)
+	time.Sleep(20 * time.Millisecond)
+	return c.Client.Put(name, data)
+}
+
+func TestMaxDirty(t *testing.T) {
+	const (
+		user  = "maxdirty@google.com"
+		limit = 64 * 1024
+		chunk = 8 * 1024
+		size  = 4 * limit
+	)
+	cfg, err := testSetup(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRealKey(t, cfg)
+	if _, err := client.New(cfg).MakeDirectory(user + "/"); err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "upspinfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	*maxDirty = limit
+	defer func() { *maxDirty = 0 }()
+	f := newUpspinFS(cfg, filepath.Join(tmp, "mnt"), tmp)
+	slow := &slowClient{Client: f.cache.client}
+	f.cache.client = slow
+	ctx := gContext.Background()
+	dn, err := f.root.Lookup(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two files, each several times the limit, written at once.
+	contents := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("file %d ", i)), size/7+1)[:size]
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, fh, err := dn.(*node).Create(ctx, &fuse.CreateRequest{Name: fmt.Sprint("file", i)}, &fuse.CreateResponse{})
+			if err != nil {
+				errs <- err
+				return
+			}
+			h := fh.(*handle)
+			data := contents(i)
+			for off := 0; off < size; off += chunk {
+				if err := h.Write(ctx, &fuse.WriteRequest{Data: data[off : off+chunk], Offset: int64(off)}, &fuse.WriteResponse{}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			if err := h.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("writes did not complete")
+	}
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	d := f.cache.dirty
+	d.mu.Lock()
+	peak, left := d.peak, d.bytes
+	d.mu.Unlock()
+	if peak > limit+chunk {
+		t.Errorf("dirty data peaked at %d bytes, want at most %d", peak, limit+chunk)
+	}
+	if left != 0 {
+		t.Errorf("%d dirty bytes left after close, want 0", left)
+	}
+	if n := atomic.LoadInt32(&slow.puts); n <= 2 {
+		t.Errorf("%d writebacks, want some before close", n)
+	}
+	for i := 0; i < 2; i++ {
+		name := upspin.PathName(fmt.Sprintf("%s/file%d", user, i))
+		data, err := client.New(cfg).Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, contents(i)) {
+			t.Errorf("%s holds %d bytes, not what was written", name, len(data))
+		}
+	}
+}
@@ -28,8 +28,35 @@ The flags are:
 		user's configuration file (default "$HOME/upspin/config")
 	-log level
 		level of logging: debug, info, error, disabled (default info)
+	-maxdirty bytes
+		once files hold 'bytes' of written data not yet written back,
+		make further writes wait until writeback makes room; a file
+		larger than 'bytes' is written back whole each time it fills
+		the room (default 0, meaning unlimited)
+	-maxopsec operations
+		max directory server metadata operations per second; when
+		exceeded, operations wait briefly and then fail with EAGAIN
+		(default 0, meaning unlimited)
+	-overlay directory
+		keep all changes in 'directory' and never modify Upspin;
+		the mounted tree reads as Upspin overlaid with the changes
+		(see Overlays below)
+	-synctiny bytes
+		when a file smaller than 'bytes' is closed, write it directly
+		to the store, bypassing the cache server's asynchronous
+		writeback, before the close returns; larger files are still
+		written back asynchronously (default 0, meaning none)
+	-wblog
+		make files that -synctiny does not write durable in the
+		background, and list those that fail in a file at the root
+		of the mount (see Writeback failures below)
+	-wbnotify command
+		with -wblog, run 'command' for each writeback that fails
 	-writethrough
 		make storage cache writethrough
+	-xattr
+		expose fields of each file's Upspin directory entry as
+		read-only extended attributes (see Extended attributes below)
 
 Examples:
 
@@ -40,6 +67,50 @@ Examples:
 	% killall -9 upspinfs
 	% umount $HOME/ufs
 
+Overlays:
+
+With -overlay, the Upspin tree is read-only and every change is kept in
+a local directory instead. Reads of unchanged files fall through to
+Upspin. A file is copied into the overlay directory the first time it
+is written, and new files and directories are created there. Removing a
+file or directory that exists in Upspin leaves a whiteout, an empty file
+named with the prefix ".wh.", that hides it. The overlay directory
+mirrors the Upspin name space, so user@example.com/dir/file is kept as
+<directory>/user@example.com/dir/file. Links and symbolic links cannot
+be made, and directories that exist in Upspin cannot be renamed.
+
+Extended attributes:
+
+With -xattr, each file, directory, and link below the root has these
+read-only extended attributes, read afresh from the directory server:
+
+	user.upspin.sequence  the entry's sequence number, in decimal
+	user.upspin.packing   the name of the entry's packing, such as ee
+	user.upspin.blocks    a line for each block, giving its offset,
+	                      size, and reference
+
+Since the sequence number changes with every change to the entry, a
+program can compare it before and after its own work to detect changes
+made by others. Other extended attributes are not supported.
+
+Writeback failures:
+
+With a cache server, a closed file is written to its store later, and
+by then the program that wrote it cannot learn that the write failed.
+There are two ways to avoid losing such a failure silently. With
+-synctiny, close waits until a small file is in its store and fails if
+it cannot be written there. With -wblog, upspinfs itself makes the
+remaining files durable once they are closed, retrying for about half a
+minute, and records each file it cannot write, or that close failed to
+write, as a line in the read-only file .writeback-failures at the root
+of the mount:
+
+	2017-06-01T10:00:00-07:00 user@example.com/dir/file: <error>
+
+With -wbnotify, the command is also run with the file's path name and
+the error as arguments, for instance to raise a desktop notification.
+The log holds the most recent 1000 failures and is lost on unmount.
+
 Limitations:
 
 Uspinfs tries to present a Posix file system.
@@ -49,6 +49,7 @@ var errnoToKind = map[syscall.Errno]errors.Kind{
 	syscall.EISDIR:    errors.IsDir,
 	syscall.ENOTDIR:   errors.NotDir,
 	syscall.ENOTEMPTY: errors.NotEmpty,
+	syscall.EAGAIN:    errors.Transient,
 }
 
 var kindToErrno = map[errors.Kind]syscall.Errno{
@@ -60,6 +61,7 @@ var kindToErrno = map[errors.Kind]syscall.Errno{
 	errors.NotEmpty:      syscall.ENOTEMPTY,
 	errors.CannotDecrypt: syscall.EPERM,
 	errors.Private:       syscall.EACCES,
+	errors.Transient:     syscall.EAGAIN,
 }
 
 func notSupported(s string) *errnoError {
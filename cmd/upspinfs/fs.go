@@ -57,6 +57,9 @@ type upspinFS struct {
 	cache      *cache                        // A cache of files read from or to be written to dir/store.
 	nodeMap    map[upspin.PathName]*node     // All in use nodes.
 	enoentMap  map[upspin.PathName]time.Time // A map of non-existent names.
+	throttle   *throttle                     // Rate limit for directory operations; nil means none.
+	xattr      bool                          // Expose directory entry fields as extended attributes.
+	wbLogNode  *node                         // The log of failed writebacks, if kept.
 }
 
 type nodeType uint8
@@ -65,6 +68,7 @@ const (
 	rootNode nodeType = iota // There is only one root.
 	userNode                 // All nodes directly below the root represent user directories.
 	otherNode
+	wbLogNode // The log of failed writebacks in the root; see writeback.go.
 )
 
 // node represents a node (directory or file) in the name space tree.  All nodes
@@ -80,6 +84,7 @@ type node struct {
 	handles    map[*handle]bool // Handles (open instances) of this node.
 	link       upspin.PathName  // If this is a symlink, the target.
 	noWB       bool             // Don't write back if set.
+	opaque     bool             // In an overlay, hides the base's contents of this directory.
 
 	// cached info.
 	cf *cachedFile        // Local file system contents of this node.
@@ -116,10 +121,23 @@ func newUpspinFS(config upspin.Config, mountpoint string, cacheDir string) *upsp
 		userDirs:   make(map[string]bool),
 		nodeMap:    make(map[upspin.PathName]*node),
 		enoentMap:  make(map[upspin.PathName]time.Time),
+		throttle:   newThrottle(*maxOpsPerSec),
+		xattr:      *xattr,
 	}
 	f.cache = newCache(config, cacheDir+"/fscache")
+	f.cache.overlay = *overlay
+	if *wbLog {
+		f.cache.failed = newFailureLog(*wbNotify)
+	}
 	// Preallocate root node.
 	f.root = f.allocNode(nil, "", 0500|os.ModeDir, 0, time.Now())
+	if f.cache.failed != nil {
+		f.wbLogNode = f.allocNode(f.root, wbLogName, 0400, 0, time.Now())
+		f.wbLogNode.t = wbLogNode
+		f.wbLogNode.uname = wbLogName
+		f.wbLogNode.user = ""
+		f.wbLogNode.attr.Valid = 0
+	}
 	return f
 }
 
@@ -184,9 +202,15 @@ func (f *upspinFS) allocNode(parent *node, name string, mode os.FileMode, size u
 	return n
 }
 
-// dirLookup returns a bound directory for user 'name'.
+// dirLookup returns a bound directory for user 'name'. If metadata
+// operations are being throttled, the directory's Lookup, Glob, Put,
+// and Delete methods are rate limited.
 func (f *upspinFS) dirLookup(name upspin.UserName) (upspin.DirServer, error) {
-	return bind.DirServerFor(f.config, name)
+	dir, err := bind.DirServerFor(f.config, name)
+	if err != nil || f.throttle == nil {
+		return dir, err
+	}
+	return throttledDir{dir, f.throttle}, nil
 }
 
 var handleID int
@@ -227,6 +251,9 @@ func (h *handle) freeNoLock() {
 func (n *node) Attr(addscontext gContext.Context, attr *fuse.Attr) error {
 	log.Debug.Printf("Attr %s", n)
 	*attr = n.attr
+	if n.t == wbLogNode {
+		attr.Size = uint64(len(n.f.cache.failed.contents()))
+	}
 	return nil
 }
 
@@ -255,9 +282,12 @@ func (n *node) Create(context gContext.Context, req *fuse.CreateRequest, resp *f
 	nn.attr.Uid = req.Header.Uid
 	nn.attr.Gid = req.Header.Gid
 
-	// Make sure we can actually create this node.
-	if err := nn.f.checkAccess(nn.uname, nn.user, access.Create); err != nil {
-		return nil, nil, e2e(errors.E(op, err))
+	// Make sure we can actually create this node. Anything
+	// can be created in an overlay.
+	if f.cache.overlay == "" {
+		if err := nn.f.checkAccess(nn.uname, nn.user, access.Create); err != nil {
+			return nil, nil, e2e(errors.E(op, err))
+		}
 	}
 
 	// Open it.
@@ -281,6 +311,9 @@ func (n *node) Mkdir(context gContext.Context, req *fuse.MkdirRequest) (fs.Node,
 	const op = "upspinfs/fs.Mkdir"
 	n.Lock()
 	defer n.Unlock()
+	if n.f.cache.overlay != "" {
+		return n.overlayMkdir(req)
+	}
 
 	nn := n.f.allocNode(n, req.Name, unixPermissions|os.ModeDir, 0, time.Now())
 	nn.attr.Uid = req.Header.Uid
@@ -336,6 +369,9 @@ func (n *node) openDir(context gContext.Context, req *fuse.OpenRequest, resp *fu
 		n.de = de
 		return h, nil
 	}
+	if n.f.cache.overlay != "" {
+		return n.openOverlayDir(req)
+	}
 	dir, err := n.f.dirLookup(n.user)
 	if err != nil {
 		return nil, e2e(errors.E(op, err))
@@ -361,9 +397,18 @@ func (n *node) openFile(context gContext.Context, req *fuse.OpenRequest, resp *f
 	if n.attr.Mode&os.ModeDir != 0 {
 		return nil, e2e(errors.E(op, errors.IsDir, n.uname))
 	}
+	if n.t == wbLogNode {
+		if !req.Flags.IsReadOnly() {
+			return nil, e2e(errors.E(op, errors.Permission, n.uname))
+		}
+		// The log grows; don't let the kernel cache its contents.
+		resp.Flags |= fuse.OpenDirectIO
+		return allocHandle(n), nil
+	}
 
 	// Make sure we can actually write this node if requested.
-	if req.Flags.IsWriteOnly() || req.Flags.IsReadWrite() {
+	// Anything can be written in an overlay.
+	if n.f.cache.overlay == "" && (req.Flags.IsWriteOnly() || req.Flags.IsReadWrite()) {
 		if err := n.f.checkAccess(n.uname, n.user, access.Write); err != nil {
 			return nil, e2e(errors.E(op, err))
 		}
@@ -429,6 +474,9 @@ func (n *node) Remove(context gContext.Context, req *fuse.RemoveRequest) error {
 	defer n.Unlock()
 
 	uname := path.Join(n.uname, req.Name)
+	if n.f.cache.overlay != "" {
+		return n.overlayRemove(uname, req)
+	}
 
 	// Find the node in question.
 	dir, de, err := n.directoryLookup(uname)
@@ -486,6 +534,9 @@ func (n *node) Lookup(context gContext.Context, name string) (fs.Node, error) {
 	uname := path.Join(n.uname, name)
 
 	f := n.f
+	if n.t == rootNode && name == wbLogName && f.wbLogNode != nil {
+		return f.wbLogNode, nil
+	}
 	f.Lock()
 	if n, ok := f.nodeMap[uname]; ok {
 		f.Unlock()
@@ -502,6 +553,13 @@ func (n *node) Lookup(context gContext.Context, name string) (fs.Node, error) {
 		return nil, e2e(errors.E(op, errors.NotExist, uname))
 	}
 
+	// Changes in an overlay hide the base.
+	if f.cache.overlay != "" {
+		if nn, ok, err := n.overlayLookup(name, uname); ok {
+			return nn, err
+		}
+	}
+
 	// Ask the Dirserver.
 	_, de, err := n.directoryLookup(uname)
 	if err != nil {
@@ -565,6 +623,9 @@ func (n *node) Forget() {
 // Files are only truncated by Setattr calls.
 func (n *node) Setattr(context gContext.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
 	const op = "upspinfs/fs.Setattr"
+	if n.t == wbLogNode && req.Valid.Size() {
+		return e2e(errors.E(op, errors.Permission, n.uname))
+	}
 	if req.Valid.Size() {
 		// Truncate.  Lots of cases:
 		// 1) we have it opened. Truncate the cached file and
@@ -647,6 +708,9 @@ func (h *handle) ReadDirAll(context gContext.Context) ([]fuse.Dirent, error) {
 		}
 		fde = append(fde, fuse.Dirent{Name: name})
 	}
+	if h.n.t == rootNode && h.n.f.wbLogNode != nil {
+		fde = append(fde, fuse.Dirent{Name: wbLogName})
+	}
 	return fde, nil
 }
 
@@ -656,6 +720,10 @@ func (h *handle) Read(context gContext.Context, req *fuse.ReadRequest, resp *fus
 	h.n.Lock()
 	defer h.n.Unlock()
 	resp.Data = make([]byte, cap(resp.Data))
+	if h.n.t == wbLogNode {
+		resp.Data = resp.Data[:h.n.f.cache.failed.readAt(resp.Data, req.Offset)]
+		return nil
+	}
 	n, err := h.n.cf.readAt(resp.Data, req.Offset)
 	if n != len(resp.Data) {
 		resp.Data = resp.Data[:n]
@@ -675,6 +743,7 @@ func (h *handle) Write(context gContext.Context, req *fuse.WriteRequest, resp *f
 	const op = "upspinfs/fs.Write"
 	h.n.Lock()
 	defer h.n.Unlock()
+	h.n.cf.makeRoom(h, int64(len(req.Data)))
 	n, err := h.n.cf.writeAt(req.Data, req.Offset)
 	if err != nil {
 		err = e2e(errors.E(op, h.n.uname, err))
@@ -690,6 +759,8 @@ func (h *handle) Write(context gContext.Context, req *fuse.WriteRequest, resp *f
 
 // Release implements fs.HandleWriter.Release. Similar to Flush but only when
 // a file is finally closed.
+// With -wblog, a failure to write the file back is also recorded in the
+// log of failed writebacks.
 // TODO(p): If we fail writing a file, should we try later asynchronously?
 func (h *handle) Release(context gContext.Context, req *fuse.ReleaseRequest) error {
 	const op = "upspinfs/fs.Release"
@@ -701,6 +772,7 @@ func (h *handle) Release(context gContext.Context, req *fuse.ReleaseRequest) err
 	if h.n.cf != nil && !h.n.noWB {
 		err = h.n.cf.writeback(h)
 		if err != nil {
+			h.n.f.cache.failed.add(h.n.uname, err)
 			err = e2e(errors.E(op, h.n.uname, err))
 		}
 	}
@@ -719,6 +791,9 @@ func (n *node) Link(ctx gContext.Context, req *fuse.LinkRequest, old fs.Node) (f
 	const op = "upspinfs/fs.Link"
 	n.Lock()
 	defer n.Unlock()
+	if n.f.cache.overlay != "" {
+		return nil, e2e(errors.E(op, errors.Invalid, n.uname, errors.Str("links are not supported in an overlay")))
+	}
 	oldPath := old.(*node).uname
 	newPath := path.Join(n.uname, req.NewName)
 	de, err := n.f.client.PutDuplicate(oldPath, newPath)
@@ -739,6 +814,9 @@ func (n *node) Rename(ctx gContext.Context, req *fuse.RenameRequest, newDir fs.N
 	const op = "upspinfs/fs.Rename"
 	n.Lock()
 	defer n.Unlock()
+	if n.f.cache.overlay != "" {
+		return n.overlayRename(req, newDir.(*node))
+	}
 	oldPath := path.Join(n.uname, req.OldName)
 	// If we still have the old node, lock it for the duration.
 	f := n.f
@@ -781,20 +859,31 @@ func (n *node) Rename(ctx gContext.Context, req *fuse.RenameRequest, newDir fs.N
 }
 
 // The following Xattr calls exist to short circuit any xattr calls.  Without them,
-// the MacOS kernel will constantly look for ._ files.
+// the MacOS kernel will constantly look for ._ files. With -xattr, they
+// instead expose the read-only attributes in xattr.go.
 
 // Getxattr implements fs.NodeGetxattrer.Getxattr.
 func (n *node) Getxattr(ctx gContext.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if n.f.xattr {
+		return n.getEntryXattr(req, resp)
+	}
 	return notSupported("getxattr")
 }
 
 // Listxattr implements fs.NodeListxattrer.Listxattr.
 func (n *node) Listxattr(ctx gContext.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	if n.f.xattr {
+		n.listEntryXattrs(resp)
+		return nil
+	}
 	return notSupported("listxattr")
 }
 
 // Setxattr implements fs.NodeSetxattrer.Setxattr.
 func (n *node) Setxattr(ctx gContext.Context, req *fuse.SetxattrRequest) error {
+	if n.f.xattr {
+		return n.setEntryXattr(req.Name)
+	}
 	return notSupported("setxattr")
 }
 
@@ -835,6 +924,9 @@ func (n *node) Symlink(ctx gContext.Context, req *fuse.SymlinkRequest) (fs.Node,
 	const op = "upspinfs/fs.Symlink"
 	n.Lock()
 	defer n.Unlock()
+	if n.f.cache.overlay != "" {
+		return nil, e2e(errors.E(op, errors.Invalid, n.uname, errors.Str("symlinks are not supported in an overlay")))
+	}
 	target, err := n.hostPathToUpspinPath(req.Target)
 	if err != nil {
 		return nil, e2e(errors.E(op, n.uname, err))
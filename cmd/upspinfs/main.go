@@ -26,6 +26,20 @@ import (
 	"upspin.io/transports"
 )
 
+var maxOpsPerSec = flag.Int("maxopsec", 0, "max directory server metadata `operations` per second (0 means unlimited)")
+
+var overlay = flag.String("overlay", "", "keep all changes in local `directory`, leaving the Upspin tree unmodified")
+
+var xattr = flag.Bool("xattr", false, "expose the sequence number, packing, and blocks of Upspin entries as read-only extended attributes")
+
+var syncTiny = flag.Int64("synctiny", 0, "write files smaller than `bytes` to the store before close returns, bypassing the cache server's writeback (0 means none)")
+
+var maxDirty = flag.Int64("maxdirty", 0, "make writes wait for writeback once files hold `bytes` of data not yet written back (0 means unlimited)")
+
+var wbLog = flag.Bool("wblog", false, "make files not written by -synctiny durable in the background, listing writebacks that fail in the file "+wbLogName+" at the root of the mount")
+
+var wbNotify = flag.String("wbnotify", "", "with -wblog, run `command` with the file's path name and the error for each writeback that fails")
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s <mountpoint>\n", os.Args[0])
 	flag.PrintDefaults()
@@ -55,6 +69,17 @@ func main() {
 	if err != nil {
 		log.Fatalf("can't determine absolute path to mount point %s: %s", flag.Arg(0), err)
 	}
+	if *overlay != "" {
+		if *overlay, err = filepath.Abs(*overlay); err != nil {
+			log.Fatalf("can't determine absolute path to overlay %s: %s", *overlay, err)
+		}
+		if err := os.MkdirAll(*overlay, 0700); err != nil {
+			log.Fatalf("can't create overlay: %s", err)
+		}
+	}
+	if *wbNotify != "" && !*wbLog {
+		log.Fatalf("-wbnotify requires -wblog")
+	}
 	done := do(cfg, mountpoint, flags.CacheDir)
 
 	// Serve expvar data on NetAddr.
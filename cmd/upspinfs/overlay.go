@@ -0,0 +1,409 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"upspin.io/errors"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// With an overlay, the mounted Upspin tree is a read-only base beneath a
+// local directory, the overlay, which holds every change. Files and
+// directories in the overlay hide those of the same name in the base. A
+// file is copied up into the overlay the first time it is written. Removing
+// something that exists in the base leaves a whiteout, an empty file named
+// by adding whiteoutPrefix, that hides it. A directory recreated over a
+// whiteout is marked opaque by a file named opaqueMarker, so that the
+// base's contents do not show through it. Nothing is ever written to Upspin.
+//
+// The overlay mirrors the Upspin name space: the file user@example.com/a/b
+// is stored as <overlay>/user@example.com/a/b.
+const (
+	whiteoutPrefix = ".wh."
+	opaqueMarker   = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// fileIO is the part of a file that a cachedFile uses. Files in the cache
+// are encrypted and vanish when closed; those in an overlay are plain files
+// that outlive the process.
+type fileIO interface {
+	io.ReaderAt
+	io.WriterAt
+	Close() error
+	Stat() (os.FileInfo, error)
+}
+
+// overlayPath returns the name of the file in the overlay for uname.
+func (c *cache) overlayPath(uname upspin.PathName) string {
+	return filepath.Join(c.overlay, filepath.FromSlash(string(uname)))
+}
+
+// whiteoutPath returns the name of the whiteout for uname.
+func (c *cache) whiteoutPath(uname upspin.PathName) string {
+	p := c.overlayPath(uname)
+	return filepath.Join(filepath.Dir(p), whiteoutPrefix+filepath.Base(p))
+}
+
+// exists reports whether the named local file exists.
+func exists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+// whiteout hides uname in the base.
+func (c *cache) whiteout(uname upspin.PathName) error {
+	wh := c.whiteoutPath(uname)
+	if err := os.MkdirAll(filepath.Dir(wh), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(wh, nil, 0600)
+}
+
+// unwhiteout removes any whiteout for uname and reports whether there was one.
+func (c *cache) unwhiteout(uname upspin.PathName) bool {
+	return os.Remove(c.whiteoutPath(uname)) == nil
+}
+
+// inBase reports whether uname, within directory n, exists in the base
+// and is not hidden. Called with n locked.
+func (n *node) inBase(uname upspin.PathName) (*upspin.DirEntry, bool) {
+	if n.opaque || exists(n.f.cache.whiteoutPath(uname)) {
+		return nil, false
+	}
+	_, de, err := n.directoryLookup(uname)
+	if err != nil {
+		return nil, false
+	}
+	return de, true
+}
+
+// overlayLookup looks up the named file in directory n, whose Upspin path
+// is uname, in the overlay. It reports whether the overlay decided the
+// answer; if not, the base is to be asked. Called with n locked.
+func (n *node) overlayLookup(name string, uname upspin.PathName) (fs.Node, bool, error) {
+	const op = "upspinfs/fs.Lookup"
+	f := n.f
+	if strings.HasPrefix(name, whiteoutPrefix) || exists(f.cache.whiteoutPath(uname)) {
+		return nil, true, e2e(errors.E(op, errors.NotExist, uname))
+	}
+	info, err := os.Lstat(f.cache.overlayPath(uname))
+	if err != nil {
+		if n.opaque {
+			return nil, true, e2e(errors.E(op, errors.NotExist, uname))
+		}
+		return nil, false, nil
+	}
+	mode := os.FileMode(unixPermissions)
+	if info.IsDir() {
+		mode |= os.ModeDir
+	}
+	nn := f.allocNode(n, name, mode, uint64(info.Size()), info.ModTime())
+	nn.opaque = n.opaque || exists(filepath.Join(f.cache.overlayPath(uname), opaqueMarker))
+	if n.t == rootNode {
+		f.addUserDir(name)
+	}
+	nn.exists()
+	return nn, true, nil
+}
+
+// openOverlayDir opens directory n, listing the base's contents merged
+// with the overlay's.
+func (n *node) openOverlayDir(req *fuse.OpenRequest) (fs.Handle, error) {
+	const op = "upspinfs/fs.Open"
+	n.Lock()
+	defer n.Unlock()
+	de, err := n.listing()
+	if err != nil {
+		return nil, e2e(errors.E(op, err, n.uname))
+	}
+	h := allocHandle(n)
+	n.de = de
+	h.flags = req.Flags
+	return h, nil
+}
+
+// listing returns the contents of directory n as the overlay presents
+// them. Called with n locked.
+func (n *node) listing() ([]*upspin.DirEntry, error) {
+	f := n.f
+	upper := f.cache.overlayPath(n.uname)
+	var base []*upspin.DirEntry
+	if !n.opaque {
+		dir, err := f.dirLookup(n.user)
+		if err != nil {
+			return nil, err
+		}
+		base, err = dir.Glob(string(path.Join(n.uname, "*")))
+		if err != nil && !(errors.Match(errors.E(errors.NotExist), err) && exists(upper)) {
+			return nil, err
+		}
+	}
+	infos, _ := ioutil.ReadDir(upper)
+	hidden := make(map[string]bool)
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasPrefix(name, whiteoutPrefix) {
+			hidden[strings.TrimPrefix(name, whiteoutPrefix)] = true
+		} else {
+			hidden[name] = true // Replaced by the overlay's.
+		}
+	}
+	var de []*upspin.DirEntry
+	for _, e := range base {
+		if !hidden[lastElem(e.Name)] {
+			de = append(de, e)
+		}
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasPrefix(name, whiteoutPrefix) {
+			continue
+		}
+		e := &upspin.DirEntry{Name: path.Join(n.uname, name)}
+		if info.IsDir() {
+			e.Attr = upspin.AttrDirectory
+		}
+		de = append(de, e)
+	}
+	return de, nil
+}
+
+// lastElem returns the final element of an Upspin path name.
+func lastElem(name upspin.PathName) string {
+	parsed, err := path.Parse(name)
+	if err != nil || parsed.IsRoot() {
+		return string(name)
+	}
+	return parsed.Elem(parsed.NElem() - 1)
+}
+
+// overlayMkdir creates directory req.Name in directory n in the overlay.
+// Called with n locked.
+func (n *node) overlayMkdir(req *fuse.MkdirRequest) (fs.Node, error) {
+	const op = "upspinfs/fs.Mkdir"
+	f := n.f
+	if n.t == rootNode {
+		return nil, e2e(errors.E(op, errors.Permission, errors.Str("can't create in root")))
+	}
+	uname := path.Join(n.uname, req.Name)
+	upper := f.cache.overlayPath(uname)
+	if _, ok := n.inBase(uname); ok || exists(upper) {
+		return nil, e2e(errors.E(op, errors.Exist, uname))
+	}
+	if err := os.MkdirAll(upper, 0700); err != nil {
+		return nil, e2e(errors.E(op, err, uname))
+	}
+	nn := f.allocNode(n, req.Name, unixPermissions|os.ModeDir, 0, time.Now())
+	nn.attr.Uid = req.Header.Uid
+	nn.attr.Gid = req.Header.Gid
+	nn.opaque = n.opaque
+	if f.cache.unwhiteout(uname) && !n.opaque {
+		// Hide what the base had under the old directory.
+		if err := ioutil.WriteFile(filepath.Join(upper, opaqueMarker), nil, 0600); err != nil {
+			return nil, e2e(errors.E(op, err, uname))
+		}
+		nn.opaque = true
+	}
+	nn.exists()
+	return nn, nil
+}
+
+// overlayRemove removes uname, in directory n, from the overlay, leaving
+// a whiteout if it exists in the base. Called with n locked.
+func (n *node) overlayRemove(uname upspin.PathName, req *fuse.RemoveRequest) error {
+	const op = "upspinfs/fs.Remove"
+	f := n.f
+	upper := f.cache.overlayPath(uname)
+	info, err := os.Lstat(upper)
+	inUpper := err == nil
+	de, inBase := n.inBase(uname)
+	if !inUpper && !inBase {
+		return e2e(errors.E(op, errors.NotExist, uname))
+	}
+	isDir := inUpper && info.IsDir() || !inUpper && de.IsDir()
+	switch {
+	case req.Dir && !isDir:
+		return e2e(errors.E(op, errors.NotDir, uname))
+	case !req.Dir && isDir:
+		return e2e(errors.E(op, errors.IsDir, uname))
+	}
+	if isDir {
+		// Look through a node for the directory to see what it holds.
+		dn := &node{f: f, uname: uname, user: n.user, opaque: n.opaque}
+		if inUpper {
+			dn.opaque = dn.opaque || exists(filepath.Join(upper, opaqueMarker))
+		}
+		if inBase && inUpper && !de.IsDir() {
+			dn.opaque = true // The base holds a file.
+		}
+		contents, err := dn.listing()
+		if err != nil {
+			return e2e(errors.E(op, err, uname))
+		}
+		if len(contents) > 0 {
+			return e2e(errors.E(op, errors.NotEmpty, uname))
+		}
+	}
+	if inUpper {
+		if err := os.RemoveAll(upper); err != nil {
+			return e2e(errors.E(op, err, uname))
+		}
+	}
+	if inBase {
+		if err := f.cache.whiteout(uname); err != nil {
+			return e2e(errors.E(op, err, uname))
+		}
+	}
+
+	// Fix the node maps.
+	f.Lock()
+	fn := f.nodeMap[uname]
+	delete(f.nodeMap, uname)
+	f.enoentMap[uname] = time.Now().Add(defaultEnoentDuration)
+	f.Unlock()
+
+	// Avoid write back if the file is currently in use.
+	if fn != nil {
+		fn.Lock()
+		fn.noWB = true
+		fn.Unlock()
+	}
+
+	// Forget the directory entry.
+	for i, e := range n.de {
+		if uname == e.Name {
+			n.de = append(n.de[0:i], n.de[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// overlayRename renames req.OldName in directory n to req.NewName in newDir
+// within the overlay. Files from the base are first copied up. Directories
+// from the base cannot be renamed. Called with n locked.
+func (n *node) overlayRename(req *fuse.RenameRequest, newDir *node) error {
+	const op = "upspinfs/fs.Rename"
+	f := n.f
+	oldPath := path.Join(n.uname, req.OldName)
+	newPath := path.Join(newDir.uname, req.NewName)
+	oldUpper, newUpper := f.cache.overlayPath(oldPath), f.cache.overlayPath(newPath)
+	info, err := os.Lstat(oldUpper)
+	inUpper := err == nil
+	de, inBase := n.inBase(oldPath)
+	switch {
+	case !inUpper && !inBase:
+		return e2e(errors.E(op, errors.NotExist, oldPath))
+	case inBase && de.IsDir() && (!inUpper || info.IsDir()):
+		return e2e(errors.E(op, errors.Invalid, oldPath, errors.Str("can't rename a directory of the base in an overlay")))
+	}
+	if err := os.MkdirAll(filepath.Dir(newUpper), 0700); err != nil {
+		return e2e(errors.E(op, err, newPath))
+	}
+	if inUpper {
+		if err := os.Rename(oldUpper, newUpper); err != nil {
+			return e2e(errors.E(op, err, oldPath))
+		}
+	} else {
+		data, err := f.client.Get(oldPath)
+		if err != nil {
+			return e2e(errors.E(op, err, oldPath))
+		}
+		if err := ioutil.WriteFile(newUpper, data, 0600); err != nil {
+			return e2e(errors.E(op, err, newPath))
+		}
+	}
+	if inBase {
+		if err := f.cache.whiteout(oldPath); err != nil {
+			return e2e(errors.E(op, err, oldPath))
+		}
+	}
+	f.cache.unwhiteout(newPath)
+
+	f.Lock()
+	oldn := f.nodeMap[oldPath]
+	delete(f.nodeMap, oldPath)
+	delete(f.nodeMap, newPath)
+	delete(f.enoentMap, newPath)
+	f.enoentMap[oldPath] = time.Now().Add(defaultEnoentDuration)
+	if oldn != nil {
+		f.nodeMap[newPath] = oldn
+		oldn.uname = newPath
+	}
+	f.Unlock()
+	if oldn != nil {
+		oldn.Lock()
+		if cf := oldn.cf; cf != nil && cf.upper != "" {
+			if cf.fname == cf.upper {
+				cf.fname = newUpper
+			}
+			cf.upper = newUpper
+		}
+		oldn.Unlock()
+	}
+	return nil
+}
+
+// openUpper opens the file in the overlay for node h.n, if there is one,
+// and reports whether there was. The node should be locked.
+func (c *cache) openUpper(h *handle, flags fuse.OpenFlags) (bool, error) {
+	const op = "upspinfs/cache.open"
+	n := h.n
+	upper := c.overlayPath(n.uname)
+	file, err := os.OpenFile(upper, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return true, errors.E(op, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return true, errors.E(op, err)
+	}
+	// The overlay's copy is the one to change, so it is already dirty.
+	n.cf = &cachedFile{c: c, fname: upper, upper: upper, dirty: true, file: file}
+	n.attr.Size = uint64(info.Size())
+	h.flags = flags
+	return true, nil
+}
+
+// createUpper creates the file in the overlay for node h.n, replacing
+// any file there and hiding any in the base. The node should be locked.
+func (c *cache) createUpper(h *handle) error {
+	const op = "upspinfs/cache.create"
+	n := h.n
+	upper := c.overlayPath(n.uname)
+	file, err := openUpperFile(upper)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	c.unwhiteout(n.uname)
+	n.cf = &cachedFile{c: c, fname: upper, upper: upper, dirty: true, file: file}
+	return nil
+}
+
+// openUpperFile creates and opens, truncated, the named file in the
+// overlay, creating its directory if necessary.
+func openUpperFile(name string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+}
@@ -0,0 +1,200 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	gContext "golang.org/x/net/context"
+
+	"bazil.org/fuse"
+
+	"upspin.io/client"
+	"upspin.io/upspin"
+)
+
+func TestOverlay(t *testing.T) {
+	const user = "overlay@google.com"
+	cfg, err := testSetup(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Give the user a real key so the base can be written.
+	putRealKey(t, cfg)
+	c := client.New(cfg)
+	for _, dir := range []upspin.PathName{user + "/", user + "/dir"} {
+		if _, err := c.MakeDirectory(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range map[upspin.PathName]string{
+		user + "/a":     "base a",
+		user + "/gone":  "base gone",
+		user + "/dir/b": "base b",
+	} {
+		if _, err := c.Put(name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// snapshot describes everything in the base.
+	snapshot := func() []string {
+		var s []string
+		for _, pattern := range []string{user + "/*", user + "/dir/*"} {
+			entries, err := c.Glob(pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				s = append(s, fmt.Sprintf("%s %d", e.Name, e.Sequence))
+			}
+		}
+		return s
+	}
+	base := snapshot()
+
+	tmp, err := ioutil.TempDir("", "upspinfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	overlayDir := filepath.Join(tmp, "overlay")
+	f := newUpspinFS(cfg, filepath.Join(tmp, "mnt"), tmp)
+	f.cache.overlay = overlayDir
+	ctx := gContext.Background()
+
+	lookup := func(dir *node, name string) *node {
+		n, err := dir.Lookup(ctx, name)
+		if err != nil {
+			t.Fatalf("lookup %s in %s: %v", name, dir.uname, err)
+		}
+		return n.(*node)
+	}
+	read := func(n *node) string {
+		h, err := n.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatalf("open %s: %v", n.uname, err)
+		}
+		resp := &fuse.ReadResponse{Data: make([]byte, 0, 1024)}
+		if err := h.(*handle).Read(ctx, &fuse.ReadRequest{}, resp); err != nil {
+			t.Fatalf("read %s: %v", n.uname, err)
+		}
+		h.(*handle).Release(ctx, &fuse.ReleaseRequest{})
+		return string(resp.Data)
+	}
+	write := func(h *handle, data string) {
+		if err := h.Write(ctx, &fuse.WriteRequest{Data: []byte(data)}, &fuse.WriteResponse{}); err != nil {
+			t.Fatalf("write %s: %v", h.n.uname, err)
+		}
+		if err := h.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+			t.Fatalf("release %s: %v", h.n.uname, err)
+		}
+	}
+	list := func(dir *node) []string {
+		h, err := dir.Open(ctx, &fuse.OpenRequest{Dir: true}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatalf("open %s: %v", dir.uname, err)
+		}
+		defer h.(*handle).free()
+		ents, err := h.(*handle).ReadDirAll(ctx)
+		if err != nil {
+			t.Fatalf("readdir %s: %v", dir.uname, err)
+		}
+		var names []string
+		for _, e := range ents {
+			names = append(names, e.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	onDisk := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(overlayDir, user, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	root := lookup(f.root, user)
+
+	// Reads fall through to the base.
+	if got := read(lookup(root, "a")); got != "base a" {
+		t.Errorf("read through: got %q, want %q", got, "base a")
+	}
+
+	// Writing a base file copies it up.
+	h, err := lookup(root, "a").Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(h.(*handle), "local")
+	if got, want := read(lookup(root, "a")), "locala"; got != want {
+		t.Errorf("overridden file: got %q, want %q", got, want)
+	}
+	if got, want := onDisk("a"), "locala"; got != want {
+		t.Errorf("overlay copy: got %q, want %q", got, want)
+	}
+
+	// New files are created in the overlay.
+	nn, h, err := root.Create(ctx, &fuse.CreateRequest{Name: "new"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(h.(*handle), "new file")
+	if got := read(nn.(*node)); got != "new file" {
+		t.Errorf("created file: got %q", got)
+	}
+
+	// Removing a base file whites it out.
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "gone"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.Lookup(ctx, "gone"); err == nil {
+		t.Error("removed file still found")
+	}
+	if _, err := os.Stat(filepath.Join(overlayDir, user, whiteoutPrefix+"gone")); err != nil {
+		t.Errorf("no whiteout: %v", err)
+	}
+	if got, want := list(root), []string{"a", "dir", "new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("listing: got %q, want %q", got, want)
+	}
+
+	// A directory removed and made again is empty.
+	dir := lookup(root, "dir")
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "dir", Dir: true}); err == nil {
+		t.Error("removed non-empty directory")
+	}
+	if err := dir.Remove(ctx, &fuse.RemoveRequest{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "dir", Dir: true}); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := list(nd.(*node)); len(got) != 0 {
+		t.Errorf("remade directory holds %q", got)
+	}
+	if _, err := nd.(*node).Lookup(ctx, "b"); err == nil {
+		t.Error("remade directory shows the base's file")
+	}
+
+	// None of it reached Upspin.
+	if got := snapshot(); !reflect.DeepEqual(got, base) {
+		t.Errorf("base modified: got %q, want %q", got, base)
+	}
+	if data, err := c.Get(user + "/a"); err != nil || string(data) != "base a" {
+		t.Errorf("base file: got %q, %v", data, err)
+	}
+}
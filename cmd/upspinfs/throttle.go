@@ -0,0 +1,110 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// maxThrottleWait is the longest an operation will wait for the throttle
+// before failing with a transient error (EAGAIN).
+const maxThrottleWait = time.Second
+
+// throttle is a token bucket that limits the rate of metadata operations
+// sent to the directory server. A nil *throttle imposes no limit.
+type throttle struct {
+	sync.Mutex
+	rate   float64   // Tokens added per second; also the bucket size.
+	tokens float64   // Tokens currently available.
+	last   time.Time // When tokens was last replenished.
+}
+
+// newThrottle returns a throttle allowing opsPerSec operations per second.
+// If opsPerSec is not positive, it returns nil, meaning no limit.
+func newThrottle(opsPerSec int) *throttle {
+	if opsPerSec <= 0 {
+		return nil
+	}
+	return &throttle{
+		rate:   float64(opsPerSec),
+		tokens: float64(opsPerSec),
+		last:   time.Now(),
+	}
+}
+
+// wait takes a token from the bucket, blocking until one is available.
+// If none will be available within maxThrottleWait, it returns a
+// transient error without taking a token.
+func (t *throttle) wait() error {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+	t.tokens--
+	if t.tokens >= 0 {
+		t.Unlock()
+		return nil
+	}
+	delay := time.Duration(-t.tokens / t.rate * float64(time.Second))
+	if delay > maxThrottleWait {
+		// Give the token back; this operation will not happen.
+		t.tokens++
+		t.Unlock()
+		return errors.E(errors.Transient, errors.Str("too many directory operations"))
+	}
+	t.Unlock()
+	time.Sleep(delay)
+	return nil
+}
+
+// throttledDir is a DirServer whose metadata operations are rate limited.
+type throttledDir struct {
+	upspin.DirServer
+	t *throttle
+}
+
+// Lookup implements upspin.DirServer.
+func (d throttledDir) Lookup(name upspin.PathName) (*upspin.DirEntry, error) {
+	if err := d.t.wait(); err != nil {
+		return nil, errors.E(name, err)
+	}
+	return d.DirServer.Lookup(name)
+}
+
+// Glob implements upspin.DirServer.
+func (d throttledDir) Glob(pattern string) ([]*upspin.DirEntry, error) {
+	if err := d.t.wait(); err != nil {
+		return nil, errors.E(upspin.PathName(pattern), err)
+	}
+	return d.DirServer.Glob(pattern)
+}
+
+// Put implements upspin.DirServer.
+func (d throttledDir) Put(entry *upspin.DirEntry) (*upspin.DirEntry, error) {
+	if err := d.t.wait(); err != nil {
+		return nil, errors.E(entry.Name, err)
+	}
+	return d.DirServer.Put(entry)
+}
+
+// Delete implements upspin.DirServer.
+func (d throttledDir) Delete(name upspin.PathName) (*upspin.DirEntry, error) {
+	if err := d.t.wait(); err != nil {
+		return nil, errors.E(name, err)
+	}
+	return d.DirServer.Delete(name)
+}
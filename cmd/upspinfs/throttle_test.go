@@ -0,0 +1,76 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// countingDir is a DirServer that counts Lookups.
+type countingDir struct {
+	upspin.DirServer
+	lookups int32
+}
+
+func (d *countingDir) Lookup(name upspin.PathName) (*upspin.DirEntry, error) {
+	atomic.AddInt32(&d.lookups, 1)
+	return &upspin.DirEntry{Name: name}, nil
+}
+
+// TestThrottle issues a burst of stats and checks that the rate reaching
+// the directory server stays under the limit.
+func TestThrottle(t *testing.T) {
+	const rate = 20
+	cd := &countingDir{}
+	dir := throttledDir{cd, newThrottle(rate)}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	var transient int32
+	for i := 0; i < 4*rate; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := dir.Lookup("tester@google.com/file")
+			if err != nil {
+				if !errors.Match(errors.E(errors.Transient), err) {
+					t.Errorf("Lookup: %v, want transient error", err)
+				}
+				atomic.AddInt32(&transient, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start).Seconds()
+
+	// The full bucket allows an initial burst of rate operations.
+	max := rate + int32(elapsed*rate) + 1
+	if n := atomic.LoadInt32(&cd.lookups); n > max {
+		t.Errorf("%d lookups in %.2fs, want at most %d", n, elapsed, max)
+	}
+	if transient == 0 {
+		t.Error("no operations were refused")
+	}
+	if n := atomic.LoadInt32(&cd.lookups) + transient; n != 4*rate {
+		t.Errorf("%d operations accounted for, want %d", n, 4*rate)
+	}
+}
+
+func TestNoThrottle(t *testing.T) {
+	th := newThrottle(0)
+	for i := 0; i < 1000; i++ {
+		if err := th.wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -79,6 +79,23 @@ func testSetup(name string) (upspin.Config, error) {
 	return cfg, err
 }
 
+// putRealKey gives the config's user its real public key, so that it
+// can write files with the config's packing.
+func putRealKey(t *testing.T, cfg upspin.Config) {
+	key, err := bind.KeyServer(cfg, cfg.KeyEndpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Put(&upspin.User{
+		Name:      cfg.UserName(),
+		Dirs:      []upspin.Endpoint{cfg.DirEndpoint()},
+		Stores:    []upspin.Endpoint{cfg.StoreEndpoint()},
+		PublicKey: cfg.Factotum().PublicKey(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func mount() error {
 	// Create a mountpoint. There are 4 possible mountpoints /tmp/upsinfstest[1-4].
 	// This lets us set up some /etc/fstab entries on Linux for the tests and
@@ -0,0 +1,119 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// wbLogName is the name, in the root of the mount, of the read-only file
+// listing writebacks that failed.
+const wbLogName = ".writeback-failures"
+
+// maxWBFailures is the number of failures the log keeps; older ones are
+// dropped.
+const maxWBFailures = 1000
+
+// A file not made durable when it is closed is made durable in the
+// background. An attempt that fails is retried wbTries times in all, at
+// intervals starting at wbRetryDelay and doubling. They are variables so
+// tests can change them.
+var (
+	wbTries      = 6
+	wbRetryDelay = 1 * time.Second
+)
+
+// failureLog records writebacks that failed after the file was closed, so that
+// they are not lost silently.
+type failureLog struct {
+	sync.Mutex
+	notify   string // Command run for each failure; empty means none.
+	failures []wbFailure
+}
+
+type wbFailure struct {
+	time time.Time
+	name upspin.PathName
+	err  error
+}
+
+func newFailureLog(notify string) *failureLog {
+	return &failureLog{notify: notify}
+}
+
+// add records the failure to write back the named file and runs the
+// notification command, if any. It does nothing if l is nil.
+func (l *failureLog) add(name upspin.PathName, err error) {
+	if l == nil {
+		return
+	}
+	log.Error.Printf("upspinfs: writeback of %s failed: %v", name, err)
+	l.Lock()
+	l.failures = append(l.failures, wbFailure{time: time.Now(), name: name, err: err})
+	if len(l.failures) > maxWBFailures {
+		l.failures = l.failures[len(l.failures)-maxWBFailures:]
+	}
+	l.Unlock()
+	if l.notify == "" {
+		return
+	}
+	go func() {
+		if out, cerr := exec.Command(l.notify, string(name), err.Error()).CombinedOutput(); cerr != nil {
+			log.Error.Printf("upspinfs: writeback notification %s: %v: %s", l.notify, cerr, out)
+		}
+	}()
+}
+
+// contents returns the text of the log: a line for each failure giving
+// its time, the file's name, and the error, joined into one line.
+func (l *failureLog) contents() []byte {
+	l.Lock()
+	defer l.Unlock()
+	var b bytes.Buffer
+	for _, f := range l.failures {
+		msg := strings.Join(strings.Fields(f.err.Error()), " ")
+		fmt.Fprintf(&b, "%s %s: %s\n", f.time.Format(time.RFC3339), f.name, msg)
+	}
+	return b.Bytes()
+}
+
+// readAt reads the log's text at the offset.
+func (l *failureLog) readAt(buf []byte, offset int64) int {
+	data := l.contents()
+	if offset >= int64(len(data)) {
+		return 0
+	}
+	return copy(buf, data[offset:])
+}
+
+// makeDurableLater makes the file durable in the background, as
+// makeDurable does before close returns for tiny files, and records it in
+// the log if that keeps failing.
+func (c *cache) makeDurableLater(de *upspin.DirEntry) {
+	go func() {
+		delay := wbRetryDelay
+		var err error
+		for try := 0; try < wbTries; try++ {
+			if try > 0 {
+				time.Sleep(delay)
+				delay *= 2
+			}
+			if err = c.makeDurable(de); err == nil {
+				return
+			}
+		}
+		c.failed.add(de.Name, err)
+	}()
+}
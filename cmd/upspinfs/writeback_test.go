@@ -0,0 +1,133 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gContext "golang.org/x/net/context"
+
+	"bazil.org/fuse"
+
+	"upspin.io/client"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// brokenStore is a StoreServer, dialed directly, that fails every Put.
+type brokenStore struct {
+	upspin.StoreServer
+}
+
+func (brokenStore) Put(data []byte) (*upspin.Refdata, error) {
+	return nil, errors.E(errors.IO, errors.Str("disk on fire"))
+}
+
+func TestWritebackLog(t *testing.T) {
+	const (
+		user = "wblog@google.com"
+		file = user + "/file"
+	)
+	cfg, err := testSetup(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRealKey(t, cfg)
+	if _, err := client.New(cfg).MakeDirectory(user + "/"); err != nil {
+		t.Fatal(err)
+	}
+	cfg = config.SetCacheEndpoint(cfg, upspin.Endpoint{Transport: upspin.Remote, NetAddr: "localhost:9999"})
+	defer func(f func(upspin.Config, upspin.Endpoint) (upspin.StoreServer, error)) { dialDirect = f }(dialDirect)
+	dialDirect = func(upspin.Config, upspin.Endpoint) (upspin.StoreServer, error) {
+		return brokenStore{}, nil
+	}
+	defer func(tries int, delay time.Duration) { wbTries, wbRetryDelay = tries, delay }(wbTries, wbRetryDelay)
+	wbTries, wbRetryDelay = 3, time.Millisecond
+
+	tmp, err := ioutil.TempDir("", "upspinfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	notified := filepath.Join(tmp, "notified")
+	notify := filepath.Join(tmp, "notify")
+	if err := ioutil.WriteFile(notify, []byte("#!/bin/sh\necho \"$1\" > "+notified+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	*wbLog, *wbNotify = true, notify
+	defer func() { *wbLog, *wbNotify = false, "" }()
+	f := newUpspinFS(cfg, filepath.Join(tmp, "mnt"), tmp)
+	ctx := gContext.Background()
+
+	// Close a file whose writeback then fails for good.
+	dn, err := f.root.Lookup(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, fh, err := dn.(*node).Create(ctx, &fuse.CreateRequest{Name: "file"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := fh.(*handle)
+	if err := h.Write(ctx, &fuse.WriteRequest{Data: []byte("precious")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if fn.(*node).uname != file {
+		t.Fatalf("created %s, want %s", fn.(*node).uname, file)
+	}
+
+	// The failure appears in the log file at the root.
+	ln, err := f.root.Lookup(ctx, wbLogName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text string
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		lh, err := ln.(*node).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &fuse.ReadResponse{Data: make([]byte, 0, 4096)}
+		if err := lh.(*handle).Read(ctx, &fuse.ReadRequest{}, resp); err != nil {
+			t.Fatal(err)
+		}
+		lh.(*handle).Release(ctx, &fuse.ReleaseRequest{})
+		if text = string(resp.Data); text != "" {
+			break
+		}
+	}
+	if !strings.Contains(text, file+":") || !strings.Contains(text, "disk on fire") {
+		t.Fatalf("log is %q, want a line for %s", text, file)
+	}
+	var attr fuse.Attr
+	if err := ln.Attr(ctx, &attr); err != nil {
+		t.Fatal(err)
+	}
+	if attr.Size != uint64(len(text)) {
+		t.Errorf("log size is %d, want %d", attr.Size, len(text))
+	}
+	if _, err := ln.(*node).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{}); err == nil {
+		t.Error("opened the log for writing")
+	}
+
+	// And the notification command was run for it.
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, err := ioutil.ReadFile(notified); err == nil && strings.TrimSpace(string(data)) == file {
+			return
+		}
+	}
+	t.Errorf("notification command not run for %s", file)
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"syscall"
+
+	"bazil.org/fuse"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// The read-only extended attributes that, with -xattr, expose fields of
+// a node's Upspin directory entry.
+const (
+	xattrSequence = "user.upspin.sequence" // The sequence number, in decimal.
+	xattrPacking  = "user.upspin.packing"  // The name of the packing.
+	xattrBlocks   = "user.upspin.blocks"   // A line for each block: offset, size, and reference.
+)
+
+var entryXattrs = []string{xattrSequence, xattrPacking, xattrBlocks}
+
+// entry looks up the node's directory entry afresh, so that the
+// attributes reflect changes made elsewhere. The root has none.
+func (n *node) entry() (*upspin.DirEntry, error) {
+	const op = "upspinfs/xattr"
+	if n.t == rootNode {
+		return nil, fuse.ErrNoXattr
+	}
+	de, err := n.f.client.Lookup(n.uname, false)
+	if err != nil {
+		return nil, e2e(errors.E(op, n.uname, err))
+	}
+	return de, nil
+}
+
+// getEntryXattr returns the value of one of entryXattrs.
+func (n *node) getEntryXattr(req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if !isEntryXattr(req.Name) {
+		return fuse.ErrNoXattr
+	}
+	de, err := n.entry()
+	if err != nil {
+		return err
+	}
+	switch req.Name {
+	case xattrSequence:
+		resp.Xattr = []byte(strconv.FormatInt(de.Sequence, 10))
+	case xattrPacking:
+		resp.Xattr = []byte(de.Packing.String())
+	case xattrBlocks:
+		var b bytes.Buffer
+		for _, block := range de.Blocks {
+			fmt.Fprintf(&b, "%d %d %s\n", block.Offset, block.Size, block.Location.Reference)
+		}
+		resp.Xattr = b.Bytes()
+	}
+	return nil
+}
+
+// listEntryXattrs lists entryXattrs for all but the root.
+func (n *node) listEntryXattrs(resp *fuse.ListxattrResponse) {
+	if n.t != rootNode {
+		resp.Append(entryXattrs...)
+	}
+}
+
+// setEntryXattr refuses to change entryXattrs, and reports that others
+// are not supported.
+func (n *node) setEntryXattr(name string) error {
+	if isEntryXattr(name) {
+		return &errnoError{syscall.EPERM, errors.Str("read-only attribute " + name)}
+	}
+	return notSupported("setxattr")
+}
+
+func isEntryXattr(name string) bool {
+	for _, x := range entryXattrs {
+		if name == x {
+			return true
+		}
+	}
+	return false
+}
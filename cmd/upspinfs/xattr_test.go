@@ -0,0 +1,106 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	gContext "golang.org/x/net/context"
+
+	"bazil.org/fuse"
+
+	"upspin.io/client"
+	"upspin.io/upspin"
+)
+
+func TestEntryXattrs(t *testing.T) {
+	const user = "xattr@google.com"
+	cfg, err := testSetup(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRealKey(t, cfg)
+	c := client.New(cfg)
+	if _, err := c.MakeDirectory(user + "/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put(user+"/file", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "upspinfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	f := newUpspinFS(cfg, filepath.Join(tmp, "mnt"), tmp)
+	f.xattr = true
+	ctx := gContext.Background()
+
+	root, err := f.root.Lookup(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, err := root.(*node).Lookup(ctx, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := fn.(*node)
+	get := func(name string) string {
+		resp := &fuse.GetxattrResponse{}
+		if err := n.Getxattr(ctx, &fuse.GetxattrRequest{Name: name}, resp); err != nil {
+			t.Fatalf("getxattr %s: %v", name, err)
+		}
+		return string(resp.Xattr)
+	}
+
+	resp := &fuse.ListxattrResponse{}
+	if err := n.Listxattr(ctx, &fuse.ListxattrRequest{}, resp); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join(entryXattrs, "\x00") + "\x00"
+	if got := string(resp.Xattr); got != want {
+		t.Errorf("listxattr: got %q, want %q", got, want)
+	}
+	if got, want := get(xattrPacking), upspin.EEPack.String(); got != want {
+		t.Errorf("packing: got %q, want %q", got, want)
+	}
+	blocks := strings.Fields(get(xattrBlocks))
+	if len(blocks) != 3 || blocks[0] != "0" || blocks[1] != "5" {
+		t.Errorf("blocks: got %q, want offset 0, size 5, and a reference", blocks)
+	}
+	before, err := strconv.ParseInt(get(xattrSequence), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Modifying the file changes its sequence number.
+	if _, err := c.Put(user+"/file", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	after, err := strconv.ParseInt(get(xattrSequence), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after <= before {
+		t.Errorf("sequence after modification is %d, was %d", after, before)
+	}
+
+	// The attributes are read-only, and others do not exist.
+	if err := n.Setxattr(ctx, &fuse.SetxattrRequest{Name: xattrSequence, Xattr: []byte("1")}); err == nil {
+		t.Error("setxattr of sequence succeeded")
+	}
+	err = n.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.other"}, &fuse.GetxattrResponse{})
+	if err != fuse.ErrNoXattr {
+		t.Errorf("getxattr of other attribute: got %v, want %v", err, fuse.ErrNoXattr)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import "sync"
+
+// byteBudget limits the bytes of block data that writers hold in memory
+// at once, as set by the writebackMemory option. A writer acquires the
+// size of a block before reading it and releases it once the Put is
+// done, waiting while the budget is spent.
+//
+// A nil *byteBudget imposes no limit.
+type byteBudget struct {
+	sync.Mutex
+	free  *sync.Cond // Signaled as bytes are released.
+	limit int64
+	held  int64 // Bytes acquired and not yet released.
+	peak  int64 // The most bytes held at once.
+}
+
+func newByteBudget(limit int64) *byteBudget {
+	b := &byteBudget{limit: limit}
+	b.free = sync.NewCond(b)
+	return b
+}
+
+// acquire waits until n bytes of the budget are free and takes them,
+// returning the number taken, to be passed to release. A request for
+// more than the whole budget waits until none is held and takes it all,
+// so that a block larger than the budget is still written back, alone.
+func (b *byteBudget) acquire(n int64) int64 {
+	if b == nil {
+		return 0
+	}
+	if n > b.limit {
+		n = b.limit
+	}
+	b.Lock()
+	defer b.Unlock()
+	for b.held+n > b.limit {
+		b.free.Wait()
+	}
+	b.held += n
+	if b.held > b.peak {
+		b.peak = b.held
+	}
+	return n
+}
+
+// release returns n bytes, as returned by acquire, to the budget.
+func (b *byteBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.held -= n
+	b.free.Broadcast()
+}
+
+// maxHeld returns the most bytes held at once.
+func (b *byteBudget) maxHeld() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.peak
+}
@@ -5,7 +5,9 @@
 package storecache // import "upspin.io/store/storecache"
 
 import (
+	"encoding/base32"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
@@ -25,7 +27,7 @@ import (
 // In the following code to avoid deadlock always lock in the order
 //   lruLock -> cachedRef
 //
-// storeCache.Mutex serializes access to the LRU. This prevents two threads simultaneously creating
+// storeCache.Mutex serializes access to the LRUs. This prevents two threads simultaneously creating
 // the same cachedRef.
 //
 // cachedRef.Mutex plus cachedRef.hold serialize readers and writers of a cachedRef.
@@ -41,25 +43,63 @@ type cachedRef struct {
 	hold   *sync.Cond      // Wait here if some other func is caching the ref.
 	valid  bool            // True if successfully cached.
 	remove bool            // Remove when no longer busy.
+
+	// hotSize is the size counted in storeCache.hotBytes, non-zero
+	// only while the ref is in the protected segment. It is guarded
+	// by the storeCache's lock, not the cachedRef's.
+	hotSize int64
 }
 
 // storeCache represents a cache for references. If, upon adding to the cache,
 // we find more than limit bytes in use, we will remove the oldest entry until below
 // the limit. It is possible to push past the limit; it is a soft limit.
 //
+// The cache is a segmented LRU. References enter the probationary segment,
+// lru, and move to the protected segment, hot, when read again while cached.
+// Entries are evicted from the probationary segment first, so a stream of
+// references read only once cannot push out those read repeatedly. When the
+// protected segment grows beyond hotFraction of the limit, its least
+// recently used entries are moved back to the probationary segment. The
+// segments share the limit on the number of entries in the same proportion.
+// References awaiting writeback are never evicted, nor are those pinned.
 type storeCache struct {
 	inUse int64 // Current bytes cached.
+	churn churn // Kept with inUse for 64-bit alignment.
 	cfg   upspin.Config
 	sync.Mutex
-	dir   string     // Top directory for cached references.
-	limit int64      // Soft limit of the maximum bytes to store.
-	lru   *cache.LRU // Key is the reference. Value is &cachedRef.
-	wbq   *writebackQueue
+	dir      string     // Top directory for cached references.
+	limit    int64      // Soft limit of the maximum bytes to store.
+	lru      *cache.LRU // Probationary segment. Key is the file. Value is &cachedRef.
+	hot      *cache.LRU // Protected segment. Key is the file. Value is &cachedRef.
+	hotBytes int64      // Bytes in the protected segment.
+	hotRefs  int        // Most entries in the protected segment.
+	wbq      *writebackQueue
+	opts     options
+	packs    *packStore // Holds cache files smaller than opts.pack; may be nil.
+
+	// kept holds the entries pushed out of a segment by its limit on
+	// the number of entries but kept, as they await writeback or are
+	// pinned, until they can be evicted; see OnEviction.
+	kept map[string]*cachedRef
+
+	// When the writeback links are loaded from the index, fill adds
+	// the cache files to the LRU in the background. Until it is done,
+	// filled is open; stopFill, closed, stops it.
+	filled   chan bool
+	stopFill chan bool
+
+	// pins holds the cache files pinned against eviction, whether or
+	// not they are cached yet.
+	pins map[string]bool
 }
 
+// hotFraction is the fraction of the cache's limit that references in the
+// protected segment may occupy.
+const hotFraction = 0.8
+
 // newCache returns the cache rooted at dir. It will walk the cache to put all files
 // into the LRU.
-func newCache(cfg upspin.Config, dir string, maxBytes int64, writethrough bool) (*storeCache, func(upspin.Location), error) {
+func newCache(cfg upspin.Config, dir string, maxBytes int64, writethrough bool, opts options) (*storeCache, func(upspin.Location), error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, nil, err
 	}
@@ -67,20 +107,77 @@ func newCache(cfg upspin.Config, dir string, maxBytes int64, writethrough bool)
 	if maxRefs > 100000 {
 		maxRefs = 100000
 	}
-	c := &storeCache{cfg: cfg, dir: dir, limit: maxBytes, lru: cache.NewLRU(maxRefs)}
+	hotRefs := int(hotFraction * float64(maxRefs))
+	if hotRefs < 1 {
+		hotRefs = 1
+	}
+	if maxRefs-hotRefs < 1 {
+		maxRefs = hotRefs + 1
+	}
+	c := &storeCache{
+		cfg:     cfg,
+		dir:     dir,
+		limit:   maxBytes,
+		lru:     cache.NewLRU(maxRefs - hotRefs),
+		hot:     cache.NewLRU(hotRefs),
+		hotRefs: hotRefs,
+		opts:    opts,
+		pins:    make(map[string]bool),
+		kept:    make(map[string]*cachedRef),
+	}
+	// Open the pack store even if packing is now off,
+	// as it may hold blocks still to be written back.
+	packs := filepath.Join(filepath.Dir(dir), packDir)
+	if _, err := os.Stat(packs); opts.pack > 0 || err == nil {
+		if c.packs, err = openPackStore(packs, dir); err != nil {
+			return nil, nil, err
+		}
+	}
 	var blockFlusher func(upspin.Location)
 	if !writethrough {
-		c.wbq = newWritebackQueue(c)
-		blockFlusher = func(l upspin.Location) { c.wbq.flush(l) }
+		j, recovered, err := openJournal(filepath.Join(filepath.Dir(dir), journalName))
+		if err != nil {
+			return nil, nil, err
+		}
+		x, err := openIndex(filepath.Join(filepath.Dir(dir), indexName), filepath.Join(dir, indexMarkerName))
+		if err != nil {
+			return nil, nil, err
+		}
+		c.wbq = newWritebackQueue(c, j, x, recovered)
+		blockFlusher = func(l upspin.Location) {
+			if err := c.wbq.flush(l); err != nil {
+				log.Error.Printf("store/storecache: flush %s: %s", l, err)
+			}
+		}
+	}
+	if c.wbq != nil && c.wbq.index.loaded {
+		// No need to walk the cache for the writeback links.
+		c.wbq.enqueueIndexed()
+		c.filled = make(chan bool)
+		c.stopFill = make(chan bool)
+		go c.fill()
+	} else {
+		c.walk(dir)
+		c.walkPacks()
+	}
+	if c.wbq != nil {
+		c.wbq.recovered = nil
+		c.wbq.startRecovered()
 	}
-	c.walk(dir)
 	return c, blockFlusher, nil
 }
 
 func (c *storeCache) close() {
+	if c.filled != nil {
+		close(c.stopFill)
+		<-c.filled
+	}
 	if c.wbq != nil {
 		c.wbq.close()
 	}
+	if c.packs != nil {
+		c.packs.close()
+	}
 }
 
 // walk does a recursive walk of the cache directories adding cached references
@@ -117,7 +214,15 @@ func (c *storeCache) walk(dir string) error {
 		if c.wbq.enqueueWritebackFile(pathName) {
 			continue
 		}
-		// Not a writeback link, remember it and account for its size.
+		// Not a writeback link. If it isn't a well formed cache file,
+		// for example a leftover temporary file or one named by an
+		// older version, remove it.
+		if _, err := c.parseCachePath(pathName); err != nil {
+			log.Info.Printf("store/storecache.walk: removing %s: %s", pathName, err)
+			os.Remove(pathName)
+			continue
+		}
+		// Remember it and account for its size.
 		cr := c.newCachedRef(pathName)
 		cr.size = i.Size()
 		cr.valid = true
@@ -126,18 +231,162 @@ func (c *storeCache) walk(dir string) error {
 	return err
 }
 
+// fill adds the cache files, in the file system and in packs, to the
+// LRU, as walk does, for a cache whose writeback links were loaded from
+// the index. It runs as the cache is used, so it leaves the links, and
+// files it does not recognize, alone, and skips files already in the LRU.
+func (c *storeCache) fill() {
+	defer close(c.filled)
+	errStopped := errors.New("stopped")
+	add := func(file string, size func() (int64, error)) error {
+		select {
+		case <-c.stopFill:
+			return errStopped
+		default:
+		}
+		if strings.HasSuffix(file, writebackSuffix) {
+			return nil
+		}
+		if _, err := c.parseCachePath(file); err != nil {
+			return nil
+		}
+		n, err := size()
+		if err != nil {
+			return nil
+		}
+		c.Lock()
+		defer c.Unlock()
+		if _, ok := c.lookup(file); ok {
+			return nil
+		}
+		cr := c.newCachedRef(file)
+		cr.size = n
+		cr.valid = true
+		cr.busy = false
+		return nil
+	}
+	err := filepath.Walk(c.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		return add(file, func() (int64, error) { return info.Size(), nil })
+	})
+	if err != nil || c.packs == nil {
+		return
+	}
+	for _, file := range c.packs.list() {
+		if err := add(file, func() (int64, error) { return c.packs.size(file) }); err != nil {
+			return
+		}
+	}
+}
+
+// filling reports whether fill is still adding cache files to the LRU.
+func (c *storeCache) filling() bool {
+	if c.filled == nil {
+		return false
+	}
+	select {
+	case <-c.filled:
+		return false
+	default:
+		return true
+	}
+}
+
 // cachePath builds a path to the local cache file.
 //
 // The actual cache file depends on the server endpoint because we have
 // not yet decided on any constraints on reference names, for example
 // when mapping host file names to references.
 // TODO(p): Revisit when we do.
+//
+// Since references may contain characters that are illegal or special
+// in host file names, the file name is an encoding of the reference.
+// See refFileName.
 func (c *storeCache) cachePath(ref upspin.Reference, e upspin.Endpoint) string {
+	name := refFileName(ref)
 	subdir := "zz"
-	if len(ref) > 1 {
-		subdir = string(ref[:2])
+	if len(name) > 1 {
+		subdir = name[:2]
+	}
+	return path.Join(c.dir, e.String(), subdir, name)
+}
+
+// parseCachePath is the inverse of cachePath. It returns the location
+// represented by the named cache file, which must not have a suffix.
+func (c *storeCache) parseCachePath(file string) (upspin.Location, error) {
+	var loc upspin.Location
+	elems := strings.SplitN(strings.TrimPrefix(file, c.dir+"/"), "/", 3)
+	if len(elems) != 3 {
+		return loc, errors.New("not a cache file name")
+	}
+	e, err := upspin.ParseEndpoint(elems[0])
+	if err != nil {
+		return loc, err
+	}
+	ref, err := parseRefFileName(elems[2])
+	if err != nil {
+		return loc, err
+	}
+	if c.cachePath(ref, *e) != file {
+		return loc, errors.New("cache file in wrong directory")
+	}
+	loc.Endpoint = *e
+	loc.Reference = ref
+	return loc, nil
+}
+
+// refEncoding encodes references as file names. Its alphabet is
+// upper case letters and digits, which are safe in host file names and
+// cannot be confused with the suffixes appended to cache file names.
+var refEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+const (
+	// maxRefElem is the maximum length of an element of a
+	// reference's file name. Longer encodings are split into
+	// several elements, each but the last ending in refElemCont.
+	maxRefElem  = 128
+	refElemCont = "-"
+
+	// emptyRefName is the file name for the empty reference.
+	emptyRefName = "_"
+)
+
+// refFileName returns a relative file name for the reference. The name is
+// unique to the reference and the reference can be recovered from it by
+// parseRefFileName.
+func refFileName(ref upspin.Reference) string {
+	enc := refEncoding.EncodeToString([]byte(ref))
+	if enc == "" {
+		return emptyRefName
+	}
+	var elems []string
+	for len(enc) > maxRefElem {
+		elems = append(elems, enc[:maxRefElem]+refElemCont)
+		enc = enc[maxRefElem:]
+	}
+	return path.Join(append(elems, enc)...)
+}
+
+// parseRefFileName returns the reference whose file name is name.
+func parseRefFileName(name string) (upspin.Reference, error) {
+	if name == emptyRefName {
+		return "", nil
 	}
-	return path.Join(c.dir, e.String(), subdir, string(ref))
+	elems := strings.Split(name, "/")
+	for i := range elems[:len(elems)-1] {
+		elems[i] = strings.TrimSuffix(elems[i], refElemCont)
+	}
+	b, err := refEncoding.DecodeString(strings.Join(elems, ""))
+	if err != nil {
+		return "", err
+	}
+	ref := upspin.Reference(b)
+	if refFileName(ref) != name {
+		return "", errors.New("not a reference file name")
+	}
+	return ref, nil
 }
 
 // newCachedRef creates a new locked and busy cachedRef.
@@ -165,7 +414,8 @@ func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpo
 	var cr *cachedRef
 	for {
 		c.Lock()
-		value, ok := c.lru.Get(file)
+		var ok bool
+		cr, ok = c.lookup(file)
 		if !ok {
 			// First time we've seen this. Create a new cachedRef and add to LRU.
 			cr = c.newCachedRef(file)
@@ -173,7 +423,6 @@ func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpo
 			c.Unlock()
 			break
 		}
-		cr = value.(*cachedRef)
 		cr.Lock()
 		c.Unlock()
 		if !cr.valid {
@@ -190,7 +439,7 @@ func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpo
 			cr.Unlock()
 			continue
 		}
-		data, err := readFromCacheFile(file)
+		data, err := c.readFile(file)
 		if err != nil {
 			// Could not read the cached data.
 			// Invalidate the cachedRef so that it will be fetched again.
@@ -198,6 +447,7 @@ func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpo
 			break
 		}
 		cr.Unlock()
+		c.touch(file)
 		return data, nil, nil
 	}
 	defer func() {
@@ -209,6 +459,15 @@ func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpo
 		cr.Unlock()
 	}()
 
+	// Until fill is done, the file may be cached but not in the LRU.
+	if c.filling() {
+		if data, err := c.readFile(file); err == nil {
+			cr.size = int64(len(data))
+			cr.valid = true
+			return data, nil, nil
+		}
+	}
+
 	// isError reports whether err is non-nil and remembers it if it is.
 	var firstError error
 	isError := func(err error) bool {
@@ -253,6 +512,8 @@ func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpo
 				if !refdata.Volatile {
 					if err := cr.saveToCacheFile(file, data); err != nil {
 						log.Info.Printf("saving cached ref %s to %s: %s", string(ref), file, err)
+					} else {
+						c.churn.create()
 					}
 				}
 				return data, nil, nil
@@ -276,7 +537,15 @@ func (c *storeCache) get(cfg upspin.Config, ref upspin.Reference, e upspin.Endpo
 }
 
 // put saves a reference in the cache. put has the same invariants as get.
+// A writeback is queued for the user of cfg.
 func (c *storeCache) put(cfg upspin.Config, data []byte, e upspin.Endpoint) (upspin.Reference, error) {
+	return c.putFor(cfg, cfg.UserName(), data, e)
+}
+
+// putFor is put for a block put by the user, whose writeback is queued
+// with those of that user. The user may not be that of cfg, as a cache
+// server can serve several users but writes back as its own.
+func (c *storeCache) putFor(cfg upspin.Config, user upspin.UserName, data []byte, e upspin.Endpoint) (upspin.Reference, error) {
 	var ref upspin.Reference
 	if c.wbq == nil {
 		// If we can't put it to the store, don't cache.
@@ -288,6 +557,7 @@ func (c *storeCache) put(cfg upspin.Config, data []byte, e upspin.Endpoint) (ups
 		if err != nil {
 			return "", err
 		}
+		c.churn.storePut(len(data))
 		ref = refdata.Reference
 	} else {
 		ref = upspin.Reference(sha256key.Of(data).String())
@@ -296,10 +566,8 @@ func (c *storeCache) put(cfg upspin.Config, data []byte, e upspin.Endpoint) (ups
 	c.enforceByteLimitByRemovingLeastRecentlyUsedFile()
 
 	c.Lock()
-	value, ok := c.lru.Get(file)
-	var cr *cachedRef
+	cr, ok := c.lookup(file)
 	if ok {
-		cr = value.(*cachedRef)
 		cr.Lock()
 		defer cr.Unlock()
 		c.Unlock()
@@ -323,11 +591,13 @@ func (c *storeCache) put(cfg upspin.Config, data []byte, e upspin.Endpoint) (ups
 			// cache is fatal.
 			return "", err
 		}
+	} else {
+		c.churn.create()
 	}
 
 	// Add to list of files to write back.
 	if c.wbq != nil {
-		if err := c.wbq.requestWriteback(ref, e); err != nil {
+		if err := c.wbq.requestWriteback(ref, e, int64(len(data)), user); err != nil {
 			return "", err
 		}
 	}
@@ -337,6 +607,26 @@ func (c *storeCache) put(cfg upspin.Config, data []byte, e upspin.Endpoint) (ups
 	return ref, nil
 }
 
+// importPending adds the block at loc, exported by another cache, whose
+// data is in file, and queues it for writeback. Storing the block as put
+// does, with requestWriteback, indexes the new writeback link and queues
+// it as enqueueWritebackFile would on startup; neither the journal nor
+// legacy names apply to a link made now.
+func (c *storeCache) importPending(loc upspin.Location, file string) error {
+	data, err := readFromCacheFile(file)
+	if err != nil {
+		return err
+	}
+	if ref := upspin.Reference(sha256key.Of(data).String()); ref != loc.Reference {
+		return fmt.Errorf("%s: contents do not match reference %q", file, loc.Reference)
+	}
+	if _, err := c.put(c.cfg, data, loc.Endpoint); err != nil {
+		return err
+	}
+	// If the block was already cached, put did not ask for a writeback.
+	return c.wbq.requestWriteback(loc.Reference, loc.Endpoint, int64(len(data)), c.cfg.UserName())
+}
+
 // delete removes a reference from the cache.
 // - No locks are held on entry or exit.
 // - If the cache file is busy, don't remove it.
@@ -348,22 +638,122 @@ func (c *storeCache) delete(cfg upspin.Config, ref upspin.Reference, e upspin.En
 	if err := store.Delete(ref); err != nil {
 		return err
 	}
-	file := c.cachePath(ref, e)
+	if ref == emptyRef && c.wbq != nil {
+		c.wbq.setHasEmpty(e, false)
+	}
+	c.remove(c.cachePath(ref, e))
+	return nil
+}
+
+// remove removes a cache file and forgets it, unless it is busy.
+// No locks are held on entry or exit.
+func (c *storeCache) remove(file string) {
 	c.Lock()
 	defer c.Unlock()
-	value, ok := c.lru.Get(file)
+	cr, ok := c.lookup(file)
 	if !ok {
-		return nil
+		return
 	}
-	cr := value.(*cachedRef)
 	cr.Lock()
 	defer cr.Unlock()
 	if cr.busy {
-		return nil
+		return
 	}
 	c.lru.Remove(file)
+	if c.hot.Remove(file) != nil {
+		c.hotBytes -= cr.hotSize
+		cr.hotSize = 0
+	}
+	delete(c.kept, file)
 	cr.removeFile(file)
-	return nil
+}
+
+// lookup returns the cachedRef for file from whichever segment holds it,
+// marking it most recently used there.
+// Called with c locked.
+func (c *storeCache) lookup(file string) (*cachedRef, bool) {
+	if value, ok := c.hot.Get(file); ok {
+		return value.(*cachedRef), true
+	}
+	if value, ok := c.lru.Get(file); ok {
+		return value.(*cachedRef), true
+	}
+	if cr, ok := c.kept[file]; ok {
+		return cr, true
+	}
+	return nil, false
+}
+
+// touch records that file was read from the cache. If it was on
+// probation, it is promoted to the protected segment, and the least
+// recently used protected files are demoted as needed to keep that
+// segment within its share of the limits.
+// No locks are held on entry or exit.
+func (c *storeCache) touch(file string) {
+	c.Lock()
+	defer c.Unlock()
+	value := c.lru.Remove(file)
+	if value == nil {
+		// Already protected, or gone.
+		return
+	}
+	cr := value.(*cachedRef)
+	cr.Lock()
+	size := cr.size
+	cr.Unlock()
+	cr.hotSize = size
+	for c.hot.Len() >= c.hotRefs {
+		key, value := c.hot.RemoveOldest()
+		c.demote(key, value.(*cachedRef))
+	}
+	c.hot.Add(file, cr)
+	c.hotBytes += size
+	maxHot := int64(hotFraction * float64(c.limit))
+	for c.hotBytes > maxHot {
+		key, value := c.hot.RemoveOldest()
+		if value == nil {
+			break
+		}
+		c.demote(key, value.(*cachedRef))
+	}
+}
+
+// demote moves a cachedRef removed from the protected segment to the
+// probationary one.
+// Called with c locked.
+func (c *storeCache) demote(file interface{}, cr *cachedRef) {
+	c.hotBytes -= cr.hotSize
+	cr.hotSize = 0
+	c.lru.Add(file, cr)
+}
+
+// pin marks the reference as never to be evicted, whether or not it is
+// cached yet. Pinning it again has no further effect.
+// No locks are held on entry or exit.
+func (c *storeCache) pin(ref upspin.Reference, e upspin.Endpoint) {
+	c.Lock()
+	c.pins[c.cachePath(ref, e)] = true
+	c.Unlock()
+}
+
+// unpin lets the reference be evicted once more, as least recently used,
+// unless it awaits writeback. It evicts what it must to bring the cache
+// back within its limit.
+// No locks are held on entry or exit.
+func (c *storeCache) unpin(ref upspin.Reference, e upspin.Endpoint) {
+	c.Lock()
+	delete(c.pins, c.cachePath(ref, e))
+	c.Unlock()
+	c.enforceByteLimitByRemovingLeastRecentlyUsedFile()
+}
+
+// isDirty reports whether the cache file is awaiting writeback.
+func (c *storeCache) isDirty(file string) bool {
+	if c.wbq == nil {
+		return false
+	}
+	_, err := c.fileSize(file + writebackSuffix)
+	return err == nil
 }
 
 // readFromCachefile reads in the cache file, if it exists.
@@ -393,6 +783,29 @@ func readFromCacheFile(name string) ([]byte, error) {
 // saveToCacheFile saves a ref in the cache.
 // Called with cr locked.
 func (cr *cachedRef) saveToCacheFile(file string, data []byte) error {
+	if err := cr.c.writeFile(file, data); err != nil {
+		return err
+	}
+
+	cr.size = int64(len(data))
+	cr.valid = true
+	cr.busy = false
+
+	// If the file was purged from the cache during the put, remove it.
+	// Unususual but possible with a small cache and simultaneous puts.
+	if cr.remove {
+		cr.removeFile(file)
+	}
+
+	// Update the total bytes cached.
+	atomic.AddInt64(&cr.c.inUse, cr.size)
+	return nil
+}
+
+// writeToCacheFile writes the data to the named file, replacing it
+// atomically if it exists. If sync is set, the data is committed to
+// stable storage before the file is given its name.
+func writeToCacheFile(file string, data []byte, sync bool) error {
 	tmpName := file + ".tmp"
 	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0700)
 	if err != nil {
@@ -417,6 +830,12 @@ func (cr *cachedRef) saveToCacheFile(file string, data []byte) error {
 		cleanup()
 		return errors.New("writing cache file")
 	}
+	if sync {
+		if err := fsyncFile(f); err != nil {
+			cleanup()
+			return err
+		}
+	}
 	if err := f.Close(); err != nil {
 		cleanup()
 		return err
@@ -425,46 +844,70 @@ func (cr *cachedRef) saveToCacheFile(file string, data []byte) error {
 		cleanup()
 		return err
 	}
-
-	cr.size = int64(len(data))
-	cr.valid = true
-	cr.busy = false
-
-	// If the file was purged from the cache during the put, remove it.
-	// Unususual but possible with a small cache and simultaneous puts.
-	if cr.remove {
-		cr.removeFile(file)
-	}
-
-	// Update the total bytes cached.
-	atomic.AddInt64(&cr.c.inUse, cr.size)
 	return nil
 }
 
-// enforceByteLimitByRemovingLeastRecentlyUsedFile removes the oldest entries until inUse is below limit. We take a leap
+// enforceByteLimitByRemovingLeastRecentlyUsedFile removes the oldest entries until inUse is below limit,
+// taking them from the probationary segment before the protected one. We take a leap
 // of faith that the least recently used entry is not currently in use.
+// Entries awaiting writeback, and those pinned by Pin, are kept, and the search
+// continues; once it is over they are put back, as most recently used on probation.
+// Setting them aside until then lets the search reach the protected segment
+// even when the probationary one holds nothing else.
 func (c *storeCache) enforceByteLimitByRemovingLeastRecentlyUsedFile() {
 	c.Lock()
 	defer c.Unlock()
-	for {
-		if atomic.LoadInt64(&c.inUse) < c.limit {
-			break
+	// Those kept out of the segments are evicted once written back
+	// and unpinned.
+	for file, cr := range c.kept {
+		if !c.pins[file] && !c.isDirty(file) {
+			delete(c.kept, file)
+			cr.OnEviction(file)
 		}
+	}
+	var keys, values []interface{} // Kept entries, oldest first.
+	for atomic.LoadInt64(&c.inUse) >= c.limit {
 		key, value := c.lru.RemoveOldest()
 		if value == nil {
-			// Nothing left.
+			key, value = c.hot.RemoveOldest()
+			if value != nil {
+				cr := value.(*cachedRef)
+				c.hotBytes -= cr.hotSize
+				cr.hotSize = 0
+			}
+		}
+		if value == nil {
+			// Nothing left, or nothing but dirty or pinned entries.
 			log.Info.Printf("exceeding cache byte limit")
 			break
 		}
+		if c.pins[key.(string)] || c.isDirty(key.(string)) {
+			keys = append(keys, key)
+			values = append(values, value)
+			continue
+		}
 		value.(*cachedRef).OnEviction(key)
 	}
+	for i, key := range keys {
+		c.lru.Add(key, values[i])
+	}
 }
 
-// OnEviction implements cache.OnEviction.
+// OnEviction implements cache.OnEviction. An entry awaiting writeback or
+// pinned, pushed out of a full segment, is kept, and its file with it,
+// until enforceByteLimitByRemovingLeastRecentlyUsedFile finds it written
+// back and unpinned.
+// Called with the storeCache locked.
 func (cr *cachedRef) OnEviction(key interface{}) {
 	file := key.(string)
+	cr.c.hotBytes -= cr.hotSize
+	cr.hotSize = 0
 	cr.Lock()
 	defer cr.Unlock()
+	if cr.c.pins[file] || cr.c.isDirty(file) {
+		cr.c.kept[file] = cr
+		return
+	}
 	if cr.busy {
 		// Someone is trying to read this in or put it. Don't bother removing anything
 		// but this is an odd situation so log it.
@@ -482,7 +925,7 @@ func (cr *cachedRef) removeFile(file string) {
 	cr.valid = false
 	cr.remove = false
 	atomic.AddInt64(&cr.c.inUse, -cr.size)
-	if err := os.Remove(file); err != nil {
+	if err := cr.c.unlinkFile(file); err != nil {
 		log.Info.Printf("can't remove file on eviction: %s", err)
 	}
 }
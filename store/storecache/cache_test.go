@@ -0,0 +1,531 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+var testRefs = []upspin.Reference{
+	"",
+	"a",
+	"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	"with/slashes/../and/dots",
+	"/leading/slash",
+	"trailing_wbf",
+	"name.tmp",
+	"ünïcødé ☺ 参考",
+	"nul\x00byte",
+	upspin.Reference(strings.Repeat("long reference ", 50)),
+	upspin.Reference(strings.Repeat("x", 80)), // Encodes to exactly maxRefElem bytes.
+}
+
+func TestRefFileNameRoundTrip(t *testing.T) {
+	seen := make(map[string]upspin.Reference)
+	for _, ref := range testRefs {
+		name := refFileName(ref)
+		for _, elem := range strings.Split(name, "/") {
+			if len(elem) == 0 || len(elem) > maxRefElem+len(refElemCont) {
+				t.Errorf("%q: bad element %q in %q", ref, elem, name)
+			}
+			if strings.HasSuffix(elem, writebackSuffix) || strings.HasSuffix(elem, ".tmp") {
+				t.Errorf("%q: element %q has a reserved suffix", ref, elem)
+			}
+		}
+		got, err := parseRefFileName(name)
+		if err != nil {
+			t.Errorf("%q: parseRefFileName(%q): %v", ref, name, err)
+			continue
+		}
+		if got != ref {
+			t.Errorf("%q: round trip returned %q", ref, got)
+		}
+		if other, ok := seen[name]; ok {
+			t.Errorf("%q and %q both map to %q", ref, other, name)
+		}
+		seen[name] = ref
+	}
+}
+
+func TestParseRefFileNameErrors(t *testing.T) {
+	long := refFileName(testRefs[len(testRefs)-2])
+	for _, name := range []string{
+		"0123456789abcdef", // A legacy unencoded reference.
+		"MFRGG===",         // Padded.
+		strings.Replace(long, refElemCont+"/", "/", 1), // Missing continuation mark.
+		strings.Replace(long, "/", "", -1),             // Missing split.
+	} {
+		if ref, err := parseRefFileName(name); err == nil {
+			t.Errorf("parseRefFileName(%q) = %q, want error", name, ref)
+		}
+	}
+}
+
+func TestCachePathRoundTrip(t *testing.T) {
+	c := &storeCache{dir: "/tmp/storecache"}
+	wbq := &writebackQueue{sc: c, request: make(chan *request, 1)}
+	e := upspin.Endpoint{Transport: upspin.Remote, NetAddr: "store.example.com:443"}
+	for _, ref := range testRefs {
+		file := c.cachePath(ref, e)
+		loc, err := c.parseCachePath(file)
+		if err != nil {
+			t.Errorf("%q: parseCachePath(%q): %v", ref, file, err)
+			continue
+		}
+		if loc.Reference != ref || loc.Endpoint != e {
+			t.Errorf("%q: parseCachePath(%q) = %v", ref, file, loc)
+		}
+
+		// On startup, writeback links are decoded to their references.
+		if !wbq.enqueueWritebackFile(file + writebackSuffix) {
+			t.Errorf("%q: %s not recognized as a writeback file", ref, file)
+			continue
+		}
+		r := <-wbq.request
+		if r.Reference != ref || r.Endpoint != e {
+			t.Errorf("%q: enqueued %v", ref, r.Location)
+		}
+	}
+}
+
+func TestLegacyWritebackFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &storeCache{dir: dir}
+	wbq := &writebackQueue{sc: c, request: make(chan *request, 1)}
+	e := upspin.Endpoint{Transport: upspin.Remote, NetAddr: "store.example.com:443"}
+
+	// A writeback link named by the reference itself.
+	const ref = "0123456789abcdef"
+	legacy := path.Join(dir, e.String(), ref[:2], ref) + writebackSuffix
+	if err := os.MkdirAll(path.Dir(legacy), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(legacy, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !wbq.enqueueWritebackFile(legacy) {
+		t.Fatalf("%s not recognized as a writeback file", legacy)
+	}
+	r := <-wbq.request
+	if r.Reference != ref || r.Endpoint != e {
+		t.Errorf("enqueued %v", r.Location)
+	}
+	data, err := ioutil.ReadFile(c.cachePath(ref, e) + writebackSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data" {
+		t.Errorf("renamed writeback file contains %q", data)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("legacy writeback file still present: %v", err)
+	}
+}
+
+// testBlock returns a distinct block of n bytes.
+func testBlock(i, n int) []byte {
+	b := []byte(fmt.Sprintf("block %d ", i))
+	for len(b) < n {
+		b = append(b, '.')
+	}
+	return b[:n]
+}
+
+func TestHotBlocksSurviveEviction(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	const (
+		blockSize = 1000
+		limit     = 10 * blockSize
+	)
+	c, _, err := newCache(testConfig, filepath.Join(tmp, "storecache"), limit, true, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	st := storeFor(upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "hotcold"})
+	st.reset()
+
+	// The blocks are in the store but not yet in the cache.
+	var hot, cold []upspin.Reference
+	for i := 0; i < 4; i++ {
+		refdata, err := st.Put(testBlock(i, blockSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hot = append(hot, refdata.Reference)
+	}
+	for i := 0; i < 30; i++ {
+		refdata, err := st.Put(testBlock(100+i, blockSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cold = append(cold, refdata.Reference)
+	}
+	get := func(ref upspin.Reference) {
+		if _, _, err := c.get(testConfig, ref, st.e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Read the hot blocks twice, then stream through the cold ones,
+	// rereading the hot ones now and then.
+	for _, ref := range hot {
+		get(ref)
+		get(ref)
+	}
+	for i, ref := range cold {
+		get(ref)
+		if i%10 == 9 {
+			for _, ref := range hot {
+				get(ref)
+			}
+		}
+	}
+
+	cached := func(ref upspin.Reference) bool {
+		_, err := os.Stat(c.cachePath(ref, st.e))
+		return err == nil
+	}
+	for i, ref := range hot {
+		if !cached(ref) {
+			t.Errorf("hot block %d evicted", i)
+		}
+	}
+	for i, ref := range cold[:len(cold)-10] {
+		if cached(ref) {
+			t.Errorf("cold block %d still cached", i)
+		}
+	}
+	if inUse := atomic.LoadInt64(&c.inUse); inUse > limit+blockSize {
+		t.Errorf("%d bytes cached, limit %d", inUse, limit)
+	}
+}
+
+func TestDirtyBlocksArePinned(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	const (
+		blockSize = 1000
+		limit     = 3 * blockSize
+	)
+	c, _, err := newCache(testConfig, filepath.Join(tmp, "storecache"), limit, false, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	st := storeFor(upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "pinned"})
+	st.reset()
+	st.Lock()
+	st.fail = true
+	st.Unlock()
+
+	// None of these can be written back, so none may be evicted.
+	var refs []upspin.Reference
+	for i := 0; i < 10; i++ {
+		ref, err := c.put(testConfig, testBlock(i, blockSize), st.e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+	for i, ref := range refs {
+		if _, err := os.Stat(c.cachePath(ref, st.e)); err != nil {
+			t.Errorf("dirty block %d evicted: %v", i, err)
+		}
+	}
+}
+
+func TestDirtyBlocksSurviveEntryLimit(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	// Blocks so small that the limit on the number of entries,
+	// 10, is reached long before the byte limit.
+	const (
+		blockSize = 10
+		maxRefs   = 10
+	)
+	c, _, err := newCache(testConfig, filepath.Join(tmp, "storecache"), 128*maxRefs, false, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	c.wbq.retryAfter = 10 * time.Millisecond
+	st := storeFor(upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "entrylimit"})
+	st.reset()
+	cached := func(ref upspin.Reference) bool {
+		_, err := os.Stat(c.cachePath(ref, st.e))
+		return err == nil
+	}
+
+	// Clean blocks, some of them read again to be protected, then a
+	// dirty one, then more clean ones to push it out of both segments.
+	var clean []upspin.Reference
+	for i := 0; i < 3*maxRefs; i++ {
+		refdata, err := st.Put(testBlock(i, blockSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clean = append(clean, refdata.Reference)
+	}
+	get := func(ref upspin.Reference) {
+		if _, _, err := c.get(testConfig, ref, st.e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ref := range clean[:maxRefs] {
+		get(ref)
+		get(ref)
+	}
+	st.Lock()
+	st.fail = true
+	st.Unlock()
+	dirty, err := c.put(testConfig, testBlock(-1, blockSize), st.e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ref := range clean[maxRefs:] {
+		get(ref)
+		if i%2 == 0 {
+			get(ref)
+		}
+		if !cached(dirty) {
+			t.Fatal("dirty block evicted")
+		}
+	}
+	if n := c.lru.Len() + c.hot.Len(); n > maxRefs {
+		t.Errorf("%d entries in the segments, limit %d", n, maxRefs)
+	}
+	if got, _, err := c.get(testConfig, dirty, st.e); err != nil || string(got) != string(testBlock(-1, blockSize)) {
+		t.Errorf("dirty block reads %q, %v", got, err)
+	}
+
+	// Once written back, it is evicted.
+	st.Lock()
+	st.fail = false
+	st.Unlock()
+	if err := c.wbq.flush(upspin.Location{Reference: dirty, Endpoint: st.e}); err != nil {
+		t.Fatal(err)
+	}
+	get(clean[0])
+	if cached(dirty) {
+		t.Error("written back block still cached")
+	}
+}
+
+func TestPinnedBlocksSurviveEviction(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	const (
+		blockSize = 1000
+		limit     = 5 * blockSize
+	)
+	c, _, err := newCache(testConfig, filepath.Join(tmp, "storecache"), limit, true, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	st := storeFor(upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "pins"})
+	st.reset()
+
+	var refs []upspin.Reference
+	for i := 0; i < 40; i++ {
+		refdata, err := st.Put(testBlock(i, blockSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, refdata.Reference)
+	}
+	get := func(ref upspin.Reference) {
+		if _, _, err := c.get(testConfig, ref, st.e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cached := func(ref upspin.Reference) bool {
+		_, err := os.Stat(c.cachePath(ref, st.e))
+		return err == nil
+	}
+
+	// Pin one block once it is cached and protected, having been read
+	// twice, and another before it is cached at all. Then fill the
+	// cache several times over.
+	pinned, early, others := refs[0], refs[1], refs[2:]
+	get(pinned)
+	get(pinned)
+	c.pin(pinned, st.e)
+	c.pin(early, st.e)
+	get(early)
+	for i, ref := range others {
+		get(ref)
+		for _, ref := range []upspin.Reference{pinned, early} {
+			if !cached(ref) {
+				t.Fatalf("pinned block %s evicted after reading block %d", ref, i)
+			}
+		}
+	}
+	for i, ref := range others[:len(others)-5] {
+		if cached(ref) {
+			t.Errorf("unpinned block %d still cached", i)
+		}
+	}
+	if inUse := atomic.LoadInt64(&c.inUse); inUse > limit+blockSize {
+		t.Errorf("%d bytes cached, limit %d", inUse, limit)
+	}
+
+	// Unpinned, a block is evicted in its turn: early, read only once,
+	// is on probation, so its turn comes at once.
+	c.unpin(early, st.e)
+	for _, ref := range others[:10] {
+		get(ref)
+	}
+	if cached(early) {
+		t.Error("unpinned block still cached")
+	}
+	if !cached(pinned) {
+		t.Error("pinned block evicted after another was unpinned")
+	}
+}
+
+func TestPinnedBlocksSurviveEntryLimit(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	// Blocks so small that the limit on the number of entries,
+	// 10, is reached long before the byte limit.
+	const (
+		blockSize = 10
+		maxRefs   = 10
+	)
+	c, _, err := newCache(testConfig, filepath.Join(tmp, "storecache"), 128*maxRefs, true, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	st := storeFor(upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "pinentries"})
+	st.reset()
+
+	var refs []upspin.Reference
+	for i := 0; i < 4*maxRefs; i++ {
+		refdata, err := st.Put(testBlock(i, blockSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, refdata.Reference)
+	}
+	get := func(ref upspin.Reference) {
+		if _, _, err := c.get(testConfig, ref, st.e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cached := func(ref upspin.Reference) bool {
+		_, err := os.Stat(c.cachePath(ref, st.e))
+		return err == nil
+	}
+
+	// Pin one protected block and one on probation, then read enough
+	// others, some twice, to push both out of their segments.
+	pinned, early, others := refs[0], refs[1], refs[2:]
+	get(pinned)
+	get(pinned)
+	c.pin(pinned, st.e)
+	c.pin(early, st.e)
+	get(early)
+	for i, ref := range others {
+		get(ref)
+		if i%2 == 0 {
+			get(ref)
+		}
+		for _, ref := range []upspin.Reference{pinned, early} {
+			if !cached(ref) {
+				t.Fatalf("pinned block %s evicted after reading block %d", ref, i)
+			}
+		}
+	}
+	if n := c.lru.Len() + c.hot.Len(); n > maxRefs {
+		t.Errorf("%d entries in the segments, limit %d", n, maxRefs)
+	}
+
+	// Unpinned, a block pushed out is evicted.
+	c.unpin(early, st.e)
+	get(others[0])
+	if cached(early) {
+		t.Error("unpinned block still cached")
+	}
+	if !cached(pinned) {
+		t.Error("pinned block evicted after another was unpinned")
+	}
+}
+
+func TestFsyncOption(t *testing.T) {
+	var syncs int32
+	defer func(f func(*os.File) error) { fsyncFile = f }(fsyncFile)
+	fsyncFile = func(f *os.File) error {
+		// Under "writeback", the file is committed before it is linked.
+		if _, err := os.Stat(f.Name() + writebackSuffix); err == nil {
+			t.Errorf("%s synced after its writeback link was made", f.Name())
+		}
+		atomic.AddInt32(&syncs, 1)
+		return f.Sync()
+	}
+	for _, tc := range []struct {
+		fsync string
+		pack  int64
+		want  int32
+	}{
+		{"never", 0, 0},
+		{"writeback", 0, 1},
+		{"always", 0, 1},
+		{"never", 1e4, 0},
+		{"writeback", 1e4, 1},
+		{"always", 1e4, 1},
+	} {
+		opts, err := parseOptions([]string{"fsync=" + tc.fsync})
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.pack = tc.pack
+		addr := fmt.Sprintf("fsync-%s-%d", tc.fsync, tc.pack)
+		c, st, cleanup := newTestCache(t, addr, opts)
+		atomic.StoreInt32(&syncs, 0)
+		if _, err := c.put(testConfig, []byte(addr), st.e); err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt32(&syncs); n != tc.want {
+			t.Errorf("fsync=%s pack=%d: %d syncs per put, want %d", tc.fsync, tc.pack, n, tc.want)
+		}
+		cleanup()
+	}
+	if _, err := parseOptions([]string{"fsync=sometimes"}); err == nil {
+		t.Error("fsync=sometimes accepted")
+	}
+}
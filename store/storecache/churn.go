@@ -0,0 +1,80 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import "sync/atomic"
+
+// tinyBlockSize is the size below which a block sent to a store is
+// counted as tiny. Many tiny blocks suggest that writers should buffer
+// more before calling Put.
+const tinyBlockSize = 4096
+
+// churn counts the cache's file activity so that write amplification
+// can be detected. All fields are accessed atomically.
+type churn struct {
+	puts          int64 // Calls to Put.
+	creates       int64 // Cache files and writeback links created.
+	storePuts     int64 // Blocks accepted by stores.
+	storePutBytes int64 // Bytes in those blocks.
+	tinyStorePuts int64 // Those blocks smaller than tinyBlockSize.
+}
+
+func (c *churn) put()    { atomic.AddInt64(&c.puts, 1) }
+func (c *churn) create() { atomic.AddInt64(&c.creates, 1) }
+
+// storePut records that a store accepted a block of n bytes.
+func (c *churn) storePut(n int) {
+	atomic.AddInt64(&c.storePuts, 1)
+	atomic.AddInt64(&c.storePutBytes, int64(n))
+	if n < tinyBlockSize {
+		atomic.AddInt64(&c.tinyStorePuts, 1)
+	}
+}
+
+func (c *churn) stats() ChurnStats {
+	return ChurnStats{
+		Puts:        atomic.LoadInt64(&c.puts),
+		FileCreates: atomic.LoadInt64(&c.creates),
+		StorePuts:   atomic.LoadInt64(&c.storePuts),
+		StoreBytes:  atomic.LoadInt64(&c.storePutBytes),
+		TinyBlocks:  atomic.LoadInt64(&c.tinyStorePuts),
+	}
+}
+
+// ChurnStats describes the file activity of the cache since it started.
+type ChurnStats struct {
+	// Puts is the number of blocks Put to the cache.
+	Puts int64
+
+	// FileCreates is the number of files created in the cache,
+	// counting both cached blocks and links marking blocks to be
+	// written back. Blocks read from stores are cached too.
+	FileCreates int64
+
+	// StorePuts is the number of blocks written to stores, and
+	// StoreBytes their total size.
+	StorePuts  int64
+	StoreBytes int64
+
+	// TinyBlocks is the number of blocks written to stores
+	// that were smaller than 4096 bytes.
+	TinyBlocks int64
+}
+
+// AverageBlockSize returns the average size of the blocks written to stores.
+func (s ChurnStats) AverageBlockSize() float64 {
+	if s.StorePuts == 0 {
+		return 0
+	}
+	return float64(s.StoreBytes) / float64(s.StorePuts)
+}
+
+// Amplification returns the number of files created in the cache per Put.
+func (s ChurnStats) Amplification() float64 {
+	if s.Puts == 0 {
+		return 0
+	}
+	return float64(s.FileCreates) / float64(s.Puts)
+}
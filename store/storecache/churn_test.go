@@ -0,0 +1,70 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"testing"
+
+	"upspin.io/upspin"
+)
+
+func TestChurnStats(t *testing.T) {
+	c, st, cleanup := newTestCache(t, "churn", options{})
+	defer cleanup()
+	srv := &server{cfg: testConfig, cache: c, authority: st.e}
+
+	// Many tiny blocks, each put twice.
+	const (
+		n    = 50
+		size = 100
+	)
+	for i := 0; i < n; i++ {
+		for j := 0; j < 2; j++ {
+			refdata, err := srv.Put(testBlock(i, size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.wbq.flush(upspin.Location{Reference: refdata.Reference, Endpoint: st.e}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// And one large one.
+	refdata, err := srv.Put(testBlock(n, 2*tinyBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.wbq.flush(upspin.Location{Reference: refdata.Reference, Endpoint: st.e}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := srv.ChurnStats()
+	want := ChurnStats{
+		Puts:        2*n + 1,
+		FileCreates: 2 * (n + 1), // A cache file and a writeback link for each new block.
+		StorePuts:   n + 1,
+		StoreBytes:  n*size + 2*tinyBlockSize,
+		TinyBlocks:  n,
+	}
+	if stats != want {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+	if got, want := stats.AverageBlockSize(), float64(n*size+2*tinyBlockSize)/(n+1); got != want {
+		t.Errorf("average block size %g, want %g", got, want)
+	}
+	if got, want := stats.Amplification(), float64(2*(n+1))/(2*n+1); got != want {
+		t.Errorf("amplification %g, want %g", got, want)
+	}
+
+	// Puts of tiny new blocks create two files each.
+	for i := 0; i < n; i++ {
+		if _, err := srv.Put(testBlock(n+1+i, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := srv.ChurnStats().Amplification(); got <= stats.Amplification() {
+		t.Errorf("amplification %g after tiny puts, want more than %g", got, stats.Amplification())
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"time"
+
+	"upspin.io/bind"
+	"upspin.io/errors"
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// Values for the healthOp option.
+const (
+	healthPing = iota // Call the store's Ping method.
+	healthPut         // Put the empty block.
+)
+
+// A deadEndpoint is an endpoint marked dead that has writebacks waiting.
+type deadEndpoint struct {
+	e   upspin.Endpoint
+	epq *endpointQueue
+}
+
+// healthChecker, started with the healthCheck option, checks the dead
+// endpoints with writebacks waiting at each interval of the option. Each
+// found healthy is sent to the scheduler to be retried at once, as if its
+// retryAfter had passed, rather than when it does.
+func (wbq *writebackQueue) healthChecker() {
+	const op = "store/storecache.healthChecker"
+	ticker := time.NewTicker(wbq.sc.opts.healthCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-wbq.die:
+			return
+		}
+		c := make(chan []deadEndpoint)
+		select {
+		case wbq.deadList <- c:
+		case <-wbq.die:
+			return
+		}
+		for _, d := range <-c {
+			if err := wbq.checkHealth(d.e); err != nil {
+				log.Debug.Printf("%s: %s still dead: %s", op, d.e, err)
+				continue
+			}
+			log.Info.Printf("%s: %s is healthy; retrying its writebacks", op, d.e)
+			select {
+			case wbq.retry <- d.epq:
+			case <-wbq.die:
+				return
+			}
+		}
+	}
+}
+
+// checkHealth returns an error if the store at the endpoint fails the
+// operation set by the healthOp option.
+func (wbq *writebackQueue) checkHealth(e upspin.Endpoint) error {
+	store, err := bind.StoreServer(wbq.sc.cfg, e)
+	if err != nil {
+		return err
+	}
+	if wbq.sc.opts.healthOp == healthPing {
+		if !store.Ping() {
+			return errors.E(errors.IO, errors.Str("ping failed"))
+		}
+		return nil
+	}
+	refdata, err := wbq.put(store, nil)
+	if err != nil {
+		return err
+	}
+	if refdata.Reference != emptyRef {
+		return errors.Errorf("store returned reference %q for the empty block", refdata.Reference)
+	}
+	wbq.setHasEmpty(e, true)
+	return nil
+}
+
+// deadEndpoints returns the endpoints marked dead that have writebacks
+// waiting. It is called only by the scheduler.
+func (wbq *writebackQueue) deadEndpoints() []deadEndpoint {
+	var list []deadEndpoint
+	for e, epq := range wbq.byEndpoint {
+		if epq.state == dead && epq.waiting() {
+			list = append(list, deadEndpoint{e: e, epq: epq})
+		}
+	}
+	return list
+}
+
+// startRecovered, with the startupCheck option, checks the stores of the
+// writebacks held since startup, all at once, and tells the scheduler
+// which are live and which dead before queuing the writebacks, so that
+// none is sent to a store known to be down. A store that has not
+// answered within the option is left for its first writeback to try.
+func (wbq *writebackQueue) startRecovered() {
+	const op = "store/storecache.startRecovered"
+	if !wbq.holding {
+		return
+	}
+	held := wbq.held
+	wbq.holding = false
+	wbq.held = nil
+	if len(held) == 0 {
+		return
+	}
+	checking := make(map[upspin.Endpoint]bool)
+	for _, r := range held {
+		checking[r.Endpoint] = true
+	}
+	type check struct {
+		e   upspin.Endpoint
+		err error
+	}
+	checks := make(chan check, len(checking))
+	for e := range checking {
+		go func(e upspin.Endpoint) {
+			checks <- check{e, wbq.checkHealth(e)}
+		}(e)
+	}
+	states := make(map[upspin.Endpoint]int)
+	timeout := time.NewTimer(wbq.sc.opts.startupCheck)
+	defer timeout.Stop()
+wait:
+	for len(states) < len(checking) {
+		select {
+		case c := <-checks:
+			if c.err != nil {
+				log.Info.Printf("%s: %s is dead: %s", op, c.e, c.err)
+				states[c.e] = dead
+				break
+			}
+			states[c.e] = live
+		case <-timeout.C:
+			log.Info.Printf("%s: %d of %d stores not checked in %v", op, len(checking)-len(states), len(checking), wbq.sc.opts.startupCheck)
+			break wait
+		}
+	}
+	wbq.startStates <- states
+	for _, r := range held {
+		wbq.request <- r
+	}
+}
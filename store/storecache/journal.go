@@ -0,0 +1,196 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+const (
+	// Name of the journal file, alongside the cache directory.
+	journalName = "storejournal"
+
+	// Number of records appended to the journal before it is compacted.
+	maxJournalRecords = 10000
+
+	// Record types.
+	intentRecord = "I"
+	doneRecord   = "D"
+)
+
+// journalState is the fate of a writeback according to the journal.
+type journalState int
+
+const (
+	unjournaled journalState = iota // No writeback was attempted.
+	uncertain                       // A writeback started but may not have reached the store.
+	completed                       // The writeback reached the store.
+)
+
+// journal is an append-only log of writebacks. Before a block is sent to a
+// store the journal records the intent to write back its location, and once
+// the store has accepted it, the completion. After a crash, the journal tells
+// writebacks that may or may not have happened from those that did.
+//
+// Each record is a line holding the record type, the endpoint, and the
+// reference encoded as by refFileName. Records are not synced to disk;
+// the journal survives a crash of the process but perhaps not of the system.
+//
+// A nil *journal records nothing.
+type journal struct {
+	sync.Mutex
+	name    string
+	f       *os.File
+	open    map[upspin.Location]bool // Intents not yet completed.
+	records int                      // Records appended since the last compaction.
+}
+
+// openJournal reads the named journal, returning the state it records for
+// each location, and opens it, emptied, for appending. The caller is
+// responsible for retrying the uncertain writebacks, which will be journaled
+// afresh.
+func openJournal(name string) (*journal, map[upspin.Location]journalState, error) {
+	states := make(map[upspin.Location]journalState)
+	f, err := os.Open(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			kind, loc, err := parseJournalRecord(scanner.Text())
+			if err != nil {
+				// Probably a record cut short by a crash.
+				log.Info.Printf("store/storecache.openJournal: %s: %s", name, err)
+				continue
+			}
+			switch kind {
+			case intentRecord:
+				states[loc] = uncertain
+			case doneRecord:
+				states[loc] = completed
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	j := &journal{
+		name: name,
+		open: make(map[upspin.Location]bool),
+	}
+	j.Lock()
+	defer j.Unlock()
+	if err := j.compact(); err != nil {
+		return nil, nil, err
+	}
+	return j, states, nil
+}
+
+// parseJournalRecord parses a line of the journal.
+func parseJournalRecord(line string) (string, upspin.Location, error) {
+	var loc upspin.Location
+	fields := strings.Split(line, " ")
+	if len(fields) != 3 || (fields[0] != intentRecord && fields[0] != doneRecord) {
+		return "", loc, errors.Errorf("bad journal record %q", line)
+	}
+	e, err := upspin.ParseEndpoint(fields[1])
+	if err != nil {
+		return "", loc, err
+	}
+	ref, err := parseRefFileName(fields[2])
+	if err != nil {
+		return "", loc, err
+	}
+	loc.Endpoint = *e
+	loc.Reference = ref
+	return fields[0], loc, nil
+}
+
+// intent records that a writeback of loc is about to start.
+func (j *journal) intent(loc upspin.Location) error {
+	if j == nil {
+		return nil
+	}
+	j.Lock()
+	defer j.Unlock()
+	j.open[loc] = true
+	return j.append(intentRecord, loc)
+}
+
+// done records that the writeback of loc has completed.
+func (j *journal) done(loc upspin.Location) error {
+	if j == nil {
+		return nil
+	}
+	j.Lock()
+	defer j.Unlock()
+	delete(j.open, loc)
+	return j.append(doneRecord, loc)
+}
+
+// append writes a record to the journal, compacting it if it has grown
+// too long. Called with j locked.
+func (j *journal) append(kind string, loc upspin.Location) error {
+	if _, err := fmt.Fprintf(j.f, "%s %s %s\n", kind, loc.Endpoint, refFileName(loc.Reference)); err != nil {
+		return err
+	}
+	j.records++
+	if j.records < maxJournalRecords {
+		return nil
+	}
+	return j.compact()
+}
+
+// compact replaces the journal with one holding only the intents not
+// yet completed, and opens it for appending. Called with j locked.
+func (j *journal) compact() error {
+	tmpName := j.name + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for loc := range j.open {
+		fmt.Fprintf(w, "%s %s %s\n", intentRecord, loc.Endpoint, refFileName(loc.Reference))
+	}
+	err = w.Flush()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, j.name)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f, err = os.OpenFile(j.name, os.O_WRONLY|os.O_APPEND, 0600)
+	j.records = 0
+	return err
+}
+
+// close closes the journal file.
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+	j.Lock()
+	defer j.Unlock()
+	return j.f.Close()
+}
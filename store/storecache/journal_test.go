@@ -0,0 +1,151 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"upspin.io/key/sha256key"
+	"upspin.io/upspin"
+)
+
+func TestJournalStates(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	name := filepath.Join(tmp, journalName)
+
+	e := upspin.Endpoint{Transport: upspin.Remote, NetAddr: "store.example.com:443"}
+	loc := func(ref string) upspin.Location {
+		return upspin.Location{Reference: upspin.Reference(ref), Endpoint: e}
+	}
+	j, states, err := openJournal(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 0 {
+		t.Errorf("new journal has %d states", len(states))
+	}
+	j.intent(loc("done"))
+	j.done(loc("done"))
+	j.intent(loc("inflight"))
+	j.intent(loc("again"))
+	j.done(loc("again"))
+	j.intent(loc("again"))
+	j.close()
+
+	// A record cut short by a crash is ignored.
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("D " + e.String())
+	f.Close()
+
+	j, states, err = openJournal(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	want := map[upspin.Location]journalState{
+		loc("done"):     completed,
+		loc("inflight"): uncertain,
+		loc("again"):    uncertain,
+	}
+	if len(states) != len(want) {
+		t.Errorf("got %d states, want %d", len(states), len(want))
+	}
+	for l, s := range want {
+		if states[l] != s {
+			t.Errorf("%q: state %d, want %d", l.Reference, states[l], s)
+		}
+	}
+
+	// Reopening compacts the journal.
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Errorf("compacted journal contains %q", data)
+	}
+}
+
+// TestJournalRecovery simulates a crash during writeback and checks that
+// on restart only writebacks not known to have completed are retried.
+func TestJournalRecovery(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "storecache")
+	// The endpoint must survive the round trip through a file name,
+	// so it can have no network address.
+	st := storeFor(upspin.Endpoint{Transport: upspin.InProcess})
+	st.reset()
+
+	// Leave three blocks waiting for writeback, as a crash would.
+	sc := &storeCache{dir: dir}
+	var locs []upspin.Location
+	for _, data := range []string{"completed", "interrupted", "not started"} {
+		ref := upspin.Reference(sha256key.Of([]byte(data)).String())
+		file := sc.cachePath(ref, st.e)
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(file, file+writebackSuffix); err != nil {
+			t.Fatal(err)
+		}
+		locs = append(locs, upspin.Location{Reference: ref, Endpoint: st.e})
+	}
+	j, _, err := openJournal(filepath.Join(tmp, journalName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.intent(locs[0])
+	j.done(locs[0])
+	j.intent(locs[1])
+	j.close()
+
+	// Restart.
+	c, _, err := newCache(testConfig, dir, 1e8, false, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	for _, loc := range locs {
+		if err := c.wbq.flush(loc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, _, err := st.Get(locs[0].Reference); err == nil {
+		t.Error("completed writeback was retried")
+	}
+	for i, loc := range locs[1:] {
+		if _, _, _, err := st.Get(loc.Reference); err != nil {
+			t.Errorf("writeback %d not retried: %v", i+1, err)
+		}
+	}
+	for i, loc := range locs {
+		wbf := c.cachePath(loc.Reference, loc.Endpoint) + writebackSuffix
+		if _, err := os.Stat(wbf); !os.IsNotExist(err) {
+			t.Errorf("writeback link %d still present: %v", i, err)
+		}
+	}
+	// The completed block is still cached.
+	if data, _, err := c.get(testConfig, locs[0].Reference, st.e); err != nil || string(data) != "completed" {
+		t.Errorf("get completed block: %q, %v", data, err)
+	}
+}
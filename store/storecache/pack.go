@@ -0,0 +1,629 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+const (
+	// Directory, alongside the cache directory, holding pack files.
+	packDir = "storepacks"
+
+	// Name of the pack index within packDir.
+	packIndexName = "index"
+
+	// Suffix of pack file names, which are a number and this suffix.
+	packSuffix = ".pack"
+
+	// Length beyond which a pack file accepts no more blocks.
+	defaultMaxPackSize = 4 << 20
+
+	// Number of records appended to the index, beyond those needed to
+	// describe its contents, before it is compacted.
+	maxPackIndexRecords = 10000
+
+	// Record types.
+	packPutRecord    = "P"
+	packRemoveRecord = "R"
+)
+
+// packExtent locates a block within a pack file.
+type packExtent struct {
+	pack int   // Number of the pack file.
+	off  int64 // Offset of the block in the pack.
+	len  int64 // Length of the block.
+}
+
+// packFile is an open pack file.
+type packFile struct {
+	f    *os.File
+	size int64 // Bytes in the file.
+	live int64 // Bytes of the blocks still named.
+}
+
+// packStore keeps small blocks in a few large append-only pack files
+// rather than a file each, saving inodes and the space lost to rounding
+// each block up to a whole file system block. It stands in for the file
+// system for the cache files it holds, so those files are named as if
+// they were stored individually. Several names, such as a cache file and
+// its writeback link, may share one block, just as a hard link shares
+// the file.
+//
+// An index, an append-only log of which block each name holds, is
+// replayed and compacted when the store is opened. Like the journal,
+// it survives a crash of the process but perhaps not of the system.
+// Once more than half of a pack no longer holds named blocks, its
+// remaining blocks are copied to the current pack and it is removed.
+type packStore struct {
+	sync.Mutex
+	dir     string // Directory holding the packs and index.
+	root    string // Names are recorded relative to this directory.
+	maxSize int64  // Length beyond which a pack accepts no more blocks.
+
+	index   *os.File
+	records int // Records appended since the index was compacted.
+
+	names map[string]packExtent
+	refs  map[packExtent]int // Number of names sharing each block.
+	packs map[int]*packFile
+	cur   int // Number of the pack receiving new blocks.
+}
+
+// openPackStore opens, creating it if need be, the pack store in dir
+// holding the cache files named within root.
+func openPackStore(dir, root string) (*packStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &packStore{
+		dir:     dir,
+		root:    root,
+		maxSize: defaultMaxPackSize,
+		names:   make(map[string]packExtent),
+		refs:    make(map[packExtent]int),
+		packs:   make(map[int]*packFile),
+	}
+	if err := s.openPacks(); err != nil {
+		s.close()
+		return nil, err
+	}
+	if err := s.replayIndex(); err != nil {
+		s.close()
+		return nil, err
+	}
+	// Blocks written to a pack just before a crash may never have been
+	// indexed. Count them as dead, and compact packs that are mostly so.
+	for n, p := range s.packs {
+		if p.live == 0 || p.live*2 < p.size {
+			s.compactPack(n)
+		}
+	}
+	if err := s.compactIndex(); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openPacks opens the pack files in the store.
+func (s *packStore) openPacks() error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, packSuffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(name, packSuffix))
+		if err != nil || n < 0 {
+			log.Info.Printf("store/storecache.openPacks: removing %s: not a pack file", name)
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		s.packs[n] = &packFile{f: f, size: info.Size()}
+		if n >= s.cur {
+			// New blocks go in a new pack.
+			s.cur = n + 1
+		}
+	}
+	return nil
+}
+
+// replayIndex reads the index, recording which block each name holds.
+func (s *packStore) replayIndex() error {
+	name := filepath.Join(s.dir, packIndexName)
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var file string
+		var ext packExtent
+		switch {
+		case strings.HasPrefix(line, packPutRecord+" "):
+			_, err = fmt.Sscanf(line, packPutRecord+" %d %d %d %q", &ext.pack, &ext.off, &ext.len, &file)
+			if err == nil {
+				if p := s.packs[ext.pack]; p == nil || ext.off < 0 || ext.len < 0 || ext.off+ext.len > p.size {
+					err = errors.Str("block beyond end of pack")
+				}
+			}
+		case strings.HasPrefix(line, packRemoveRecord+" "):
+			_, err = fmt.Sscanf(line, packRemoveRecord+" %q", &file)
+		default:
+			err = errors.Str("unknown record type")
+		}
+		if err != nil {
+			// Probably a record cut short by a crash.
+			log.Info.Printf("store/storecache.replayIndex: %s: bad record %q: %s", name, line, err)
+			continue
+		}
+		file = filepath.Join(s.root, file)
+		s.release(file)
+		if strings.HasPrefix(line, packPutRecord) {
+			s.hold(file, ext)
+		}
+	}
+	return scanner.Err()
+}
+
+// hold records that the named file holds the block. Called with s locked
+// or before s is shared.
+func (s *packStore) hold(file string, ext packExtent) {
+	s.names[file] = ext
+	if s.refs[ext] == 0 {
+		s.packs[ext.pack].live += ext.len
+	}
+	s.refs[ext]++
+}
+
+// release forgets the named file and reports the block it held, if any,
+// and whether that block is now unnamed. Called with s locked or before
+// s is shared.
+func (s *packStore) release(file string) (packExtent, bool) {
+	ext, ok := s.names[file]
+	if !ok {
+		return ext, false
+	}
+	delete(s.names, file)
+	s.refs[ext]--
+	if s.refs[ext] > 0 {
+		return ext, false
+	}
+	delete(s.refs, ext)
+	s.packs[ext.pack].live -= ext.len
+	return ext, true
+}
+
+// has reports whether the named file is in the store.
+func (s *packStore) has(file string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.names[file]
+	return ok
+}
+
+// size returns the length of the named file.
+func (s *packStore) size(file string) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	ext, ok := s.names[file]
+	if !ok {
+		return 0, &os.PathError{Op: "stat", Path: file, Err: os.ErrNotExist}
+	}
+	return ext.len, nil
+}
+
+// list returns the names of the files in the store, sorted.
+func (s *packStore) list() []string {
+	s.Lock()
+	defer s.Unlock()
+	files := make([]string, 0, len(s.names))
+	for file := range s.names {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// read returns the contents of the named file.
+func (s *packStore) read(file string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	ext, ok := s.names[file]
+	if !ok {
+		return nil, &os.PathError{Op: "read", Path: file, Err: os.ErrNotExist}
+	}
+	return s.readExtent(ext)
+}
+
+// readExtent reads a block. Called with s locked.
+func (s *packStore) readExtent(ext packExtent) ([]byte, error) {
+	data := make([]byte, ext.len)
+	if _, err := s.packs[ext.pack].f.ReadAt(data, ext.off); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// write stores data as the named file, replacing any file of that name.
+func (s *packStore) write(file string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	ext, err := s.appendBlock(data)
+	if err != nil {
+		return err
+	}
+	if err := s.record(packPutRecord, file, ext); err != nil {
+		return err
+	}
+	s.remove(file)
+	s.hold(file, ext)
+	return nil
+}
+
+// appendBlock appends data to the current pack, starting a new pack if
+// it is full. Called with s locked.
+func (s *packStore) appendBlock(data []byte) (packExtent, error) {
+	p := s.packs[s.cur]
+	if p != nil && p.size >= s.maxSize {
+		s.cur++
+		p = nil
+	}
+	if p == nil {
+		name := filepath.Join(s.dir, strconv.Itoa(s.cur)+packSuffix)
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+		if err != nil {
+			return packExtent{}, err
+		}
+		p = &packFile{f: f}
+		s.packs[s.cur] = p
+	}
+	if _, err := p.f.WriteAt(data, p.size); err != nil {
+		return packExtent{}, err
+	}
+	ext := packExtent{pack: s.cur, off: p.size, len: int64(len(data))}
+	p.size += ext.len
+	return ext, nil
+}
+
+// link makes newFile another name for the block held by oldFile,
+// as os.Link does.
+func (s *packStore) link(oldFile, newFile string) error {
+	s.Lock()
+	defer s.Unlock()
+	ext, ok := s.names[oldFile]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldFile, New: newFile, Err: os.ErrNotExist}
+	}
+	if _, ok := s.names[newFile]; ok {
+		return &os.LinkError{Op: "link", Old: oldFile, New: newFile, Err: os.ErrExist}
+	}
+	if err := s.record(packPutRecord, newFile, ext); err != nil {
+		return err
+	}
+	s.hold(newFile, ext)
+	return nil
+}
+
+// sync commits the pack holding the named file to stable storage.
+func (s *packStore) sync(file string) error {
+	s.Lock()
+	defer s.Unlock()
+	ext, ok := s.names[file]
+	if !ok {
+		return &os.PathError{Op: "sync", Path: file, Err: os.ErrNotExist}
+	}
+	return fsyncFile(s.packs[ext.pack].f)
+}
+
+// unlink removes the named file from the store.
+func (s *packStore) unlink(file string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.names[file]; !ok {
+		return &os.PathError{Op: "remove", Path: file, Err: os.ErrNotExist}
+	}
+	if err := s.record(packRemoveRecord, file, packExtent{}); err != nil {
+		return err
+	}
+	s.remove(file)
+	return nil
+}
+
+// unpack moves the named file out of the store into the file system.
+func (s *packStore) unpack(file string) error {
+	s.Lock()
+	defer s.Unlock()
+	ext, ok := s.names[file]
+	if !ok {
+		return &os.PathError{Op: "unpack", Path: file, Err: os.ErrNotExist}
+	}
+	data, err := s.readExtent(ext)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		return err
+	}
+	if err := s.record(packRemoveRecord, file, packExtent{}); err != nil {
+		return err
+	}
+	s.remove(file)
+	return nil
+}
+
+// remove forgets the named file and, if that leaves most of its pack
+// unused, compacts the pack. Called with s locked.
+func (s *packStore) remove(file string) {
+	ext, freed := s.release(file)
+	if !freed || ext.pack == s.cur {
+		return
+	}
+	if p := s.packs[ext.pack]; p.live*2 < p.size {
+		s.compactPack(ext.pack)
+	}
+}
+
+// compactPack copies the blocks still named in pack n to the current pack,
+// and removes pack n. If that fails, pack n is left as it is.
+// Called with s locked.
+func (s *packStore) compactPack(n int) {
+	const op = "store/storecache.compactPack"
+	if n == s.cur {
+		return
+	}
+	moved := make(map[packExtent]packExtent)
+	for ext := range s.refs {
+		if ext.pack != n {
+			continue
+		}
+		data, err := s.readExtent(ext)
+		if err == nil {
+			moved[ext], err = s.appendBlock(data)
+		}
+		if err != nil {
+			log.Error.Printf("%s: pack %d: %s", op, n, err)
+			return
+		}
+	}
+	for file, ext := range s.names {
+		if ext.pack != n {
+			continue
+		}
+		if err := s.record(packPutRecord, file, moved[ext]); err != nil {
+			log.Error.Printf("%s: pack %d: %s", op, n, err)
+			return
+		}
+	}
+	for file, ext := range s.names {
+		if to, ok := moved[ext]; ok {
+			s.release(file)
+			s.hold(file, to)
+		}
+	}
+	p := s.packs[n]
+	delete(s.packs, n)
+	p.f.Close()
+	if err := os.Remove(p.f.Name()); err != nil {
+		log.Error.Printf("%s: %s", op, err)
+	}
+}
+
+// record appends a record to the index, compacting the index if it has
+// grown too long. Called with s locked.
+func (s *packStore) record(kind, file string, ext packExtent) error {
+	rel, err := filepath.Rel(s.root, file)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case packPutRecord:
+		_, err = fmt.Fprintf(s.index, "%s %d %d %d %q\n", kind, ext.pack, ext.off, ext.len, rel)
+	case packRemoveRecord:
+		_, err = fmt.Fprintf(s.index, "%s %q\n", kind, rel)
+	}
+	if err != nil {
+		return err
+	}
+	s.records++
+	if s.records < maxPackIndexRecords {
+		return nil
+	}
+	return s.compactIndex()
+}
+
+// compactIndex replaces the index with one holding a record for each name
+// in the store, and opens it for appending. Called with s locked.
+func (s *packStore) compactIndex() error {
+	name := filepath.Join(s.dir, packIndexName)
+	tmpName := name + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for file, ext := range s.names {
+		rel, err := filepath.Rel(s.root, file)
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpName)
+			return err
+		}
+		fmt.Fprintf(w, "%s %d %d %d %q\n", packPutRecord, ext.pack, ext.off, ext.len, rel)
+	}
+	err = w.Flush()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, name)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if s.index != nil {
+		s.index.Close()
+	}
+	s.index, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	s.records = 0
+	return err
+}
+
+// close closes the index and pack files.
+func (s *packStore) close() error {
+	s.Lock()
+	defer s.Unlock()
+	var err error
+	if s.index != nil {
+		err = s.index.Close()
+	}
+	for _, p := range s.packs {
+		p.f.Close()
+	}
+	return err
+}
+
+// walkPacks adds the cache files held in packs to the LRU, and queues
+// the writeback links held there, as walk does for those in the file
+// system.
+func (c *storeCache) walkPacks() {
+	if c.packs == nil {
+		return
+	}
+	for _, file := range c.packs.list() {
+		if c.wbq.enqueueWritebackFile(file) {
+			continue
+		}
+		if _, err := c.parseCachePath(file); err != nil {
+			log.Info.Printf("store/storecache.walkPacks: removing %s: %s", file, err)
+			c.packs.unlink(file)
+			continue
+		}
+		size, _ := c.packs.size(file)
+		cr := c.newCachedRef(file)
+		cr.size = size
+		cr.valid = true
+		cr.busy = false
+	}
+}
+
+// The following methods operate on cache files and writeback links
+// whether they are held in a pack or in the file system.
+
+// readFile returns the contents of the named file.
+func (c *storeCache) readFile(file string) ([]byte, error) {
+	if c.packs != nil {
+		data, err := c.packs.read(file)
+		if !os.IsNotExist(err) {
+			return data, err
+		}
+	}
+	return readFromCacheFile(file)
+}
+
+// writeFile stores the data as the named file, in a pack if it is small
+// enough. Under the fsync option "always", it commits the data to stable
+// storage.
+func (c *storeCache) writeFile(file string, data []byte) error {
+	sync := c.opts.fsync == fsyncAlways
+	if c.packs != nil && int64(len(data)) < c.opts.pack {
+		if err := c.packs.write(file, data); err != nil || !sync {
+			return err
+		}
+		return c.packs.sync(file)
+	}
+	return writeToCacheFile(file, data, sync)
+}
+
+// syncFile commits the named file to stable storage.
+func (c *storeCache) syncFile(file string) error {
+	if c.packs != nil && c.packs.has(file) {
+		return c.packs.sync(file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fsyncFile(f)
+}
+
+// fsyncFile commits the file to stable storage. It is a variable so
+// tests can see when it is called.
+var fsyncFile = (*os.File).Sync
+
+// fileSize returns the length of the named file.
+func (c *storeCache) fileSize(file string) (int64, error) {
+	if c.packs != nil {
+		size, err := c.packs.size(file)
+		if !os.IsNotExist(err) {
+			return size, err
+		}
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// linkFile makes newFile another name for oldFile, as os.Link does.
+func (c *storeCache) linkFile(oldFile, newFile string) error {
+	if c.packs != nil && c.packs.has(oldFile) {
+		return c.packs.link(oldFile, newFile)
+	}
+	return os.Link(oldFile, newFile)
+}
+
+// unlinkFile removes the named file.
+func (c *storeCache) unlinkFile(file string) error {
+	if c.packs != nil {
+		err := c.packs.unlink(file)
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(file)
+}
+
+// unpackFile moves the named file, if it is held in a pack, into the
+// file system, for those that must find it there.
+func (c *storeCache) unpackFile(file string) error {
+	if c.packs == nil {
+		return nil
+	}
+	if err := c.packs.unpack(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
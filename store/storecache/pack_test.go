@@ -0,0 +1,242 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"upspin.io/upspin"
+)
+
+func TestPackStore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir, root := filepath.Join(tmp, packDir), filepath.Join(tmp, "storecache")
+	file := func(name string) string { return filepath.Join(root, "inprocess", name) }
+
+	s, err := openPackStore(dir, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		file("a"):          "first",
+		file("b"):          "second",
+		file("c"):          "",
+		file("with space"): "third",
+	}
+	for f, data := range want {
+		if err := s.write(f, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.write(file("a"), []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	want[file("a")] = "replaced"
+	if err := s.link(file("b"), file("b"+writebackSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	want[file("b"+writebackSuffix)] = "second"
+	if err := s.link(file("a"), file("b"+writebackSuffix)); !os.IsExist(err) {
+		t.Errorf("link to existing name: %v", err)
+	}
+	if err := s.unlink(file("c")); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, file("c"))
+	if _, err := s.read(file("c")); !os.IsNotExist(err) {
+		t.Errorf("read of removed file: %v", err)
+	}
+	s.close()
+
+	// A record cut short by a crash is ignored.
+	f, err := os.OpenFile(filepath.Join(dir, packIndexName), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(packRemoveRecord + ` "inpro`)
+	f.Close()
+
+	s, err = openPackStore(dir, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	files := s.list()
+	if len(files) != len(want) {
+		t.Errorf("reopened store holds %q, want %d files", files, len(want))
+	}
+	for f, data := range want {
+		got, err := s.read(f)
+		if err != nil || string(got) != data {
+			t.Errorf("%s: got %q, %v; want %q", f, got, err, data)
+		}
+	}
+
+	// Removing one name of a shared block leaves the other.
+	if err := s.unlink(file("b")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.read(file("b" + writebackSuffix)); err != nil || string(got) != "second" {
+		t.Errorf("linked file: got %q, %v", got, err)
+	}
+}
+
+func TestPackCompaction(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir, root := filepath.Join(tmp, packDir), filepath.Join(tmp, "storecache")
+
+	s, err := openPackStore(dir, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	s.maxSize = 100
+	// Three 40-byte blocks fill a pack.
+	var files []string
+	for i := 0; i < 9; i++ {
+		f := filepath.Join(root, fmt.Sprintf("block%d", i))
+		if err := s.write(f, []byte(fmt.Sprintf("%040d", i))); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	packs := func() []string {
+		names, err := filepath.Glob(filepath.Join(dir, "*"+packSuffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+	if n := len(packs()); n != 3 {
+		t.Fatalf("%d packs, want 3", n)
+	}
+	first := filepath.Join(dir, "0"+packSuffix)
+
+	// Removing one block of three leaves the first pack alone.
+	if err := s.unlink(files[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Fatalf("pack compacted too soon: %v", err)
+	}
+	// Removing a second compacts it.
+	if err := s.unlink(files[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Errorf("mostly unused pack not removed: %v", err)
+	}
+	for i, f := range files[2:] {
+		got, err := s.read(f)
+		if want := fmt.Sprintf("%040d", i+2); err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v; want %q", f, got, err, want)
+		}
+	}
+	var total int64
+	for _, p := range packs() {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += info.Size()
+	}
+	if total != 7*40 {
+		t.Errorf("packs hold %d bytes, want %d", total, 7*40)
+	}
+}
+
+func TestPackWriteback(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "storecache")
+	// The endpoint must survive the round trip through a file name,
+	// so it can have no network address.
+	st := storeFor(upspin.Endpoint{Transport: upspin.InProcess})
+	st.reset()
+	opts := options{pack: 100}
+
+	c, _, err := newCache(testConfig, dir, 1e8, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := []string{"small", "also small", strings.Repeat("large ", 100)}
+	var refs []upspin.Reference
+	for _, b := range blocks {
+		ref, err := c.put(testConfig, []byte(b), st.e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+	for i, ref := range refs {
+		if err := c.wbq.flush(upspin.Location{Reference: ref, Endpoint: st.e}); err != nil {
+			t.Fatal(err)
+		}
+		data, _, _, err := st.Get(ref)
+		if err != nil || string(data) != blocks[i] {
+			t.Errorf("block %d written back as %q, %v; want %q", i, data, err, blocks[i])
+		}
+	}
+	// Only the large block has a file of its own.
+	var loose []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			loose = append(loose, path)
+		}
+		return nil
+	})
+	if len(loose) != 1 || loose[0] != c.cachePath(refs[2], st.e) {
+		t.Errorf("cache files %q, want only that of the large block", loose)
+	}
+
+	// Leave a small block pending across a restart.
+	st.Lock()
+	st.fail = true
+	st.Unlock()
+	pending, err := c.put(testConfig, []byte("pending"), st.e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.close()
+	st.reset()
+
+	c, _, err = newCache(testConfig, dir, 1e8, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if err := c.wbq.flush(upspin.Location{Reference: pending, Endpoint: st.e}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, _, err := st.Get(pending); err != nil || string(data) != "pending" {
+		t.Errorf("pending block written back as %q, %v", data, err)
+	}
+	// The blocks are still cached, though the store has forgotten them.
+	st.Lock()
+	st.fail = true
+	st.data = make(map[upspin.Reference][]byte)
+	st.Unlock()
+	for i, ref := range refs {
+		if data, _, err := c.get(testConfig, ref, st.e); err != nil || string(data) != blocks[i] {
+			t.Errorf("cached block %d: got %q, %v", i, data, err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// defaultReplayWait is how long a replay waits, by default, for each
+// block to be written back.
+const defaultReplayWait = time.Minute
+
+// ReplayOptions controls ReplayQuarantine.
+type ReplayOptions struct {
+	// Endpoint, if assigned, limits the replay to blocks
+	// destined for that store.
+	Endpoint upspin.Endpoint
+
+	// Rate is the most blocks a second to queue for writeback.
+	// Zero means there is no limit.
+	Rate float64
+
+	// Wait is how long to wait for each block to be written back;
+	// zero means defaultReplayWait. A block not written back in
+	// time stays queued, and leaves quarantine once it is written.
+	Wait time.Duration
+
+	// Progress, if set, is called with the counts so far each time
+	// a block is queued or its writeback settled. Calls are serialized.
+	Progress func(ReplayStats)
+}
+
+// ReplayStats counts the blocks handled by ReplayQuarantine.
+type ReplayStats struct {
+	Total     int // Quarantined blocks selected for replay.
+	Queued    int // Blocks queued for writeback so far.
+	Succeeded int // Blocks written back and removed from quarantine.
+	Failed    int // Blocks that could not be written back, left in quarantine.
+	Pending   int // Blocks still being written back when the wait ended.
+}
+
+// quarantineRoot returns the quarantine directory.
+func (wbq *writebackQueue) quarantineRoot() string {
+	return filepath.Join(filepath.Dir(wbq.sc.dir), quarantineDir)
+}
+
+// quarantined returns the sorted locations of the blocks in quarantine
+// for endpoint e or, if e is unassigned, for all endpoints.
+func (wbq *writebackQueue) quarantined(e upspin.Endpoint) ([]upspin.Location, error) {
+	const op = "store/storecache.quarantined"
+	root := wbq.quarantineRoot()
+	var locs []upspin.Location
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root && os.IsNotExist(err) {
+				return nil // Nothing was ever quarantined.
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		elems := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+		if len(elems) != 2 {
+			log.Error.Printf("%s: odd quarantine file %s", op, path)
+			return nil
+		}
+		ep, err := upspin.ParseEndpoint(elems[0])
+		if err != nil {
+			log.Error.Printf("%s: odd quarantine file %s: %s", op, path, err)
+			return nil
+		}
+		ref, err := parseRefFileName(elems[1])
+		if err != nil {
+			log.Error.Printf("%s: odd quarantine file %s: %s", op, path, err)
+			return nil
+		}
+		if e.Transport == upspin.Unassigned || *ep == e {
+			locs = append(locs, upspin.Location{Reference: ref, Endpoint: *ep})
+		}
+		return nil
+	})
+	sortLocations(locs)
+	return locs, err
+}
+
+// sortLocations sorts locations by endpoint and then reference.
+func sortLocations(locs []upspin.Location) {
+	sort.Slice(locs, func(i, j int) bool {
+		if locs[i].Endpoint != locs[j].Endpoint {
+			return locs[i].Endpoint.String() < locs[j].Endpoint.String()
+		}
+		return locs[i].Reference < locs[j].Reference
+	})
+}
+
+// replay queues the quarantined blocks selected by opts for writeback,
+// no faster than opts.Rate, and waits for the writebacks. Blocks written
+// back are removed from quarantine; those the store refuses stay.
+func (wbq *writebackQueue) replay(opts ReplayOptions) (ReplayStats, error) {
+	const op = "store/storecache.replay"
+	locs, err := wbq.quarantined(opts.Endpoint)
+	if err != nil {
+		return ReplayStats{}, err
+	}
+	wait := opts.Wait
+	if wait == 0 {
+		wait = defaultReplayWait
+	}
+
+	var mu sync.Mutex
+	stats := ReplayStats{Total: len(locs)}
+	count := func(n *int) {
+		mu.Lock()
+		defer mu.Unlock()
+		*n++
+		if opts.Progress != nil {
+			opts.Progress(stats)
+		}
+	}
+
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var wg sync.WaitGroup
+	for i, loc := range locs {
+		if i > 0 && tick != nil {
+			<-tick
+		}
+		q := wbq.quarantinePath(loc)
+		if err := wbq.sc.importPending(loc, q); err != nil {
+			log.Error.Printf("%s: %s", op, err)
+			count(&stats.Failed)
+			continue
+		}
+		count(&stats.Queued)
+
+		wg.Add(1)
+		go func(loc upspin.Location, q string) {
+			defer wg.Done()
+			flushed := make(chan error, 1)
+			go func() { flushed <- wbq.flush(loc) }()
+			select {
+			case err := <-flushed:
+				if err != nil {
+					// The block is abandoned again, and
+					// discard has put it back in quarantine.
+					log.Error.Printf("%s: %s", op, err)
+					count(&stats.Failed)
+					return
+				}
+				wbq.unquarantine(q)
+				count(&stats.Succeeded)
+			case <-time.After(wait):
+				count(&stats.Pending)
+				go func() {
+					if <-flushed == nil {
+						wbq.unquarantine(q)
+					}
+				}()
+			}
+		}(loc, q)
+	}
+	wg.Wait()
+	return stats, nil
+}
+
+// unquarantine removes the quarantined block q and any directories
+// left empty.
+func (wbq *writebackQueue) unquarantine(q string) {
+	const op = "store/storecache.unquarantine"
+	if err := os.Remove(q); err != nil && !os.IsNotExist(err) {
+		log.Error.Printf("%s: %s", op, err)
+		return
+	}
+	root := wbq.quarantineRoot()
+	for dir := filepath.Dir(q); dir != root; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"upspin.io/bind"
+	"upspin.io/key/sha256key"
+	"upspin.io/upspin"
+)
+
+func init() {
+	// Quarantined blocks are filed by endpoint, and only remote
+	// endpoints keep their network address in a file name.
+	bind.RegisterStoreServer(upspin.Remote, testStoreDialer{})
+}
+
+func TestReplayQuarantine(t *testing.T) {
+	c, _, cleanup := newTestCache(t, "replay", options{})
+	defer cleanup()
+	store := func(addr upspin.NetAddr) *testStore {
+		st := storeFor(upspin.Endpoint{Transport: upspin.Remote, NetAddr: addr})
+		st.reset()
+		return st
+	}
+	fixed, broken, other := store("fixed:443"), store("broken:443"), store("other:443")
+	broken.Lock()
+	broken.badRef = true
+	broken.Unlock()
+
+	// Seed the quarantine as discard would have.
+	quarantine := func(st *testStore, n int) []upspin.Location {
+		var locs []upspin.Location
+		for i := 0; i < n; i++ {
+			data := []byte(fmt.Sprintf("block %d for %s", i, st.e.NetAddr))
+			loc := upspin.Location{Reference: upspin.Reference(sha256key.Of(data).String()), Endpoint: st.e}
+			q := c.wbq.quarantinePath(loc)
+			if err := os.MkdirAll(filepath.Dir(q), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(q, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			locs = append(locs, loc)
+		}
+		return locs
+	}
+	fixedLocs := quarantine(fixed, 4)
+	brokenLocs := quarantine(broken, 2)
+	otherLocs := quarantine(other, 1)
+	inQuarantine := func(loc upspin.Location) bool {
+		_, err := os.Stat(c.wbq.quarantinePath(loc))
+		return err == nil
+	}
+
+	// Replay one store's blocks, slowly.
+	const rate = 20
+	var progress []ReplayStats
+	var queued []time.Time
+	stats, err := c.wbq.replay(ReplayOptions{
+		Endpoint: fixed.e,
+		Rate:     rate,
+		Progress: func(s ReplayStats) {
+			if len(progress) == 0 || s.Queued > progress[len(progress)-1].Queued {
+				queued = append(queued, time.Now())
+			}
+			progress = append(progress, s)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ReplayStats{Total: 4, Queued: 4, Succeeded: 4}); stats != want {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+	if len(progress) != 8 || progress[7] != stats {
+		t.Errorf("progress %+v, want 8 reports ending with %+v", progress, stats)
+	}
+	if len(queued) != 4 {
+		t.Fatalf("%d blocks queued, want 4", len(queued))
+	}
+	if d, min := queued[3].Sub(queued[0]), 3*time.Second/rate; d < min {
+		t.Errorf("4 blocks queued in %v, want at least %v", d, min)
+	}
+	for _, loc := range fixedLocs {
+		if inQuarantine(loc) {
+			t.Errorf("%s still quarantined", loc.Reference)
+		}
+		if _, _, _, err := fixed.Get(loc.Reference); err != nil {
+			t.Errorf("%s not written back: %v", loc.Reference, err)
+		}
+	}
+	if n := broken.numPuts() + other.numPuts(); n != 0 {
+		t.Errorf("%d puts to stores not replayed", n)
+	}
+
+	// Replay the rest; the broken store still refuses its blocks.
+	stats, err = c.wbq.replay(ReplayOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ReplayStats{Total: 3, Queued: 3, Succeeded: 1, Failed: 2}); stats != want {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+	for _, loc := range brokenLocs {
+		if !inQuarantine(loc) {
+			t.Errorf("refused block %s removed from quarantine", loc.Reference)
+		}
+	}
+	if inQuarantine(otherLocs[0]) {
+		t.Errorf("%s still quarantined", otherLocs[0].Reference)
+	}
+	if _, err := os.Stat(filepath.Join(c.wbq.quarantineRoot(), fixed.e.String())); !os.IsNotExist(err) {
+		t.Errorf("emptied quarantine directory not removed: %v", err)
+	}
+}
@@ -9,6 +9,10 @@ package storecache
 import (
 	"fmt"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"upspin.io/errors"
 	"upspin.io/log"
@@ -24,6 +28,10 @@ type server struct {
 
 	// The store server this dialed server should talk to.
 	authority upspin.Endpoint
+
+	// The user who dialed, whose blocks take their turn to be written
+	// back with those of other users.
+	user upspin.UserName
 }
 
 // New creates a new store cache that implements upspin.StoreServer.
@@ -31,20 +39,385 @@ type server struct {
 // that are waiting to be written back. This is important to allow
 // the client to flush out Access file blocks before writing the
 // DirEntry.
-func New(cfg upspin.Config, cacheDir string, maxBytes int64, writethrough bool) (upspin.StoreServer, func(upspin.Location), error) {
-	c, blockFlusher, err := newCache(cfg, path.Join(cacheDir, "storecache"), maxBytes, writethrough)
+//
+// The options are "key=value" strings. The keys are:
+//
+//	refMismatch: what to do with a block written back to a store that
+//	returns a reference other than the one the block was cached under.
+//	Either "quarantine", the default, to move the block into the
+//	storequarantine directory alongside the cache, or "delete" to
+//	remove it.
+//
+//	schedule: how to choose among stores with pending writebacks.
+//	Either "roundRobin", the default, or "leastLoaded" to prefer the
+//	stores with the fewest writebacks in progress.
+//
+//	deadline: a duration, such as "30s", within which each block
+//	should be written back. Blocks still pending after it are logged
+//	and counted in DeadlineStats. Scheduling is unaffected.
+//
+//	smallBlock: a size in bytes, 16384 by default. Blocks smaller than
+//	this, such as those holding Access files and directory entries,
+//	are written back in a fast lane, ahead of any larger blocks, so
+//	they become durable quickly even during a bulk flush. Zero turns
+//	the fast lane off.
+//
+//	fastLaneSlots: how many of the parallel writebacks, zero by
+//	default, larger blocks may not use, so that small blocks need not
+//	wait for a large one to finish. Reserved writebacks stay idle when
+//	there are no small blocks to send.
+//
+//	aging: a duration, 1m by default, after which a larger block still
+//	waiting to be written back is treated like a small one, so that a
+//	steady stream of small blocks cannot delay it forever. Zero turns
+//	aging off.
+//
+//	pack: a size in bytes, zero by default. Blocks smaller than this are
+//	not stored as a file each but appended to large pack files in the
+//	storepacks directory alongside the cache, saving inodes and space
+//	when there are many small blocks. Space held by removed blocks is
+//	reclaimed by copying what remains of a mostly unused pack into a new
+//	one. Zero turns packing off.
+//
+//	writerIdle: a duration, zero by default, after which a writer
+//	goroutine with no writeback to do exits, so an idle cache holds
+//	fewer goroutines. More are started, up to the number of writers,
+//	when writebacks wait for one. Zero keeps every writer running.
+//
+//	minWriters: the fewest writers, 1 by default, that writerIdle
+//	leaves running.
+//
+//	putTimeout: a duration, zero by default, after which a writeback's
+//	Put to a store is given up on and the block queued again, so that a
+//	wedged store cannot hold writers forever. The timeout reduces the
+//	parallel writebacks as a server timeout would. A Put given up on is
+//	not cancelled, as stores cannot cancel one; while a few are still
+//	running for a store, no more are sent to it. Zero means no limit.
+//
+//	latencySeed: a duration, zero by default. If set, the cache times a
+//	Put of the empty block to the first store it writes back to and
+//	starts with one parallel writeback for each latencySeed of the round
+//	trip, up to the number of writers, rather than 6, so that a distant
+//	store starts with more in flight and a near one with fewer. The
+//	usual adjustment refines the number from there. Zero turns the probe
+//	off.
+//
+//	fsync: when to commit cache files to stable storage, trading
+//	speed for durability across a crash of the system. Either "never",
+//	the default, to leave it to the operating system; "writeback", to
+//	commit each cache file before linking it for writeback, so that a
+//	block pending writeback is never lost or truncated by a crash; or
+//	"always", to commit every cache file as it is written. A block held
+//	in a pack is committed by committing its pack file.
+//
+//	batch: the most blocks, 1 by default, that a writer sends to a store
+//	in one call when several are waiting for it, saving a round trip for
+//	each of the others. A store that cannot take several blocks in one
+//	call, as one with a PutBatch method can, is sent them one at a time
+//	by the same writer.
+//
+//	healthCheck: a duration, zero by default. If set, a store that has
+//	failed, whose writebacks would otherwise wait 5 minutes to be
+//	retried, is checked at this interval and retried as soon as it
+//	passes, so that writebacks resume soon after a brief outage. Zero
+//	turns checking off.
+//
+//	healthOp: how healthCheck checks a store. Either "ping", the default,
+//	to call its Ping method, or "put" to Put the empty block, which also
+//	shows that it accepts writes.
+//
+//	startupCheck: a duration, zero by default. If set, the stores of the
+//	writebacks found on startup are checked, all at once and with
+//	healthOp, before the writebacks are queued, waiting at most this
+//	long. A store that fails starts out dead, to be retried as any that
+//	has failed, rather than each being tried anew with a writeback; one
+//	that passes starts out live. A store that has not answered in time
+//	is tried with a writeback, as without the option. This speeds
+//	recovery after an outage of some stores.
+//
+//	userParallel: the most writebacks, zero by default for no limit, in
+//	flight at once for the blocks of any one user. Whatever the option,
+//	the users who dial the cache, as a cache server does for each user
+//	it serves, take turns in the writebacks to each store, so that one
+//	user's backlog cannot delay another's writebacks. The limit also
+//	leaves writers free for other users' blocks as they arrive. A block
+//	already waiting for writeback when another user puts it keeps its
+//	place in the first user's turn.
+//
+//	writebackMemory: a size in bytes, zero by default for no limit, of
+//	the block data that writebacks may hold in memory at once. Each
+//	writer reads the whole of a block, or of a batch, before sending it
+//	to the store, so many writers with large blocks can hold a lot; with
+//	the limit, a writer waits before reading until the blocks already
+//	read are sent and the data it needs fits. A block larger than the
+//	limit is written back alone.
+//
+// The returned StoreServer also has ExportPending and ImportPending methods,
+// for moving pending writebacks from one cache to another, a SetWriters
+// method to change the number of parallel writers at run time, and an
+// IsPending method to ask, without waiting, whether a block is yet to be
+// written back. Its DeadlineStats and OnDeadlineBreach methods monitor the
+// deadline option, its OnParallelismChange method reports each adjustment
+// of the number of parallel writebacks, and its ChurnStats method reports
+// the file activity of the cache. Its ReplayQuarantine method retries the
+// writeback of blocks that were quarantined, once the store has been fixed.
+// Its Trace method follows the writebacks of chosen blocks step by step,
+// for debugging, and its PrioritizeEndpoint method drains the writebacks
+// for one store ahead of the others, as before a cutover. Its Pin and
+// Unpin methods keep chosen blocks in the cache, as an application's hot
+// working set, however full it gets.
+func New(cfg upspin.Config, cacheDir string, maxBytes int64, writethrough bool, options ...string) (upspin.StoreServer, func(upspin.Location), error) {
+	const op = "store/storecache.New"
+	opts, err := parseOptions(options)
+	if err != nil {
+		return nil, nil, errors.E(op, err)
+	}
+	c, blockFlusher, err := newCache(cfg, path.Join(cacheDir, "storecache"), maxBytes, writethrough, opts)
 	if err != nil {
 		return nil, nil, err
 	}
 	return &server{
 		cfg:   cfg,
 		cache: c,
+		user:  cfg.UserName(),
 	}, blockFlusher, nil
 }
 
+// options are the optional parameters of a store cache.
+type options struct {
+	// deleteMismatched says to remove rather than quarantine blocks
+	// whose writeback returned an unexpected reference.
+	deleteMismatched bool
+
+	// leastLoaded says to dispatch writebacks to the endpoint with
+	// the fewest in flight rather than round robin.
+	leastLoaded bool
+
+	// deadline, if non-zero, is how soon after being put a block
+	// should be written back.
+	deadline time.Duration
+
+	// smallBlock is the size below which blocks are written back
+	// in the fast lane. Zero means there is no fast lane.
+	smallBlock int64
+
+	// fastLaneSlots is the number of parallel writebacks reserved
+	// for the fast lane.
+	fastLaneSlots int
+
+	// aging, if non-zero, is how long a block waits in the normal
+	// queue before it is sent like one in the fast lane.
+	aging time.Duration
+
+	// pack is the size below which blocks are stored in pack files.
+	// Zero means none are.
+	pack int64
+
+	// writerIdle, if non-zero, is how long a writer waits for work
+	// before exiting, leaving at least minWriters running.
+	writerIdle time.Duration
+	minWriters int
+
+	// putTimeout, if non-zero, limits how long a writeback waits
+	// for a store's Put.
+	putTimeout time.Duration
+
+	// latencySeed, if non-zero, is the round trip time to a store
+	// per parallel writeback to start with.
+	latencySeed time.Duration
+
+	// fsync says when cache files are committed to stable storage:
+	// fsyncNever, fsyncWriteback, or fsyncAlways.
+	fsync int
+
+	// batch, if more than 1, is the most blocks to write back to a
+	// store in one call.
+	batch int
+
+	// healthCheck, if non-zero, is how often dead endpoints are checked,
+	// with healthOp: healthPing or healthPut.
+	healthCheck time.Duration
+	healthOp    int
+
+	// startupCheck, if non-zero, is how long to wait on startup for the
+	// stores of the recovered writebacks to be checked with healthOp.
+	startupCheck time.Duration
+
+	// userParallel, if non-zero, is the most writebacks in flight at
+	// once for any one user.
+	userParallel int
+
+	// writebackMemory, if non-zero, is the most bytes of block data
+	// that writebacks hold in memory at once.
+	writebackMemory int64
+}
+
+// Values for the fsync option.
+const (
+	fsyncNever     = iota // Leave it to the operating system.
+	fsyncWriteback        // Before a writeback link is made to a cache file.
+	fsyncAlways           // Whenever a cache file is written.
+)
+
+// Defaults for the fast lane options.
+const (
+	defaultSmallBlock    = 16 << 10
+	defaultFastLaneSlots = 0
+	defaultAging         = time.Minute
+	defaultMinWriters    = 1
+)
+
+// parseOptions parses the "key=value" options passed to New.
+func parseOptions(opts []string) (options, error) {
+	o := options{
+		smallBlock:    defaultSmallBlock,
+		fastLaneSlots: defaultFastLaneSlots,
+		aging:         defaultAging,
+		minWriters:    defaultMinWriters,
+		batch:         1,
+	}
+	for _, opt := range opts {
+		kv := strings.Split(opt, "=")
+		if len(kv) != 2 {
+			return o, errors.E(errors.Invalid, errors.Errorf("invalid option format: %q", opt))
+		}
+		k, v := kv[0], kv[1]
+		switch k {
+		case "refMismatch":
+			switch v {
+			case "quarantine":
+				o.deleteMismatched = false
+			case "delete":
+				o.deleteMismatched = true
+			default:
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+		case "schedule":
+			switch v {
+			case "roundRobin":
+				o.leastLoaded = false
+			case "leastLoaded":
+				o.leastLoaded = true
+			default:
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+		case "deadline":
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.deadline = d
+		case "smallBlock":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.smallBlock = n
+		case "fastLaneSlots":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.fastLaneSlots = n
+		case "aging":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.aging = d
+		case "pack":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.pack = n
+		case "writerIdle":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.writerIdle = d
+		case "minWriters":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.minWriters = n
+		case "putTimeout":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.putTimeout = d
+		case "latencySeed":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.latencySeed = d
+		case "fsync":
+			switch v {
+			case "never":
+				o.fsync = fsyncNever
+			case "writeback":
+				o.fsync = fsyncWriteback
+			case "always":
+				o.fsync = fsyncAlways
+			default:
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+		case "batch":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.batch = n
+		case "healthCheck":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.healthCheck = d
+		case "healthOp":
+			switch v {
+			case "ping":
+				o.healthOp = healthPing
+			case "put":
+				o.healthOp = healthPut
+			default:
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+		case "startupCheck":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.startupCheck = d
+		case "userParallel":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.userParallel = n
+		case "writebackMemory":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return o, errors.E(errors.Invalid, errors.Errorf("invalid value for %s: %q", k, v))
+			}
+			o.writebackMemory = n
+		default:
+			return o, errors.E(errors.Invalid, errors.Errorf("unknown option %q", k))
+		}
+	}
+	return o, nil
+}
+
 func (s *server) Dial(config upspin.Config, e upspin.Endpoint) (upspin.Service, error) {
 	s2 := *s
 	s2.authority = e
+	if config != nil {
+		s2.user = config.UserName()
+	}
 	return &s2, nil
 }
 
@@ -76,7 +449,8 @@ func (s *server) Put(data []byte) (*upspin.Refdata, error) {
 
 	op := logf("Put %.30x...", data)
 
-	ref, err := s.cache.put(s.cfg, data, s.authority)
+	s.cache.churn.put()
+	ref, err := s.cache.putFor(s.cfg, s.user, data, s.authority)
 	if err != nil {
 		return nil, op.error(err)
 	}
@@ -102,6 +476,234 @@ func (s *server) Delete(ref upspin.Reference) error {
 	return nil
 }
 
+// PendingWriteback describes a block waiting to be written back.
+type PendingWriteback struct {
+	// Location is where the block is to be written.
+	upspin.Location
+
+	// File holds the block's data. It is a slash-separated path
+	// relative to the directory of the cache that exported it, as
+	// passed to New, so that the directory can be moved to another
+	// host.
+	File string
+}
+
+var errWritethrough = errors.E(errors.Invalid, errors.Str("writethrough cache has no writeback queue"))
+
+// ExportPending returns a manifest of the blocks waiting to be written back,
+// sorted by location. The manifest is a snapshot; writebacks continue.
+func (s *server) ExportPending() ([]PendingWriteback, error) {
+	const op = "store/storecache.ExportPending"
+	wbq := s.cache.wbq
+	if wbq == nil {
+		return nil, errors.E(op, errWritethrough)
+	}
+	locs := wbq.pending()
+	sortLocations(locs)
+	root := filepath.Dir(s.cache.dir)
+	manifest := make([]PendingWriteback, len(locs))
+	for i, loc := range locs {
+		file := s.cache.cachePath(loc.Reference, loc.Endpoint) + writebackSuffix
+		// The manifest names files that another cache can read.
+		if err := s.cache.unpackFile(file); err != nil {
+			return nil, errors.E(op, err)
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
+		manifest[i] = PendingWriteback{
+			Location: loc,
+			File:     filepath.ToSlash(rel),
+		}
+	}
+	return manifest, nil
+}
+
+// ImportPending adds the blocks in a manifest produced by ExportPending,
+// perhaps by another cache, to the cache and queues them for writeback.
+// The data is read from the files named in the manifest, relative to dir,
+// which holds the exporting cache's directory or a copy of it, wherever
+// it is now.
+func (s *server) ImportPending(dir string, manifest []PendingWriteback) error {
+	const op = "store/storecache.ImportPending"
+	if s.cache.wbq == nil {
+		return errors.E(op, errWritethrough)
+	}
+	for _, p := range manifest {
+		if f := path.Clean(p.File); path.IsAbs(f) || f == ".." || strings.HasPrefix(f, "../") {
+			return errors.E(op, errors.Invalid, errors.Errorf("file %q is not within the cache", p.File))
+		}
+		if err := s.cache.importPending(p.Location, filepath.Join(dir, filepath.FromSlash(p.File))); err != nil {
+			return errors.E(op, err)
+		}
+	}
+	return nil
+}
+
+// ReplayQuarantine queues the blocks in the quarantine directory for
+// writeback again, perhaps after the store that refused them has been
+// fixed, and waits for the writebacks. The options choose the blocks,
+// limit the rate at which they are queued so as not to overwhelm the
+// store, and report progress. Blocks written back are removed from
+// quarantine; those refused again stay there.
+func (s *server) ReplayQuarantine(opts ReplayOptions) (ReplayStats, error) {
+	const op = "store/storecache.ReplayQuarantine"
+	if s.cache.wbq == nil {
+		return ReplayStats{}, errors.E(op, errWritethrough)
+	}
+	stats, err := s.cache.wbq.replay(opts)
+	if err != nil {
+		return stats, errors.E(op, err)
+	}
+	return stats, nil
+}
+
+// IsPending reports whether the block at loc has yet to be written back
+// to its store. It does not wait for the writeback. A writethrough cache
+// has nothing pending.
+func (s *server) IsPending(loc upspin.Location) bool {
+	if s.cache.wbq == nil {
+		return false
+	}
+	return s.cache.wbq.isPending(loc)
+}
+
+// SetWriters changes the number of goroutines writing blocks back to their
+// stores to n, which must be positive. Fewer writers mean less load on the
+// stores; more may drain a backlog faster.
+func (s *server) SetWriters(n int) error {
+	const op = "store/storecache.SetWriters"
+	if s.cache.wbq == nil {
+		return errors.E(op, errWritethrough)
+	}
+	if err := s.cache.wbq.setWriters(n); err != nil {
+		return errors.E(op, err)
+	}
+	return nil
+}
+
+// ChurnStats returns counts of the cache's file activity, from which
+// write amplification may be judged.
+func (s *server) ChurnStats() ChurnStats {
+	return s.cache.churn.stats()
+}
+
+// DeadlineStats describes the writebacks that have passed the deadline
+// set by the deadline option.
+type DeadlineStats struct {
+	// Overdue is the number of blocks now pending past their deadline.
+	Overdue int
+
+	// Breaches is the number of blocks that have passed their deadline
+	// since the cache started, whether or not they have since been
+	// written back.
+	Breaches int
+}
+
+// DeadlineStats returns the current deadline statistics. They are zero
+// if no deadline is set.
+func (s *server) DeadlineStats() (DeadlineStats, error) {
+	const op = "store/storecache.DeadlineStats"
+	if s.cache.wbq == nil {
+		return DeadlineStats{}, errors.E(op, errWritethrough)
+	}
+	return s.cache.wbq.deadlineStats(), nil
+}
+
+// OnDeadlineBreach arranges for f to be called, in a new goroutine, with
+// the location of each block whose writeback passes its deadline.
+// A nil f cancels the call.
+func (s *server) OnDeadlineBreach(f func(upspin.Location)) error {
+	const op = "store/storecache.OnDeadlineBreach"
+	wbq := s.cache.wbq
+	if wbq == nil {
+		return errors.E(op, errWritethrough)
+	}
+	wbq.breachMu.Lock()
+	wbq.onBreach = f
+	wbq.breachMu.Unlock()
+	return nil
+}
+
+// ParallelismChange describes an adjustment, reported to the function
+// given to OnParallelismChange, of the number of writebacks the cache
+// lets run in parallel.
+type ParallelismChange struct {
+	// Endpoint is the store whose writeback, by succeeding or timing
+	// out, triggered the change.
+	Endpoint upspin.Endpoint
+
+	// Old and New are the maximum number of parallel writebacks before
+	// and after the change.
+	Old, New int
+
+	// Up reports whether the maximum was raised, after a run of
+	// successes, rather than lowered, after a timeout.
+	Up bool
+}
+
+// OnParallelismChange arranges for f to be called, in a new goroutine,
+// each time a writeback's success or timeout changes the maximum number
+// of parallel writebacks, so that the adjustments may be watched when
+// tuning the writers. A nil f cancels the call.
+func (s *server) OnParallelismChange(f func(ParallelismChange)) error {
+	const op = "store/storecache.OnParallelismChange"
+	wbq := s.cache.wbq
+	if wbq == nil {
+		return errors.E(op, errWritethrough)
+	}
+	wbq.parallelMu.Lock()
+	wbq.onParallel = f
+	wbq.parallelMu.Unlock()
+	return nil
+}
+
+// Trace logs each step in the writebacks of the blocks at locs, and
+// passes it to f, if f is not nil, replacing any earlier trace. An empty
+// locs stops tracing. F is called synchronously, as each step happens,
+// by the goroutine taking it, so it must be quick and safe to call
+// concurrently; the events for a single location are delivered in order.
+func (s *server) Trace(locs []upspin.Location, f func(TraceEvent)) error {
+	const op = "store/storecache.Trace"
+	if s.cache.wbq == nil {
+		return errors.E(op, errWritethrough)
+	}
+	s.cache.wbq.tracer.set(locs, f)
+	return nil
+}
+
+// PrioritizeEndpoint reshapes the scheduling of writebacks to drain those
+// queued for the endpoint as fast as possible: it is given all the
+// parallel writebacks but a quarter, or one if fewer, which are left to
+// the other endpoints so that they are slowed rather than stopped. Fair
+// scheduling resumes once none are queued or in flight for it. Unlike
+// a flush, it returns at once. Only one endpoint is prioritized at a time;
+// a later call replaces an earlier one.
+func (s *server) PrioritizeEndpoint(e upspin.Endpoint) error {
+	const op = "store/storecache.PrioritizeEndpoint"
+	if s.cache.wbq == nil {
+		return errors.E(op, errWritethrough)
+	}
+	s.cache.wbq.prioritizeEndpoint(e)
+	return nil
+}
+
+// Pin keeps the block with the reference, from the store at the endpoint,
+// in the cache: once cached, it is never evicted, however full the cache
+// gets and however long since it was read, until Unpin is called. It may
+// be pinned before it is cached. Pinned blocks count against the cache's
+// limit, which is soft, so pinning too many pushes the cache past it.
+// Blocks awaiting writeback are kept in the cache without being pinned.
+func (s *server) Pin(ref upspin.Reference, e upspin.Endpoint) {
+	s.cache.pin(ref, e)
+}
+
+// Unpin undoes Pin, letting the block be evicted again in its turn.
+func (s *server) Unpin(ref upspin.Reference, e upspin.Endpoint) {
+	s.cache.unpin(ref, e)
+}
+
 func (s *server) Endpoint() upspin.Endpoint { return s.authority }
 func (s *server) Close()                    {}
 func (s *server) Ping() bool                { return true }
@@ -0,0 +1,123 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// TraceKind is the kind of a TraceEvent.
+type TraceKind int
+
+// The steps in the writeback of a block, in the order they happen.
+// A writeback that fails is requeued and goes through them again.
+const (
+	TraceEnqueued   TraceKind = iota // Queued for writeback.
+	TracePicked                      // Chosen by the scheduler for a writer.
+	TraceDispatched                  // Taken by a writer.
+	TracePutStarted                  // Being Put to the store.
+	TracePutDone                     // Put returned; Err is its error.
+	TraceRequeued                    // Queued again after an error, Err.
+	TraceFinished                    // Written back; the writeback is over.
+	TraceAbandoned                   // Given up on after Err; the writeback is over.
+)
+
+var traceKindNames = []string{
+	TraceEnqueued:   "enqueued",
+	TracePicked:     "picked",
+	TraceDispatched: "dispatched",
+	TracePutStarted: "put started",
+	TracePutDone:    "put done",
+	TraceRequeued:   "requeued",
+	TraceFinished:   "finished",
+	TraceAbandoned:  "abandoned",
+}
+
+func (k TraceKind) String() string {
+	if k < 0 || int(k) >= len(traceKindNames) {
+		return fmt.Sprintf("TraceKind(%d)", int(k))
+	}
+	return traceKindNames[k]
+}
+
+// A TraceEvent is a step in the writeback of a traced block.
+type TraceEvent struct {
+	upspin.Location
+	Time time.Time
+	Kind TraceKind
+
+	// Writer identifies the writer goroutine handling the block, from
+	// TraceDispatched to TracePutDone. It is -1 for a block written back
+	// outside the writers, as empty blocks are.
+	Writer int
+
+	// Err is the error of TracePutDone, TraceRequeued, and
+	// TraceAbandoned events, if any.
+	Err error
+}
+
+func (e TraceEvent) String() string {
+	s := fmt.Sprintf("%s %s %s", e.Reference, e.Endpoint, e.Kind)
+	switch e.Kind {
+	case TraceDispatched, TracePutStarted, TracePutDone:
+		s += fmt.Sprintf(" writer %d", e.Writer)
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// tracer follows the writebacks of chosen locations.
+type tracer struct {
+	mu   sync.Mutex
+	locs map[upspin.Location]bool // Locations traced; nil if none.
+	f    func(TraceEvent)         // Called with each event, if set.
+}
+
+// set replaces the traced locations and the function to call.
+func (t *tracer) set(locs []upspin.Location, f func(TraceEvent)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(locs) == 0 {
+		t.locs, t.f = nil, nil
+		return
+	}
+	t.locs = make(map[upspin.Location]bool)
+	for _, loc := range locs {
+		t.locs[loc] = true
+	}
+	t.f = f
+}
+
+// event logs the event for the request's location, if it is traced,
+// and passes it to the trace function, if any.
+func (t *tracer) event(r *request, kind TraceKind, err error) {
+	t.mu.Lock()
+	traced, f := t.locs[r.Location], t.f
+	t.mu.Unlock()
+	if !traced {
+		return
+	}
+	e := TraceEvent{
+		Location: r.Location,
+		Time:     time.Now(),
+		Kind:     kind,
+		Err:      err,
+	}
+	switch kind {
+	case TraceDispatched, TracePutStarted, TracePutDone:
+		e.Writer = r.writer
+	}
+	log.Info.Printf("store/storecache.trace: %s", e)
+	if f != nil {
+		f(e)
+	}
+}
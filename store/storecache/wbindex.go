@@ -0,0 +1,284 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+const (
+	// Name of the writeback index, alongside the cache directory.
+	indexName = "storewbindex"
+
+	// Name of the file, in the cache directory, holding the generation
+	// of the index when the cache was last closed cleanly. It is in
+	// the cache directory so that the walk of a version of the cache
+	// that does not maintain the index removes it, as it would any
+	// file it does not recognize, and so marks the index stale.
+	indexMarkerName = "storewbindex.clean"
+
+	// Number of records appended to the index before it is compacted.
+	maxIndexRecords = 10000
+
+	// Record types.
+	indexGenRecord    = "G"
+	indexAddRecord    = "+"
+	indexRemoveRecord = "-"
+)
+
+// writebackIndex records the writeback links in the cache, with the size
+// of each block, so that on startup the writeback queue can be loaded
+// from it rather than by walking the whole cache, which for a large
+// cache is slow. An entry is added before a link is made and removed
+// before the link is, so that while the cache runs the index may name
+// links that do not exist but never misses one that does; writeback
+// finds and forgets the former.
+//
+// Like the journal, the index is a file of records: the generation
+// first, then one per link added or removed. Each time the cache opens
+// the index, it moves to a new generation, and only when it is closed
+// cleanly does it record the generation in the marker file. The index is
+// trusted only if it is of the generation in the marker; otherwise, after
+// a crash, say, or a run of a version of the cache that did not maintain
+// it, the cache is walked for the links as before.
+//
+// A nil *writebackIndex records nothing.
+type writebackIndex struct {
+	sync.Mutex
+	name    string
+	marker  string
+	f       *os.File
+	gen     int64
+	links   map[upspin.Location]int64 // The size of the block of each link.
+	records int                       // Records appended since the last compaction.
+
+	// loaded reports whether the links were loaded from an index
+	// that could be trusted.
+	loaded bool
+}
+
+// openIndex reads the named index, trusting it if its generation is that
+// in the named marker file, and opens it, compacted and of the next
+// generation, for appending. The marker is removed until the index is
+// closed.
+func openIndex(name, marker string) (*writebackIndex, error) {
+	x := &writebackIndex{
+		name:   name,
+		marker: marker,
+		links:  make(map[upspin.Location]int64),
+	}
+	gen, err := readIndexMarker(marker)
+	if rerr := os.Remove(marker); rerr != nil && !os.IsNotExist(rerr) {
+		return nil, rerr
+	}
+	if err == nil {
+		err = x.read(gen)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Info.Printf("store/storecache.openIndex: %s: %s", name, err)
+		}
+		x.links = make(map[upspin.Location]int64)
+	} else {
+		x.loaded = true
+	}
+	x.gen = gen + 1
+	x.Lock()
+	defer x.Unlock()
+	if err := x.compact(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// readIndexMarker returns the generation recorded in the marker file.
+func readIndexMarker(marker string) (int64, error) {
+	data, err := ioutil.ReadFile(marker)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// read loads the links from the index, which must be of generation gen.
+// Unlike the journal, a bad record makes the whole index suspect.
+func (x *writebackIndex) read(gen int64) error {
+	f, err := os.Open(x.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || scanner.Text() != fmt.Sprintf("%s %d", indexGenRecord, gen) {
+		return errors.Errorf("index is not of generation %d", gen)
+	}
+	for scanner.Scan() {
+		kind, loc, size, err := parseIndexRecord(scanner.Text())
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case indexAddRecord:
+			x.links[loc] = size
+		case indexRemoveRecord:
+			delete(x.links, loc)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseIndexRecord parses a line of the index after the first.
+func parseIndexRecord(line string) (string, upspin.Location, int64, error) {
+	var loc upspin.Location
+	fields := strings.Split(line, " ")
+	switch {
+	case len(fields) == 4 && fields[0] == indexAddRecord:
+	case len(fields) == 3 && fields[0] == indexRemoveRecord:
+	default:
+		return "", loc, 0, errors.Errorf("bad index record %q", line)
+	}
+	e, err := upspin.ParseEndpoint(fields[1])
+	if err != nil {
+		return "", loc, 0, err
+	}
+	ref, err := parseRefFileName(fields[2])
+	if err != nil {
+		return "", loc, 0, err
+	}
+	var size int64
+	if fields[0] == indexAddRecord {
+		if size, err = strconv.ParseInt(fields[3], 10, 64); err != nil {
+			return "", loc, 0, err
+		}
+	}
+	loc.Endpoint = *e
+	loc.Reference = ref
+	return fields[0], loc, size, nil
+}
+
+// add records that a link is about to be made for the block of the
+// given size at loc.
+func (x *writebackIndex) add(loc upspin.Location, size int64) error {
+	if x == nil {
+		return nil
+	}
+	x.Lock()
+	defer x.Unlock()
+	x.links[loc] = size
+	return x.append(fmt.Sprintf("%s %s %s %d\n", indexAddRecord, loc.Endpoint, refFileName(loc.Reference), size))
+}
+
+// remove records that the link for loc is gone.
+func (x *writebackIndex) remove(loc upspin.Location) error {
+	if x == nil {
+		return nil
+	}
+	x.Lock()
+	defer x.Unlock()
+	if _, ok := x.links[loc]; !ok {
+		return nil
+	}
+	delete(x.links, loc)
+	return x.append(fmt.Sprintf("%s %s %s\n", indexRemoveRecord, loc.Endpoint, refFileName(loc.Reference)))
+}
+
+// has reports whether the index holds a link for loc.
+func (x *writebackIndex) has(loc upspin.Location) bool {
+	if x == nil {
+		return false
+	}
+	x.Lock()
+	defer x.Unlock()
+	_, ok := x.links[loc]
+	return ok
+}
+
+// list returns the links in the index, with their sizes.
+func (x *writebackIndex) list() map[upspin.Location]int64 {
+	x.Lock()
+	defer x.Unlock()
+	links := make(map[upspin.Location]int64, len(x.links))
+	for loc, size := range x.links {
+		links[loc] = size
+	}
+	return links
+}
+
+// append writes a record to the index, compacting it if it has grown
+// too long. Called with x locked.
+func (x *writebackIndex) append(record string) error {
+	if _, err := x.f.WriteString(record); err != nil {
+		return err
+	}
+	x.records++
+	if x.records < maxIndexRecords {
+		return nil
+	}
+	return x.compact()
+}
+
+// compact replaces the index with one holding only the links it
+// records, and opens it for appending. Called with x locked.
+func (x *writebackIndex) compact() error {
+	tmpName := x.name + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	fmt.Fprintf(w, "%s %d\n", indexGenRecord, x.gen)
+	for loc, size := range x.links {
+		fmt.Fprintf(w, "%s %s %s %d\n", indexAddRecord, loc.Endpoint, refFileName(loc.Reference), size)
+	}
+	err = w.Flush()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, x.name)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if x.f != nil {
+		x.f.Close()
+	}
+	x.f, err = os.OpenFile(x.name, os.O_WRONLY|os.O_APPEND, 0600)
+	x.records = 0
+	return err
+}
+
+// close compacts and closes the index and then records its generation in
+// the marker, so that it will be trusted when next opened.
+func (x *writebackIndex) close() error {
+	if x == nil {
+		return nil
+	}
+	x.Lock()
+	defer x.Unlock()
+	if err := x.compact(); err != nil {
+		return err
+	}
+	if err := x.f.Close(); err != nil {
+		return err
+	}
+	// The walk removes the cache directory if it is empty.
+	if err := os.MkdirAll(filepath.Dir(x.marker), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(x.marker, []byte(fmt.Sprintf("%d\n", x.gen)), 0600)
+}
@@ -0,0 +1,120 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"upspin.io/upspin"
+)
+
+// TestIndexRecovery checks that a cache restarted from its writeback
+// index recovers the same writebacks and cache files as one restarted by
+// walking the cache.
+func TestIndexRecovery(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "storecache")
+	// The endpoint must survive the round trip through a file name,
+	// so it can have no network address.
+	st := storeFor(upspin.Endpoint{Transport: upspin.InProcess})
+	st.reset()
+	opts := options{pack: 100}
+
+	// Write back some blocks, small and large, and leave others pending.
+	c, _, err := newCache(testConfig, dir, 1e8, false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.wbq.index.loaded {
+		t.Error("new cache loaded index")
+	}
+	for _, b := range []string{"written", strings.Repeat("written large ", 100)} {
+		ref, err := c.put(testConfig, []byte(b), st.e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.wbq.flush(upspin.Location{Reference: ref, Endpoint: st.e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st.Lock()
+	st.fail = true
+	st.Unlock()
+	want := make(map[upspin.Location]bool)
+	for _, b := range []string{"pending", strings.Repeat("pending large ", 100)} {
+		ref, err := c.put(testConfig, []byte(b), st.e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[upspin.Location{Reference: ref, Endpoint: st.e}] = true
+	}
+	c.close()
+
+	// recover restarts the cache, walking it if scan is set, and
+	// returns what it recovered.
+	type recovery struct {
+		pending map[upspin.Location]bool
+		files   map[string]int64
+	}
+	recover := func(scan bool) recovery {
+		if scan {
+			if err := os.Remove(filepath.Join(dir, indexMarkerName)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c, _, err := newCache(testConfig, dir, 1e8, false, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.close()
+		if c.wbq.index.loaded == scan {
+			t.Errorf("scan %t: loaded index %t", scan, c.wbq.index.loaded)
+		}
+		if c.filled != nil {
+			<-c.filled
+		}
+		r := recovery{
+			pending: make(map[upspin.Location]bool),
+			files:   make(map[string]int64),
+		}
+		for _, loc := range c.wbq.pending() {
+			r.pending[loc] = true
+		}
+		it := c.lru.NewIterator()
+		for {
+			key, value, ok := it.GetAndAdvance()
+			if !ok {
+				break
+			}
+			r.files[key.(string)] = value.(*cachedRef).size
+		}
+		return r
+	}
+
+	indexed := recover(false)
+	if !reflect.DeepEqual(indexed.pending, want) {
+		t.Errorf("index recovered writebacks %v, want %v", indexed.pending, want)
+	}
+	if len(indexed.files) != 4 {
+		t.Errorf("index recovered %d cache files, want 4: %v", len(indexed.files), indexed.files)
+	}
+	scanned := recover(true)
+	if !reflect.DeepEqual(scanned, indexed) {
+		t.Errorf("scan recovered %v, index %v", scanned, indexed)
+	}
+	// The scan rebuilt the index.
+	if again := recover(false); !reflect.DeepEqual(again, indexed) {
+		t.Errorf("rebuilt index recovered %v, want %v", again, indexed)
+	}
+}
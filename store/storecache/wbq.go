@@ -5,18 +5,23 @@
 package storecache
 
 import (
+	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"upspin.io/bind"
 	"upspin.io/errors"
+	"upspin.io/key/sha256key"
 	"upspin.io/log"
 	"upspin.io/upspin"
 )
 
 const (
-	// Number of writer goroutines to start.
+	// Number of writer goroutines to start. SetWriters changes it.
 	writers = 20
 
 	// Initial maximum number of parallel writebacks.
@@ -27,21 +32,82 @@ const (
 
 	// Retry interval for endpoints that we failed to Put to.
 	retryInterval = 5 * time.Minute
+
+	// Directory, alongside the cache directory, holding blocks
+	// that could not be written back.
+	quarantineDir = "storequarantine"
+
+	// Shortest interval between checks for writebacks past their deadline.
+	minDeadlineCheck = time.Second
+
+	// While an endpoint is prioritized, the others keep this fraction,
+	// 1/priorityReserve, of the max parallel writebacks, and at least one.
+	priorityReserve = 4
 )
 
+// emptyRef is the reference of the empty block, which empty files share.
+var emptyRef = upspin.Reference(sha256key.Of(nil).String())
+
 // request represents a request to writeback a block. Each corresponds
 // to a Put to the storecache.
 type request struct {
 	upspin.Location
-	err        error       // the result of the Put() to the StoreServer.
-	flushChans []chan bool // each flusher waits for its chan to close.
+	err     error           // the result of the Put() to the StoreServer.
+	flushes []*flushRequest // each flusher waits for its chan to close.
+	size    int64           // the length of the block.
+
+	// user is the user whose Put queued the block. The requests of each
+	// user wait in a queue of their own; see endpointQueue.
+	user upspin.UserName
+
+	deadline time.Time // when the block should be durable; zero if none.
+	breached bool      // whether the deadline has been reported as passed.
+	queuedAt time.Time // when the request was queued, if aging is on.
+	fast     bool      // sent ahead of the others, outside the parallelism; see pickEmpty.
+
+	// batch holds the requests sent to the store in the same call as
+	// this one, with the batch option; see send.
+	batch []*request
+
+	// writer identifies the writer handling the request, or is -1
+	// if it is sent outside the writers. It is used for tracing.
+	writer int
+}
+
+// batchPutter is implemented by StoreServers that can store several
+// blocks in one call. PutBatch stores each block of data, returning the
+// Refdata of each in order, or an error if any could not be stored.
+type batchPutter interface {
+	PutBatch(data [][]byte) ([]*upspin.Refdata, error)
 }
 
 // flushRequest represents a requester waiting for the writeback to happen.
-// flushed will be closed when it happens.
+// flushed will be closed when it happens. If the writeback failed
+// permanently, err is set before flushed is closed.
 type flushRequest struct {
 	upspin.Location
 	flushed chan bool
+	err     error
+}
+
+// endpointFlush represents a requester waiting for every writeback to an
+// endpoint to be done. flushed will be closed when none is queued or in
+// flight. If any block for the endpoint was abandoned, err is set first.
+type endpointFlush struct {
+	upspin.Endpoint
+	flushed chan bool
+	err     error
+}
+
+// mismatchError reports that a store returned a reference other than the
+// one a block was cached under. Retrying the writeback cannot help.
+type mismatchError struct {
+	upspin.Location
+	got upspin.Reference
+}
+
+func (e *mismatchError) Error() string {
+	return fmt.Sprintf("writeback to %s: store returned reference %q, expected %q", e.Endpoint, e.got, e.Reference)
 }
 
 // the values for endpointQueue.state
@@ -52,15 +118,90 @@ const (
 )
 
 // endpointQueue represents a queue of pending requests destined
-// for an endpoint.
+// for an endpoint. The requests are kept in a queue for each user who
+// queued them, and the users take turns, so that one with a backlog
+// cannot delay the writebacks of the others.
 type endpointQueue struct {
+	users    map[upspin.UserName]*userQueue // the users with requests waiting.
+	order    []upspin.UserName              // the users, in turn.
+	next     int                            // index in order of the next user's turn.
+	state    int
+	inFlight int  // requests sent to writers but not yet done.
+	retrying bool // a retry is scheduled.
+
+	// empty is the request to write back the empty block, if it is
+	// waiting for a writer; see enqueue. emptyInFlight reports whether
+	// it has been sent to one but is not yet done.
+	empty         *request
+	emptyInFlight bool
+
+	flushes []*endpointFlush // each waits for the queue to drain.
+}
+
+// userQueue holds the requests of one user waiting for writeback to an
+// endpoint.
+type userQueue struct {
 	queue []*request // references waiting for writeback.
-	state int
+	small []*request // the fast lane: small blocks waiting for writeback.
+}
+
+// waiting reports whether the endpoint has writebacks queued.
+func (q *endpointQueue) waiting() bool {
+	return len(q.users) > 0
+}
+
+// drained reports whether the endpoint has no writebacks queued or in flight.
+func (q *endpointQueue) drained() bool {
+	return !q.waiting() && q.inFlight == 0 && q.empty == nil && !q.emptyInFlight
+}
+
+// userQueue returns the queue of the user's requests, creating it if need
+// be, the user then taking the last turn.
+func (q *endpointQueue) userQueue(user upspin.UserName) *userQueue {
+	uq := q.users[user]
+	if uq == nil {
+		if q.users == nil {
+			q.users = make(map[upspin.UserName]*userQueue)
+		}
+		uq = &userQueue{}
+		q.users[user] = uq
+		q.order = append(q.order, user)
+	}
+	return uq
+}
+
+// took passes the turn on from the user, a request of whose has just been
+// sent, forgetting the user if none are left waiting.
+func (q *endpointQueue) took(user upspin.UserName) {
+	for i, u := range q.order {
+		if u != user {
+			continue
+		}
+		if uq := q.users[u]; len(uq.queue) > 0 || len(uq.small) > 0 {
+			q.next = i + 1
+			return
+		}
+		delete(q.users, u)
+		q.order = append(q.order[:i], q.order[i+1:]...)
+		q.next = i
+		return
+	}
 }
 
 type writebackQueue struct {
 	sc *storeCache
 
+	// journal records the progress of writebacks.
+	journal *journal
+
+	// index records the writeback links, so that they may be found on
+	// startup without walking the cache.
+	index *writebackIndex
+
+	// recovered is the state of writebacks recorded in the journal
+	// when the cache started. It is used only while walking the cache.
+	recovered map[upspin.Location]journalState
+
 	// byEndpoint contains references to be written back. This
 	// is used/modified exclusively by the scheduler goroutine.
 	byEndpoint map[upspin.Endpoint]*endpointQueue
@@ -69,12 +210,73 @@ type writebackQueue struct {
 	// exclusively by the scheduler goroutine.
 	queued map[upspin.Location]*request
 
+	// Requests that failed permanently, and the reason. Used/modified
+	// exclusively by the scheduler goroutine.
+	abandoned map[upspin.Location]error
+
 	// request carries writeback requests to the scheduler.
 	request chan *request
 
 	// flushRequest carries flush requests to the scheduler.
 	flushRequest chan *flushRequest
 
+	// endpointWait carries requests to flush an endpoint to the scheduler.
+	endpointWait chan *endpointFlush
+
+	// prioritize carries endpoints to drain ahead of the others to the
+	// scheduler.
+	prioritize chan upspin.Endpoint
+
+	// priority is the endpoint being drained ahead of the others, if
+	// any; see pickPriority. Used/modified exclusively by the scheduler
+	// goroutine.
+	priority    upspin.Endpoint
+	hasPriority bool
+
+	// snapshot carries requests for the list of queued locations.
+	snapshot chan chan []upspin.Location
+
+	// pendingCheck carries requests to know whether a location
+	// is queued.
+	pendingCheck chan *pendingCheck
+
+	// deadlines carries requests for the deadline statistics.
+	deadlines chan chan DeadlineStats
+
+	// breaches counts the requests that have passed their deadline.
+	// Used/modified exclusively by the scheduler goroutine.
+	breaches int
+
+	// now returns the current time. Tests replace it.
+	now func() time.Time
+
+	// retryAfter is how long to wait before retrying an endpoint
+	// that failed. Tests shorten it.
+	retryAfter time.Duration
+
+	// onBreach, if set, is called with the location of each block
+	// whose writeback passes its deadline.
+	breachMu sync.Mutex
+	onBreach func(upspin.Location)
+
+	// onParallel, if set, is called with each change of the maximum
+	// parallelism.
+	parallelMu sync.Mutex
+	onParallel func(ParallelismChange)
+
+	// tracer follows the writebacks of the locations chosen by Trace.
+	tracer tracer
+
+	// hasEmpty records the endpoints known to hold the empty block.
+	// Writebacks of the empty block to them are skipped.
+	emptyMu  sync.Mutex
+	hasEmpty map[upspin.Endpoint]bool
+
+	// stuck counts, by endpoint, the Puts given up on by timeLimit that
+	// have yet to return.
+	stuckMu sync.Mutex
+	stuck   map[upspin.Endpoint]int
+
 	// ready carries requests ready for writers.
 	ready chan *request
 
@@ -84,40 +286,203 @@ type writebackQueue struct {
 	// retry carries queues to retry.
 	retry chan *endpointQueue
 
+	// deadList carries the health checker's requests for the dead
+	// endpoints to check. See health.go.
+	deadList chan chan []deadEndpoint
+
+	// newLimit carries the number of writers to the scheduler
+	// so it can limit parallelism to match.
+	newLimit chan int
+
+	// seeds carries the results of latency probes to the scheduler.
+	seeds chan *latencyProbe
+
+	// With the startupCheck option, holding is set and the writebacks
+	// found on startup are held until the health of their stores is
+	// known; see startRecovered. Used only while starting up.
+	holding bool
+	held    []*request
+
+	// startStates carries the states of the stores checked on startup
+	// to the scheduler.
+	startStates chan map[upspin.Endpoint]int
+
+	// probing and seeded record whether a latency probe is under way
+	// and whether one has seeded parallelism. Used/modified exclusively
+	// by the scheduler goroutine.
+	probing bool
+	seeded  bool
+
+	// maxParallel carries requests for the maximum number of parallel
+	// writebacks.
+	maxParallel chan chan int
+
+	// userInFlight counts the writebacks in flight for each user, with
+	// the userParallel option. Used/modified exclusively by the
+	// scheduler goroutine.
+	userInFlight map[upspin.UserName]int
+
+	// budget limits the block data writers hold in memory, with the
+	// writebackMemory option; nil without it.
+	budget *byteBudget
+
 	// Closing die signals all go routines to exit.
 	die chan bool
 
+	// Sending to stop signals one writer to exit.
+	stop chan bool
+
 	// Writers and scheduler send to terminated on exit.
 	terminated chan bool
+
+	// writersMu serializes changes to the number of writers
+	// with each other and with close.
+	writersMu sync.Mutex
+	nWriters  int  // Number of writers; fewer run if idle ones exit.
+	closed    bool // Set by close.
+
+	// runMu guards the count of running writers, which changes
+	// without writersMu as idle writers exit and the scheduler
+	// starts more to meet demand.
+	runMu    sync.Mutex
+	running  int  // Number of running writers.
+	maxRun   int  // Most writers to run: nWriters.
+	nextID   int  // Identifies the next writer started.
+	stopping bool // Set by close; idle writers then stay for die.
 }
 
-func newWritebackQueue(sc *storeCache) *writebackQueue {
+func newWritebackQueue(sc *storeCache, j *journal, x *writebackIndex, recovered map[upspin.Location]journalState) *writebackQueue {
 	const op = "store/storecache.newWritebackQueue"
 
 	wbq := &writebackQueue{
 		sc:           sc,
+		journal:      j,
+		index:        x,
+		recovered:    recovered,
 		byEndpoint:   make(map[upspin.Endpoint]*endpointQueue),
 		queued:       make(map[upspin.Location]*request),
+		abandoned:    make(map[upspin.Location]error),
 		request:      make(chan *request, writers),
 		flushRequest: make(chan *flushRequest, writers),
+		endpointWait: make(chan *endpointFlush),
+		prioritize:   make(chan upspin.Endpoint),
+		snapshot:     make(chan chan []upspin.Location),
+		pendingCheck: make(chan *pendingCheck),
+		deadlines:    make(chan chan DeadlineStats),
+		hasEmpty:     make(map[upspin.Endpoint]bool),
+		stuck:        make(map[upspin.Endpoint]int),
+		now:          time.Now,
+		retryAfter:   retryInterval,
 		ready:        make(chan *request, writers),
 		done:         make(chan *request, writers),
 		retry:        make(chan *endpointQueue, writers),
+		deadList:     make(chan chan []deadEndpoint),
+		newLimit:     make(chan int),
+		seeds:        make(chan *latencyProbe),
+		holding:      sc.opts.startupCheck > 0,
+		startStates:  make(chan map[upspin.Endpoint]int),
+		maxParallel:  make(chan chan int),
+		userInFlight: make(map[upspin.UserName]int),
 		die:          make(chan bool),
+		stop:         make(chan bool),
 		terminated:   make(chan bool),
 	}
 
+	if sc.opts.writebackMemory > 0 {
+		wbq.budget = newByteBudget(sc.opts.writebackMemory)
+	}
+
 	// Start scheduler.
 	go wbq.scheduler()
+	if sc.opts.healthCheck > 0 {
+		go wbq.healthChecker()
+	}
 
 	// Start writers.
-	for i := 0; i < writers; i++ {
-		go wbq.writer(i)
+	wbq.nWriters = writers
+	wbq.runMu.Lock()
+	wbq.maxRun = writers
+	for wbq.running < writers {
+		wbq.startWriter()
 	}
+	wbq.runMu.Unlock()
 
 	return wbq
 }
 
+// startWriter starts a writer goroutine. Called with runMu locked.
+func (wbq *writebackQueue) startWriter() {
+	go wbq.writer(wbq.nextID)
+	wbq.nextID++
+	wbq.running++
+}
+
+// runningMore reports whether more than n writers are running.
+func (wbq *writebackQueue) runningMore(n int) bool {
+	wbq.runMu.Lock()
+	defer wbq.runMu.Unlock()
+	return wbq.running > n
+}
+
+// growWriters starts a writer for each request waiting in the ready
+// channel, up to nWriters in all. Idle writers may have exited to leave
+// fewer running. It is called only by the scheduler.
+func (wbq *writebackQueue) growWriters() {
+	wbq.runMu.Lock()
+	defer wbq.runMu.Unlock()
+	for n := len(wbq.ready); n > 0 && !wbq.stopping && wbq.running < wbq.maxRun; n-- {
+		wbq.startWriter()
+	}
+}
+
+// idleExit reports whether a writer that has had nothing to do for the
+// writerIdle option should exit and, if so, counts it as gone. Writers
+// do not exit that way below the minWriters option or once closing.
+func (wbq *writebackQueue) idleExit() bool {
+	wbq.runMu.Lock()
+	defer wbq.runMu.Unlock()
+	min := wbq.sc.opts.minWriters
+	if min < 1 {
+		min = 1
+	}
+	if wbq.stopping || wbq.running <= min {
+		return false
+	}
+	wbq.running--
+	return true
+}
+
+// setWriters changes the number of writer goroutines to n, which must be
+// positive, and limits the number of parallel writebacks to match. Writers
+// being removed finish any writeback they have started before exiting.
+func (wbq *writebackQueue) setWriters(n int) error {
+	if n < 1 {
+		return errors.E(errors.Invalid, errors.Errorf("%d writers", n))
+	}
+	wbq.writersMu.Lock()
+	defer wbq.writersMu.Unlock()
+	if wbq.closed {
+		return errors.E(errors.Invalid, errors.Str("writeback queue closed"))
+	}
+	// Lower the limit before removing writers so that
+	// the scheduler stops handing out work for them.
+	wbq.newLimit <- n
+	wbq.nWriters = n
+	wbq.runMu.Lock()
+	wbq.maxRun = n
+	for wbq.running < n {
+		wbq.startWriter()
+	}
+	wbq.runMu.Unlock()
+	// A writer counts itself gone when it stops. Idle writers never
+	// leave fewer than minWriters, at least one, to take the stop.
+	for wbq.runningMore(n) {
+		wbq.stop <- true
+		<-wbq.terminated
+	}
+	return nil
+}
+
 // enqueueWritebackFile populates the writeback queue on startup.
 // It returns true if this was indeed a write back file.
 func (wbq *writebackQueue) enqueueWritebackFile(path string) bool {
@@ -133,167 +498,857 @@ func (wbq *writebackQueue) enqueueWritebackFile(path string) bool {
 		log.Error.Printf("%s: writeback file %s but running as writethrough", op, path)
 		return true
 	}
-	f = strings.TrimPrefix(f, wbq.sc.dir+"/")
+	loc, err := wbq.sc.parseCachePath(f)
+	if err != nil {
+		// Perhaps it was named by a version that used the reference
+		// itself as the file name. If so, rename it.
+		if loc, err = wbq.renameLegacyWritebackFile(path); err != nil {
+			log.Error.Printf("%s: odd writeback file %s: %s", op, path, err)
+			return true
+		}
+	}
+	// The size only chooses the lane; if unknown, use the normal one.
+	var size int64 = math.MaxInt64
+	if n, err := wbq.sc.fileSize(path); err == nil {
+		size = n
+	}
+	if wbq.recovered[loc] != completed {
+		if err := wbq.index.add(loc, size); err != nil {
+			log.Error.Printf("%s: index: %s", op, err)
+		}
+	}
+	wbq.enqueueRecovered(loc, size)
+	return true
+}
+
+// enqueueIndexed populates the writeback queue on startup from the
+// links recorded in the index, rather than by walking the cache. The
+// links are not checked; writeback forgets any that have gone.
+func (wbq *writebackQueue) enqueueIndexed() {
+	for loc, size := range wbq.index.list() {
+		wbq.enqueueRecovered(loc, size)
+	}
+}
+
+// enqueueRecovered queues the writeback of the link for loc, found on
+// startup, unless the journal shows it was written back, in which case
+// it removes the link. The size is that of the block.
+func (wbq *writebackQueue) enqueueRecovered(loc upspin.Location, size int64) {
+	const op = "store/storecache.enqueueRecovered"
+	wbf := wbq.sc.cachePath(loc.Reference, loc.Endpoint) + writebackSuffix
+	switch wbq.recovered[loc] {
+	case completed:
+		// The store has it; we stopped before removing the link.
+		log.Info.Printf("%s: %s already written back", op, wbf)
+		if err := wbq.index.remove(loc); err != nil {
+			log.Error.Printf("%s: index: %s", op, err)
+		}
+		if err := wbq.sc.unlinkFile(wbf); err != nil {
+			log.Error.Printf("%s: %s", op, err)
+		}
+		return
+	case uncertain:
+		log.Info.Printf("%s: retrying interrupted writeback %s", op, wbf)
+	}
+	// The user who queued it is not recorded, so it takes a turn
+	// of its own, with any others recovered, under no user.
+	r := &request{
+		Location: loc,
+		err:      nil,
+		flushes:  nil,
+		size:     size,
+	}
+	if wbq.holding {
+		wbq.held = append(wbq.held, r)
+		return
+	}
+	wbq.request <- r
+}
+
+// renameLegacyWritebackFile renames a writeback link whose name is the
+// unencoded reference to the name cachePath would now give it.
+func (wbq *writebackQueue) renameLegacyWritebackFile(path string) (upspin.Location, error) {
+	var loc upspin.Location
+	f := strings.TrimPrefix(strings.TrimSuffix(path, writebackSuffix), wbq.sc.dir+"/")
 	elems := strings.Split(f, "/")
 	if len(elems) != 3 {
-		log.Error.Printf("%s: odd writeback file %s", op, path)
-		return true
+		return loc, errors.Str("not a cache file name")
 	}
 	e, err := upspin.ParseEndpoint(elems[0])
 	if err != nil {
-		log.Error.Printf("%s: odd writeback file %s: %s", op, path, err)
-		return true
+		return loc, err
 	}
-	wbq.request <- &request{
-		Location:   upspin.Location{Reference: upspin.Reference(elems[2]), Endpoint: *e},
-		err:        nil,
-		flushChans: nil,
+	loc = upspin.Location{Reference: upspin.Reference(elems[2]), Endpoint: *e}
+	wbf := wbq.sc.cachePath(loc.Reference, loc.Endpoint) + writebackSuffix
+	if err := os.MkdirAll(filepath.Dir(wbf), 0700); err != nil {
+		return loc, err
 	}
-	return true
+	return loc, os.Rename(path, wbf)
 }
 
 func (wbq *writebackQueue) close() {
+	wbq.writersMu.Lock()
+	defer wbq.writersMu.Unlock()
+	wbq.closed = true
+	wbq.runMu.Lock()
+	wbq.stopping = true
+	running := wbq.running
+	wbq.runMu.Unlock()
 	close(wbq.die)
-	for i := 0; i < writers+1; i++ {
+	for i := 0; i < running+1; i++ {
 		<-wbq.terminated
 	}
+	if err := wbq.journal.close(); err != nil {
+		log.Error.Printf("store/storecache.close: %s", err)
+	}
+	if err := wbq.index.close(); err != nil {
+		log.Error.Printf("store/storecache.close: index: %s", err)
+	}
 }
 
 // scheduler puts requests into the ready queue for the writers to work on.
 func (wbq *writebackQueue) scheduler() {
 	const op = "store/storecache.scheduler"
 	p := newParallelism(initialMaxParallel)
+	if wbq.sc.opts.smallBlock > 0 {
+		p.reserved = wbq.sc.opts.fastLaneSlots
+	}
+	var check <-chan time.Time
+	if d := wbq.sc.opts.deadline; d > 0 {
+		interval := d / 4
+		if interval < minDeadlineCheck {
+			interval = minDeadlineCheck
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		check = ticker.C
+	}
 	for {
 		select {
 		case r := <-wbq.request:
-			log.Debug.Printf("%s: received %s %s", op, r.Reference, r.Endpoint)
-			// Keep a map of requests so that we can handle flushes
-			// and avoid Duplicates.
-			if wbq.queued[r.Location] != nil {
-				// Already queued. Unusual but OK.
+			wbq.enqueue(r)
+		case r := <-wbq.done:
+			if len(r.batch) > 0 {
+				wbq.batchDone(p, r)
 				break
 			}
-			wbq.queued[r.Location] = r
-
-			// A new request
-			epq := wbq.byEndpoint[r.Endpoint]
-			if epq == nil {
-				// New endpoints start in unknown state.
-				epq = &endpointQueue{state: unknown}
-				wbq.byEndpoint[r.Endpoint] = epq
-			}
-			epq.queue = append(epq.queue, r)
-		case r := <-wbq.done:
 			// A request has been completed.
 			epq := wbq.byEndpoint[r.Endpoint]
+			if r.fast {
+				// It did not count against parallelism.
+				r.fast = false
+				epq.emptyInFlight = false
+				switch r.err.(type) {
+				case nil:
+					wbq.finish(r)
+				case *mismatchError:
+					wbq.finish(r)
+					wbq.abandoned[r.Location] = r.err
+					log.Error.Printf("%s: %s %s abandoned: %s", op, r.Reference, r.Endpoint, r.err)
+				default:
+					// Retry as for any other block.
+					wbq.requeue(epq, r)
+				}
+				break
+			}
+			epq.inFlight--
+			wbq.userDone(r)
+			if _, ok := r.err.(*mismatchError); ok {
+				// The store is working but will never accept
+				// this block. Give up on it.
+				epq.state = live
+				wbq.parallelSuccess(p, r.Endpoint)
+				wbq.finish(r)
+				wbq.abandoned[r.Location] = r.err
+				log.Error.Printf("%s: %s %s abandoned: %s", op, r.Reference, r.Endpoint, r.err)
+				break
+			}
 			if r.err != nil {
-				epq.queue = append(epq.queue, r)
-				if p.failure(r.err) {
-					// The error has been dealt with
+				wbq.requeue(epq, r)
+				if wbq.parallelFailure(p, r.Endpoint, r.err) && epq.state != dead {
+					// The error has been dealt with. An endpoint
+					// whose state was unknown, such as one whose
+					// first Put timed out, still needs a retry.
 					break
 				}
 
-				// Mark endpoint as dead so we don't waste time trying. Retry
-				// after retryInterval.
-				if epq.state != dead {
-					epq.state = dead
-					time.AfterFunc(retryInterval, func() { wbq.retry <- epq })
-				}
+				wbq.markDead(epq)
 				break
 			}
 
 			// Mark endpoint as live so we can queue more requests for it.
 			epq.state = live
-			p.success()
-
-			// Awaken everyone waiting for a flush.
-			for _, c := range r.flushChans {
-				log.Debug.Printf("flushing...")
-				close(c)
-			}
-			delete(wbq.queued, r.Location)
+			wbq.parallelSuccess(p, r.Endpoint)
+			wbq.finish(r)
 			log.Debug.Printf("%s: %s %s done", op, r.Reference, r.Endpoint)
+		case n := <-wbq.newLimit:
+			p.setLimit(n)
+		case lp := <-wbq.seeds:
+			wbq.probing = false
+			if lp.err != nil {
+				log.Info.Printf("%s: latency probe of %s: %s", op, lp.e, lp.err)
+				break
+			}
+			wbq.seeded = true
+			p.seed(seedParallel(lp.rtt, wbq.sc.opts.latencySeed))
+			log.Debug.Printf("%s: %s round trip %v, max parallel %d", op, lp.e, lp.rtt, p.max)
+		case c := <-wbq.maxParallel:
+			c <- p.max
+		case c := <-wbq.deadList:
+			c <- wbq.deadEndpoints()
+		case states := <-wbq.startStates:
+			for e, state := range states {
+				epq := wbq.queueFor(e, state)
+				if state == dead {
+					wbq.markDead(epq)
+				}
+			}
 		case epq := <-wbq.retry:
+			epq.retrying = false
 			// Set its state to unknown so we'll try a single request to feel it out.
 			if epq.state == dead {
 				epq.state = unknown
 			}
 		case fr := <-wbq.flushRequest:
+			// The request may still be in the channel.
+			wbq.drainRequests()
 			r := wbq.queued[fr.Location]
 			if r == nil {
 				// Not in flight
+				fr.err = wbq.abandoned[fr.Location]
 				close(fr.flushed)
 				break
 			}
 			// Could be multiple outstanding flush requests.
-			r.flushChans = append(r.flushChans, fr.flushed)
+			r.flushes = append(r.flushes, fr)
+		case ef := <-wbq.endpointWait:
+			// Requests for the endpoint may still be in the channel.
+			wbq.drainRequests()
+			epq := wbq.byEndpoint[ef.Endpoint]
+			if epq == nil || epq.drained() {
+				ef.err = wbq.abandonedFor(ef.Endpoint)
+				close(ef.flushed)
+				break
+			}
+			epq.flushes = append(epq.flushes, ef)
+		case e := <-wbq.prioritize:
+			// Requests for the endpoint may still be in the channel.
+			wbq.drainRequests()
+			wbq.setPriority(e)
+		case c := <-wbq.snapshot:
+			wbq.drainRequests()
+			locs := make([]upspin.Location, 0, len(wbq.queued))
+			for loc := range wbq.queued {
+				locs = append(locs, loc)
+			}
+			c <- locs
+		case pc := <-wbq.pendingCheck:
+			wbq.drainRequests()
+			pc.reply <- wbq.queued[pc.Location] != nil
+		case <-check:
+			wbq.checkDeadlines()
+		case c := <-wbq.deadlines:
+			wbq.drainRequests()
+			c <- wbq.checkDeadlines()
 		case <-wbq.die:
 			wbq.terminated <- true
 			return
 		}
 
+		// Wake those waiting for endpoints that have drained.
+		for e, epq := range wbq.byEndpoint {
+			if len(epq.flushes) > 0 && epq.drained() {
+				wbq.finishEndpoint(e, epq)
+			}
+		}
+
 		// Fill the ready queue.
 		for {
 			if !wbq.pickAndQueue(p) {
 				break
 			}
 		}
+		if len(wbq.ready) > 0 {
+			wbq.growWriters()
+		}
+	}
+}
+
+// batchDone handles the completion of r and the requests of its batch,
+// which were sent to the store in one call. Each is finished, abandoned,
+// or queued again as it would be alone, but since the batch counted as a
+// single writeback against the parallelism, it succeeds or fails as one.
+// It is called only by the scheduler.
+func (wbq *writebackQueue) batchDone(p *parallelism, r *request) {
+	const op = "store/storecache.scheduler"
+	reqs := append([]*request{r}, r.batch...)
+	r.batch = nil
+	epq := wbq.byEndpoint[r.Endpoint]
+	epq.inFlight -= len(reqs)
+	wbq.userDone(r)
+	var err error
+	for _, r := range reqs {
+		switch r.err.(type) {
+		case nil:
+			wbq.finish(r)
+			log.Debug.Printf("%s: %s %s done", op, r.Reference, r.Endpoint)
+		case *mismatchError:
+			wbq.finish(r)
+			wbq.abandoned[r.Location] = r.err
+			log.Error.Printf("%s: %s %s abandoned: %s", op, r.Reference, r.Endpoint, r.err)
+		default:
+			wbq.requeue(epq, r)
+			err = r.err
+		}
+	}
+	if err == nil {
+		epq.state = live
+		wbq.parallelSuccess(p, r.Endpoint)
+		return
+	}
+	if wbq.parallelFailure(p, r.Endpoint, err) && epq.state != dead {
+		return
+	}
+	wbq.markDead(epq)
+}
+
+// parallelSuccess records the success of a writeback to e in p.
+// It is called only by the scheduler.
+func (wbq *writebackQueue) parallelSuccess(p *parallelism, e upspin.Endpoint) {
+	old := p.max
+	p.success()
+	wbq.parallelChanged(e, old, p.max)
+}
+
+// parallelFailure records the failure of a writeback to e in p, returning
+// what p.failure does. It is called only by the scheduler.
+func (wbq *writebackQueue) parallelFailure(p *parallelism, e upspin.Endpoint, err error) bool {
+	old := p.max
+	handled := p.failure(err)
+	wbq.parallelChanged(e, old, p.max)
+	return handled
+}
+
+// parallelChanged reports a change in the maximum parallelism, if there
+// was one, to the onParallel function. It is called only by the scheduler.
+func (wbq *writebackQueue) parallelChanged(e upspin.Endpoint, old, new int) {
+	if old == new {
+		return
+	}
+	wbq.parallelMu.Lock()
+	onParallel := wbq.onParallel
+	wbq.parallelMu.Unlock()
+	if onParallel != nil {
+		// Don't let the callback block the scheduler.
+		go onParallel(ParallelismChange{Endpoint: e, Old: old, New: new, Up: new > old})
+	}
+}
+
+// markDead marks the endpoint as dead so we don't waste time trying.
+// It is retried after retryAfter. The endpoint may already be marked
+// dead because its state was unknown when the request was sent.
+// It is called only by the scheduler.
+func (wbq *writebackQueue) markDead(epq *endpointQueue) {
+	epq.state = dead
+	if !epq.retrying {
+		epq.retrying = true
+		time.AfterFunc(wbq.retryAfter, func() { wbq.retry <- epq })
 	}
 }
 
+// enqueue adds a new request to the queue for its endpoint.
+// It is called only by the scheduler.
+func (wbq *writebackQueue) enqueue(r *request) {
+	log.Debug.Printf("store/storecache.scheduler: received %s %s", r.Reference, r.Endpoint)
+	delete(wbq.abandoned, r.Location)
+	// Keep a map of requests so that we can handle flushes
+	// and avoid Duplicates.
+	if wbq.queued[r.Location] != nil {
+		// Already queued. Unusual but OK.
+		return
+	}
+	wbq.queued[r.Location] = r
+	wbq.tracer.event(r, TraceEnqueued, nil)
+	if d := wbq.sc.opts.deadline; d > 0 {
+		r.deadline = wbq.now().Add(d)
+	}
+	if wbq.sc.opts.aging > 0 {
+		r.queuedAt = wbq.now()
+	}
+
+	// A new request. New endpoints start in unknown state.
+	epq := wbq.queueFor(r.Endpoint, unknown)
+	if r.size == 0 && epq.state != dead {
+		// An empty block costs the store next to nothing, so write
+		// it back ahead of the others rather than wait for a slot.
+		// All empty blocks have the same reference, so there is at
+		// most one such request for each endpoint.
+		r.fast = true
+		epq.empty = r
+		return
+	}
+	wbq.add(epq, r)
+}
+
+// queueFor returns the queue for the endpoint, creating it in the
+// given state if need be. It is called only by the scheduler.
+func (wbq *writebackQueue) queueFor(e upspin.Endpoint, state int) *endpointQueue {
+	epq := wbq.byEndpoint[e]
+	if epq != nil {
+		return epq
+	}
+	epq = &endpointQueue{state: state}
+	wbq.byEndpoint[e] = epq
+	if state != dead && wbq.sc.opts.latencySeed > 0 && !wbq.probing && !wbq.seeded {
+		wbq.probing = true
+		go wbq.probe(e)
+	}
+	return epq
+}
+
+// add appends a request to the fast lane of its user's queue for its
+// endpoint if the block is smaller than the smallBlock option, otherwise
+// to the normal queue. It is called only by the scheduler.
+func (wbq *writebackQueue) add(epq *endpointQueue, r *request) {
+	uq := epq.userQueue(r.user)
+	if r.size < wbq.sc.opts.smallBlock {
+		uq.small = append(uq.small, r)
+		return
+	}
+	uq.queue = append(uq.queue, r)
+}
+
+// userDone counts the writeback of r, sent by a writer, as no longer in
+// flight for its user. A batch counts as one, as it does against the
+// parallelism. It is called only by the scheduler.
+func (wbq *writebackQueue) userDone(r *request) {
+	if wbq.sc.opts.userParallel == 0 {
+		return
+	}
+	if n := wbq.userInFlight[r.user] - 1; n > 0 {
+		wbq.userInFlight[r.user] = n
+	} else {
+		delete(wbq.userInFlight, r.user)
+	}
+}
+
+// userCapped reports whether the user has as many writebacks in flight as
+// the userParallel option allows.
+func (wbq *writebackQueue) userCapped(user upspin.UserName) bool {
+	max := wbq.sc.opts.userParallel
+	return max > 0 && wbq.userInFlight[user] >= max
+}
+
+// requeue adds a request whose writeback failed back to its endpoint
+// queue, to be retried. It is called only by the scheduler.
+func (wbq *writebackQueue) requeue(epq *endpointQueue, r *request) {
+	wbq.tracer.event(r, TraceRequeued, r.err)
+	wbq.add(epq, r)
+}
+
+// checkDeadlines reports, by logging and calling the onBreach function,
+// each queued request newly past its deadline, and returns the
+// deadline statistics. It is called only by the scheduler.
+func (wbq *writebackQueue) checkDeadlines() DeadlineStats {
+	const op = "store/storecache.checkDeadlines"
+	var stats DeadlineStats
+	if wbq.sc.opts.deadline == 0 {
+		return stats
+	}
+	wbq.breachMu.Lock()
+	onBreach := wbq.onBreach
+	wbq.breachMu.Unlock()
+	now := wbq.now()
+	for _, r := range wbq.queued {
+		if !now.After(r.deadline) {
+			continue
+		}
+		stats.Overdue++
+		if r.breached {
+			continue
+		}
+		r.breached = true
+		wbq.breaches++
+		log.Error.Printf("%s: writeback of %s to %s not done by its deadline", op, r.Reference, r.Endpoint)
+		if onBreach != nil {
+			// Don't let the callback block the scheduler.
+			go onBreach(r.Location)
+		}
+	}
+	stats.Breaches = wbq.breaches
+	return stats
+}
+
+// drainRequests enqueues the requests waiting in the request channel,
+// so that the queue reflects every writeback requested so far.
+// It is called only by the scheduler.
+func (wbq *writebackQueue) drainRequests() {
+	for {
+		select {
+		case r := <-wbq.request:
+			wbq.enqueue(r)
+		default:
+			return
+		}
+	}
+}
+
+// finish forgets a request that will not be retried and awakens everyone
+// waiting for it to be flushed, passing on its error, if any.
+// It is called only by the scheduler.
+func (wbq *writebackQueue) finish(r *request) {
+	if _, ok := r.err.(*mismatchError); ok {
+		wbq.tracer.event(r, TraceAbandoned, r.err)
+	} else {
+		wbq.tracer.event(r, TraceFinished, r.err)
+	}
+	for _, fr := range r.flushes {
+		log.Debug.Printf("flushing...")
+		fr.err = r.err
+		close(fr.flushed)
+	}
+	delete(wbq.queued, r.Location)
+}
+
+// finishEndpoint awakens everyone waiting for the drained endpoint queue
+// to be flushed. It is called only by the scheduler.
+func (wbq *writebackQueue) finishEndpoint(e upspin.Endpoint, epq *endpointQueue) {
+	err := wbq.abandonedFor(e)
+	for _, ef := range epq.flushes {
+		ef.err = err
+		close(ef.flushed)
+	}
+	epq.flushes = nil
+}
+
+// abandonedFor returns the error of a block for the endpoint that
+// failed permanently, or nil if there is none.
+// It is called only by the scheduler.
+func (wbq *writebackQueue) abandonedFor(e upspin.Endpoint) error {
+	for loc, err := range wbq.abandoned {
+		if loc.Endpoint == e {
+			return err
+		}
+	}
+	return nil
+}
+
 // pickAndQueue makes one round robin pass through the endpoint queues sending
-// the first request in each queue to the ready channel.
+// the first request in each queue to the ready channel. Under the leastLoaded
+// policy it instead sends one request from the queue whose endpoint has the
+// fewest requests in flight. Requests for the empty block, then those in
+// the fast lanes and those in the normal queues that have aged, are sent
+// before any others.
+//
+// While an endpoint is prioritized, pickPriority decides instead.
 //
 // It returns false if it found nothing to do.
 func (wbq *writebackQueue) pickAndQueue(p *parallelism) bool {
+	if wbq.pickEmpty() {
+		return true
+	}
+	if sent, ok := wbq.pickPriority(p); ok {
+		return sent
+	}
+	if wbq.sc.opts.leastLoaded {
+		return wbq.pickLeastLoaded(p, true) || wbq.pickLeastLoaded(p, false)
+	}
+	return wbq.pickRoundRobin(p, true) || wbq.pickRoundRobin(p, false)
+}
+
+// pickEmpty sends a waiting request to write back the empty block to the
+// ready channel, if there is one and room for it. It reports whether it
+// did. Such requests do not count against the parallelism.
+func (wbq *writebackQueue) pickEmpty() bool {
+	for _, q := range wbq.byEndpoint {
+		r := q.empty
+		if r == nil || q.state == dead {
+			continue
+		}
+		select {
+		case wbq.ready <- r:
+			wbq.tracer.event(r, TracePicked, nil)
+			q.empty = nil
+			q.emptyInFlight = true
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// pickRoundRobin makes one round robin pass through the endpoint queues
+// sending the first request in each fast lane, if small is set, or normal
+// queue, if not, to the ready channel.
+//
+// It returns false if it found nothing to do.
+func (wbq *writebackQueue) pickRoundRobin(p *parallelism, small bool) bool {
 	sent := false
 	for _, q := range wbq.byEndpoint {
-		if !p.ok() {
+		if !p.okLane(small) {
 			// Already at the max parallel requests.
 			return false
 		}
 		if q.state == dead {
 			continue
 		}
-		if len(q.queue) == 0 {
+		lane := wbq.lane(q, small)
+		if lane == nil {
 			continue
 		}
-		r := q.queue[0]
-		select {
-		case wbq.ready <- r:
-			q.queue = q.queue[1:]
-			p.add()
-			if q.state == unknown {
-				// Once we send a request for an unknown endpoint
-				// assume it is dead until the request terminates
-				// and tells us otherwise.
-				q.state = dead
-			}
-			sent = true
-		default:
+		if !wbq.send(p, q, lane) {
 			// Queue full.
 			return false
 		}
+		sent = true
 	}
 	return sent
 }
 
+// pickLeastLoaded sends the first request in the fast lane, if small is set,
+// or normal queue, if not, of the endpoint with the fewest requests in flight
+// to the ready channel.
+//
+// It returns false if it found nothing to do.
+func (wbq *writebackQueue) pickLeastLoaded(p *parallelism, small bool) bool {
+	if !p.okLane(small) {
+		// Already at the max parallel requests.
+		return false
+	}
+	var best *endpointQueue
+	var bestLane *[]*request
+	for _, q := range wbq.byEndpoint {
+		if q.state == dead {
+			continue
+		}
+		lane := wbq.lane(q, small)
+		if lane == nil {
+			continue
+		}
+		if best == nil || q.inFlight < best.inFlight {
+			best, bestLane = q, lane
+		}
+	}
+	if best == nil {
+		return false
+	}
+	return wbq.send(p, best, bestLane)
+}
+
+// setPriority makes the endpoint's queue the one to drain ahead of the
+// others, replacing any chosen before. An endpoint with no writebacks
+// queued or in flight is already drained, and the others keep their turns.
+// It is called only by the scheduler.
+func (wbq *writebackQueue) setPriority(e upspin.Endpoint) {
+	const op = "store/storecache.scheduler"
+	q := wbq.byEndpoint[e]
+	if q == nil || q.drained() {
+		log.Info.Printf("%s: %s has no writebacks to prioritize", op, e)
+		return
+	}
+	log.Info.Printf("%s: prioritizing writebacks to %s", op, e)
+	wbq.priority, wbq.hasPriority = e, true
+}
+
+// pickPriority is pickAndQueue while an endpoint is prioritized. It sends
+// a request for that endpoint unless the others are owed a slot: for as
+// long as they have requests waiting, they keep a 1/priorityReserve share
+// of the max parallel writebacks, and at least one, sent a request at a
+// time from each in turn. It reports whether it sent a request and whether
+// it decided at all. It does not while the endpoint is dead or has only
+// writebacks in flight, leaving the others to be served as usual, and
+// once it has drained, which ends its priority.
+func (wbq *writebackQueue) pickPriority(p *parallelism) (sent, ok bool) {
+	if !wbq.hasPriority {
+		return false, false
+	}
+	pq := wbq.byEndpoint[wbq.priority]
+	if pq.drained() {
+		log.Info.Printf("store/storecache.scheduler: writebacks to %s drained; ending their priority", wbq.priority)
+		wbq.priority, wbq.hasPriority = upspin.Endpoint{}, false
+		return false, false
+	}
+	if pq.state == dead || !pq.waiting() {
+		return false, false
+	}
+	reserve := p.max / priorityReserve
+	if reserve < 1 {
+		reserve = 1
+	}
+	// The others' requests in flight only approximate the slots they
+	// hold, as a batch holds one and a fast writeback none.
+	others, waiting := 0, false
+	for _, q := range wbq.byEndpoint {
+		if q == pq {
+			continue
+		}
+		others += q.inFlight
+		if q.state != dead && q.waiting() {
+			waiting = true
+		}
+	}
+	owed := 0
+	if waiting && others < reserve {
+		owed = reserve - others
+	}
+	if p.inFlight+owed < p.max {
+		for _, small := range []bool{true, false} {
+			if lane := wbq.lane(pq, small); lane != nil && p.okLane(small) {
+				return wbq.send(p, pq, lane), true
+			}
+		}
+	}
+	if owed == 0 {
+		return false, true
+	}
+	for _, q := range wbq.byEndpoint {
+		if q == pq || q.state == dead {
+			continue
+		}
+		for _, small := range []bool{true, false} {
+			if lane := wbq.lane(q, small); lane != nil && p.okLane(small) {
+				return wbq.send(p, q, lane), true
+			}
+		}
+	}
+	return false, true
+}
+
+// lane returns the queue of q from which to send a request, or nil if there
+// is none. It is a queue of the first user, taking turns from the one whose
+// turn is next, that has a request to send and has not reached the
+// userParallel option; see userLane.
+func (wbq *writebackQueue) lane(q *endpointQueue, small bool) *[]*request {
+	for i := range q.order {
+		user := q.order[(q.next+i)%len(q.order)]
+		if wbq.userCapped(user) {
+			continue
+		}
+		if lane := wbq.userLane(q.users[user], small); lane != nil {
+			return lane
+		}
+	}
+	return nil
+}
+
+// userLane returns the queue of q from which to send a request, or nil if
+// there is none. If small is set, that is the fast lane unless the first
+// request in the normal queue has aged, that is, waited longer than the
+// aging option, and waited longer than the first in the fast lane.
+// Otherwise it is the normal queue.
+func (wbq *writebackQueue) userLane(q *userQueue, small bool) *[]*request {
+	if !small {
+		if len(q.queue) == 0 {
+			return nil
+		}
+		return &q.queue
+	}
+	if len(q.queue) > 0 && wbq.aged(q.queue[0]) {
+		if len(q.small) == 0 || q.queue[0].queuedAt.Before(q.small[0].queuedAt) {
+			return &q.queue
+		}
+	}
+	if len(q.small) == 0 {
+		return nil
+	}
+	return &q.small
+}
+
+// aged reports whether the request has waited long enough to be sent
+// as promptly as a small block.
+func (wbq *writebackQueue) aged(r *request) bool {
+	aging := wbq.sc.opts.aging
+	return aging > 0 && wbq.now().Sub(r.queuedAt) >= aging
+}
+
+// send sends the first request in lane, one of the queues of q, to the
+// ready channel if there is room, and passes the turn to the next user.
+// It reports whether it did. With the
+// batch option, the requests that follow it in the lane, up to the batch
+// size, go with it, to be sent to a live endpoint in one call; together
+// they count as one writeback against the parallelism.
+func (wbq *writebackQueue) send(p *parallelism, q *endpointQueue, lane *[]*request) bool {
+	r := (*lane)[0]
+	n := 1
+	if q.state == live && wbq.sc.opts.batch > 1 {
+		n = wbq.sc.opts.batch
+		if n > len(*lane) {
+			n = len(*lane)
+		}
+		r.batch = append([]*request(nil), (*lane)[1:n]...)
+	}
+	select {
+	case wbq.ready <- r:
+		for _, r := range (*lane)[:n] {
+			wbq.tracer.event(r, TracePicked, nil)
+		}
+		*lane = (*lane)[n:]
+		q.inFlight += n
+		q.took(r.user)
+		if wbq.sc.opts.userParallel > 0 {
+			wbq.userInFlight[r.user]++
+		}
+		p.add()
+		if q.state == unknown {
+			// Once we send a request for an unknown endpoint
+			// assume it is dead until the request terminates
+			// and tells us otherwise.
+			q.state = dead
+		}
+		return true
+	default:
+		r.batch = nil
+		return false
+	}
+}
+
 func (wbq *writebackQueue) writer(me int) {
 	for {
+		var idle <-chan time.Time
+		var timer *time.Timer
+		if d := wbq.sc.opts.writerIdle; d > 0 {
+			timer = time.NewTimer(d)
+			idle = timer.C
+		}
+
 		// Wait for something to do.
 		select {
 		case r := <-wbq.ready:
 			r.err = nil
+			r.writer = me
+			wbq.tracer.event(r, TraceDispatched, nil)
+			for _, br := range r.batch {
+				br.writer = me
+				wbq.tracer.event(br, TraceDispatched, nil)
+			}
 
 			// Write it back.
-			if r.err = wbq.writeback(r); r.err != nil {
+			if len(r.batch) > 0 {
+				wbq.writebackBatch(r)
+			} else if r.err = wbq.writeback(r); r.err != nil {
 				log.Error.Printf("store/storecache.writer: writeback failed: %s", r.err)
 			}
 			wbq.done <- r
+		case <-idle:
+			if wbq.idleExit() {
+				log.Debug.Printf("store/storecache.writer: writer %d idle, exiting", me)
+				return
+			}
+		case <-wbq.stop:
+			log.Debug.Printf("store/storecache.writer: writer %d stopped", me)
+			wbq.runMu.Lock()
+			wbq.running--
+			wbq.runMu.Unlock()
+			wbq.terminated <- true
+			return
 		case <-wbq.die:
 			wbq.terminated <- true
 			return
 		}
+		if timer != nil {
+			timer.Stop()
+		}
 	}
 }
 
@@ -302,10 +1357,12 @@ func (wbq *writebackQueue) writer(me int) {
 func (wbq *writebackQueue) writeback(r *request) error {
 	// Read it in.
 	file := wbq.sc.cachePath(r.Reference, r.Endpoint) + writebackSuffix
-	data, err := readFromCacheFile(file)
+	defer wbq.holdBudget(file)()
+	data, err := wbq.sc.readFile(file)
 	if err != nil {
 		// Nothing we can do, log it but act like we succeeded.
 		log.Error.Printf("store/storecache.writer: disappeared before writeback: %s", err)
+		wbq.index.remove(r.Location)
 		return nil
 	}
 
@@ -314,46 +1371,414 @@ func (wbq *writebackQueue) writeback(r *request) error {
 	if err != nil {
 		return err
 	}
-	refdata, err := store.Put(data)
+	if err := wbq.journal.intent(r.Location); err != nil {
+		log.Error.Printf("store/storecache.writer: journal: %s", err)
+	}
+	wbq.tracer.event(r, TracePutStarted, nil)
+	refdata, err := wbq.put(store, data)
+	wbq.tracer.event(r, TracePutDone, err)
 	if err != nil {
 		return err
 	}
+	return wbq.stored(r, file, len(data), refdata)
+}
+
+// stored records that the store has taken the size bytes of the block of
+// r, read from file, returning the refdata, and that the file need no
+// longer be kept for writeback.
+func (wbq *writebackQueue) stored(r *request, file string, size int, refdata *upspin.Refdata) error {
+	wbq.sc.churn.storePut(size)
 	if refdata.Reference != r.Reference {
-		err := errors.Errorf("refdata mismatch expected %q got %q", r.Reference, refdata.Reference)
+		err := &mismatchError{Location: r.Location, got: refdata.Reference}
+		wbq.discard(r.Location, err)
+		wbq.journal.done(r.Location)
 		return err
 	}
-	if err := os.Remove(file); err != nil {
+	if r.Reference == emptyRef {
+		wbq.setHasEmpty(r.Endpoint, true)
+	}
+	if err := wbq.journal.done(r.Location); err != nil {
+		log.Error.Printf("store/storecache.writer: journal: %s", err)
+	}
+	if err := wbq.index.remove(r.Location); err != nil {
+		log.Error.Printf("store/storecache.writer: index: %s", err)
+	}
+	if err := wbq.sc.unlinkFile(file); err != nil {
 		log.Info.Printf("store/storecache.writer: fail remove after writeback: %s", err)
 	}
 	return nil
 }
 
+// writebackBatch writes back r and the requests of its batch, setting the
+// err of each. If the store can take several blocks in one call, they
+// are sent in one; otherwise each is written back in turn.
+func (wbq *writebackQueue) writebackBatch(r *request) {
+	const op = "store/storecache.writer"
+	reqs := append([]*request{r}, r.batch...)
+	store, err := bind.StoreServer(wbq.sc.cfg, r.Endpoint)
+	bp, ok := store.(batchPutter)
+	if err != nil || !ok {
+		for _, r := range reqs {
+			if r.err = wbq.writeback(r); r.err != nil {
+				log.Error.Printf("%s: writeback failed: %s", op, r.err)
+			}
+		}
+		return
+	}
+
+	// Read in the blocks, as writeback does.
+	var sent []*request
+	var files []string
+	var data [][]byte
+	links := make([]string, len(reqs))
+	for i, r := range reqs {
+		links[i] = wbq.sc.cachePath(r.Reference, r.Endpoint) + writebackSuffix
+	}
+	defer wbq.holdBudget(links...)()
+	for i, r := range reqs {
+		r.err = nil
+		file := links[i]
+		d, err := wbq.sc.readFile(file)
+		if err != nil {
+			log.Error.Printf("%s: disappeared before writeback: %s", op, err)
+			wbq.index.remove(r.Location)
+			continue
+		}
+		if err := wbq.journal.intent(r.Location); err != nil {
+			log.Error.Printf("%s: journal: %s", op, err)
+		}
+		sent = append(sent, r)
+		files = append(files, file)
+		data = append(data, d)
+	}
+	if len(sent) == 0 {
+		return
+	}
+
+	for _, r := range sent {
+		wbq.tracer.event(r, TracePutStarted, nil)
+	}
+	var refdata []*upspin.Refdata
+	err = wbq.timeLimit(store, func() (err error) {
+		refdata, err = bp.PutBatch(data)
+		return err
+	})
+	if err == nil && len(refdata) != len(data) {
+		err = errors.E(errors.IO, errors.Errorf("PutBatch to %s: %d references for %d blocks", r.Endpoint, len(refdata), len(data)))
+	}
+	for _, r := range sent {
+		wbq.tracer.event(r, TracePutDone, err)
+	}
+	if err != nil {
+		log.Error.Printf("%s: writeback of %d blocks failed: %s", op, len(data), err)
+		for _, r := range sent {
+			r.err = err
+		}
+		return
+	}
+	for i, r := range sent {
+		if r.err = wbq.stored(r, files[i], len(data[i]), refdata[i]); r.err != nil {
+			log.Error.Printf("%s: writeback failed: %s", op, r.err)
+		}
+	}
+}
+
+// holdBudget waits for the writebackMemory option's budget to have room
+// for the blocks of the files, writeback links about to be read, and
+// takes it, returning the function that gives it back once the blocks
+// are no longer needed.
+func (wbq *writebackQueue) holdBudget(files ...string) func() {
+	if wbq.budget == nil {
+		return func() {}
+	}
+	var size int64
+	for _, file := range files {
+		if n, err := wbq.sc.fileSize(file); err == nil {
+			size += n
+		}
+	}
+	n := wbq.budget.acquire(size)
+	return func() { wbq.budget.release(n) }
+}
+
+// put puts data to the store, within the putTimeout option; see timeLimit.
+func (wbq *writebackQueue) put(store upspin.StoreServer, data []byte) (*upspin.Refdata, error) {
+	var refdata *upspin.Refdata
+	err := wbq.timeLimit(store, func() (err error) {
+		refdata, err = store.Put(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refdata, nil
+}
+
+// maxStuck is how many Puts given up on by timeLimit may still be
+// running for an endpoint before timeLimit stops starting more.
+const maxStuck = 4
+
+// timeLimit calls f, which stores blocks in the store, giving up after the
+// putTimeout option, if set, with an error that counts as a timeout so the
+// requests are retried with less parallelism. A StoreServer cannot cancel
+// a Put, so one given up on is not cancelled but runs on in the
+// background, its result ignored. So that a wedged store cannot gather
+// them without bound, once maxStuck are running for its endpoint
+// timeLimit fails at once, without calling f, until one returns.
+func (wbq *writebackQueue) timeLimit(store upspin.StoreServer, f func() error) error {
+	d := wbq.sc.opts.putTimeout
+	if d == 0 {
+		return f()
+	}
+	e := store.Endpoint()
+	wbq.stuckMu.Lock()
+	n := wbq.stuck[e]
+	wbq.stuckMu.Unlock()
+	if n >= maxStuck {
+		return errors.E(errors.IO, errors.Errorf("Put to %s: %d earlier Puts timed out and have not returned", e, n))
+	}
+	c := make(chan error, 1)
+	finished, givenUp := false, false // Guarded by stuckMu.
+	go func() {
+		err := f()
+		wbq.stuckMu.Lock()
+		finished = true
+		if givenUp {
+			wbq.stuck[e]--
+			if wbq.stuck[e] == 0 {
+				delete(wbq.stuck, e)
+			}
+		}
+		wbq.stuckMu.Unlock()
+		c <- err
+	}()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case err := <-c:
+		return err
+	case <-timer.C:
+	}
+	wbq.stuckMu.Lock()
+	if finished {
+		wbq.stuckMu.Unlock()
+		return <-c
+	}
+	givenUp = true
+	if wbq.stuck == nil {
+		wbq.stuck = make(map[upspin.Endpoint]int)
+	}
+	wbq.stuck[e]++
+	wbq.stuckMu.Unlock()
+	return errors.E(errors.IO, errors.Errorf("Put to %s: timeout after %v", e, d))
+}
+
+// latencyProbe is the result of timing a Put to an endpoint.
+type latencyProbe struct {
+	e   upspin.Endpoint
+	rtt time.Duration
+	err error
+}
+
+// probe times a Put of the empty block, which costs the store next to
+// nothing, to the endpoint and sends the result to the scheduler.
+func (wbq *writebackQueue) probe(e upspin.Endpoint) {
+	lp := &latencyProbe{e: e}
+	store, err := bind.StoreServer(wbq.sc.cfg, e)
+	if err == nil {
+		start := time.Now()
+		var refdata *upspin.Refdata
+		refdata, err = wbq.put(store, nil)
+		lp.rtt = time.Since(start)
+		if err == nil && refdata.Reference != emptyRef {
+			err = errors.Errorf("store returned reference %q for the empty block", refdata.Reference)
+		}
+	}
+	if err == nil {
+		wbq.setHasEmpty(e, true)
+	}
+	lp.err = err
+	select {
+	case wbq.seeds <- lp:
+	case <-wbq.die:
+	}
+}
+
+// seedParallel returns the maximum number of parallel writebacks with
+// which to start for a store whose round trip time is rtt: one for each
+// latencySeed of it. Like a bandwidth-delay product, the longer the round
+// trip, the more writebacks it takes to keep the line to the store full.
+func seedParallel(rtt, latencySeed time.Duration) int {
+	n := (rtt + latencySeed - 1) / latencySeed
+	if n > writers {
+		return writers
+	}
+	return int(n)
+}
+
+// parallelMax returns the maximum number of parallel writebacks.
+func (wbq *writebackQueue) parallelMax() int {
+	c := make(chan int)
+	wbq.maxParallel <- c
+	return <-c
+}
+
+// discard disposes of a block that can never be written back, either
+// moving its writeback link to the quarantine directory or removing it,
+// and removes its cache file.
+func (wbq *writebackQueue) discard(loc upspin.Location, why error) {
+	const op = "store/storecache.discard"
+	cf := wbq.sc.cachePath(loc.Reference, loc.Endpoint)
+	wbf := cf + writebackSuffix
+	if err := wbq.index.remove(loc); err != nil {
+		log.Error.Printf("%s: index: %s", op, err)
+	}
+	if wbq.sc.opts.deleteMismatched {
+		log.Error.Printf("%s: deleting %s: %s", op, wbf, why)
+		if err := wbq.sc.unlinkFile(wbf); err != nil {
+			log.Error.Printf("%s: %s", op, err)
+		}
+	} else {
+		q := wbq.quarantinePath(loc)
+		log.Error.Printf("%s: quarantining %s as %s: %s", op, wbf, q, why)
+		err := os.MkdirAll(filepath.Dir(q), 0700)
+		if err == nil {
+			err = wbq.sc.unpackFile(wbf)
+		}
+		if err == nil {
+			err = os.Rename(wbf, q)
+		}
+		if err != nil {
+			log.Error.Printf("%s: %s", op, err)
+		}
+	}
+	wbq.sc.remove(cf)
+}
+
+// quarantinePath returns the name under which a block that could not be
+// written back is kept.
+func (wbq *writebackQueue) quarantinePath(loc upspin.Location) string {
+	return filepath.Join(wbq.quarantineRoot(), loc.Endpoint.String(), refFileName(loc.Reference))
+}
+
 // requestWriteback makes a hard link to the cache file sends a request to the scheduler queue.
-func (wbq *writebackQueue) requestWriteback(ref upspin.Reference, e upspin.Endpoint) error {
+// The size is the length of the block, and user is the user whose Put cached it.
+func (wbq *writebackQueue) requestWriteback(ref upspin.Reference, e upspin.Endpoint, size int64, user upspin.UserName) error {
+	if ref == emptyRef && wbq.holdsEmpty(e) {
+		// The store already has it.
+		return nil
+	}
 	// Make a link to the cache file.
 	cf := wbq.sc.cachePath(ref, e)
 	wbf := cf + writebackSuffix
-	if err := os.Link(cf, wbf); err != nil {
+	if wbq.sc.opts.fsync == fsyncWriteback {
+		// Don't let a crash leave the link naming a truncated file.
+		if err := wbq.sc.syncFile(cf); err != nil {
+			return err
+		}
+	}
+	// Index the link before making it, so the index never misses it.
+	loc := upspin.Location{Reference: ref, Endpoint: e}
+	if err := wbq.index.add(loc, size); err != nil {
+		return err
+	}
+	if err := wbq.sc.linkFile(cf, wbf); err != nil {
 		if strings.Contains(err.Error(), "exists") {
 			// Someone else is already writing it back.
 			return nil
 		}
+		wbq.index.remove(loc)
 		return err
 	}
+	wbq.sc.churn.create()
 
 	// Let the scheduler know.
-	wbq.request <- &request{upspin.Location{Reference: ref, Endpoint: e}, nil, nil}
+	wbq.request <- &request{Location: loc, size: size, user: user}
 	return nil
 }
 
-// flush waits until the indicated block has been flushed.
-func (wbq *writebackQueue) flush(loc upspin.Location) {
-	flushed := make(chan bool)
-	wbq.flushRequest <- &flushRequest{
+// holdsEmpty reports whether the store at e is known to hold the empty block.
+func (wbq *writebackQueue) holdsEmpty(e upspin.Endpoint) bool {
+	wbq.emptyMu.Lock()
+	defer wbq.emptyMu.Unlock()
+	return wbq.hasEmpty[e]
+}
+
+// setHasEmpty records whether the store at e holds the empty block.
+func (wbq *writebackQueue) setHasEmpty(e upspin.Endpoint, has bool) {
+	wbq.emptyMu.Lock()
+	defer wbq.emptyMu.Unlock()
+	if has {
+		wbq.hasEmpty[e] = true
+	} else {
+		delete(wbq.hasEmpty, e)
+	}
+}
+
+// pending returns the locations of all blocks waiting to be written back,
+// including those being written back now.
+func (wbq *writebackQueue) pending() []upspin.Location {
+	c := make(chan []upspin.Location)
+	wbq.snapshot <- c
+	return <-c
+}
+
+// pendingCheck is a request to the scheduler to report whether
+// a location is queued.
+type pendingCheck struct {
+	upspin.Location
+	reply chan bool
+}
+
+// isPending reports whether the block at loc is waiting to be written back,
+// including being written back now. Unlike flush, it does not wait for the
+// writeback.
+func (wbq *writebackQueue) isPending(loc upspin.Location) bool {
+	pc := &pendingCheck{Location: loc, reply: make(chan bool)}
+	wbq.pendingCheck <- pc
+	return <-pc.reply
+}
+
+// deadlineStats returns the current deadline statistics, first reporting
+// any requests newly past their deadline.
+func (wbq *writebackQueue) deadlineStats() DeadlineStats {
+	c := make(chan DeadlineStats)
+	wbq.deadlines <- c
+	return <-c
+}
+
+// flush waits until the indicated block has been flushed. It returns an
+// error if the block was abandoned rather than written back.
+func (wbq *writebackQueue) flush(loc upspin.Location) error {
+	fr := &flushRequest{
 		Location: loc,
-		flushed:  flushed,
+		flushed:  make(chan bool),
+	}
+	wbq.flushRequest <- fr
+	<-fr.flushed
+	return fr.err
+}
+
+// flushEndpoint waits until no writebacks to the endpoint are queued or in
+// flight, regardless of those to other endpoints. An endpoint that is not
+// responding is retried indefinitely, and flushEndpoint waits for it. It
+// returns an error if any block for the endpoint was abandoned rather than
+// written back.
+func (wbq *writebackQueue) flushEndpoint(e upspin.Endpoint) error {
+	ef := &endpointFlush{
+		Endpoint: e,
+		flushed:  make(chan bool),
 	}
-	<-flushed
+	wbq.endpointWait <- ef
+	<-ef.flushed
+	return ef.err
+}
+
+// prioritizeEndpoint makes the scheduler drain the writebacks queued for
+// the endpoint ahead of all others until none are left. Unlike
+// flushEndpoint, it does not wait for them.
+func (wbq *writebackQueue) prioritizeEndpoint(e upspin.Endpoint) {
+	wbq.prioritize <- e
 }
 
 // parallelism controls the number of parallel writebacks.
@@ -372,13 +1797,43 @@ type parallelism struct {
 	// the last timeout or change of max. When successes equals
 	// max, we increment max.
 	successes int
+
+	// limit is the number of writers, above which max cannot go.
+	limit int
+
+	// reserved is the number of the max parallel requests that
+	// only requests from the fast lanes may use.
+	reserved int
 }
 
 func newParallelism(max int) *parallelism {
 	if max < 1 {
 		max = 1
 	}
-	return &parallelism{max: max}
+	return &parallelism{max: max, limit: writers}
+}
+
+// setLimit changes the number of writers, lowering max if necessary.
+// Requests already in flight are unaffected.
+func (p *parallelism) setLimit(n int) {
+	p.limit = n
+	if p.max > n {
+		p.max = n
+		p.successes = 0
+	}
+}
+
+// seed replaces max, within the number of writers, as the starting point
+// from which to adjust it.
+func (p *parallelism) seed(max int) {
+	if max < 1 {
+		max = 1
+	}
+	if max > p.limit {
+		max = p.limit
+	}
+	p.max = max
+	p.successes = 0
 }
 
 // failure is called when a writeback fails. It returns true if it
@@ -422,7 +1877,8 @@ func (p *parallelism) success() {
 	p.inFlight--
 
 	// inFlight below max (not enough write load) give us no information.
-	if p.inFlight+1 < p.max {
+	// The slots reserved for the fast lane may stay idle under load.
+	if p.inFlight+1 < p.largeMax() {
 		return
 	}
 
@@ -431,7 +1887,7 @@ func (p *parallelism) success() {
 	p.successes++
 
 	// max can't go above the number of available writers.
-	if p.max == writers {
+	if p.max >= p.limit {
 		return
 	}
 
@@ -439,7 +1895,7 @@ func (p *parallelism) success() {
 	// writebacks can occur concurrently without a timeout error. As with TCP
 	// congestion windows we approximate that with a sawtooth that increments
 	// past the goal and then falls back.  We limit p.max to a large but finite
-	// number, that is, the number of preallocated writers and hope that will be
+	// number, that is, the number of running writers and hope that will be
 	// enough. Unlimited would easily DOS the server.
 	//
 	// If we simultaneously start p.max writebacks and they all terminate
@@ -462,6 +1918,25 @@ func (p *parallelism) ok() bool {
 	return p.inFlight < p.max
 }
 
+// okLane is like ok but for requests from the fast lane, if small is
+// set, or otherwise from the normal queues, which may not use the
+// reserved slots.
+func (p *parallelism) okLane(small bool) bool {
+	if small {
+		return p.ok()
+	}
+	return p.inFlight < p.largeMax()
+}
+
+// largeMax returns the max parallel requests from the normal queues.
+// It is at least 1 so that they are never starved.
+func (p *parallelism) largeMax() int {
+	if p.max-p.reserved < 1 {
+		return 1
+	}
+	return p.max - p.reserved
+}
+
 func (p *parallelism) add() {
 	p.inFlight++
 }
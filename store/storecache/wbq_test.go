@@ -5,9 +5,215 @@
 package storecache
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"upspin.io/bind"
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/key/sha256key"
+	"upspin.io/upspin"
 )
 
+var testConfig = config.SetUserName(config.New(), "tester@google.com")
+
+func init() {
+	bind.RegisterStoreServer(upspin.InProcess, testStoreDialer{})
+}
+
+// testStores holds the test StoreServers, by network address.
+var testStores = struct {
+	sync.Mutex
+	m     map[upspin.NetAddr]*testStore
+	batch map[upspin.NetAddr]*batchStore
+}{
+	m:     make(map[upspin.NetAddr]*testStore),
+	batch: make(map[upspin.NetAddr]*batchStore),
+}
+
+// testStoreDialer dials the testStore for an endpoint, creating it if needed.
+type testStoreDialer struct {
+	upspin.StoreServer
+}
+
+func (testStoreDialer) Dial(cfg upspin.Config, e upspin.Endpoint) (upspin.Service, error) {
+	testStores.Lock()
+	bs := testStores.batch[e.NetAddr]
+	testStores.Unlock()
+	if bs != nil {
+		return bs, nil
+	}
+	return storeFor(e), nil
+}
+
+func storeFor(e upspin.Endpoint) *testStore {
+	testStores.Lock()
+	defer testStores.Unlock()
+	s := testStores.m[e.NetAddr]
+	if s == nil {
+		s = &testStore{e: e, data: make(map[upspin.Reference][]byte)}
+		testStores.m[e.NetAddr] = s
+	}
+	return s
+}
+
+// testStore is an in-memory StoreServer that counts Puts.
+type testStore struct {
+	sync.Mutex
+	e      upspin.Endpoint
+	data   map[upspin.Reference][]byte
+	puts   int
+	badRef bool          // Put returns the wrong reference.
+	fail   bool          // Put fails.
+	down   bool          // Ping fails.
+	gate   chan bool     // If set, Put waits until it is closed, once counted.
+	delay  time.Duration // Put takes at least this long.
+
+	// Bytes being Put now, and the most at once.
+	inPut, maxInPut int
+}
+
+func (s *testStore) Dial(cfg upspin.Config, e upspin.Endpoint) (upspin.Service, error) {
+	return s, nil
+}
+
+func (s *testStore) Get(ref upspin.Reference) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	s.Lock()
+	defer s.Unlock()
+	data, ok := s.data[ref]
+	if !ok {
+		return nil, nil, nil, os.ErrNotExist
+	}
+	return data, &upspin.Refdata{Reference: ref}, nil, nil
+}
+
+func (s *testStore) Put(data []byte) (*upspin.Refdata, error) {
+	s.Lock()
+	s.puts++
+	s.inPut += len(data)
+	if s.inPut > s.maxInPut {
+		s.maxInPut = s.inPut
+	}
+	gate, delay := s.gate, s.delay
+	s.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	time.Sleep(delay)
+	s.Lock()
+	defer s.Unlock()
+	s.inPut -= len(data)
+	if s.fail {
+		return nil, errors.Str("store unavailable")
+	}
+	ref := upspin.Reference(sha256key.Of(data).String())
+	if s.badRef {
+		ref = "bad" + ref
+	}
+	s.data[ref] = data
+	return &upspin.Refdata{Reference: ref}, nil
+}
+
+func (s *testStore) Delete(ref upspin.Reference) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.data, ref)
+	return nil
+}
+
+// reset empties the store. The store itself is kept as bind caches it.
+func (s *testStore) reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.data = make(map[upspin.Reference][]byte)
+	s.puts = 0
+	s.badRef = false
+	s.fail = false
+	s.down = false
+	s.gate = nil
+	s.delay = 0
+	s.inPut = 0
+	s.maxInPut = 0
+}
+
+func (s *testStore) numPuts() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.puts
+}
+
+// batchStore is a testStore that can store several blocks in one call,
+// recording how many are in each.
+type batchStore struct {
+	*testStore
+	sizes []int // Guarded by the testStore's mutex.
+}
+
+// batchStoreFor returns a new batchStore for the endpoint, which must
+// not have been dialed before.
+func batchStoreFor(e upspin.Endpoint) *batchStore {
+	bs := &batchStore{testStore: storeFor(e)}
+	testStores.Lock()
+	testStores.batch[e.NetAddr] = bs
+	testStores.Unlock()
+	return bs
+}
+
+func (s *batchStore) Dial(cfg upspin.Config, e upspin.Endpoint) (upspin.Service, error) {
+	return s, nil
+}
+
+func (s *batchStore) PutBatch(data [][]byte) ([]*upspin.Refdata, error) {
+	s.Lock()
+	s.sizes = append(s.sizes, len(data))
+	s.Unlock()
+	refdata := make([]*upspin.Refdata, len(data))
+	for i, d := range data {
+		rd, err := s.Put(d)
+		if err != nil {
+			return nil, err
+		}
+		refdata[i] = rd
+	}
+	return refdata, nil
+}
+
+func (s *testStore) Endpoint() upspin.Endpoint { return s.e }
+func (s *testStore) Close()                    {}
+func (s *testStore) Ping() bool {
+	s.Lock()
+	defer s.Unlock()
+	return !s.down
+}
+
+// newTestCache returns a writeback cache in a temporary directory,
+// writing back to the test store with the given network address.
+// The returned function closes the cache and removes the directory.
+func newTestCache(t *testing.T, addr string, opts options) (*storeCache, *testStore, func()) {
+	tmp, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _, err := newCache(testConfig, filepath.Join(tmp, "storecache"), 1e8, false, opts)
+	if err != nil {
+		os.RemoveAll(tmp)
+		t.Fatal(err)
+	}
+	st := storeFor(upspin.Endpoint{Transport: upspin.InProcess, NetAddr: upspin.NetAddr(addr)})
+	st.reset()
+	return c, st, func() {
+		c.close()
+		os.RemoveAll(tmp)
+	}
+}
+
 func TestParallelismOK(t *testing.T) {
 	max := 5
 	p := newParallelism(max)
@@ -48,3 +254,1447 @@ func TestParallelismSuccess(t *testing.T) {
 		p.add()
 	}
 }
+
+func TestParallelismChange(t *testing.T) {
+	changes := make(chan ParallelismChange, 100)
+	wbq := &writebackQueue{onParallel: func(c ParallelismChange) { changes <- c }}
+	e := upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "parallelism"}
+	// expect checks the next call of the callback, which runs in a
+	// goroutine of its own, so it must be waited for before the next
+	// change is made.
+	expect := func(old, new int) {
+		t.Helper()
+		want := ParallelismChange{Endpoint: e, Old: old, New: new, Up: new > old}
+		select {
+		case got := <-changes:
+			if got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no call, want %+v", want)
+		}
+	}
+
+	max := 2
+	p := newParallelism(max)
+	for i := 0; i < max; i++ {
+		p.add()
+	}
+	// With continuous write load, two successes raise max to 3 and
+	// three more to 4.
+	for _, n := range []int{2, 3} {
+		for i := 0; i < n; i++ {
+			wbq.parallelSuccess(p, e)
+			p.add()
+		}
+		expect(n, n+1)
+		p.add()
+	}
+	// A timeout halves max, and a second, from a request sent before
+	// the first, does not lower it again.
+	timeout := errors.Str("rpc timeout")
+	for i := 0; i < 2; i++ {
+		if !wbq.parallelFailure(p, e, timeout) {
+			t.Fatal("timeout not handled")
+		}
+	}
+	expect(4, 2)
+	// An error other than a timeout leaves max alone.
+	if wbq.parallelFailure(p, e, errors.Str("broken")) {
+		t.Fatal("non-timeout error handled")
+	}
+	select {
+	case got := <-changes:
+		t.Errorf("unexpected change %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWritebackRefMismatch(t *testing.T) {
+	for _, del := range []bool{false, true} {
+		addr := "mismatch-quarantine"
+		if del {
+			addr = "mismatch-delete"
+		}
+		c, st, cleanup := newTestCache(t, addr, options{deleteMismatched: del})
+		st.Lock()
+		st.badRef = true
+		st.Unlock()
+
+		data := []byte("some data")
+		ref, err := c.put(testConfig, data, st.e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loc := upspin.Location{Reference: ref, Endpoint: st.e}
+
+		// Wait for the scheduler to pick up the writeback so the
+		// flush cannot overtake it.
+		for st.numPuts() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		err = c.wbq.flush(loc)
+		if _, ok := err.(*mismatchError); !ok {
+			t.Errorf("%s: flush returned %v, want mismatch error", addr, err)
+		}
+
+		// The writeback is abandoned, not retried.
+		time.Sleep(10 * time.Millisecond)
+		if err := c.wbq.flush(loc); err == nil {
+			t.Errorf("%s: second flush succeeded", addr)
+		}
+		if n := st.numPuts(); n != 1 {
+			t.Errorf("%s: %d puts, want 1", addr, n)
+		}
+
+		cf := c.cachePath(ref, st.e)
+		for _, f := range []string{cf, cf + writebackSuffix} {
+			if _, err := os.Stat(f); !os.IsNotExist(err) {
+				t.Errorf("%s: %s still present: %v", addr, f, err)
+			}
+		}
+		q, err := ioutil.ReadFile(c.wbq.quarantinePath(loc))
+		if del {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s: quarantined file present: %v", addr, err)
+			}
+		} else if string(q) != string(data) {
+			t.Errorf("%s: quarantined file contains %q, %v; want %q", addr, q, err, data)
+		}
+		cleanup()
+	}
+}
+
+func TestExportImportPending(t *testing.T) {
+	c1, st, cleanup1 := newTestCache(t, "migrate", options{})
+	defer cleanup1()
+	st.Lock()
+	st.fail = true
+	st.Unlock()
+
+	// Queue some writebacks that cannot complete.
+	blocks := []string{"first block", "second block", "third block"}
+	var want []upspin.Location
+	for _, b := range blocks {
+		ref, err := c1.put(testConfig, []byte(b), st.e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, upspin.Location{Reference: ref, Endpoint: st.e})
+	}
+	s1 := &server{cfg: testConfig, cache: c1}
+	manifest, err := s1.ExportPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != len(want) {
+		t.Fatalf("exported %d writebacks, want %d", len(manifest), len(want))
+	}
+	for _, loc := range want {
+		found := false
+		for _, p := range manifest {
+			found = found || p.Location == loc
+		}
+		if !found {
+			t.Errorf("%v not exported", loc)
+		}
+	}
+	for _, p := range manifest {
+		if filepath.IsAbs(p.File) {
+			t.Errorf("manifest names absolute path %s", p.File)
+		}
+	}
+
+	// Move the old cache's directory, as to another host.
+	moved, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(moved)
+	moved = filepath.Join(moved, "cache")
+	if err := os.Rename(filepath.Dir(c1.dir), moved); err != nil {
+		t.Fatal(err)
+	}
+
+	// Import them into a fresh cache writing to the same, now working, store.
+	c2, _, cleanup2 := newTestCache(t, "migrate-new", options{})
+	defer cleanup2()
+	st.Lock()
+	st.fail = false
+	st.Unlock()
+	s2 := &server{cfg: testConfig, cache: c2}
+	if err := s2.ImportPending(moved, manifest); err != nil {
+		t.Fatal(err)
+	}
+	for i, loc := range want {
+		if err := c2.wbq.flush(loc); err != nil {
+			t.Errorf("flush %v: %v", loc, err)
+		}
+		data, _, _, err := st.Get(loc.Reference)
+		if err != nil {
+			t.Errorf("block %d not written back: %v", i, err)
+			continue
+		}
+		if string(data) != blocks[i] {
+			t.Errorf("block %d contains %q, want %q", i, data, blocks[i])
+		}
+	}
+	if m, _ := s2.ExportPending(); len(m) != 0 {
+		t.Errorf("%d writebacks still pending after import", len(m))
+	}
+
+	// A manifest entry whose file does not match its reference is refused.
+	bad := []PendingWriteback{{Location: want[0], File: manifest[1].File}}
+	if err := s2.ImportPending(moved, bad); err == nil {
+		t.Error("imported a block with the wrong contents")
+	}
+
+	// As is one outside the directory.
+	bad = []PendingWriteback{{Location: want[0], File: "../" + manifest[0].File}}
+	if err := s2.ImportPending(moved, bad); err == nil {
+		t.Error("imported a block from outside the cache")
+	}
+}
+
+// slowShare simulates writebacks to a fast endpoint, whose requests complete
+// as soon as they are dispatched, and a slow one, whose requests never
+// complete, and returns the number in flight to the slow one.
+func slowShare(leastLoaded bool) int {
+	wbq := &writebackQueue{
+		sc:         &storeCache{opts: options{leastLoaded: leastLoaded}},
+		byEndpoint: make(map[upspin.Endpoint]*endpointQueue),
+		ready:      make(chan *request, writers),
+	}
+	slow := upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "slow"}
+	fast := upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "fast"}
+	for _, e := range []upspin.Endpoint{slow, fast} {
+		q := &endpointQueue{state: live}
+		for i := 0; i < 100; i++ {
+			wbq.add(q, &request{Location: upspin.Location{Endpoint: e}})
+		}
+		wbq.byEndpoint[e] = q
+	}
+	p := newParallelism(writers)
+	for wbq.byEndpoint[fast].waiting() {
+		for wbq.pickAndQueue(p) {
+		}
+		if len(wbq.ready) == 0 {
+			// The slow endpoint has all the writers.
+			break
+		}
+		for len(wbq.ready) > 0 {
+			r := <-wbq.ready
+			if r.Endpoint == fast {
+				wbq.byEndpoint[fast].inFlight--
+				p.success()
+			}
+		}
+	}
+	return wbq.byEndpoint[slow].inFlight
+}
+
+func TestLeastLoaded(t *testing.T) {
+	// While the fast endpoint has work, the slow one should not hold
+	// more than its share of the writers.
+	if n := slowShare(true); n > writers/2 {
+		t.Errorf("least loaded: %d requests in flight to slow endpoint, want at most %d", n, writers/2)
+	}
+	// Round robin lets the slow endpoint take almost every writer.
+	if n := slowShare(false); n <= writers/2 {
+		t.Errorf("round robin: %d requests in flight to slow endpoint, expected more than %d", n, writers/2)
+	}
+}
+
+// dispatchOrder simulates a bulk flush of large blocks, followed by the
+// writeback of a small one, with writers taking each request as soon as
+// it is ready and the oldest writeback completing at each step. It returns
+// the number of large blocks written back before the small one was
+// dispatched and the number then in flight.
+func dispatchOrder(opts options) (before, inFlight int) {
+	const max = 4
+	wbq := &writebackQueue{
+		sc:         &storeCache{opts: opts},
+		byEndpoint: make(map[upspin.Endpoint]*endpointQueue),
+		queued:     make(map[upspin.Location]*request),
+		abandoned:  make(map[upspin.Location]error),
+		ready:      make(chan *request, writers),
+	}
+	p := newParallelism(max)
+	p.limit = max
+	if opts.smallBlock > 0 {
+		p.reserved = opts.fastLaneSlots
+	}
+	e := upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "bulk"}
+	add := func(ref string, size int64) {
+		wbq.enqueue(&request{Location: upspin.Location{Reference: upspin.Reference(ref), Endpoint: e}, size: size})
+	}
+	for i := 0; i < 20; i++ {
+		add(fmt.Sprint("large", i), 1<<20)
+	}
+	q := wbq.byEndpoint[e]
+	q.state = live
+	for wbq.pickAndQueue(p) {
+	}
+	add("small", 100)
+	for ; ; before++ {
+		for wbq.pickAndQueue(p) {
+		}
+		for len(wbq.ready) > 0 {
+			if r := <-wbq.ready; r.Reference == "small" {
+				return before, q.inFlight - 1
+			}
+		}
+		q.inFlight--
+		p.success()
+	}
+}
+
+func TestFastLane(t *testing.T) {
+	for _, leastLoaded := range []bool{false, true} {
+		// With the fast lane off, the small block waits behind the backlog.
+		if before, _ := dispatchOrder(options{leastLoaded: leastLoaded}); before != 17 {
+			t.Errorf("leastLoaded=%v, no fast lane: small block dispatched after %d large ones, want 17", leastLoaded, before)
+		}
+		// With it on, it is dispatched at once, using the reserved slot.
+		opts := options{leastLoaded: leastLoaded, smallBlock: 1000, fastLaneSlots: 1}
+		before, inFlight := dispatchOrder(opts)
+		if before != 0 || inFlight != 3 {
+			t.Errorf("leastLoaded=%v: small block dispatched after %d large ones, with %d in flight; want 0, 3", leastLoaded, before, inFlight)
+		}
+		// Without a reserved slot, it is dispatched
+		// as soon as a large block finishes.
+		opts.fastLaneSlots = 0
+		if before, inFlight := dispatchOrder(opts); before != 1 || inFlight != 3 {
+			t.Errorf("leastLoaded=%v, no reserved slot: small block dispatched after %d large ones, with %d in flight; want 1, 3", leastLoaded, before, inFlight)
+		}
+	}
+
+	// The options are parsed, with defaults.
+	o, err := parseOptions(nil)
+	if err != nil || o.smallBlock != defaultSmallBlock || o.fastLaneSlots != defaultFastLaneSlots {
+		t.Errorf("default options: %+v, %v", o, err)
+	}
+	o, err = parseOptions([]string{"smallBlock=0", "fastLaneSlots=2"})
+	if err != nil || o.smallBlock != 0 || o.fastLaneSlots != 2 {
+		t.Errorf("options: %+v, %v", o, err)
+	}
+	if _, err := parseOptions([]string{"smallBlock=-1"}); err == nil {
+		t.Error("negative smallBlock accepted")
+	}
+}
+
+// starvedSteps simulates a large block waiting behind a steady stream of
+// small ones, more than can be written back, with one writeback completing
+// and a second of fake time passing at each step. It returns the number of
+// steps before the large block was dispatched, or -1 if it was not within
+// limit steps.
+func starvedSteps(opts options, limit int) int {
+	const max = 4
+	clock := &fakeClock{t: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+	wbq := &writebackQueue{
+		sc:         &storeCache{opts: opts},
+		byEndpoint: make(map[upspin.Endpoint]*endpointQueue),
+		queued:     make(map[upspin.Location]*request),
+		abandoned:  make(map[upspin.Location]error),
+		ready:      make(chan *request, writers),
+		now:        clock.now,
+	}
+	p := newParallelism(max)
+	p.limit = max
+	p.reserved = opts.fastLaneSlots
+	e := upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "busy"}
+	n := 0
+	add := func(ref string, size int64) {
+		wbq.enqueue(&request{Location: upspin.Location{Reference: upspin.Reference(ref), Endpoint: e}, size: size})
+	}
+	addSmall := func(count int) {
+		for i := 0; i < count; i++ {
+			add(fmt.Sprint("small", n), 100)
+			n++
+		}
+	}
+	addSmall(2 * max)
+	add("large", 1<<20)
+	wbq.byEndpoint[e].state = live
+	var inFlight []*request
+	for step := 0; step < limit; step++ {
+		addSmall(2)
+		for wbq.pickAndQueue(p) {
+		}
+		for len(wbq.ready) > 0 {
+			r := <-wbq.ready
+			if r.Reference == "large" {
+				return step
+			}
+			inFlight = append(inFlight, r)
+		}
+		// The oldest writeback completes.
+		wbq.finish(inFlight[0])
+		inFlight = inFlight[1:]
+		wbq.byEndpoint[e].inFlight--
+		p.success()
+		clock.advance(time.Second)
+	}
+	return -1
+}
+
+func TestAging(t *testing.T) {
+	opts := options{smallBlock: 1000, fastLaneSlots: 1}
+	for _, leastLoaded := range []bool{false, true} {
+		opts.leastLoaded = leastLoaded
+		// Without aging, the large block is starved.
+		opts.aging = 0
+		if steps := starvedSteps(opts, 1000); steps >= 0 {
+			t.Errorf("leastLoaded=%v, no aging: large block dispatched after %d steps, expected starvation", leastLoaded, steps)
+		}
+		// With it, it is dispatched once it has aged.
+		opts.aging = 10 * time.Second
+		if steps := starvedSteps(opts, 1000); steps != 10 {
+			t.Errorf("leastLoaded=%v: large block dispatched after %d steps, want 10", leastLoaded, steps)
+		}
+	}
+	if o, err := parseOptions([]string{"aging=5s"}); err != nil || o.aging != 5*time.Second {
+		t.Errorf("aging option: %+v, %v", o, err)
+	}
+}
+
+func TestSetWriters(t *testing.T) {
+	c, st, cleanup := newTestCache(t, "setwriters", options{})
+	closed := false
+	defer func() {
+		if !closed {
+			cleanup()
+		}
+	}()
+
+	// Write blocks back continuously while the writers change.
+	var n int32
+	put := func() error {
+		i := atomic.AddInt32(&n, 1)
+		ref, err := c.put(testConfig, testBlock(int(i), 100), st.e)
+		if err != nil {
+			return err
+		}
+		loc := upspin.Location{Reference: ref, Endpoint: st.e}
+		if err := c.wbq.flush(loc); err != nil {
+			return err
+		}
+		if _, _, _, err := st.Get(ref); err != nil {
+			return fmt.Errorf("block %d not written back: %v", i, err)
+		}
+		return nil
+	}
+	stop := make(chan bool)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				errc <- nil
+				return
+			default:
+			}
+			if err := put(); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	for _, w := range []int{1, 30, 2, writers} {
+		if err := c.wbq.setWriters(w); err != nil {
+			t.Fatal(err)
+		}
+		c.wbq.writersMu.Lock()
+		got := c.wbq.nWriters
+		c.wbq.writersMu.Unlock()
+		if got != w {
+			t.Errorf("%d writers running, want %d", got, w)
+		}
+		for i := 0; i < 5; i++ {
+			if err := put(); err != nil {
+				t.Fatalf("%d writers: %v", w, err)
+			}
+		}
+	}
+	close(stop)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if err := c.wbq.setWriters(0); err == nil {
+		t.Error("setWriters(0) succeeded")
+	}
+
+	// Changing the writers races safely with close.
+	done := make(chan bool)
+	go func() {
+		for w := 1; c.wbq.setWriters(w%5+1) == nil; w++ {
+		}
+		done <- true
+	}()
+	cleanup()
+	closed = true
+	<-done
+}
+
+// fakeClock is a clock that moves only when told.
+type fakeClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	c.t = c.t.Add(d)
+	c.Unlock()
+}
+
+func TestWritebackDeadline(t *testing.T) {
+	const deadline = 10 * time.Second
+	c, st, cleanup := newTestCache(t, "deadline", options{deadline: deadline})
+	defer cleanup()
+	clock := &fakeClock{t: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+	// Set before any request reaches the scheduler.
+	c.wbq.now = clock.now
+	srv := &server{cache: c}
+	breached := make(chan upspin.Location, 10)
+	if err := srv.OnDeadlineBreach(func(l upspin.Location) { breached <- l }); err != nil {
+		t.Fatal(err)
+	}
+
+	// The store is dead, so the writeback stays pending.
+	st.Lock()
+	st.fail = true
+	st.Unlock()
+	ref, err := c.put(testConfig, []byte("durable soon"), st.e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := upspin.Location{Reference: ref, Endpoint: st.e}
+
+	check := func(overdue, breaches int) {
+		stats, err := srv.DeadlineStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Overdue != overdue || stats.Breaches != breaches {
+			t.Errorf("stats %+v, want Overdue %d, Breaches %d", stats, overdue, breaches)
+		}
+	}
+	check(0, 0)
+	clock.advance(deadline / 2)
+	check(0, 0)
+	clock.advance(deadline)
+	check(1, 1)
+	select {
+	case l := <-breached:
+		if l != loc {
+			t.Errorf("breach reported for %v, want %v", l, loc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no breach reported")
+	}
+
+	// A breach is counted once.
+	clock.advance(deadline)
+	check(1, 1)
+	select {
+	case l := <-breached:
+		t.Errorf("second breach reported for %v", l)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestIsPending(t *testing.T) {
+	c, st, cleanup := newTestCache(t, "ispending", options{})
+	defer cleanup()
+	c.wbq.retryAfter = 10 * time.Millisecond
+
+	// The store is down.
+	st.Lock()
+	st.fail = true
+	st.Unlock()
+	ref, err := c.put(testConfig, []byte("pending data"), st.e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := upspin.Location{Reference: ref, Endpoint: st.e}
+	for st.numPuts() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !c.wbq.isPending(loc) {
+		t.Fatal("writeback to dead store not pending")
+	}
+	other := upspin.Location{Reference: "other", Endpoint: st.e}
+	if c.wbq.isPending(other) {
+		t.Error("location never written is pending")
+	}
+
+	// The store comes back.
+	st.Lock()
+	st.fail = false
+	st.Unlock()
+	for deadline := time.Now().Add(10 * time.Second); c.wbq.isPending(loc); {
+		if time.Now().After(deadline) {
+			t.Fatal("writeback still pending after store came back")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, _, _, err := st.Get(ref); err != nil {
+		t.Errorf("block not written back: %v", err)
+	}
+}
+
+func TestEmptyWriteback(t *testing.T) {
+	c, st, cleanup := newTestCache(t, "empty", options{})
+	defer cleanup()
+	c.wbq.retryAfter = 10 * time.Millisecond
+
+	// The first write of an empty file reaches the store, even
+	// while it is down, once it comes back.
+	st.Lock()
+	st.fail = true
+	st.Unlock()
+	ref, err := c.put(testConfig, nil, st.e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != emptyRef {
+		t.Fatalf("empty block has reference %q, want %q", ref, emptyRef)
+	}
+	loc := upspin.Location{Reference: ref, Endpoint: st.e}
+	for st.numPuts() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	st.Lock()
+	st.fail = false
+	st.Unlock()
+	if err := c.wbq.flush(loc); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, _, err := st.Get(ref); err != nil || len(data) != 0 {
+		t.Fatalf("empty block written back as %q, %v", data, err)
+	}
+	puts := st.numPuts()
+
+	// Once the store has it, more empty files cost it nothing,
+	// even when the cache has forgotten the block.
+	for i := 0; i < 10; i++ {
+		c.remove(c.cachePath(ref, st.e))
+		if _, err := c.put(testConfig, []byte{}, st.e); err != nil {
+			t.Fatal(err)
+		}
+		if c.wbq.isPending(loc) {
+			t.Fatal("empty block queued for writeback again")
+		}
+	}
+	if n := st.numPuts(); n != puts {
+		t.Errorf("%d puts, want %d", n, puts)
+	}
+
+	// Once the block is deleted from the store, it is written again.
+	if err := c.delete(testConfig, ref, st.e); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.put(testConfig, nil, st.e); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.wbq.flush(loc); err != nil {
+		t.Fatal(err)
+	}
+	if n := st.numPuts(); n != puts+1 {
+		t.Errorf("after delete: %d puts, want %d", n, puts+1)
+	}
+	if _, _, _, err := st.Get(ref); err != nil {
+		t.Errorf("empty block not written back after delete: %v", err)
+	}
+}
+
+func TestEmptyDispatch(t *testing.T) {
+	// Empty blocks for many endpoints wait for the writers like any
+	// others, but ahead of them and outside the parallelism.
+	wbq := &writebackQueue{
+		sc:         &storeCache{},
+		byEndpoint: make(map[upspin.Endpoint]*endpointQueue),
+		queued:     make(map[upspin.Location]*request),
+		abandoned:  make(map[upspin.Location]error),
+		ready:      make(chan *request, 4),
+	}
+	p := newParallelism(1)
+	e := upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "large"}
+	wbq.enqueue(&request{Location: upspin.Location{Reference: "large", Endpoint: e}, size: 1 << 20})
+	wbq.byEndpoint[e].state = live
+	for i := 0; i < 10; i++ {
+		e := upspin.Endpoint{Transport: upspin.InProcess, NetAddr: upspin.NetAddr(fmt.Sprint("empty", i))}
+		wbq.enqueue(&request{Location: upspin.Location{Reference: emptyRef, Endpoint: e}})
+	}
+	for wbq.pickAndQueue(p) {
+	}
+	if n := len(wbq.ready); n != cap(wbq.ready) {
+		t.Fatalf("%d requests ready, want %d", n, cap(wbq.ready))
+	}
+	waiting := 0
+	for len(wbq.ready) > 0 {
+		r := <-wbq.ready
+		if r.size != 0 {
+			t.Fatal("large block sent ahead of empty ones")
+		}
+	}
+	for _, q := range wbq.byEndpoint {
+		if q.inFlight != 0 {
+			t.Errorf("%d requests in flight, want 0", q.inFlight)
+		}
+		if q.empty != nil {
+			waiting++
+		}
+	}
+	if waiting != 6 || p.inFlight != 0 {
+		t.Errorf("%d empty blocks waiting and %d in flight, want 6 and 0", waiting, p.inFlight)
+	}
+}
+
+func TestWriterIdle(t *testing.T) {
+	c, st, cleanup := newTestCache(t, "idle", options{writerIdle: 10 * time.Millisecond, minWriters: 2})
+	defer cleanup()
+	running := func() int {
+		c.wbq.runMu.Lock()
+		defer c.wbq.runMu.Unlock()
+		return c.wbq.running
+	}
+	waitFor := func(what string, ok func(int) bool) {
+		for deadline := time.Now().Add(10 * time.Second); !ok(running()); {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: %d writers running", what, running())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// A first writeback shows the store is live.
+	ref, err := c.put(testConfig, testBlock(-1, 100), st.e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.wbq.flush(upspin.Location{Reference: ref, Endpoint: st.e}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Idle writers exit down to the minimum.
+	waitFor("idle", func(n int) bool { return n == 2 })
+	time.Sleep(50 * time.Millisecond)
+	if n := running(); n != 2 {
+		t.Errorf("%d writers running after idle, want 2", n)
+	}
+
+	// Writebacks waiting for a writer start more.
+	st.Lock()
+	st.gate = make(chan bool)
+	st.Unlock()
+	release := func() {
+		st.Lock()
+		defer st.Unlock()
+		if st.gate != nil {
+			close(st.gate)
+			st.gate = nil
+		}
+	}
+	defer release()
+	var locs []upspin.Location
+	for i := 0; i < 10; i++ {
+		ref, err := c.put(testConfig, testBlock(i, 100), st.e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		locs = append(locs, upspin.Location{Reference: ref, Endpoint: st.e})
+	}
+	waitFor("under load", func(n int) bool { return n > 2 })
+	release()
+	for _, loc := range locs {
+		if err := c.wbq.flush(loc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := running(); n > writers {
+		t.Errorf("%d writers running, want at most %d", n, writers)
+	}
+
+	// Changing the number of writers still works.
+	if err := c.wbq.setWriters(3); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("after setWriters", func(n int) bool { return n == 2 })
+
+	if o, err := parseOptions([]string{"writerIdle=1m", "minWriters=4"}); err != nil || o.writerIdle != time.Minute || o.minWriters != 4 {
+		t.Errorf("options: %+v, %v", o, err)
+	}
+	if _, err := parseOptions([]string{"minWriters=0"}); err == nil {
+		t.Error("minWriters=0 accepted")
+	}
+}
+
+func TestPutTimeout(t *testing.T) {
+	c, st, cleanup := newTestCache(t, "wedged", options{putTimeout: 10 * time.Millisecond})
+	defer cleanup()
+	c.wbq.retryAfter = 10 * time.Millisecond
+
+	// The store takes every Put but never answers.
+	st.Lock()
+	st.gate = make(chan bool)
+	st.Unlock()
+	release := func() {
+		st.Lock()
+		defer st.Unlock()
+		if st.gate != nil {
+			close(st.gate)
+			st.gate = nil
+		}
+	}
+	defer release()
+
+	ref, err := c.put(testConfig, []byte("stuck"), st.e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := upspin.Location{Reference: ref, Endpoint: st.e}
+
+	// The writeback is given up on and tried again.
+	for deadline := time.Now().Add(10 * time.Second); st.numPuts() < 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d puts; writeback not retried", st.numPuts())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !c.wbq.isPending(loc) {
+		t.Error("timed out writeback not pending")
+	}
+
+	// The Puts given up on are still running, so after a few no more
+	// are sent.
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		c.wbq.stuckMu.Lock()
+		n := c.wbq.stuck[st.e]
+		c.wbq.stuckMu.Unlock()
+		if n == maxStuck {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d Puts timed out, want %d", n, maxStuck)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	puts := st.numPuts()
+	time.Sleep(20 * c.wbq.retryAfter)
+	if n := st.numPuts(); n != puts || n > maxStuck+1 {
+		t.Errorf("%d puts to a wedged store, then %d; want at most %d", puts, n, maxStuck+1)
+	}
+
+	// Once the store answers, the block is written back.
+	release()
+	if err := c.wbq.flush(loc); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, _, err := st.Get(ref); err != nil || string(data) != "stuck" {
+		t.Errorf("block written back as %q, %v", data, err)
+	}
+
+	if o, err := parseOptions([]string{"putTimeout=30s"}); err != nil || o.putTimeout != 30*time.Second {
+		t.Errorf("options: %+v, %v", o, err)
+	}
+}
+
+func TestLatencySeed(t *testing.T) {
+	const latencySeed = 10 * time.Millisecond
+	seed := func(addr string, delay time.Duration) int {
+		c, st, cleanup := newTestCache(t, addr, options{latencySeed: latencySeed})
+		defer cleanup()
+		st.Lock()
+		st.delay = delay
+		st.Unlock()
+		if _, err := c.put(testConfig, []byte("first contact"), st.e); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(10 * time.Second); ; {
+			if max := c.wbq.parallelMax(); max != initialMaxParallel {
+				return max
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: max parallel not seeded", addr)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// A near store starts with fewer parallel writebacks than usual,
+	// a distant one with more.
+	near := seed("near", 0)
+	far := seed("far", 10*latencySeed)
+	if near >= initialMaxParallel || far <= initialMaxParallel {
+		t.Errorf("seeded max parallel: near %d, far %d; want below and above %d", near, far, initialMaxParallel)
+	}
+
+	if n := seedParallel(95*time.Millisecond, latencySeed); n != 10 {
+		t.Errorf("seedParallel(95ms) = %d, want 10", n)
+	}
+	if n := seedParallel(time.Hour, latencySeed); n != writers {
+		t.Errorf("seedParallel(1h) = %d, want %d", n, writers)
+	}
+	if o, err := parseOptions([]string{"latencySeed=5ms"}); err != nil || o.latencySeed != 5*time.Millisecond {
+		t.Errorf("options: %+v, %v", o, err)
+	}
+}
+
+// prioritySteps simulates writebacks to a target endpoint and two others,
+// each with the same backlog, all the requests dispatched at a step
+// completing before the next. If prioritize is set, the target is
+// prioritized first. It returns the number of requests dispatched to each
+// endpoint at each step, and whether the target is still prioritized at
+// the end.
+func prioritySteps(prioritize bool) (steps []map[string]int, prioritized bool) {
+	const (
+		max     = 8
+		backlog = 40
+	)
+	wbq := &writebackQueue{
+		sc:         &storeCache{},
+		byEndpoint: make(map[upspin.Endpoint]*endpointQueue),
+		queued:     make(map[upspin.Location]*request),
+		abandoned:  make(map[upspin.Location]error),
+		ready:      make(chan *request, writers),
+	}
+	p := newParallelism(max)
+	p.limit = max
+	var target upspin.Endpoint
+	for _, addr := range []string{"target", "other1", "other2"} {
+		e := upspin.Endpoint{Transport: upspin.InProcess, NetAddr: upspin.NetAddr(addr)}
+		for i := 0; i < backlog; i++ {
+			wbq.enqueue(&request{Location: upspin.Location{Reference: upspin.Reference(fmt.Sprint(addr, i)), Endpoint: e}, size: 1})
+		}
+		wbq.byEndpoint[e].state = live
+		if addr == "target" {
+			target = e
+		}
+	}
+	if prioritize {
+		wbq.setPriority(target)
+	}
+	for len(wbq.queued) > 0 {
+		for wbq.pickAndQueue(p) {
+		}
+		step := make(map[string]int)
+		for len(wbq.ready) > 0 {
+			r := <-wbq.ready
+			step[string(r.Endpoint.NetAddr)]++
+			wbq.byEndpoint[r.Endpoint].inFlight--
+			p.success()
+			wbq.finish(r)
+		}
+		steps = append(steps, step)
+	}
+	// Let the scheduler notice that the target has drained.
+	wbq.pickAndQueue(p)
+	return steps, wbq.hasPriority
+}
+
+func TestPrioritizeEndpoint(t *testing.T) {
+	// drained returns the step after which the target had no more
+	// requests, and the number dispatched to the others by then.
+	drained := func(steps []map[string]int) (step, others int) {
+		n := 0
+		for i, s := range steps {
+			n += s["target"]
+			others += s["other1"] + s["other2"]
+			if n == 40 {
+				return i + 1, others
+			}
+		}
+		return -1, others
+	}
+
+	fair, _ := prioritySteps(false)
+	fairStep, _ := drained(fair)
+	steps, prioritized := prioritySteps(true)
+	step, others := drained(steps)
+	if step < 0 || step*2 > fairStep {
+		t.Errorf("prioritized target drained after %d steps, want at most half the %d without priority", step, fairStep)
+	}
+	// The others are slowed, not stopped: each step they keep 2 of the 8.
+	for i, s := range steps[:step-1] {
+		if s["other1"]+s["other2"] != 2 || s["target"] != 6 {
+			t.Errorf("step %d: dispatched %v, want 6 to target and 2 to the others", i, s)
+		}
+	}
+	if others == 0 {
+		t.Error("other endpoints made no progress while target was prioritized")
+	}
+	// Once the target has drained, the others share the slots again.
+	if prioritized {
+		t.Error("target still prioritized after draining")
+	}
+	if s := steps[step]; s["other1"] != 4 || s["other2"] != 4 {
+		t.Errorf("step after target drained: dispatched %v, want 4 to each other", s)
+	}
+}
+
+// userSteps simulates a heavy user flooding an endpoint with writebacks
+// and a light one queuing as many just after, with writers taking each
+// request as soon as it is ready and every writeback completing at each
+// step. It returns the number dispatched for each user at each step.
+func userSteps(opts options) []map[upspin.UserName]int {
+	const (
+		max     = 4
+		backlog = 40
+	)
+	wbq := &writebackQueue{
+		sc:           &storeCache{opts: opts},
+		byEndpoint:   make(map[upspin.Endpoint]*endpointQueue),
+		queued:       make(map[upspin.Location]*request),
+		abandoned:    make(map[upspin.Location]error),
+		ready:        make(chan *request, writers),
+		userInFlight: make(map[upspin.UserName]int),
+	}
+	p := newParallelism(max)
+	p.limit = max
+	e := upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "shared"}
+	for _, user := range []upspin.UserName{"heavy@example.com", "light@example.com"} {
+		for i := 0; i < backlog; i++ {
+			wbq.enqueue(&request{Location: upspin.Location{Reference: upspin.Reference(fmt.Sprint(user, i)), Endpoint: e}, size: 1, user: user})
+		}
+	}
+	wbq.byEndpoint[e].state = live
+	var steps []map[upspin.UserName]int
+	for len(wbq.queued) > 0 {
+		for wbq.pickAndQueue(p) {
+		}
+		step := make(map[upspin.UserName]int)
+		for len(wbq.ready) > 0 {
+			r := <-wbq.ready
+			step[r.user]++
+			wbq.byEndpoint[e].inFlight--
+			wbq.userDone(r)
+			p.success()
+			wbq.finish(r)
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+func TestUserFairness(t *testing.T) {
+	// The users take turns, so the light user, though it queued last,
+	// gets half the writebacks from the start.
+	steps := userSteps(options{})
+	if len(steps) != 20 {
+		t.Errorf("took %d steps, want 20", len(steps))
+	}
+	for i, s := range steps {
+		if s["heavy@example.com"] != 2 || s["light@example.com"] != 2 {
+			t.Errorf("step %d: dispatched %v, want 2 for each user", i, s)
+		}
+	}
+
+	// With userParallel, neither has more than its limit in flight,
+	// even with writers to spare.
+	steps = userSteps(options{userParallel: 1})
+	if len(steps) != 40 {
+		t.Errorf("userParallel=1: took %d steps, want 40", len(steps))
+	}
+	for i, s := range steps {
+		if s["heavy@example.com"] != 1 || s["light@example.com"] != 1 {
+			t.Errorf("userParallel=1: step %d: dispatched %v, want 1 for each user", i, s)
+		}
+	}
+
+	// The user is the one who dialed the cache.
+	s := &server{cfg: testConfig, user: testConfig.UserName()}
+	e := upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "shared"}
+	svc, err := s.Dial(config.SetUserName(testConfig, "light@example.com"), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := svc.(*server).user; user != "light@example.com" {
+		t.Errorf("dialed server has user %q, want light@example.com", user)
+	}
+}
+
+func TestFlushEndpoint(t *testing.T) {
+	c, near, cleanup := newTestCache(t, "flushnear", options{})
+	defer cleanup()
+	far := storeFor(upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "flushfar"})
+	far.reset()
+
+	// Writebacks to the far store wait until the gate opens.
+	gate := make(chan bool)
+	far.Lock()
+	far.gate = gate
+	far.Unlock()
+	locs := make(map[*testStore][]upspin.Location)
+	for i := 0; i < 3; i++ {
+		for _, st := range []*testStore{near, far} {
+			ref, err := c.put(testConfig, []byte(fmt.Sprint(st.e.NetAddr, " block ", i)), st.e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			locs[st] = append(locs[st], upspin.Location{Reference: ref, Endpoint: st.e})
+		}
+	}
+
+	if err := c.wbq.flushEndpoint(near.e); err != nil {
+		t.Fatal(err)
+	}
+	for _, loc := range locs[near] {
+		if _, _, _, err := near.Get(loc.Reference); err != nil {
+			t.Errorf("%s not written back to near store: %v", loc.Reference, err)
+		}
+	}
+	for _, loc := range locs[far] {
+		if !c.wbq.isPending(loc) {
+			t.Errorf("%s no longer pending for far store", loc.Reference)
+		}
+	}
+
+	// An endpoint with no writebacks is already flushed.
+	if err := c.wbq.flushEndpoint(upspin.Endpoint{Transport: upspin.InProcess, NetAddr: "flushnone"}); err != nil {
+		t.Fatal(err)
+	}
+
+	close(gate)
+	if err := c.wbq.flushEndpoint(far.e); err != nil {
+		t.Fatal(err)
+	}
+	for _, loc := range locs[far] {
+		if c.wbq.isPending(loc) {
+			t.Errorf("%s still pending after flushing far store", loc.Reference)
+		}
+	}
+}
+
+// batchRuns counts the runs of TestBatch.
+var batchRuns int32
+
+func TestBatch(t *testing.T) {
+	const (
+		batch  = 4
+		blocks = 10
+	)
+	check := func(c *storeCache, st *testStore, addr string) {
+		// The first writeback to a store is sent alone; hold it so
+		// the rest queue up behind it.
+		gate := make(chan bool)
+		st.Lock()
+		st.gate = gate
+		st.Unlock()
+		var locs []upspin.Location
+		for i := 0; i < blocks; i++ {
+			ref, err := c.put(testConfig, []byte(fmt.Sprint(addr, " block ", i)), st.e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			locs = append(locs, upspin.Location{Reference: ref, Endpoint: st.e})
+		}
+		// Wait for a block to be flushed while in a batch.
+		flushed := make(chan error)
+		go func() { flushed <- c.wbq.flush(locs[blocks-1]) }()
+		close(gate)
+		if err := <-flushed; err != nil {
+			t.Fatalf("%s: flush: %v", addr, err)
+		}
+		if err := c.wbq.flushEndpoint(st.e); err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		for i, loc := range locs {
+			data, _, _, err := st.Get(loc.Reference)
+			if want := fmt.Sprint(addr, " block ", i); err != nil || string(data) != want {
+				t.Errorf("%s: block %d written back as %q, %v; want %q", addr, i, data, err, want)
+			}
+			if c.wbq.isPending(loc) {
+				t.Errorf("%s: block %d still pending", addr, i)
+			}
+		}
+		if n := st.numPuts(); n != blocks {
+			t.Errorf("%s: %d puts, want %d", addr, n, blocks)
+		}
+	}
+
+	// Blocks waiting for a store that takes batches are sent together.
+	// The store's address is new on each run of the test, as bind keeps
+	// the store it dialed for an address.
+	addr := fmt.Sprint("batching", atomic.AddInt32(&batchRuns, 1))
+	bs := batchStoreFor(upspin.Endpoint{Transport: upspin.InProcess, NetAddr: upspin.NetAddr(addr)})
+	c, st, cleanup := newTestCache(t, addr, options{batch: batch})
+	defer cleanup()
+	check(c, st, addr)
+	bs.Lock()
+	sizes := bs.sizes
+	bs.Unlock()
+	if len(sizes) == 0 {
+		t.Error("no blocks sent in batches")
+	}
+	for _, n := range sizes {
+		if n < 2 || n > batch {
+			t.Errorf("batch sizes %v, want 2 to %d", sizes, batch)
+			break
+		}
+	}
+
+	// Other stores are sent each block in turn.
+	c2, st2, cleanup2 := newTestCache(t, "nobatching", options{batch: batch})
+	defer cleanup2()
+	check(c2, st2, "nobatching")
+
+	if o, err := parseOptions([]string{"batch=8"}); err != nil || o.batch != 8 {
+		t.Errorf("options: %+v, %v", o, err)
+	}
+	if o, err := parseOptions(nil); err != nil || o.batch != 1 {
+		t.Errorf("default options: %+v, %v", o, err)
+	}
+	if _, err := parseOptions([]string{"batch=0"}); err == nil {
+		t.Error("batch=0 accepted")
+	}
+}
+
+func TestTrace(t *testing.T) {
+	c, st, cleanup := newTestCache(t, "trace", options{})
+	defer cleanup()
+	c.wbq.retryAfter = 10 * time.Millisecond
+	srv := &server{cfg: testConfig, cache: c, authority: st.e}
+
+	data := []byte("traced block")
+	loc := upspin.Location{Reference: upspin.Reference(sha256key.Of(data).String()), Endpoint: st.e}
+	var mu sync.Mutex
+	var events []TraceEvent
+	requeued := make(chan bool, 1)
+	err := srv.Trace([]upspin.Location{loc}, func(e TraceEvent) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+		if e.Kind == TraceRequeued {
+			select {
+			case requeued <- true:
+			default:
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first Put fails and the block is requeued; the retry succeeds.
+	st.Lock()
+	st.fail = true
+	st.Unlock()
+	if _, err := c.put(testConfig, data, st.e); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.put(testConfig, []byte("untraced block"), st.e); err != nil {
+		t.Fatal(err)
+	}
+	<-requeued
+	st.Lock()
+	st.fail = false
+	st.Unlock()
+	if err := c.wbq.flush(loc); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []TraceKind{
+		TraceEnqueued, TracePicked, TraceDispatched, TracePutStarted, TracePutDone, TraceRequeued,
+		TracePicked, TraceDispatched, TracePutStarted, TracePutDone, TraceFinished,
+	}
+	var got []TraceKind
+	for _, e := range events {
+		if e.Location != loc {
+			t.Errorf("event for untraced location: %s", e)
+		}
+		got = append(got, e.Kind)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("trace events:\n\t%v\nwant\n\t%v", got, want)
+	}
+	if events[4].Err == nil || events[9].Err != nil {
+		t.Errorf("put results: %v, %v; want an error, then none", events[4].Err, events[9].Err)
+	}
+	if events[2].Writer != events[4].Writer {
+		t.Errorf("dispatched to writer %d but put done by writer %d", events[2].Writer, events[4].Writer)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	for _, healthOp := range []int{healthPing, healthPut} {
+		addr := fmt.Sprint("health", healthOp)
+		c, st, cleanup := newTestCache(t, addr, options{healthCheck: 10 * time.Millisecond, healthOp: healthOp})
+
+		// The store is down when the block is first written back,
+		// so the endpoint is marked dead for retryInterval.
+		st.Lock()
+		st.fail = true
+		st.Unlock()
+		data := []byte(addr + " block")
+		ref, err := c.put(testConfig, data, st.e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loc := upspin.Location{Reference: ref, Endpoint: st.e}
+		// Pinging revives the endpoint, only for the Put to fail again;
+		// putting the empty block fails too. Either way the store sees
+		// more Puts while it is down.
+		for deadline := time.Now().Add(10 * time.Second); st.numPuts() < 3; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: %d puts while store down, want more than 2", addr, st.numPuts())
+			}
+		}
+		if !c.wbq.isPending(loc) {
+			t.Fatalf("%s: block not pending while store down", addr)
+		}
+
+		// Once the store is back, the health check finds it and the
+		// writeback resumes long before retryInterval.
+		st.Lock()
+		st.fail = false
+		st.Unlock()
+		flushed := make(chan error)
+		go func() { flushed <- c.wbq.flush(loc) }()
+		select {
+		case err := <-flushed:
+			if err != nil {
+				t.Fatalf("%s: %v", addr, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: writeback did not resume", addr)
+		}
+		if got, _, _, err := st.Get(ref); err != nil || string(got) != string(data) {
+			t.Errorf("%s: written back %q, %v; want %q", addr, got, err, data)
+		}
+		cleanup()
+	}
+
+	if o, err := parseOptions([]string{"healthCheck=30s", "healthOp=put"}); err != nil || o.healthCheck != 30*time.Second || o.healthOp != healthPut {
+		t.Errorf("health options: %+v, %v", o, err)
+	}
+	if _, err := parseOptions([]string{"healthOp=get"}); err == nil {
+		t.Error("healthOp=get accepted")
+	}
+}
+
+// TestStartupCheck checks that with the startupCheck option the
+// writebacks found on startup are not sent to a store found to be down,
+// and are written back to one found to be up.
+func TestStartupCheck(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "storecache")
+	// Only remote endpoints keep their network address in a file name.
+	live := storeFor(upspin.Endpoint{Transport: upspin.Remote, NetAddr: "startup-live:443"})
+	dead := storeFor(upspin.Endpoint{Transport: upspin.Remote, NetAddr: "startup-dead:443"})
+
+	// Leave a block pending for each store.
+	c, _, err := newCache(testConfig, dir, 1e8, false, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	locs := make(map[*testStore]upspin.Location)
+	for _, st := range []*testStore{live, dead} {
+		st.reset()
+		st.Lock()
+		st.fail = true
+		st.Unlock()
+		ref, err := c.put(testConfig, []byte(string(st.e.NetAddr)+" block"), st.e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		locs[st] = upspin.Location{Reference: ref, Endpoint: st.e}
+	}
+	c.close()
+
+	// One store comes back, the other stays down.
+	live.reset()
+	dead.reset()
+	dead.Lock()
+	dead.fail = true
+	dead.down = true
+	dead.Unlock()
+	c, _, err = newCache(testConfig, dir, 1e8, false, options{startupCheck: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if err := c.wbq.flush(locs[live]); err != nil {
+		t.Fatal(err)
+	}
+	// Give the scheduler a chance to send the other block, as it would
+	// to a store whose state it does not know.
+	time.Sleep(100 * time.Millisecond)
+	if n := dead.numPuts(); n != 0 {
+		t.Errorf("%d puts to dead store, want 0", n)
+	}
+	if !c.wbq.isPending(locs[dead]) {
+		t.Error("block for dead store not pending")
+	}
+	list := make(chan []deadEndpoint)
+	c.wbq.deadList <- list
+	var got []upspin.Endpoint
+	for _, d := range <-list {
+		got = append(got, d.e)
+	}
+	if len(got) != 1 || got[0] != dead.e {
+		t.Errorf("dead endpoints %v, want [%v]", got, dead.e)
+	}
+
+	if o, err := parseOptions([]string{"startupCheck=5s"}); err != nil || o.startupCheck != 5*time.Second {
+		t.Errorf("startupCheck option: %+v, %v", o, err)
+	}
+}
+
+// TestWritebackMemory checks that with the writebackMemory option the
+// writers never hold more block data than it allows, yet write back
+// every block.
+func TestWritebackMemory(t *testing.T) {
+	const (
+		blockSize = 64 << 10
+		nBlocks   = 30
+		limit     = 3*blockSize + blockSize/2
+	)
+	c, st, cleanup := newTestCache(t, "memory", options{writebackMemory: limit})
+	defer cleanup()
+	st.Lock()
+	st.delay = 10 * time.Millisecond
+	st.Unlock()
+
+	var locs []upspin.Location
+	for i := 0; i < nBlocks; i++ {
+		ref, err := c.put(testConfig, bytes.Repeat([]byte{byte(i)}, blockSize), st.e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		locs = append(locs, upspin.Location{Reference: ref, Endpoint: st.e})
+	}
+	for _, loc := range locs {
+		if err := c.wbq.flush(loc); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := st.Get(loc.Reference); err != nil {
+			t.Errorf("%s not written back: %v", loc.Reference, err)
+		}
+	}
+	if held := c.wbq.budget.maxHeld(); held > limit {
+		t.Errorf("writers held %d bytes, more than the limit %d", held, limit)
+	}
+	st.Lock()
+	maxInPut := st.maxInPut
+	st.Unlock()
+	if maxInPut > limit {
+		t.Errorf("%d bytes put at once, more than the limit %d", maxInPut, limit)
+	}
+	if maxInPut < 2*blockSize {
+		t.Errorf("%d bytes put at once; want writebacks in parallel within the limit", maxInPut)
+	}
+}
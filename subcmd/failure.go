@@ -0,0 +1,117 @@
+// Copyright 2017 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package subcmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"upspin.io/errors"
+)
+
+// A Failure records an error reported by Fail or Failf.
+type Failure struct {
+	Path string      // Upspin or local path name involved; may be empty.
+	Op   string      // Operation that failed; may be empty.
+	Kind errors.Kind // Class of the error; Other if unknown.
+	Err  error       // The error as reported.
+}
+
+// newFailure returns the Failure for err, taking its path, operation, and
+// kind from err or, if err does not provide them, from the errors it wraps.
+// If cause is nil, err is used.
+func newFailure(err, cause error) Failure {
+	f := Failure{Err: err}
+	if cause == nil {
+		cause = err
+	}
+	for cause != nil {
+		switch e := cause.(type) {
+		case *errors.Error:
+			f.fill(string(e.Path), e.Op, e.Kind)
+			cause = e.Err
+			continue
+		case *os.PathError:
+			f.fill(e.Path, e.Op, osKind(e.Err))
+		case *os.LinkError:
+			f.fill(e.Old, e.Op, osKind(e.Err))
+		case *os.SyscallError:
+			f.fill("", e.Syscall, osKind(e.Err))
+		}
+		break
+	}
+	return f
+}
+
+// fill sets those fields of f that are still unset.
+func (f *Failure) fill(path, op string, kind errors.Kind) {
+	if f.Path == "" {
+		f.Path = path
+	}
+	if f.Op == "" {
+		f.Op = op
+	}
+	if f.Kind == errors.Other {
+		f.Kind = kind
+	}
+}
+
+// osKind returns the kind of an error from the os package.
+func osKind(err error) errors.Kind {
+	switch {
+	case os.IsNotExist(err):
+		return errors.NotExist
+	case os.IsExist(err):
+		return errors.Exist
+	case os.IsPermission(err):
+		return errors.Permission
+	}
+	return errors.Other
+}
+
+// String returns a one-line description of the failure for a summary,
+// naming its path and operation if they are known and otherwise
+// quoting the error.
+func (f Failure) String() string {
+	switch {
+	case f.Path != "" && f.Op != "":
+		return fmt.Sprintf("%s (%s)", f.Path, f.Op)
+	case f.Path != "":
+		return f.Path
+	}
+	return f.Err.Error()
+}
+
+// PrintFailures prints to w a summary of the failures grouped by kind,
+// in the order of the kinds, keeping the order of the failures within
+// each group. It prints nothing if there are no failures.
+func (s *State) PrintFailures(w io.Writer, failures []Failure) {
+	if len(failures) == 0 {
+		return
+	}
+	byKind := make(map[errors.Kind][]Failure)
+	var kinds []int
+	for _, f := range failures {
+		if byKind[f.Kind] == nil {
+			kinds = append(kinds, int(f.Kind))
+		}
+		byKind[f.Kind] = append(byKind[f.Kind], f)
+	}
+	sort.Ints(kinds)
+	plural := "s"
+	if len(failures) == 1 {
+		plural = ""
+	}
+	fmt.Fprintf(w, "upspin: %s: %d error%s:\n", s.Name, len(failures), plural)
+	for _, k := range kinds {
+		group := byKind[errors.Kind(k)]
+		fmt.Fprintf(w, "%s (%d):\n", errors.Kind(k), len(group))
+		for _, f := range group {
+			fmt.Fprintf(w, "\t%s\n", f)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"upspin.io/bind"
 	"upspin.io/client"
+	"upspin.io/errors"
 	"upspin.io/shutdown"
 	"upspin.io/upspin"
 )
@@ -23,6 +24,7 @@ type State struct {
 	Client      upspin.Client // Client; may be nil.
 	Interactive bool          // Whether the command is line-by-line.
 	ExitCode    int           // Exit with non-zero status for minor problems.
+	Failures    []Failure     // Errors reported by Fail and Failf, in order.
 }
 
 // NewState returns a new State for the named subcommand.
@@ -65,16 +67,30 @@ func (s *State) ExitNow() {
 	shutdown.Now(s.ExitCode)
 }
 
-// Failf logs the error and sets the exit code. It does not exit the program.
+// Failf logs the error, records it in Failures, and sets the exit code.
+// It does not exit the program. The path, operation, and kind of the
+// recorded Failure are taken from the first argument that is an error.
 func (s *State) Failf(format string, args ...interface{}) {
-	format = fmt.Sprintf("upspin: %s: %s\n", s.Name, format)
-	fmt.Fprintf(os.Stderr, format, args...)
-	s.ExitCode = 1
+	var cause error
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			cause = err
+			break
+		}
+	}
+	s.fail(errors.Errorf(format, args...), cause)
 }
 
-// Fail calls s.Failf with the error.
+// Fail logs the error, records it in Failures, and sets the exit code.
+// It does not exit the program.
 func (s *State) Fail(err error) {
-	s.Failf("%v", err)
+	s.fail(err, nil)
+}
+
+func (s *State) fail(err, cause error) {
+	fmt.Fprintf(os.Stderr, "upspin: %s: %v\n", s.Name, err)
+	s.Failures = append(s.Failures, newFailure(err, cause))
+	s.ExitCode = 1
 }
 
 // KeyServer returns the KeyServer for the root of the name, or exits on failure.